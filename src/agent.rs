@@ -0,0 +1,274 @@
+use crate::{
+    config, crypt, fetch, history,
+    logging::debug_log,
+    parser, plugins,
+    provider::{ApiClient, RequestParams},
+    rag, sandbox, shell, Message,
+};
+use anyhow::Result;
+use serde_json::Value;
+use std::path::{Path, PathBuf};
+
+pub const AGENT_ENV: &str = "CHAT_AGENT";
+
+const DEFAULT_STEPS: usize = 6;
+// Tool output is cut to this much before it goes back to the model
+const MAX_RESULT_CHARS: usize = 8000;
+const MAX_SEARCH_HITS: usize = 50;
+// Lines of each result shown in the trace
+const TRACE_LINES: usize = 12;
+
+const INSTRUCTIONS: &str = "You can use tools to look at the user's files before answering. To use one, reply with \
+nothing but a fenced code block tagged `tool` holding a JSON call, for example:
+
+```tool
+{\"tool\": \"read_file\", \"path\": \"src/main.rs\"}
+```
+
+Tools:
+- read_file {\"path\"}: the contents of a file
+- list_dir {\"path\"}: the entries of a directory (\".\" for the top)
+- search {\"query\", \"path\"?}: lines containing the query, case-insensitively, in text files under path
+- fetch_url {\"url\"}: a web page as text
+- run_code {\"language\": \"python\" or \"go\", \"code\"}: runs a program in a sandbox (a fresh temporary \
+directory, no network, limited CPU time and memory) and returns what it printed. The project directory is \
+readable at the path in the PROJECT_DIR environment variable. Use it to compute or analyse data.
+- run_shell {\"command\"}: runs a shell command in the project directory, once the user approves it; its output \
+and exit status come back. Only use it when reading files is not enough.
+
+Paths are relative to the project directory. The result comes back in the next message. Use as few steps as you \
+need, then answer normally, without a tool block.";
+
+// `agent: true` (or a number of steps) in the frontmatter or CHAT_AGENT:
+// the most tool steps a reply may take, or None when agent mode is off
+pub fn parse_steps(value: &str) -> Option<usize> {
+    match value.trim().parse::<usize>() {
+        Ok(steps) => (steps > 0).then_some(steps),
+        Err(_) => config::parse_bool(value)?.then_some(DEFAULT_STEPS),
+    }
+}
+
+pub fn steps_from_env() -> Option<usize> {
+    std::env::var(AGENT_ENV).ok().as_deref().and_then(parse_steps)
+}
+
+struct Step {
+    call: String,
+    result: String,
+    // Shown whole in the trace, like a command's output
+    full: bool,
+}
+
+// Lets the model call tools on the files next to `chat` for up to
+// `max_steps` rounds before it answers. Shell commands are approved in the
+// chat first. Returns the answer and the steps
+// taken, rendered as a collapsed trace for the chat ("" when there were none).
+pub async fn run(
+    messages: &mut Vec<Message>,
+    max_steps: usize,
+    chat: &Path,
+    api_client: &ApiClient,
+    model: &str,
+    params: &RequestParams,
+) -> Result<(String, String)> {
+    let base_dir = chat.parent().filter(|d| !d.as_os_str().is_empty()).unwrap_or(Path::new("."));
+    let leading_system = messages.iter().take_while(|m| m.role == "system").count();
+    let mut instructions = INSTRUCTIONS.to_string();
+    if !sandbox::isolates_files() {
+        instructions.push_str("\n\nHere run_code can't hide the user's other files, so each program waits for the user to approve it, like run_shell.");
+    }
+    let plugin_tools = plugins::tools().await;
+    if !plugin_tools.is_empty() {
+        instructions.push_str("\n\nMore tools:");
+        for (_, tool) in &plugin_tools {
+            let mut arguments: Vec<String> = tool.arguments.iter().map(|(k, v)| format!("\"{}\": {}", k, v)).collect();
+            arguments.sort();
+            instructions.push_str(&format!("\n- {} {{{}}}: {}", tool.name, arguments.join(", "), tool.description));
+        }
+    }
+    let instructions = format!("{}\n\nYou have at most {} tool steps.", instructions, max_steps);
+    messages.insert(leading_system, Message::new("system", instructions));
+
+    let mut steps = Vec::new();
+    loop {
+        let reply = api_client.call_api(messages.clone(), model, params).await?;
+        history::record(chat, &reply.usage, &reply.text).await;
+        let response = reply.text;
+        let Some(call) = tool_call(&response) else {
+            return Ok((response, trace(&steps)));
+        };
+        if steps.len() >= max_steps {
+            debug_log(&format!("error: agent used all {} steps, asking for an answer", max_steps));
+            messages.push(Message::new("assistant", response));
+            messages.push(Message::new(
+                "user",
+                "You have used all your tool steps. Answer now with what you have, without a tool block.",
+            ));
+            let answer = api_client.call_api(messages.clone(), model, params).await?;
+            history::record(chat, &answer.usage, &answer.text).await;
+            return Ok((answer.text, trace(&steps)));
+        }
+
+        debug_log(&format!("call: agent step {}: {}", steps.len() + 1, crypt::loggable(chat, &call)));
+        let full = matches!(tool_name(&call).as_str(), "run_shell" | "run_code");
+        let result = match run_tool(&call, chat, base_dir, &plugin_tools).await {
+            Ok(result) => result,
+            Err(e) => format!("error: {}", e),
+        };
+        let result = truncate(&result, MAX_RESULT_CHARS);
+        messages.push(Message::new("assistant", response));
+        messages.push(Message::new("user", format!("Result of {}:\n{}", call, fenced(&result, "text"))));
+        steps.push(Step { call, result, full });
+    }
+}
+
+// The JSON in the reply's `tool` block, if it has one
+fn tool_call(response: &str) -> Option<String> {
+    parser::fences(response)
+        .into_iter()
+        .find(|fence| fence.info == "tool")
+        .map(|fence| response[fence.body].trim().to_string())
+}
+
+fn tool_name(call: &str) -> String {
+    serde_json::from_str::<Value>(call)
+        .ok()
+        .and_then(|call| call["tool"].as_str().map(str::to_string))
+        .unwrap_or_default()
+}
+
+async fn run_tool(call: &str, chat: &Path, base_dir: &Path, plugin_tools: &[(PathBuf, plugins::Tool)]) -> Result<String> {
+    let call: Value = serde_json::from_str(call).map_err(|e| anyhow::anyhow!("the call is not valid JSON: {}", e))?;
+    let arg = |name: &str| call[name].as_str().unwrap_or_default().to_string();
+    match call["tool"].as_str().unwrap_or_default() {
+        "read_file" => {
+            let path = resolve(base_dir, &arg("path"))?;
+            Ok(tokio::fs::read_to_string(&path).await?)
+        }
+        "list_dir" => {
+            let path = resolve(base_dir, &arg("path"))?;
+            let mut entries: Vec<String> = std::fs::read_dir(&path)?
+                .filter_map(|e| e.ok())
+                .map(|e| {
+                    let name = e.file_name().to_string_lossy().into_owned();
+                    match e.file_type().is_ok_and(|t| t.is_dir()) {
+                        true => format!("{}/", name),
+                        false => name,
+                    }
+                })
+                .collect();
+            entries.sort();
+            Ok(entries.join("\n"))
+        }
+        "search" => {
+            let query = arg("query").to_lowercase();
+            if query.trim().is_empty() {
+                anyhow::bail!("search needs a query");
+            }
+            let dir = resolve(base_dir, &arg("path"))?;
+            let mut hits = Vec::new();
+            for path in rag::document_paths(&dir) {
+                let Ok(text) = std::fs::read_to_string(&path) else {
+                    continue;
+                };
+                let shown = path.strip_prefix(&dir).unwrap_or(&path).display().to_string();
+                for (i, line) in text.lines().enumerate().filter(|(_, l)| l.to_lowercase().contains(&query)) {
+                    hits.push(format!("{}:{}: {}", shown, i + 1, line.trim()));
+                    if hits.len() >= MAX_SEARCH_HITS {
+                        return Ok(hits.join("\n"));
+                    }
+                }
+            }
+            Ok(match hits.is_empty() {
+                true => "no matches".to_string(),
+                false => hits.join("\n"),
+            })
+        }
+        "fetch_url" => {
+            let page = fetch::fetch_public(&arg("url")).await?;
+            Ok(match page.title {
+                Some(title) => format!("# {}\n\n{}", title, page.text),
+                None => page.text,
+            })
+        }
+        "run_code" => {
+            let code = arg("code");
+            if code.trim().is_empty() {
+                anyhow::bail!("run_code needs some code");
+            }
+            sandbox::run(&arg("language"), &code, base_dir, chat).await
+        }
+        "run_shell" => {
+            let command = arg("command");
+            if command.trim().is_empty() {
+                anyhow::bail!("run_shell needs a command");
+            }
+            if !chat.is_file() {
+                anyhow::bail!("commands need a chat file to be approved in");
+            }
+            match shell::approve(chat, &command).await? {
+                true => shell::run(&command, base_dir).await,
+                false => Ok("The user did not approve this command, so it was not run.".to_string()),
+            }
+        }
+        other => match plugin_tools.iter().find(|(_, tool)| tool.name == other) {
+            Some((plugin, _)) => plugins::call_tool(plugin, &call, chat).await,
+            None => anyhow::bail!("unknown tool {:?}; use read_file, list_dir, search, fetch_url, run_code or run_shell", other),
+        },
+    }
+}
+
+// `path` under `base_dir`, refusing anything that leads outside it
+fn resolve(base_dir: &Path, path: &str) -> Result<PathBuf> {
+    let base = base_dir.canonicalize()?;
+    let path = match path.trim() {
+        "" | "." => base.clone(),
+        path => base.join(path).canonicalize().map_err(|e| anyhow::anyhow!("{}: {}", path, e))?,
+    };
+    if !path.starts_with(&base) {
+        anyhow::bail!("{} is outside the project directory", path.display());
+    }
+    Ok(path)
+}
+
+fn truncate(text: &str, max: usize) -> String {
+    match text.char_indices().nth(max) {
+        Some((cut, _)) => format!("{}\n[... {} more characters]", &text[..cut], text[cut..].chars().count()),
+        None => text.to_string(),
+    }
+}
+
+// A code block that holds `text` whatever backticks it contains
+fn fenced(text: &str, info: &str) -> String {
+    let longest = text
+        .lines()
+        .map(|line| line.trim_start().chars().take_while(|c| *c == '`').count())
+        .max()
+        .unwrap_or(0);
+    let fence = "`".repeat(longest.max(2) + 1);
+    format!("{}{}\n{}\n{}", fence, info, text.trim_end(), fence)
+}
+
+fn trace(steps: &[Step]) -> String {
+    if steps.is_empty() {
+        return String::new();
+    }
+    let body: Vec<String> = steps
+        .iter()
+        .enumerate()
+        .map(|(i, step)| {
+            let lines: Vec<&str> = step.result.lines().collect();
+            let limit = if step.full { lines.len() } else { TRACE_LINES };
+            let mut shown = lines[..lines.len().min(limit)].join("\n");
+            if lines.len() > limit {
+                shown.push_str(&format!("\n[... {} more lines]", lines.len() - limit));
+            }
+            format!("Step {}:\n\n{}\n\n{}", i + 1, fenced(&step.call, "json"), fenced(&shown, "text"))
+        })
+        .collect();
+    let summary = match steps.len() {
+        1 => "Agent trace: 1 step".to_string(),
+        n => format!("Agent trace: {} steps", n),
+    };
+    parser::agent_trace(&summary, &body.join("\n\n"))
+}
@@ -0,0 +1,124 @@
+use crate::{
+    export, files,
+    http::{Reply, Request, Response},
+    watch::{self, WatchSet},
+    web,
+};
+use serde_json::{json, Value};
+use std::{
+    path::Path,
+    time::{Duration, Instant},
+};
+
+// How long POST .../messages waits for the reply unless told otherwise
+const DEFAULT_WAIT: Duration = Duration::from_secs(300);
+const CHECK_EVERY: Duration = Duration::from_millis(250);
+
+// The JSON API under /conversations, served next to the web UI:
+//
+//   GET  /conversations                   every watched chat
+//   GET  /conversations/{file}            a chat's messages
+//   POST /conversations/{file}/messages   {"content": "..."} sends a message
+//
+// Requests need the server's token like every other page, and posts need a
+// JSON Content-Type, which no other site's page can send without the
+// browser asking first.
+//
+// A posted message is appended to the file like one typed in the browser,
+// and the reply is returned once the watcher has written it. Send
+// `"wait": false` to return straight away, or `"timeout": seconds` to wait
+// longer than five minutes.
+pub async fn handle(request: &Request, watch_set: &WatchSet) -> Reply {
+    let rest = request.path.trim_start_matches("/conversations").trim_matches('/');
+    if rest.is_empty() {
+        return match request.method.as_str() {
+            "GET" => Response::json(200, &list(watch_set).await),
+            _ => error(405, "use GET"),
+        }
+        .into();
+    }
+
+    let (name, messages) = match rest.strip_suffix("/messages") {
+        Some(name) => (name, true),
+        None => (rest, false),
+    };
+    let Some(path) = web::find_chat(watch_set, name) else {
+        return error(404, &format!("{} is not a watched chat", name)).into();
+    };
+    match (request.method.as_str(), messages) {
+        ("GET", _) => {
+            let content = files::read_chat(&path).await.unwrap_or_default();
+            Response::json(200, &conversation(&content, name)).into()
+        }
+        ("POST", true) => post(request, &path, name).await.into(),
+        _ => error(405, "use GET, or POST to /messages").into(),
+    }
+}
+
+async fn list(watch_set: &WatchSet) -> Value {
+    let mut conversations = Vec::new();
+    for path in watch_set.files() {
+        let name = watch::display_path(&path);
+        let content = files::read_chat(&path).await.unwrap_or_default();
+        conversations.push(json!({
+            "file": name,
+            "title": export::title(&content, &name),
+            "messages": export::records(&content, &name).len(),
+        }));
+    }
+    Value::Array(conversations)
+}
+
+fn conversation(content: &str, name: &str) -> Value {
+    json!({
+        "file": name,
+        "title": export::title(content, name),
+        "messages": export::records(content, name),
+    })
+}
+
+async fn post(request: &Request, path: &Path, name: &str) -> Response {
+    if request.content_type() != "application/json" {
+        return error(415, "send the message as application/json");
+    }
+    let body: Value = match serde_json::from_slice(&request.body) {
+        Ok(body) => body,
+        Err(e) => return error(400, &format!("expected a JSON body: {}", e)),
+    };
+    let Some(content) = body["content"].as_str().filter(|c| !c.trim().is_empty()) else {
+        return error(400, "\"content\" must be a non-empty string");
+    };
+    let wait = body["wait"].as_bool().unwrap_or(true);
+    let timeout = body["timeout"].as_u64().map_or(DEFAULT_WAIT, Duration::from_secs);
+
+    let before = export::records(&files::read_chat(path).await.unwrap_or_default(), name).len();
+    if let Err(e) = web::send_message(path, content).await {
+        return error(500, &e.to_string());
+    }
+    if !wait {
+        return Response::json(202, &json!({ "file": name, "status": "sent" }));
+    }
+
+    // Done once the chat has grown and ends with an answer; read only when
+    // it changes, since an encrypted chat takes age or gpg each time
+    let mut chat_file = files::Poll::new(path);
+    let started = Instant::now();
+    while started.elapsed() < timeout {
+        tokio::time::sleep(CHECK_EVERY).await;
+        let Ok(Some(content)) = chat_file.changed().await else {
+            continue;
+        };
+        let records = export::records(&content, name);
+        match records.last() {
+            Some(reply) if records.len() > before && reply.role == "assistant" => {
+                return Response::json(200, &json!({ "file": name, "reply": reply }));
+            }
+            _ => {}
+        }
+    }
+    error(504, "no reply yet; it will still be written to the chat")
+}
+
+fn error(status: u16, message: &str) -> Response {
+    Response::json(status, &json!({ "error": message }))
+}
@@ -0,0 +1,68 @@
+use crate::{crypt, files, parser};
+use anyhow::Result;
+use std::path::{Path, PathBuf};
+use tokio::{fs, io::AsyncWriteExt};
+
+pub const DEFAULT_KEEP_EXCHANGES: usize = 3;
+pub const ARCHIVE_AFTER_ENV: &str = "CHAT_ARCHIVE_AFTER";
+
+// chat.md -> chat.archive.md, next to the original; chat.md.gpg ->
+// chat.archive.md.gpg, encrypted like it
+pub fn archive_path(chat_file: &Path) -> PathBuf {
+    let name = chat_file.file_name().unwrap_or_default().to_string_lossy();
+    let plain = crypt::plain_name(&name);
+    let stem = Path::new(plain)
+        .file_stem()
+        .map(|s| s.to_string_lossy().into_owned())
+        .unwrap_or_else(|| "chat".to_string());
+    chat_file.with_file_name(format!("{}.archive.md{}", stem, &name[plain.len()..]))
+}
+
+// Offset in `body` where the last `keep` answered exchanges start, if there
+// is anything older to move out. Always cuts at a user message so the
+// remaining file keeps its user/assistant alternation.
+pub fn archive_cut(body: &str, separator: &str, keep: usize) -> Option<usize> {
+    let ranges = parser::split_unfenced_ranges(body, separator);
+    let answered: Vec<usize> = (0..ranges.len())
+        .step_by(2)
+        .filter(|&i| {
+            ranges
+                .get(i + 1)
+                .is_some_and(|r| !body[r.clone()].trim().is_empty())
+        })
+        .collect();
+
+    if answered.len() <= keep {
+        return None;
+    }
+    Some(ranges[answered[answered.len() - keep]].start)
+}
+
+// Appends `body[..cut]` to the archive file and returns the chat content
+// without it. The archived chunk ends with a separator, so the archive stays
+// a valid chat file however many times it is appended to.
+pub async fn archive(chat_file: &Path, content: &str, body_start: usize, cut: usize) -> Result<String> {
+    let archived = &content[body_start..body_start + cut];
+
+    // Nothing can be appended to an encrypted file; it is written again whole
+    let path = archive_path(chat_file);
+    if crypt::scheme(&path).is_some() {
+        let earlier = match files::read_chat(&path).await {
+            Ok(earlier) => earlier,
+            Err(e) if e.kind() == std::io::ErrorKind::NotFound => String::new(),
+            Err(e) => return Err(e.into()),
+        };
+        files::write_chat(&path, &format!("{}{}", earlier, archived)).await?;
+        return Ok(format!("{}{}", &content[..body_start], &content[body_start + cut..]));
+    }
+
+    let mut file = fs::OpenOptions::new()
+        .create(true)
+        .append(true)
+        .open(&path)
+        .await?;
+    file.write_all(archived.as_bytes()).await?;
+    file.flush().await?;
+
+    Ok(format!("{}{}", &content[..body_start], &content[body_start + cut..]))
+}
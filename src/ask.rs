@@ -0,0 +1,86 @@
+use crate::{
+    auth, config, files, library, parser,
+    provider::{ApiClient, RequestParams},
+    reply, validate, ChatContext, Message, LOG_TO_STDERR,
+};
+use anyhow::{Context, Result};
+use std::{
+    path::PathBuf,
+    sync::{atomic::Ordering, RwLock},
+};
+use tokio::io::AsyncReadExt;
+
+// `ask [--chat file] [--model name] [--git what] [question] [-]`: one request,
+// answer on stdout. `-` (or --stdin) reads the prompt from stdin, after any
+// question given as arguments, so `git diff | ask "review this" -` works;
+// `--git diff|staged|<commit>` attaches those changes instead. With --chat
+// the file's history, model and persona are used, but the file is not
+// written.
+pub async fn run(args: &[String]) -> Result<()> {
+    LOG_TO_STDERR.store(true, Ordering::Relaxed);
+
+    let mut chat_file = None;
+    let mut model = None;
+    let mut read_stdin = false;
+    let mut git = None;
+    let mut words = Vec::new();
+    let mut args = args.iter();
+    while let Some(arg) = args.next() {
+        match arg.as_str() {
+            "-" | "--stdin" => read_stdin = true,
+            "--chat" | "-c" => chat_file = Some(PathBuf::from(args.next().context("--chat needs a file")?)),
+            "--model" | "-m" => model = Some(args.next().context("--model needs a name")?.clone()),
+            "--git" | "-g" => git = Some(args.next().context("--git needs diff, staged or a commit")?.clone()),
+            _ => words.push(arg.as_str()),
+        }
+    }
+
+    let mut prompt = words.join(" ");
+    if read_stdin {
+        let mut input = String::new();
+        tokio::io::stdin().read_to_string(&mut input).await?;
+        if !prompt.is_empty() {
+            prompt.push_str("\n\n");
+        }
+        prompt.push_str(input.trim_end());
+    }
+    if prompt.trim().is_empty() {
+        anyhow::bail!("usage: ask [--chat file] [--model name] [--git what] [question] [-]");
+    }
+    if let Some(git) = git {
+        prompt.push_str(&format!("\n\n@git {}", git));
+    }
+
+    let api_key = auth::api_key()
+        .with_context(|| format!("{} not found; set it or run `auth login`", config::API_KEY_ENV))?;
+    let api_client = ApiClient::new(api_key);
+    let validators = validate::Validators::from_env();
+    let library = RwLock::new(library::PromptLibrary::from_env());
+
+    let (chat_context, mut messages) = match &chat_file {
+        Some(path) => {
+            let content = files::read_chat(path)
+                .await
+                .with_context(|| format!("cannot read {}", path.display()))?;
+            let chat_context = ChatContext::new(path.clone(), content.clone());
+            let body = &content[chat_context.body_start..];
+            let history = chat_context.build_history(body, body.len(), body.len());
+            (chat_context, history)
+        }
+        None => (ChatContext::new(PathBuf::from("."), String::new()), Vec::new()),
+    };
+
+    let (prompt, mut params) = RequestParams::take_from(&prompt);
+    if model.is_some() {
+        params.model = model;
+    }
+    let prompt = reply::take_mention(parser::strip_branch_headings(&prompt), &mut params, &library);
+    messages.push(Message::new("user", prompt));
+
+    let (reply, warning) = reply::request_reply(messages, &params, &api_client, &chat_context, &validators, &library, &|_| {}).await?;
+    if reply.is_empty() {
+        anyhow::bail!("{}", warning.unwrap_or_default());
+    }
+    println!("{}", reply.trim_end());
+    Ok(())
+}
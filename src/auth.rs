@@ -0,0 +1,121 @@
+use crate::{config, debug_log, mock};
+use anyhow::{bail, Context, Result};
+use std::{
+    io::{BufRead, IsTerminal, Write},
+    process::{Command, Stdio},
+};
+
+// Keychain entries are filed under this service, named after the variable
+// they stand in for
+const SERVICE: &str = "chatmd";
+
+// `auth login|logout|status`: keeps the API key in the system keychain
+// (macOS Keychain, Secret Service, Windows Credential Manager) instead of in
+// a plaintext .env
+pub async fn run(args: &[String]) -> Result<()> {
+    match args.first().map(String::as_str) {
+        Some("login") => login(),
+        Some("logout") => logout(),
+        Some("status") | None => status(),
+        Some(other) => bail!("unknown auth command {:?}; expected login, logout or status", other),
+    }
+}
+
+// The environment (including .env and config files) wins, so a key set
+// there for one project overrides the stored one. The mock provider needs
+// none, so it gets a stand-in.
+pub fn api_key() -> Option<String> {
+    env_key()
+        .or_else(|| mock::active().then(|| mock::PROVIDER.to_string()))
+        .or_else(stored_key)
+}
+
+fn env_key() -> Option<String> {
+    std::env::var(config::API_KEY_ENV).ok().filter(|k| !k.trim().is_empty())
+}
+
+pub fn stored_key() -> Option<String> {
+    match entry().and_then(|entry| entry.get_password()) {
+        Ok(key) => Some(key),
+        Err(keyring::Error::NoEntry) => None,
+        Err(e) => {
+            debug_log(&format!("error: cannot read the API key from the keychain: {}", e));
+            None
+        }
+    }
+}
+
+fn entry() -> keyring::Result<keyring::Entry> {
+    keyring::Entry::new(SERVICE, config::API_KEY_ENV)
+}
+
+fn login() -> Result<()> {
+    let key = read_secret("API key: ")?;
+    if key.is_empty() {
+        bail!("no key entered");
+    }
+    entry()
+        .and_then(|entry| entry.set_password(&key))
+        .context("cannot save the key to the keychain")?;
+    println!("saved the API key ({}) to the system keychain", mask(&key));
+    if env_key().is_some() {
+        println!("note: {} is also set in the environment and takes precedence", config::API_KEY_ENV);
+    }
+    Ok(())
+}
+
+fn logout() -> Result<()> {
+    match entry().and_then(|entry| entry.delete_credential()) {
+        Ok(()) => println!("removed the API key from the system keychain"),
+        Err(keyring::Error::NoEntry) => println!("no API key was stored"),
+        Err(e) => return Err(e).context("cannot remove the key from the keychain"),
+    }
+    Ok(())
+}
+
+fn status() -> Result<()> {
+    match (env_key(), stored_key()) {
+        (Some(key), _) => println!("using {} from the environment ({})", config::API_KEY_ENV, mask(&key)),
+        (None, Some(key)) => println!("using the API key in the system keychain ({})", mask(&key)),
+        (None, None) => bail!("no API key; run `auth login` or set {}", config::API_KEY_ENV),
+    }
+    Ok(())
+}
+
+// One line from stdin, not echoed when typed at a terminal. Piped input
+// works too: `pass show deepseek | chatmd auth login`.
+fn read_secret(prompt: &str) -> Result<String> {
+    let stdin = std::io::stdin();
+    let interactive = stdin.is_terminal();
+    if interactive {
+        eprint!("{}", prompt);
+        std::io::stderr().flush()?;
+        set_echo(false);
+    }
+    let mut line = String::new();
+    let read = stdin.lock().read_line(&mut line);
+    if interactive {
+        set_echo(true);
+        eprintln!();
+    }
+    read?;
+    Ok(line.trim().to_string())
+}
+
+// Where there is no `stty`, the key is simply echoed
+fn set_echo(on: bool) {
+    let _ = Command::new("stty")
+        .arg(if on { "echo" } else { "-echo" })
+        .stdin(Stdio::inherit())
+        .status();
+}
+
+// Enough of a key to tell which one is set, not enough to use it
+pub fn mask(key: &str) -> String {
+    let chars: Vec<char> = key.chars().collect();
+    if chars.len() <= 8 {
+        return "*".repeat(chars.len());
+    }
+    let tail: String = chars[chars.len() - 4..].iter().collect();
+    format!("{}…{}", chars[..3].iter().collect::<String>(), tail)
+}
@@ -0,0 +1,117 @@
+use crate::{archive, config, logging::debug_log, parser, watch};
+use anyhow::{bail, Context, Result};
+use std::path::{Path, PathBuf};
+
+pub const AUTO_COMMIT_ENV: &str = "CHAT_AUTO_COMMIT";
+// Commit subjects quote the question up to this many characters
+const SUBJECT_CHARS: usize = 60;
+
+// Where finished exchanges are committed
+#[derive(Debug, Clone, PartialEq)]
+pub enum Target {
+    // The repository the chat file is already in
+    Own,
+    // A repository of its own (created if needed), which gets a copy
+    Repo(PathBuf),
+}
+
+// `auto_commit:` in the frontmatter or CHAT_AUTO_COMMIT: true for the chat's
+// own repository, a directory for a separate one, false or empty for none
+pub fn parse(value: &str) -> Option<Target> {
+    let value = config::unquote(value.trim());
+    match config::parse_bool(&value) {
+        Some(true) => Some(Target::Own),
+        Some(false) => None,
+        None if value.is_empty() => None,
+        None => Some(Target::Repo(watch::expand_home(&value))),
+    }
+}
+
+pub fn from_env() -> Option<Target> {
+    std::env::var(AUTO_COMMIT_ENV).ok().as_deref().and_then(parse)
+}
+
+// Commits `chat` (and its archive, if there is one) with a subject taken
+// from `question`. Nothing is committed when the files have not changed.
+pub async fn commit(chat: &Path, target: &Target, question: Option<&str>) -> Result<()> {
+    let chat_dir = chat.parent().filter(|d| !d.as_os_str().is_empty()).unwrap_or(Path::new("."));
+    let mut files = vec![chat.to_path_buf()];
+    let archive = archive::archive_path(chat);
+    if archive.is_file() {
+        files.push(archive);
+    }
+
+    let (repo, files) = match target {
+        Target::Own => (chat_dir.to_path_buf(), files),
+        Target::Repo(repo) => {
+            let repo = chat_dir.join(repo);
+            tokio::fs::create_dir_all(&repo).await?;
+            if !repo.join(".git").exists() {
+                git(&repo, &["init", "-q"]).await?;
+                debug_log(&format!("write: created a git repository for chats in {}", repo.display()));
+            }
+            let mut copies = Vec::new();
+            for file in files {
+                let copy = repo.join(file.file_name().context("chat file has no name")?);
+                tokio::fs::copy(&file, &copy).await?;
+                copies.push(copy);
+            }
+            (repo, copies)
+        }
+    };
+
+    let paths: Vec<String> = files
+        .iter()
+        .map(|f| f.canonicalize().unwrap_or_else(|_| f.clone()).display().to_string())
+        .collect();
+    let mut add = vec!["add", "--"];
+    add.extend(paths.iter().map(String::as_str));
+    git(&repo, &add).await?;
+
+    let mut staged = vec!["diff", "--cached", "--quiet", "--"];
+    staged.extend(paths.iter().map(String::as_str));
+    if git(&repo, &staged).await.is_ok() {
+        return Ok(());
+    }
+
+    let message = message(chat, question);
+    let mut commit = vec!["commit", "-q", "-m", &message, "--"];
+    commit.extend(paths.iter().map(String::as_str));
+    git(&repo, &commit).await?;
+    debug_log(&format!("write: committed {} to git", watch::display_path(chat)));
+    Ok(())
+}
+
+// "chat.md: how do I…" from the first line of the question
+fn message(chat: &Path, question: Option<&str>) -> String {
+    let name = chat.file_name().map_or("chat".into(), |n| n.to_string_lossy());
+    let question = question.map(parser::strip_private).unwrap_or_default();
+    let line = question.lines().map(str::trim).find(|l| !l.is_empty()).unwrap_or_default();
+    let line = line.split_whitespace().collect::<Vec<_>>().join(" ");
+    let subject = match line.char_indices().nth(SUBJECT_CHARS) {
+        Some((cut, _)) => format!("{}…", line[..cut].trim_end()),
+        None => line.to_string(),
+    };
+    match subject.is_empty() {
+        true => format!("{}: new reply", name),
+        false => format!("{}: {}", name, subject),
+    }
+}
+
+async fn git(repo: &Path, args: &[&str]) -> Result<()> {
+    let output = tokio::process::Command::new("git")
+        .arg("-C")
+        .arg(repo)
+        .args(args)
+        .output()
+        .await
+        .context("cannot run git")?;
+    if !output.status.success() {
+        bail!(
+            "git {} failed: {}",
+            args.first().unwrap_or(&""),
+            String::from_utf8_lossy(&output.stderr).trim()
+        );
+    }
+    Ok(())
+}
@@ -0,0 +1,166 @@
+use crate::{export, files, logging::debug_log, parser, pending, watch, web};
+use anyhow::Result;
+use std::{
+    collections::VecDeque,
+    path::{Path, PathBuf},
+    time::Duration,
+};
+
+// Another chat service one chat file is mirrored to. Messages typed there
+// are sent into the chat; the file stays the record of the conversation.
+pub(crate) trait Remote {
+    fn name(&self) -> &'static str;
+    // Posts a message from the chat file; `from_user` is false for replies
+    async fn post(&mut self, text: &str, from_user: bool) -> Result<()>;
+    // Messages sent on the other side since the last call
+    async fn receive(&mut self) -> Result<Vec<String>>;
+}
+
+// Starts every bridge configured in the environment, for chats the watcher
+// answers. A bridge to a chat outside the watch set would never get replies.
+pub fn start(watch_set: &watch::WatchSet) {
+    if let Some((remote, chat)) = configured(crate::slack::from_env(), "slack", watch_set) {
+        tokio::spawn(run(remote, chat, crate::slack::POLL_EVERY));
+    }
+    if let Some((remote, chat)) = configured(crate::discord::from_env(), "discord", watch_set) {
+        tokio::spawn(run(remote, chat, crate::discord::POLL_EVERY));
+    }
+    if let Some((remote, chat)) = configured(crate::telegram::from_env(), "telegram", watch_set) {
+        tokio::spawn(run(remote, chat, crate::telegram::POLL_EVERY));
+    }
+    if let Some((remote, chat)) = configured(crate::matrix::from_env(), "matrix", watch_set) {
+        tokio::spawn(run(remote, chat, crate::matrix::POLL_EVERY));
+    }
+}
+
+// A bridge set up in the environment, with its chat as the watcher knows it
+fn configured<R>(bridge: Result<Option<(R, PathBuf)>>, name: &str, watch_set: &watch::WatchSet) -> Option<(R, PathBuf)> {
+    let (remote, chat) = match bridge {
+        Ok(bridge) => bridge?,
+        Err(e) => {
+            debug_log(&format!("error: {} bridge: {:#}", name, e));
+            return None;
+        }
+    };
+    let found = watch_set.find(&chat);
+    if found.is_none() {
+        debug_log(&format!("error: {} bridge: {} is not being watched", name, watch::display_path(&chat)));
+    }
+    Some((remote, found?))
+}
+
+// Mirrors `chat` to `remote` and back until the process ends. Only
+// exchanges that have a reply are posted, so drafts being typed in the file
+// stay private; earlier history is never posted.
+pub async fn run<R: Remote>(mut remote: R, chat: PathBuf, every: Duration) {
+    debug_log(&format!("init: {} bridge for {}", remote.name(), watch::display_path(&chat)));
+    // Read only when it changes: an encrypted chat takes age or gpg each time
+    let mut chat_file = files::Poll::new(&chat);
+    let mut records = match chat_file.changed().await {
+        Ok(Some(content)) => settled(&content, &chat),
+        _ => Vec::new(),
+    };
+    let mut posted = records.len();
+    // Messages that came from the remote, so they aren't posted back to it
+    let mut echoes: VecDeque<String> = VecDeque::new();
+
+    loop {
+        tokio::time::sleep(every).await;
+
+        match remote.receive().await {
+            Ok(messages) => {
+                for message in messages.iter().filter(|m| !m.trim().is_empty()) {
+                    debug_log(&format!("detect: message from {} for {}", remote.name(), watch::display_path(&chat)));
+                    match web::send_bridged(&chat, message, remote.name()).await {
+                        Ok(written) => echoes.push_back(written),
+                        Err(e) => debug_log(&format!("error: {} bridge: cannot write to the chat: {}", remote.name(), e)),
+                    }
+                }
+            }
+            Err(e) => debug_log(&format!("error: {} bridge: {:#}", remote.name(), e)),
+        }
+
+        if pending::load(&chat).await.is_some() {
+            continue;
+        }
+        match chat_file.changed().await {
+            Ok(Some(content)) => records = settled(&content, &chat),
+            Ok(None) => {}
+            Err(e) => debug_log(&format!("error: {} bridge: cannot read the chat: {}", remote.name(), e)),
+        }
+        // Archived or rewritten; carry on from the end as it is now
+        if records.len() < posted {
+            posted = records.len();
+        }
+        for (role, text) in &records[posted..] {
+            if role == "user" && echoes.front().is_some_and(|echo| echo == text) {
+                echoes.pop_front();
+                posted += 1;
+                continue;
+            }
+            if let Err(e) = remote.post(text, role == "user").await {
+                debug_log(&format!("error: {} bridge: cannot post: {:#}", remote.name(), e));
+                break;
+            }
+            posted += 1;
+        }
+    }
+}
+
+// The chat's messages up to its last reply, as they read without notes,
+// traces or earlier answers
+fn settled(content: &str, chat: &Path) -> Vec<(String, String)> {
+    let mut records: Vec<(String, String)> = export::records(content, &chat.display().to_string())
+        .into_iter()
+        .map(|r| {
+            let text = match r.role.as_str() {
+                "assistant" => parser::take_alternatives(&parser::strip_trace(&r.content)).0,
+                // Sent from the remote but not yet picked up by the watcher
+                _ => parser::take_via(&parser::take_send_marker(&r.content, None).unwrap_or(r.content)).0.trim().to_string(),
+            };
+            (r.role, text)
+        })
+        .filter(|(_, text)| !text.is_empty())
+        .collect();
+    let last_reply = records.iter().rposition(|(role, _)| role == "assistant").map_or(0, |i| i + 1);
+    records.truncate(last_reply);
+    records
+}
+
+// `text` in parts of at most `max` characters, cut between lines where it
+// can be; a code block cut in two is closed and reopened
+pub fn split(text: &str, max: usize) -> Vec<String> {
+    let mut parts = Vec::new();
+    let mut part = String::new();
+    let mut fence: Option<String> = None;
+    for line in text.lines() {
+        // Room for closing a fence at the end of the part
+        if !part.is_empty() && part.chars().count() + line.chars().count() + 5 > max {
+            if fence.is_some() {
+                part.push_str("```");
+            }
+            parts.push(std::mem::take(&mut part));
+            if let Some(open) = &fence {
+                part = format!("{}\n", open);
+            }
+        }
+        let mut line = line;
+        while line.chars().count() > max - 5 {
+            let cut = line.char_indices().nth(max - 5).map_or(line.len(), |(i, _)| i);
+            parts.push(line[..cut].to_string());
+            line = &line[cut..];
+        }
+        if line.trim_start().starts_with("```") {
+            fence = match fence {
+                Some(_) => None,
+                None => Some(line.trim().to_string()),
+            };
+        }
+        part.push_str(line);
+        part.push('\n');
+    }
+    if !part.trim().is_empty() {
+        parts.push(part.trim_end().to_string());
+    }
+    parts
+}
@@ -0,0 +1,152 @@
+use crate::{logging, LogFormat, LogLevel};
+use anyhow::{Context, Result};
+use std::path::{Path, PathBuf};
+
+// Name, usage and summary of each subcommand, in the order `help` lists them
+const COMMANDS: &[(&str, &str, &str)] = &[
+    (
+        "watch",
+        "watch [file|dir|glob...] [--poll] [--poll-interval ms] [--include glob] [--exclude glob] [--metrics addr] [--daemon]",
+        "watch chats and answer new messages (the default)",
+    ),
+    ("serve", "serve [file|dir|glob...] [--web addr]", "watch chats and show them in the browser (default :8080)"),
+    ("stop", "stop", "stop the watcher started with --daemon"),
+    ("status", "status", "say whether a --daemon watcher is running"),
+    ("service", "service install [targets...] [--print] | service uninstall", "run the watcher on login"),
+    ("ask", "ask [--chat file] [--model name] [--git what] [question] [-]", "send one question and print the answer"),
+    ("auth", "auth [login|logout|status]", "keep the API key in the system keychain"),
+    ("new", "new <name>", "start a chat from the starter template"),
+    ("context", "context [file]", "show what the next message in a chat would send"),
+    ("tokens", "tokens [file] [--select start:end] [--model name]", "count the tokens in each message and the next request"),
+    ("rpc", "rpc", "JSON-RPC on stdin/stdout for editor extensions"),
+    ("search", "search <query> [file|dir|glob...] [--role user|assistant] [--since date] [--until date]", "find messages across chats"),
+    ("index", "index [file|dir|glob...] [--rebuild]", "bring the search index up to date"),
+    ("stats", "stats [file|dir|glob...] [--days n]", "messages per day, usage per model and the longest chats"),
+    ("cost", "cost [--since date] [--until date] [--by model|day|month|chat] [--csv]", "add up spend from the usage log"),
+    ("export", "export [--format html|pdf] [--out path] [file]", "render a chat as a page to share"),
+    ("import", "import <conversations.json> [--out dir]", "convert a ChatGPT or Claude export into chats"),
+    ("fmt", "fmt [--check] [file...]", "normalize separators, whitespace and code fences"),
+    ("doctor", "doctor [file|dir|glob...] [--online]", "check the API key, settings and chat files"),
+    ("email", "email [--listen addr]", "answer mail sent to CHAT_EMAIL_ADDRESS (SMTP, default 127.0.0.1:2525)"),
+    ("plugins", "plugins", "list the tools and providers plugins offer"),
+    ("schedule", "schedule", "list the scheduled prompts and when each runs next"),
+];
+
+// Accepted anywhere on the command line, for every command
+const LOG_FLAGS: &[(&str, LogLevel)] = &[
+    ("--quiet", LogLevel::Quiet),
+    ("-q", LogLevel::Quiet),
+    ("--verbose", LogLevel::Verbose),
+    ("--debug", LogLevel::Debug),
+];
+
+// The subcommand to run and its arguments, or None when only help or the
+// version was asked for. Without a subcommand the arguments are watch
+// targets, as they were before subcommands existed.
+pub fn parse(args: &[String]) -> Result<Option<(&'static str, Vec<String>)>> {
+    let args = take_global_flags(args)?;
+    let Some(first) = args.first() else {
+        return Ok(Some(("watch", Vec::new())));
+    };
+
+    match first.as_str() {
+        "help" | "--help" | "-h" => {
+            match args.get(1).and_then(|name| find(name)) {
+                Some(command) => print_usage(command),
+                None => print_help(),
+            }
+            return Ok(None);
+        }
+        "--version" | "-V" => {
+            println!("{} {}", env!("CARGO_PKG_NAME"), env!("CARGO_PKG_VERSION"));
+            return Ok(None);
+        }
+        _ => {}
+    }
+
+    if let Some(command) = find(first) {
+        if args[1..].iter().any(|a| a == "--help" || a == "-h") {
+            print_usage(command);
+            return Ok(None);
+        }
+        return Ok(Some((command.0, args[1..].to_vec())));
+    }
+
+    // A typo'd subcommand must not be taken for a new chat to create
+    if !first.starts_with('-') && !looks_like_path(first) {
+        anyhow::bail!("unknown command {:?}; run `help` to list them", first);
+    }
+    Ok(Some(("watch", args)))
+}
+
+// Every `--env-file path`, read before anything else so the files can set
+// the log level and the rest. parse() then drops them.
+pub fn env_files(args: &[String]) -> Vec<PathBuf> {
+    let mut paths = Vec::new();
+    let mut args = args.iter();
+    while let Some(arg) = args.next() {
+        if let Some(Some(path)) = flag_value(arg, "--env-file", &mut args) {
+            paths.push(PathBuf::from(path));
+        }
+    }
+    paths
+}
+
+// Applies the flags every command takes and returns the other arguments
+fn take_global_flags(args: &[String]) -> Result<Vec<String>> {
+    let mut rest = Vec::with_capacity(args.len());
+    let mut args = args.iter();
+    while let Some(arg) = args.next() {
+        if let Some((_, level)) = LOG_FLAGS.iter().find(|(flag, _)| flag == arg) {
+            level.set();
+        } else if let Some(format) = flag_value(arg, "--log-format", &mut args) {
+            match format.and_then(LogFormat::parse) {
+                Some(format) => format.set(),
+                None => anyhow::bail!("--log-format needs pretty or json"),
+            }
+        } else if let Some(path) = flag_value(arg, "--env-file", &mut args) {
+            path.context("--env-file needs a path")?;
+        } else if let Some(path) = flag_value(arg, "--log-file", &mut args) {
+            logging::log_to_file(Path::new(path.context("--log-file needs a path")?))?;
+        } else {
+            rest.push(arg.clone());
+        }
+    }
+    Ok(rest)
+}
+
+// The value of `--flag value` or `--flag=value`, if `arg` is that flag
+fn flag_value<'a>(arg: &'a str, flag: &str, rest: &mut impl Iterator<Item = &'a String>) -> Option<Option<&'a str>> {
+    match arg.strip_prefix(flag)? {
+        "" => Some(rest.next().map(String::as_str)),
+        value => Some(value.strip_prefix('=')).filter(Option::is_some),
+    }
+}
+
+fn find(name: &str) -> Option<&'static (&'static str, &'static str, &'static str)> {
+    COMMANDS.iter().find(|(command, _, _)| *command == name)
+}
+
+fn looks_like_path(arg: &str) -> bool {
+    Path::new(arg).exists() || arg.contains(['/', '\\', '.', '*', '?'])
+}
+
+fn print_usage((_, usage, summary): &(&str, &str, &str)) {
+    println!("{}\n\nusage: {} {}", summary, env!("CARGO_PKG_NAME"), usage);
+}
+
+fn print_help() {
+    println!("Chat with a model from a markdown file.\n");
+    println!("usage: {} [command] [args...]\n\ncommands:", env!("CARGO_PKG_NAME"));
+    for (name, _, summary) in COMMANDS {
+        println!("  {:<9} {}", name, summary);
+    }
+    println!("\nfor any command:");
+    println!("  --env-file path    read settings from this file instead of .env; repeat for several");
+    println!("  --quiet, -q  errors only");
+    println!("  --verbose    also why changes were skipped or trimmed");
+    println!("  --debug      everything, including each parse");
+    println!("  --log-format json  one JSON object per line, with event, file, model, tokens and duration_ms");
+    println!("  --log-file path    log to a file, rotated by size and age, instead of the terminal");
+    println!("\nRun `help <command>` for a command's arguments.");
+}
@@ -0,0 +1,25 @@
+use crate::logging::debug_log;
+use chrono::{DateTime, Local};
+use std::sync::atomic::{AtomicBool, Ordering};
+
+pub const CLOCK_ENV: &str = "CHAT_CLOCK";
+
+static WARNED: AtomicBool = AtomicBool::new(false);
+
+// The time written into chats, requests and the usage log. CHAT_CLOCK stops
+// it at an RFC 3339 moment, so the same session writes the same files and
+// sends the same requests every run: for demos, replays and tests.
+pub fn now() -> DateTime<Local> {
+    let Some(fixed) = std::env::var(CLOCK_ENV).ok().filter(|v| !v.trim().is_empty()) else {
+        return Local::now();
+    };
+    match DateTime::parse_from_rfc3339(fixed.trim()) {
+        Ok(fixed) => fixed.with_timezone(&Local),
+        Err(e) => {
+            if !WARNED.swap(true, Ordering::Relaxed) {
+                debug_log(&format!("error: ignoring {}={:?}: {}", CLOCK_ENV, fixed, e));
+            }
+            Local::now()
+        }
+    }
+}
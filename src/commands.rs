@@ -0,0 +1,55 @@
+// A line of its own typed while a reply is on its way drops the reply
+pub const STOP: &str = "/stop";
+
+pub const SUMMARIZE_PROMPT: &str = "Summarize our conversation so far: the main topics, decisions and any open questions. Be concise.";
+
+// Slash commands typed as a whole message. They run locally and their output
+// is written back as the reply, instead of being sent to the API.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub enum Command {
+    Archive(Option<usize>),
+    Clear,
+    Context,
+    Fetch(Option<String>),
+    Model(Option<String>),
+    Persona(Option<String>),
+    Retry,
+    Stop,
+    Summarize,
+    Tokens,
+}
+
+impl Command {
+    pub fn parse(message: &str) -> Option<Self> {
+        let message = message.trim();
+        let rest = message.strip_prefix('/')?;
+        if message.lines().count() > 1 {
+            return None;
+        }
+
+        let mut words = rest.split_whitespace();
+        let name = words.next()?.to_lowercase();
+        let argument = words.collect::<Vec<_>>().join(" ");
+        let argument = (!argument.is_empty()).then_some(argument);
+
+        // Anything else starting with a slash (a path, say) is a normal message
+        match name.as_str() {
+            "archive" => Some(Command::Archive(argument.and_then(|a| a.parse().ok()))),
+            "clear" => Some(Command::Clear),
+            "context" => Some(Command::Context),
+            "fetch" => Some(Command::Fetch(argument)),
+            "model" => Some(Command::Model(argument)),
+            "persona" => Some(Command::Persona(argument)),
+            "retry" => Some(Command::Retry),
+            "stop" => Some(Command::Stop),
+            "summarize" | "summarise" => Some(Command::Summarize),
+            "tokens" => Some(Command::Tokens),
+            _ => None,
+        }
+    }
+
+    // Whether the reply to this command is worth keeping in the context
+    pub fn keeps_reply(&self) -> bool {
+        matches!(self, Command::Summarize | Command::Fetch(_))
+    }
+}
@@ -0,0 +1,192 @@
+use std::{
+    borrow::Cow,
+    collections::HashMap,
+    sync::atomic::{AtomicUsize, Ordering},
+    time::Duration,
+};
+
+pub const API_KEY_ENV: &str = "DEEPSEEK_API_KEY";
+pub const DEFAULT_SEPARATOR: &str = "***";
+pub const SEPARATOR_ENV: &str = "CHAT_SEPARATOR";
+pub const DEFAULT_MODEL: &str = "deepseek-chat";
+pub const MODEL_ENV: &str = "CHAT_MODEL";
+pub const TIMESTAMPS_ENV: &str = "CHAT_TIMESTAMPS";
+pub const EXPLICIT_SEND_ENV: &str = "CHAT_EXPLICIT_SEND";
+pub const SEND_MARKER_ENV: &str = "CHAT_SEND_MARKER";
+pub const TYPING_INDICATOR_ENV: &str = "CHAT_TYPING_INDICATOR";
+pub const KEEP_ALTERNATIVES_ENV: &str = "CHAT_KEEP_ALTERNATIVES";
+pub const CONTEXT_MESSAGES_ENV: &str = "CHAT_CONTEXT_MESSAGES";
+pub const CONTEXT_TOKENS_ENV: &str = "CHAT_CONTEXT_TOKENS";
+pub const CONTEXT_LIMIT_ENV: &str = "CHAT_CONTEXT_LIMIT";
+pub const LOG_LEVEL_ENV: &str = "CHAT_LOG_LEVEL";
+pub const DEBOUNCE_ENV: &str = "CHAT_DEBOUNCE_MS";
+pub const DEFAULT_DEBOUNCE_MS: u64 = 150;
+
+const FRONTMATTER_FENCE: &str = "---";
+
+// Bumped whenever the environment changes under a running process, so
+// settings read from it once can tell they are stale
+static GENERATION: AtomicUsize = AtomicUsize::new(0);
+
+pub fn generation() -> usize {
+    GENERATION.load(Ordering::Relaxed)
+}
+
+pub fn bump_generation() {
+    GENERATION.fetch_add(1, Ordering::Relaxed);
+}
+
+// Key/value pairs from a `---` block at the very top of a chat file.
+// Only flat `key: value` lines are understood; anything else is ignored.
+#[derive(Debug, Clone, Default)]
+pub struct Frontmatter {
+    values: HashMap<String, String>,
+    pub body_start: usize,
+}
+
+impl Frontmatter {
+    pub fn parse(content: &str) -> Self {
+        let mut frontmatter = Self::default();
+
+        let Some(rest) = content.strip_prefix(FRONTMATTER_FENCE) else {
+            return frontmatter;
+        };
+        let Some(rest) = rest.strip_prefix('\n') else {
+            return frontmatter;
+        };
+
+        let mut offset = content.len() - rest.len();
+        for line in rest.split_inclusive('\n') {
+            offset += line.len();
+            let line = line.trim();
+            if line == FRONTMATTER_FENCE {
+                frontmatter.body_start = offset;
+                return frontmatter;
+            }
+            if let Some((key, value)) = line.split_once(':') {
+                frontmatter
+                    .values
+                    .insert(key.trim().to_lowercase(), unquote(value.trim()).into_owned());
+            }
+        }
+
+        // Unterminated block: treat the whole file as body
+        Self::default()
+    }
+
+    pub fn get(&self, key: &str) -> Option<&str> {
+        self.values.get(key).map(String::as_str)
+    }
+}
+
+// Returns `content` with `key` set in its frontmatter, adding a frontmatter
+// block if the file has none
+pub fn set_frontmatter_value(content: &str, key: &str, value: &str) -> String {
+    let entry = format!("{}: {}\n", key, value);
+    let body_start = Frontmatter::parse(content).body_start;
+    if body_start == 0 {
+        return format!("{}\n{}{}\n{}", FRONTMATTER_FENCE, entry, FRONTMATTER_FENCE, content);
+    }
+
+    let mut updated = String::with_capacity(content.len() + entry.len());
+    let mut replaced = false;
+    let lines: Vec<&str> = content[..body_start].split_inclusive('\n').collect();
+    for (i, line) in lines.iter().enumerate() {
+        let is_key = i > 0
+            && line
+                .split_once(':')
+                .is_some_and(|(k, _)| k.trim().eq_ignore_ascii_case(key));
+        let is_closing = i == lines.len() - 1;
+
+        if is_key && !replaced {
+            updated.push_str(&entry);
+            replaced = true;
+            continue;
+        }
+        if is_closing && !replaced {
+            updated.push_str(&entry);
+        }
+        updated.push_str(line);
+    }
+
+    updated.push_str(&content[body_start..]);
+    updated
+}
+
+pub fn default_model() -> String {
+    std::env::var(MODEL_ENV)
+        .ok()
+        .filter(|s| !s.trim().is_empty())
+        .unwrap_or_else(|| DEFAULT_MODEL.to_string())
+}
+
+// How long a file must stay quiet before its changes are processed
+pub fn debounce_window() -> Duration {
+    let millis = std::env::var(DEBOUNCE_ENV)
+        .ok()
+        .and_then(|v| v.trim().parse().ok())
+        .unwrap_or(DEFAULT_DEBOUNCE_MS);
+    Duration::from_millis(millis)
+}
+
+// Double-quoted values may escape `"` and `\` with a backslash, as in YAML
+pub fn unquote(value: &str) -> Cow<'_, str> {
+    if let Some(inner) = value.strip_prefix('"').and_then(|v| v.strip_suffix('"')) {
+        if !inner.contains('\\') {
+            return Cow::Borrowed(inner);
+        }
+        let mut unescaped = String::with_capacity(inner.len());
+        let mut chars = inner.chars().peekable();
+        while let Some(c) = chars.next() {
+            match (c, chars.peek()) {
+                ('\\', Some(&next @ ('"' | '\\'))) => {
+                    unescaped.push(next);
+                    chars.next();
+                }
+                _ => unescaped.push(c),
+            }
+        }
+        return Cow::Owned(unescaped);
+    }
+    match value.strip_prefix('\'').and_then(|v| v.strip_suffix('\'')) {
+        Some(inner) => Cow::Borrowed(inner),
+        None => Cow::Borrowed(value),
+    }
+}
+
+// `value` double-quoted for the frontmatter, read back as it was by unquote
+pub fn quote(value: &str) -> String {
+    format!("\"{}\"", value.replace('\\', "\\\\").replace('"', "\\\""))
+}
+
+pub fn default_separator() -> String {
+    std::env::var(SEPARATOR_ENV)
+        .ok()
+        .filter(|s| !s.trim().is_empty())
+        .unwrap_or_else(|| DEFAULT_SEPARATOR.to_string())
+}
+
+// Separators live on their own line, so `---` becomes `\n---\n`.
+pub fn separator_line(raw: &str) -> String {
+    format!("\n{}\n", raw.trim())
+}
+
+// A count from the environment, or None when unset or not a number
+pub fn env_count(name: &str) -> Option<usize> {
+    std::env::var(name).ok().and_then(|v| v.trim().parse().ok())
+}
+
+pub fn parse_bool(value: &str) -> Option<bool> {
+    match value.trim().to_lowercase().as_str() {
+        "1" | "true" | "on" | "yes" => Some(true),
+        "0" | "false" | "off" | "no" => Some(false),
+        _ => None,
+    }
+}
+
+pub fn env_flag(name: &str, default: bool) -> bool {
+    std::env::var(name)
+        .ok()
+        .and_then(|v| parse_bool(&v))
+        .unwrap_or(default)
+}
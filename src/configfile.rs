@@ -0,0 +1,113 @@
+use crate::{config, crypt, debug_log, hooks, index, logging, memory, metrics, otel, provider, rag, schedule, summary, tokens, watch, web, webhook};
+use std::path::PathBuf;
+
+const PROJECT_FILE: &str = ".chatmd.toml";
+const USER_FILE: &str = "chatmd/config.toml";
+
+// Settings file keys and the environment variables they stand for. Anything
+// else can be set by its variable name in an `[env]` table.
+const KEYS: &[(&str, &str)] = &[
+    ("provider", provider::PROVIDER_ENV),
+    ("api_url", provider::API_URL_ENV),
+    ("api_key", config::API_KEY_ENV),
+    ("model", config::MODEL_ENV),
+    ("separator", config::SEPARATOR_ENV),
+    ("timestamps", config::TIMESTAMPS_ENV),
+    ("context_messages", config::CONTEXT_MESSAGES_ENV),
+    ("context_tokens", config::CONTEXT_TOKENS_ENV),
+    ("context_limit", config::CONTEXT_LIMIT_ENV),
+    ("rolling_summary", summary::ROLLING_SUMMARY_ENV),
+    ("summary_model", summary::SUMMARY_MODEL_ENV),
+    ("memory", memory::MEMORY_ENV),
+    ("project_memory", memory::PROJECT_MEMORY_ENV),
+    ("docs", rag::DOCS_DIR_ENV),
+    ("watch", watch::WATCH_ENV),
+    ("include", watch::INCLUDE_ENV),
+    ("exclude", watch::EXCLUDE_ENV),
+    ("poll", watch::POLL_ENV),
+    ("log_level", config::LOG_LEVEL_ENV),
+    ("log_format", logging::LOG_FORMAT_ENV),
+    ("log_file", logging::LOG_FILE_ENV),
+    ("web_token", web::WEB_TOKEN_ENV),
+    ("web_hosts", web::WEB_HOSTS_ENV),
+    ("pre_send_hook", hooks::PRE_SEND_ENV),
+    ("post_response_hook", hooks::POST_RESPONSE_ENV),
+    ("webhook", webhook::WEBHOOK_ENV),
+    ("webhook_events", webhook::WEBHOOK_EVENTS_ENV),
+    ("schedule", schedule::SCHEDULE_ENV),
+    ("index", index::INDEX_ENV),
+    ("prices", tokens::PRICES_ENV),
+    ("metrics", metrics::METRICS_ADDR_ENV),
+    ("otlp_endpoint", otel::OTLP_ENDPOINT_ENV),
+    ("age_recipients", crypt::AGE_RECIPIENTS_ENV),
+    ("age_identity", crypt::AGE_IDENTITY_ENV),
+    ("gpg_recipients", crypt::GPG_RECIPIENTS_ENV),
+];
+
+// Lists of commands, which may hold commas themselves
+const COMMAND_LISTS: &[&str] = &[hooks::PRE_SEND_ENV, hooks::POST_RESPONSE_ENV];
+
+// `.chatmd.toml` in the working directory, then the user's
+// `~/.config/chatmd/config.toml`, whichever exist
+pub fn paths() -> Vec<PathBuf> {
+    let config_dir = std::env::var_os("XDG_CONFIG_HOME")
+        .map(PathBuf::from)
+        .or_else(|| std::env::var_os("HOME").map(|home| PathBuf::from(home).join(".config")));
+    std::iter::once(PathBuf::from(PROJECT_FILE))
+        .chain(config_dir.map(|dir| dir.join(USER_FILE)))
+        .filter(|path| path.is_file())
+        .collect()
+}
+
+// Fills in settings the environment (or .env) doesn't already have, so
+// those always win and the project file wins over the user's. Returns the
+// files read.
+pub fn load() -> Vec<PathBuf> {
+    let mut loaded = Vec::new();
+    for path in paths() {
+        let table = match std::fs::read_to_string(&path).map(|raw| raw.parse::<toml::Table>()) {
+            Ok(Ok(table)) => table,
+            Ok(Err(e)) => {
+                debug_log(&format!("error: skipping {}: {}", path.display(), e));
+                continue;
+            }
+            Err(e) => {
+                debug_log(&format!("error: cannot read {}: {}", path.display(), e));
+                continue;
+            }
+        };
+
+        for (key, value) in &table {
+            let vars: Vec<(&str, &toml::Value)> = match (key.as_str(), value) {
+                ("env", toml::Value::Table(env)) => env.iter().map(|(name, value)| (name.as_str(), value)).collect(),
+                _ => match KEYS.iter().find(|(name, _)| name == key) {
+                    Some((_, var)) => vec![(var, value)],
+                    None => {
+                        debug_log(&format!("error: unknown setting {:?} in {}", key, path.display()));
+                        continue;
+                    }
+                },
+            };
+            for (var, value) in vars {
+                if std::env::var_os(var).is_none() {
+                    let value = match (value, COMMAND_LISTS.contains(&var)) {
+                        (toml::Value::Array(items), true) => items.iter().map(env_value).collect::<Vec<_>>().join("\n"),
+                        _ => env_value(value),
+                    };
+                    std::env::set_var(var, value);
+                }
+            }
+        }
+        loaded.push(path);
+    }
+    loaded
+}
+
+// Lists become the comma-separated form list variables take
+fn env_value(value: &toml::Value) -> String {
+    match value {
+        toml::Value::String(s) => s.clone(),
+        toml::Value::Array(items) => items.iter().map(env_value).collect::<Vec<_>>().join(","),
+        other => other.to_string(),
+    }
+}
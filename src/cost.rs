@@ -0,0 +1,135 @@
+use crate::{index, search, stats, watch};
+use anyhow::{bail, Context, Result};
+use chrono::{DateTime, Local};
+use rusqlite::params;
+use std::{collections::BTreeMap, path::PathBuf};
+
+const USAGE: &str = "usage: cost [--since date] [--until date] [--by model|day|month|chat] [--csv]";
+
+// One row of the usage log
+struct Request {
+    at: DateTime<Local>,
+    path: String,
+    model: String,
+    input_tokens: i64,
+    output_tokens: i64,
+    cost: Option<f64>,
+}
+
+#[derive(Default)]
+struct Total {
+    requests: i64,
+    input_tokens: i64,
+    output_tokens: i64,
+    cost: f64,
+    unpriced: i64,
+}
+
+// `cost [--since date] [--until date] [--by model|day|month|chat] [--csv]`:
+// spend from the usage log, grouped one way, to check against a
+// provider's invoice. Days and months are local, as the log records them.
+pub async fn run(args: &[String]) -> Result<()> {
+    let mut since = None;
+    let mut until = None;
+    let mut by = "model".to_string();
+    let mut csv = false;
+    let mut args = args.iter();
+    while let Some(arg) = args.next() {
+        match arg.as_str() {
+            "--since" => since = Some(search::parse_date(args.next().context("--since needs a date")?, false)?),
+            "--until" => until = Some(search::parse_date(args.next().context("--until needs a date")?, true)?),
+            "--by" => by = args.next().context("--by needs model, day, month or chat")?.to_lowercase(),
+            "--csv" => csv = true,
+            _ => bail!("{}", USAGE),
+        }
+    }
+    if !["model", "day", "month", "chat"].contains(&by.as_str()) {
+        bail!("--by needs model, day, month or chat");
+    }
+    if index::path().is_none() {
+        bail!("the usage log is turned off (CHAT_INDEX)");
+    }
+
+    let requests = tokio::task::spawn_blocking(|| -> Result<Vec<Request>> {
+        let conn = index::open()?;
+        let mut statement = conn.prepare("SELECT at, path, model, input_tokens, output_tokens, cost FROM requests ORDER BY id")?;
+        let rows = statement.query_map(params![], |row| {
+            Ok((
+                row.get::<_, String>(0)?,
+                row.get::<_, String>(1)?,
+                row.get::<_, String>(2)?,
+                row.get::<_, i64>(3)?,
+                row.get::<_, i64>(4)?,
+                row.get::<_, Option<f64>>(5)?,
+            ))
+        })?;
+        let mut requests = Vec::new();
+        for row in rows {
+            let (at, path, model, input_tokens, output_tokens, cost) = row?;
+            let Ok(at) = DateTime::parse_from_rfc3339(&at) else {
+                continue;
+            };
+            requests.push(Request { at: at.with_timezone(&Local), path, model, input_tokens, output_tokens, cost });
+        }
+        Ok(requests)
+    })
+    .await??;
+
+    let mut groups: BTreeMap<String, Total> = BTreeMap::new();
+    let mut total = Total::default();
+    for request in requests {
+        if since.is_some_and(|since| request.at < since) || until.is_some_and(|until| request.at > until) {
+            continue;
+        }
+        let key = match by.as_str() {
+            "day" => request.at.format("%Y-%m-%d").to_string(),
+            "month" => request.at.format("%Y-%m").to_string(),
+            "chat" => watch::display_path(&PathBuf::from(&request.path)),
+            _ => request.model.clone(),
+        };
+        for sum in [groups.entry(key).or_default(), &mut total] {
+            sum.requests += 1;
+            sum.input_tokens += request.input_tokens;
+            sum.output_tokens += request.output_tokens;
+            match request.cost {
+                Some(cost) => sum.cost += cost,
+                None => sum.unpriced += 1,
+            }
+        }
+    }
+
+    if csv {
+        println!("{},requests,input_tokens,output_tokens,cost_usd", by);
+        for (key, sum) in &groups {
+            println!("\"{}\",{},{},{},{:.6}", key.replace('"', "\"\""), sum.requests, sum.input_tokens, sum.output_tokens, sum.cost);
+        }
+        return Ok(());
+    }
+
+    let period = match (since, until) {
+        (Some(since), Some(until)) => format!(" from {} to {}", since.format("%Y-%m-%d"), until.format("%Y-%m-%d")),
+        (Some(since), None) => format!(" since {}", since.format("%Y-%m-%d")),
+        (None, Some(until)) => format!(" until {}", until.format("%Y-%m-%d")),
+        (None, None) => String::new(),
+    };
+    println!("Spend{}, by {}", period, by);
+    let mut table = vec![stats::row(&[&by, "requests", "input", "output", "cost"])];
+    for (key, sum) in groups.iter().chain([(&"total".to_string(), &total)]) {
+        table.push(stats::row(&[
+            key,
+            &sum.requests.to_string(),
+            &sum.input_tokens.to_string(),
+            &sum.output_tokens.to_string(),
+            &stats::dollars(Some(sum.cost)),
+        ]));
+    }
+    if groups.is_empty() {
+        table.truncate(1);
+    }
+    print!("{}", stats::columns(&table, "  no requests recorded"));
+    if total.unpriced > 0 {
+        println!("  {} requests are to models with no known price (set CHAT_PRICES)", total.unpriced);
+    }
+    println!("  costs come from the price list; token counts are the provider's where it reported them");
+    Ok(())
+}
@@ -0,0 +1,145 @@
+use crate::{subprocess, watch};
+use anyhow::{bail, Context, Result};
+use std::{path::Path, time::Duration};
+use tokio::process::Command;
+
+// Who encrypted chats are written for: age recipients (`age1…` or `ssh-…`
+// keys, or files of them) and GPG key IDs or emails, comma separated
+pub const AGE_RECIPIENTS_ENV: &str = "CHAT_AGE_RECIPIENTS";
+pub const GPG_RECIPIENTS_ENV: &str = "CHAT_GPG_RECIPIENTS";
+// age identity files to decrypt with, comma separated
+pub const AGE_IDENTITY_ENV: &str = "CHAT_AGE_IDENTITY";
+
+// gpg may be waiting on pinentry for a passphrase
+const TIMEOUT: Duration = Duration::from_secs(120);
+const SUFFIXES: &[&str] = &[".age", ".gpg", ".asc"];
+
+#[derive(Debug, Clone, Copy, PartialEq)]
+pub enum Scheme {
+    Age,
+    // `.asc` files are ASCII-armored
+    Gpg { armor: bool },
+}
+
+// chat.md.age, chat.md.gpg and chat.md.asc are encrypted: the names editor
+// plugins (age.vim, vim-gnupg, Emacs EasyPG) decrypt on open and encrypt on
+// save, so the same file works in the editor and here
+pub fn scheme(path: &Path) -> Option<Scheme> {
+    match path.extension()?.to_str()? {
+        "age" => Some(Scheme::Age),
+        "gpg" => Some(Scheme::Gpg { armor: false }),
+        "asc" => Some(Scheme::Gpg { armor: true }),
+        _ => None,
+    }
+}
+
+// chat.md.gpg -> chat.md, for matching names against patterns like `*.md`
+pub fn plain_name(name: &str) -> &str {
+    SUFFIXES.iter().find_map(|suffix| name.strip_suffix(suffix)).unwrap_or(name)
+}
+
+// The text of an encrypted chat's `bytes`. A chat still in plain text, like
+// one just created, is read as it is and encrypted when next written.
+pub async fn open(scheme: Scheme, bytes: Vec<u8>) -> Result<String> {
+    if !looks_encrypted(&bytes) {
+        return String::from_utf8(bytes).context("neither encrypted nor text");
+    }
+    let mut command = match scheme {
+        Scheme::Age => {
+            let identities = watch::env_list(AGE_IDENTITY_ENV);
+            if identities.is_empty() {
+                bail!("set {} to the age identity file to decrypt with", AGE_IDENTITY_ENV);
+            }
+            let mut age = Command::new("age");
+            age.arg("--decrypt");
+            for identity in identities {
+                age.arg("--identity").arg(watch::expand_home(&identity));
+            }
+            age
+        }
+        Scheme::Gpg { .. } => {
+            let mut gpg = Command::new("gpg");
+            gpg.args(["--quiet", "--batch", "--decrypt"]);
+            gpg
+        }
+    };
+    let plain = run(&mut command, &bytes).await?;
+    String::from_utf8(plain).context("decrypted to something that isn't text")
+}
+
+// `text` encrypted for the configured recipients. With none, age encrypts
+// to the identities in CHAT_AGE_IDENTITY and GPG to the default key.
+pub async fn seal(scheme: Scheme, text: &str) -> Result<Vec<u8>> {
+    let mut command = match scheme {
+        Scheme::Age => {
+            let mut age = Command::new("age");
+            age.arg("--encrypt");
+            let recipients = watch::env_list(AGE_RECIPIENTS_ENV);
+            if recipients.is_empty() {
+                let identities = watch::env_list(AGE_IDENTITY_ENV);
+                if identities.is_empty() {
+                    bail!("set {} (or {}) to encrypt with age", AGE_RECIPIENTS_ENV, AGE_IDENTITY_ENV);
+                }
+                for identity in identities {
+                    age.arg("--identity").arg(watch::expand_home(&identity));
+                }
+            }
+            for recipient in recipients {
+                let file = watch::expand_home(&recipient);
+                match file.is_file() {
+                    true => age.arg("--recipients-file").arg(file),
+                    false => age.arg("--recipient").arg(recipient),
+                };
+            }
+            age
+        }
+        Scheme::Gpg { armor } => {
+            let mut gpg = Command::new("gpg");
+            gpg.args(["--quiet", "--batch", "--yes", "--encrypt"]);
+            if armor {
+                gpg.arg("--armor");
+            }
+            let recipients = watch::env_list(GPG_RECIPIENTS_ENV);
+            if recipients.is_empty() {
+                gpg.arg("--default-recipient-self");
+            }
+            for recipient in recipients {
+                gpg.arg("--recipient").arg(recipient);
+            }
+            gpg
+        }
+    };
+    run(&mut command, text.as_bytes()).await
+}
+
+// age's header, armored or not, and OpenPGP's: armored, or a binary packet,
+// whose first byte has the high bit set and which is never valid UTF-8
+fn looks_encrypted(bytes: &[u8]) -> bool {
+    [&b"age-encryption.org/"[..], b"-----BEGIN AGE ENCRYPTED FILE-----", b"-----BEGIN PGP MESSAGE-----"]
+        .iter()
+        .any(|header| bytes.starts_with(header))
+        || (bytes.first().is_some_and(|b| b & 0x80 != 0) && std::str::from_utf8(bytes).is_err())
+}
+
+// Feeds `input` to `command` and returns what it printed, or what went wrong
+async fn run(command: &mut Command, input: &[u8]) -> Result<Vec<u8>> {
+    let program = command.as_std().get_program().to_string_lossy().into_owned();
+    let output = subprocess::output(command, input, TIMEOUT).await?;
+    if !output.status.success() {
+        let stderr = String::from_utf8_lossy(&output.stderr);
+        match stderr.trim() {
+            "" => bail!("{} {}", program, output.status),
+            stderr => bail!("{}", stderr),
+        }
+    }
+    Ok(output.stdout)
+}
+
+// What a log line may show of `text` from the chat at `path`. The log isn't
+// encrypted, so for an encrypted chat that is only its length.
+pub fn loggable(path: &Path, text: &str) -> String {
+    match scheme(path) {
+        Some(_) => format!("({} characters)", text.chars().count()),
+        None => format!("{:?}", text),
+    }
+}
@@ -0,0 +1,160 @@
+use crate::logging;
+use anyhow::{bail, Context, Result};
+use std::{
+    path::PathBuf,
+    process::{Command, Stdio},
+    time::{Duration, Instant},
+};
+
+pub const PID_FILE_ENV: &str = "CHAT_PID_FILE";
+
+const PID_FILE: &str = "chatmd.pid";
+const DEFAULT_LOG_FILE: &str = ".chatmd.log";
+
+// Longer than the watcher waits for replies in flight when told to stop
+const STOP_TIMEOUT: Duration = Duration::from_secs(75);
+
+// CHAT_PID_FILE, or chatmd.pid in $XDG_RUNTIME_DIR or else
+// $XDG_DATA_HOME/chatmd, so `stop` and `status` find it from any directory
+pub fn pid_path() -> PathBuf {
+    if let Some(path) = std::env::var(PID_FILE_ENV).ok().filter(|p| !p.trim().is_empty()) {
+        return PathBuf::from(path);
+    }
+    std::env::var_os("XDG_RUNTIME_DIR")
+        .map(PathBuf::from)
+        .or_else(|| std::env::var_os("XDG_DATA_HOME").map(|dir| PathBuf::from(dir).join("chatmd")))
+        .or_else(|| std::env::var_os("HOME").map(|home| PathBuf::from(home).join(".local/share/chatmd")))
+        .map(|dir| dir.join(PID_FILE))
+        .unwrap_or_else(|| PathBuf::from(format!(".{}", PID_FILE)))
+}
+
+// `watch --daemon`: runs this same command line, minus --daemon, as a
+// background process in its own process group, so closing the terminal or
+// Ctrl-C there doesn't reach it. Its logs go to CHAT_LOG_FILE, or
+// .chatmd.log, since it has no terminal to print to.
+pub fn start() -> Result<()> {
+    if let Some(pid) = running_pid() {
+        bail!("already running (pid {}); run `stop` first", pid);
+    }
+
+    let args: Vec<String> = std::env::args().skip(1).filter(|a| a != "--daemon").collect();
+    let mut command = Command::new(std::env::current_exe().context("cannot find this program to restart it")?);
+    command.args(&args).stdin(Stdio::null()).stdout(Stdio::null()).stderr(Stdio::null());
+
+    let logs_to_file = args.iter().any(|a| a.starts_with("--log-file"))
+        || std::env::var(logging::LOG_FILE_ENV).is_ok_and(|p| !p.trim().is_empty());
+    let log_file = (!logs_to_file).then(|| PathBuf::from(DEFAULT_LOG_FILE));
+    if let Some(log_file) = &log_file {
+        command.env(logging::LOG_FILE_ENV, log_file);
+    }
+    #[cfg(unix)]
+    {
+        use std::os::unix::process::CommandExt;
+        command.process_group(0);
+    }
+
+    let child = command.spawn().context("cannot start the background watcher")?;
+    let pid_path = pid_path();
+    if let Some(dir) = pid_path.parent().filter(|d| !d.as_os_str().is_empty()) {
+        std::fs::create_dir_all(dir).with_context(|| format!("cannot create {}", dir.display()))?;
+    }
+    std::fs::write(&pid_path, format!("{}\n", child.id()))
+        .with_context(|| format!("cannot write {}", pid_path.display()))?;
+
+    match log_file {
+        Some(log_file) => println!("started in the background (pid {}), logging to {}", child.id(), log_file.display()),
+        None => println!("started in the background (pid {})", child.id()),
+    }
+    Ok(())
+}
+
+// `stop`: asks the background watcher to shut down as Ctrl-C would, and
+// waits for it to finish the replies it is writing
+pub async fn stop() -> Result<()> {
+    let Some(pid) = running_pid() else {
+        println!("not running");
+        return Ok(());
+    };
+
+    signal(pid)?;
+    println!("stopping pid {}...", pid);
+    let started = Instant::now();
+    while alive(pid) {
+        if started.elapsed() > STOP_TIMEOUT {
+            bail!("pid {} is still running", pid);
+        }
+        tokio::time::sleep(Duration::from_millis(200)).await;
+    }
+    let _ = std::fs::remove_file(pid_path());
+    println!("stopped");
+    Ok(())
+}
+
+// `status`: whether a background watcher is running
+pub fn status() -> Result<()> {
+    match running_pid() {
+        Some(pid) => println!("running (pid {}, {})", pid, pid_path().display()),
+        None => println!("not running"),
+    }
+    Ok(())
+}
+
+// Called by the watcher on the way out, so the PID file never outlives it
+pub fn release() {
+    let path = pid_path();
+    if read_pid(&path) == Some(std::process::id()) {
+        let _ = std::fs::remove_file(path);
+    }
+}
+
+// The PID in the PID file, if that process is still there. A stale file
+// from a crash or reboot is removed.
+fn running_pid() -> Option<u32> {
+    let path = pid_path();
+    let pid = read_pid(&path)?;
+    if alive(pid) {
+        return Some(pid);
+    }
+    let _ = std::fs::remove_file(path);
+    None
+}
+
+fn read_pid(path: &std::path::Path) -> Option<u32> {
+    std::fs::read_to_string(path).ok()?.trim().parse().ok()
+}
+
+#[cfg(unix)]
+fn alive(pid: u32) -> bool {
+    Command::new("kill")
+        .args(["-0", &pid.to_string()])
+        .stderr(Stdio::null())
+        .status()
+        .is_ok_and(|s| s.success())
+}
+
+#[cfg(not(unix))]
+fn alive(pid: u32) -> bool {
+    Command::new("tasklist")
+        .args(["/FI", &format!("PID eq {}", pid), "/NH"])
+        .output()
+        .is_ok_and(|out| String::from_utf8_lossy(&out.stdout).contains(&pid.to_string()))
+}
+
+// SIGTERM, which the watcher handles like Ctrl-C
+#[cfg(unix)]
+fn signal(pid: u32) -> Result<()> {
+    let status = Command::new("kill").args(["-TERM", &pid.to_string()]).status()?;
+    if !status.success() {
+        bail!("cannot signal pid {}", pid);
+    }
+    Ok(())
+}
+
+#[cfg(not(unix))]
+fn signal(pid: u32) -> Result<()> {
+    let status = Command::new("taskkill").args(["/PID", &pid.to_string()]).status()?;
+    if !status.success() {
+        bail!("cannot stop pid {}", pid);
+    }
+    Ok(())
+}
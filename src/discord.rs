@@ -0,0 +1,118 @@
+use crate::{
+    bridge::{self, Remote},
+    logging::debug_log,
+    watch,
+};
+use anyhow::{bail, Context, Result};
+use serde_json::{json, Value};
+use std::{
+    path::PathBuf,
+    time::{Duration, SystemTime, UNIX_EPOCH},
+};
+
+pub const DISCORD_TOKEN_ENV: &str = "CHAT_DISCORD_TOKEN";
+pub const DISCORD_CHANNEL_ENV: &str = "CHAT_DISCORD_CHANNEL";
+pub const DISCORD_CHAT_ENV: &str = "CHAT_DISCORD_CHAT";
+pub const DISCORD_USERS_ENV: &str = "CHAT_DISCORD_USERS";
+pub const POLL_EVERY: Duration = Duration::from_secs(2);
+const API: &str = "https://discord.com/api/v10";
+// Discord refuses longer messages, so replies are posted in parts
+const MAX_MESSAGE_CHARS: usize = 2000;
+// Snowflake IDs count milliseconds from the start of 2015
+const DISCORD_EPOCH_MS: u128 = 1_420_070_400_000;
+
+pub struct Discord {
+    client: reqwest::Client,
+    token: String,
+    channel: String,
+    // User IDs that may write to the chat; anyone in the channel could otherwise
+    users: Vec<String>,
+    // ID of the newest message seen
+    after: u64,
+}
+
+// The bridge CHAT_DISCORD_TOKEN (a bot token), CHAT_DISCORD_CHANNEL (a
+// channel ID), CHAT_DISCORD_USERS (the user IDs allowed to write) and
+// CHAT_DISCORD_CHAT (the chat file) describe, if the token is set
+pub fn from_env() -> Result<Option<(Discord, PathBuf)>> {
+    let var = |name: &str| std::env::var(name).ok().filter(|v| !v.trim().is_empty());
+    let Some(token) = var(DISCORD_TOKEN_ENV) else {
+        return Ok(None);
+    };
+    let channel = var(DISCORD_CHANNEL_ENV)
+        .with_context(|| format!("{} is set but {} is not", DISCORD_TOKEN_ENV, DISCORD_CHANNEL_ENV))?;
+    let chat = var(DISCORD_CHAT_ENV).with_context(|| format!("{} is set but {} is not", DISCORD_TOKEN_ENV, DISCORD_CHAT_ENV))?;
+    let users = watch::env_list(DISCORD_USERS_ENV);
+    if users.is_empty() {
+        bail!("{} is set but {} is not", DISCORD_TOKEN_ENV, DISCORD_USERS_ENV);
+    }
+    let now = SystemTime::now().duration_since(UNIX_EPOCH).unwrap_or_default().as_millis();
+    let discord = Discord {
+        client: reqwest::Client::builder().timeout(Duration::from_secs(20)).build()?,
+        token,
+        channel,
+        users,
+        after: (now.saturating_sub(DISCORD_EPOCH_MS) << 22) as u64,
+    };
+    Ok(Some((discord, PathBuf::from(chat))))
+}
+
+impl Discord {
+    async fn call(&self, request: reqwest::RequestBuilder) -> Result<Value> {
+        let response = request.header("Authorization", format!("Bot {}", self.token)).send().await?;
+        let status = response.status();
+        let body: Value = response.json().await.unwrap_or_default();
+        if !status.is_success() {
+            bail!("status {}: {}", status, body["message"].as_str().unwrap_or("unknown error"));
+        }
+        Ok(body)
+    }
+}
+
+impl Remote for Discord {
+    fn name(&self) -> &'static str {
+        "discord"
+    }
+
+    async fn post(&mut self, text: &str, from_user: bool) -> Result<()> {
+        let text = match from_user {
+            true => format!("*From the chat file:*\n{}", text),
+            false => text.to_string(),
+        };
+        for part in bridge::split(&text, MAX_MESSAGE_CHARS) {
+            let request = self
+                .client
+                .post(format!("{}/channels/{}/messages", API, self.channel))
+                .json(&json!({ "content": part, "allowed_mentions": { "parse": [] } }));
+            self.call(request).await?;
+        }
+        Ok(())
+    }
+
+    async fn receive(&mut self) -> Result<Vec<String>> {
+        let request = self
+            .client
+            .get(format!("{}/channels/{}/messages", API, self.channel))
+            .query(&[("after", self.after.to_string()), ("limit", "50".to_string())]);
+        let response = self.call(request).await?;
+
+        // Newest first; other bots, and this one, are left out
+        let mut messages = Vec::new();
+        for message in response.as_array().into_iter().flatten().rev() {
+            let id = message["id"].as_str().and_then(|id| id.parse().ok()).unwrap_or(0);
+            self.after = self.after.max(id);
+            if message["author"]["bot"].as_bool() == Some(true) {
+                continue;
+            }
+            let author = message["author"]["id"].as_str().unwrap_or_default();
+            if !self.users.iter().any(|user| user == author) {
+                debug_log(&format!("error: discord bridge: ignoring a message from user {} (not in {})", author, DISCORD_USERS_ENV));
+                continue;
+            }
+            if let Some(text) = message["content"].as_str() {
+                messages.push(text.to_string());
+            }
+        }
+        Ok(messages)
+    }
+}
@@ -0,0 +1,190 @@
+use crate::{
+    auth, config, configfile, envfile, export, files, library, memory, mock, plugins,
+    provider::{self, ApiClient, RequestParams},
+    tokens, watch, ChatContext, Message,
+};
+use anyhow::Result;
+use std::path::Path;
+
+// Tools used when present, and what is lost without them
+const OPTIONAL_TOOLS: &[(&str, &str)] = &[
+    ("python3", "Python code blocks are not validated"),
+    ("gofmt", "Go code blocks are not validated"),
+];
+
+#[derive(Default)]
+struct Report {
+    failures: usize,
+}
+
+impl Report {
+    fn ok(&mut self, message: &str) {
+        println!("  ok  {}", message);
+    }
+
+    fn warn(&mut self, message: &str) {
+        println!("warn  {}", message);
+    }
+
+    fn fail(&mut self, message: &str) {
+        println!("FAIL  {}", message);
+        self.failures += 1;
+    }
+}
+
+// `doctor [targets...] [--online]`: checks what the watcher would need for
+// the given chats, without starting it. --online also sends one tiny request.
+pub async fn run(args: &[String]) -> Result<()> {
+    let online = args.iter().any(|a| a == "--online");
+    let targets: Vec<String> = args.iter().filter(|a| !a.starts_with("--")).cloned().collect();
+    let mut report = Report::default();
+
+    for path in envfile::loaded() {
+        if path.exists() {
+            report.ok(&format!("settings loaded from {}", path.display()));
+        } else {
+            report.warn(&format!("no {}; using the environment only", path.display()));
+        }
+    }
+    for path in configfile::paths() {
+        report.ok(&format!("settings loaded from {}", path.display()));
+    }
+
+    let api_key = auth::api_key();
+    match &api_key {
+        Some(_) if mock::active() => report.ok("no API key needed for the mock provider"),
+        Some(key) => report.ok(&format!("API key found ({})", auth::mask(key))),
+        None => report.fail(&format!("no API key; set {} or run `auth login`", config::API_KEY_ENV)),
+    }
+
+    let name = provider::provider_name();
+    let plugin = match provider::builtin(&name) {
+        true => None,
+        false => plugins::provider(&name).await,
+    };
+    match plugin {
+        Some(plugin) => report.ok(&format!("provider {} from plugin {}", name, plugin.display())),
+        None if mock::active() => report.ok("provider mock: canned replies, no network"),
+        None => {
+            let (provider, url) = provider::endpoint();
+            report.ok(&format!("provider {} at {}", provider, url));
+        }
+    }
+
+    let model = config::default_model();
+    let limit = config::env_count(config::CONTEXT_LIMIT_ENV).or_else(|| tokens::model_limit(&model));
+    match limit {
+        Some(limit) => report.ok(&format!("model {} (context window {} tokens)", model, limit)),
+        None => report.warn(&format!(
+            "model {} has no known context window; set {} to be warned before it fills",
+            model,
+            config::CONTEXT_LIMIT_ENV
+        )),
+    }
+
+    if tokens::exact() {
+        report.ok("tokenizer loaded");
+    } else {
+        report.warn("tokenizer unavailable; token counts are rough estimates");
+    }
+
+    let library = library::PromptLibrary::from_env();
+    report.ok(&format!("prompt library: {}", library.summary()));
+    for error in &library.errors {
+        report.warn(error);
+    }
+
+    check_chats(&targets, &library, &mut report).await;
+
+    for (program, without) in OPTIONAL_TOOLS {
+        if !on_path(program) {
+            report.warn(&format!("{} not found: {}", program, without));
+        }
+    }
+    match export::PDF_CONVERTERS.iter().find(|(program, _)| on_path(program)) {
+        Some((program, _)) => report.ok(&format!("PDF export uses {}", program)),
+        None => report.warn("no wkhtmltopdf or chromium found: PDF export is unavailable"),
+    }
+
+    if let (true, Some(key)) = (online, api_key) {
+        let ping = vec![Message::new("user", "Reply with OK.")];
+        match ApiClient::new(key).call_api(ping, &model, &RequestParams::default()).await {
+            Ok(_) => report.ok(&format!("API answered a request with {}", model)),
+            Err(e) => report.fail(&format!("API request failed: {}", e)),
+        }
+    }
+
+    if report.failures > 0 {
+        anyhow::bail!("{} problem(s) found", report.failures);
+    }
+    Ok(())
+}
+
+// Every file the watcher would pick up, and the files its settings point to
+async fn check_chats(targets: &[String], library: &library::PromptLibrary, report: &mut Report) {
+    let include = watch::env_list(watch::INCLUDE_ENV);
+    let exclude = watch::env_list(watch::EXCLUDE_ENV);
+    let watch_set = match watch::WatchSet::from_args(targets, include, exclude) {
+        Ok(watch_set) => watch_set,
+        Err(e) => {
+            report.fail(&format!("cannot resolve chats to watch: {}", e));
+            return;
+        }
+    };
+
+    let paths = watch_set.files();
+    if paths.is_empty() {
+        report.warn(&format!("no chats found in {}", watch_set.describe()));
+    }
+    for path in paths {
+        let shown = watch::display_path(&path);
+        if !path.exists() {
+            report.warn(&format!("{} does not exist yet; watching creates it", shown));
+            continue;
+        }
+        let content = match files::read_chat(&path).await {
+            Ok(content) => content,
+            Err(e) => {
+                report.fail(&format!("cannot read {}: {}", shown, e));
+                continue;
+            }
+        };
+
+        let chat_context = ChatContext::new(path.clone(), content);
+        let mut problems = 0;
+        if let Some(persona) = &chat_context.persona {
+            if library.get(library::Kind::Persona, persona).is_none() {
+                report.warn(&format!("{}: persona {:?} is not in the library", shown, persona));
+                problems += 1;
+            }
+        }
+        let base_dir = path.parent().unwrap_or(Path::new("."));
+        let linked = [
+            ("continues", chat_context.continues.as_ref().map(|c| base_dir.join(c))),
+            ("project memory", chat_context.project_memory.clone()),
+            ("docs", chat_context.docs_dir.clone()),
+        ];
+        for (setting, target) in linked {
+            if let Some(target) = target.filter(|t| !t.exists()) {
+                report.warn(&format!("{}: {} {} not found", shown, setting, target.display()));
+                problems += 1;
+            }
+        }
+        if chat_context.memory && !memory::path().exists() {
+            report.ok(&format!("{}: memory is on; {} is created on first use", shown, memory::path().display()));
+        }
+        if problems == 0 {
+            report.ok(&format!("{} (model {})", shown, chat_context.model));
+        }
+    }
+}
+
+fn on_path(program: &str) -> bool {
+    let Some(path) = std::env::var_os("PATH") else {
+        return false;
+    };
+    std::env::split_paths(&path).any(|dir| {
+        let candidate = dir.join(program);
+        candidate.is_file() || candidate.with_extension("exe").is_file()
+    })
+}
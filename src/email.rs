@@ -0,0 +1,525 @@
+use crate::{clock, config, files, logging::debug_log, parser, rpc, watch, LOG_TO_STDERR};
+use anyhow::{bail, Context, Result};
+use base64::Engine;
+use std::{
+    path::{Path, PathBuf},
+    process::Stdio,
+    sync::{atomic::Ordering, Arc},
+};
+use tokio::{
+    io::{AsyncBufReadExt, AsyncReadExt, AsyncWriteExt, BufReader},
+    net::{TcpListener, TcpStream},
+    sync::Mutex,
+};
+
+// The address mail must be sent to
+pub const EMAIL_ADDRESS_ENV: &str = "CHAT_EMAIL_ADDRESS";
+// Senders allowed to use it, comma-separated
+pub const EMAIL_ALLOW_ENV: &str = "CHAT_EMAIL_ALLOW";
+// The receiving MTA's authserv-id; its Authentication-Results header is
+// trusted to say whether DKIM or DMARC passed for the sender's domain
+pub const EMAIL_AUTHSERV_ENV: &str = "CHAT_EMAIL_AUTHSERV_ID";
+// Or a secret mail must be addressed with, as name+secret@host
+pub const EMAIL_SECRET_ENV: &str = "CHAT_EMAIL_SECRET";
+// Where each thread's chat file goes
+pub const EMAIL_DIR_ENV: &str = "CHAT_EMAIL_DIR";
+// Reads a whole message, headers included, on stdin and sends it
+pub const EMAIL_SEND_ENV: &str = "CHAT_EMAIL_SEND_COMMAND";
+const DEFAULT_LISTEN: &str = "127.0.0.1:2525";
+const DEFAULT_DIR: &str = "mail";
+const DEFAULT_SEND: &str = "sendmail -t -i";
+const MAX_MESSAGE_BYTES: usize = 1024 * 1024;
+// SMTP allows 1000; this is lenient, but stops a line that never ends
+const MAX_LINE_BYTES: u64 = 64 * 1024;
+// Thread files are named after this much of the root message's hash
+const THREAD_ID_CHARS: usize = 8;
+const MAX_SLUG_CHARS: usize = 40;
+
+struct Gateway {
+    address: String,
+    allowed: Vec<String>,
+    authserv_id: Option<String>,
+    secret_address: Option<String>,
+    dir: PathBuf,
+    send_command: String,
+    services: rpc::Services,
+    // One email at a time, so two messages to one thread never race
+    busy: Mutex<()>,
+}
+
+// `email [--listen addr]`: an SMTP listener that turns mail to
+// CHAT_EMAIL_ADDRESS into messages in per-thread chat files and mails the
+// replies back
+pub async fn run(args: &[String]) -> Result<()> {
+    LOG_TO_STDERR.store(true, Ordering::Relaxed);
+    let listen = match args {
+        [flag, addr] if flag == "--listen" => addr.clone(),
+        [] => DEFAULT_LISTEN.to_string(),
+        _ => bail!("usage: email [--listen addr]"),
+    };
+    let var = |name: &str| std::env::var(name).ok().filter(|v| !v.trim().is_empty());
+    let address = var(EMAIL_ADDRESS_ENV)
+        .with_context(|| format!("set {} to the address mail is sent to", EMAIL_ADDRESS_ENV))?
+        .to_lowercase();
+    let allowed: Vec<String> = var(EMAIL_ALLOW_ENV)
+        .with_context(|| format!("set {} to the senders that may use it", EMAIL_ALLOW_ENV))?
+        .split(',')
+        .map(|a| a.trim().to_lowercase())
+        .filter(|a| !a.is_empty())
+        .collect();
+    // Anyone can write any From header, so the allowlist alone proves nothing
+    let authserv_id = var(EMAIL_AUTHSERV_ENV).map(|id| id.trim().to_lowercase());
+    let secret_address = var(EMAIL_SECRET_ENV).map(|secret| match address.split_once('@') {
+        Some((name, host)) => format!("{}+{}@{}", name, secret.trim().to_lowercase(), host),
+        None => format!("{}+{}", address, secret.trim().to_lowercase()),
+    });
+    if authserv_id.is_none() && secret_address.is_none() {
+        bail!(
+            "set {} to trust your mail server's sender checks, or {} to a secret to address mail with",
+            EMAIL_AUTHSERV_ENV,
+            EMAIL_SECRET_ENV
+        );
+    }
+    let gateway = Arc::new(Gateway {
+        address,
+        allowed,
+        authserv_id,
+        secret_address,
+        dir: PathBuf::from(var(EMAIL_DIR_ENV).unwrap_or_else(|| DEFAULT_DIR.to_string())),
+        send_command: var(EMAIL_SEND_ENV).unwrap_or_else(|| DEFAULT_SEND.to_string()),
+        services: rpc::Services::from_env()?,
+        busy: Mutex::new(()),
+    });
+    tokio::fs::create_dir_all(&gateway.dir).await?;
+
+    let listener = TcpListener::bind(&listen).await.with_context(|| format!("cannot listen on {}", listen))?;
+    debug_log(&format!("init: email gateway for {} on {}", gateway.address, listener.local_addr()?));
+    println!("Accepting mail for {} on {}", gateway.address, listener.local_addr()?);
+    loop {
+        let (stream, peer) = listener.accept().await?;
+        let gateway = gateway.clone();
+        tokio::spawn(async move {
+            if let Err(e) = session(stream, &gateway).await {
+                debug_log(&format!("error: smtp session from {}: {:#}", peer, e));
+            }
+        });
+    }
+}
+
+// Just enough SMTP for a local MTA or fetchmail to hand messages over
+async fn session(stream: TcpStream, gateway: &Arc<Gateway>) -> Result<()> {
+    let (reader, mut writer) = stream.into_split();
+    let mut reader = BufReader::new(reader);
+    writer.write_all(b"220 chatmd ESMTP\r\n").await?;
+
+    let mut from = String::new();
+    let mut to = String::new();
+    let mut accepted = false;
+    let mut line = String::new();
+    loop {
+        line.clear();
+        if read_line(&mut reader, &mut line).await? == 0 {
+            return Ok(());
+        }
+        let command = line.trim_end().to_string();
+        let verb = command.split_whitespace().next().unwrap_or_default().to_uppercase();
+        let reply = match verb.as_str() {
+            "HELO" | "EHLO" => "250 chatmd".to_string(),
+            "MAIL" => {
+                from = angle_address(&command);
+                accepted = false;
+                "250 OK".to_string()
+            }
+            "RCPT" => match angle_address(&command) {
+                rcpt if rcpt == gateway.address || gateway.secret_address.as_ref() == Some(&rcpt) => {
+                    to = rcpt;
+                    accepted = true;
+                    "250 OK".to_string()
+                }
+                _ => "550 No such mailbox".to_string(),
+            },
+            "DATA" if !accepted => "503 Need a recipient first".to_string(),
+            "DATA" => {
+                writer.write_all(b"354 End data with <CR><LF>.<CR><LF>\r\n").await?;
+                let message = read_data(&mut reader).await?;
+                let gateway = gateway.clone();
+                let sender = from.clone();
+                let recipient = to.clone();
+                tokio::spawn(async move {
+                    let _busy = gateway.busy.lock().await;
+                    if let Err(e) = handle(&sender, &recipient, &message, &gateway).await {
+                        debug_log(&format!("error: email from {}: {:#}", sender, e));
+                    }
+                });
+                accepted = false;
+                "250 OK".to_string()
+            }
+            "RSET" => {
+                accepted = false;
+                "250 OK".to_string()
+            }
+            "NOOP" => "250 OK".to_string(),
+            "QUIT" => {
+                writer.write_all(b"221 Bye\r\n").await?;
+                return Ok(());
+            }
+            _ => "502 Command not implemented".to_string(),
+        };
+        writer.write_all(format!("{}\r\n", reply).as_bytes()).await?;
+    }
+}
+
+async fn read_data<R: AsyncBufReadExt + Unpin>(reader: &mut R) -> Result<String> {
+    let mut message = String::new();
+    let mut line = String::new();
+    loop {
+        line.clear();
+        if read_line(reader, &mut line).await? == 0 {
+            bail!("connection closed during DATA");
+        }
+        let text = line.trim_end_matches(['\r', '\n']);
+        if text == "." {
+            return Ok(message);
+        }
+        if message.len() < MAX_MESSAGE_BYTES {
+            message.push_str(text.strip_prefix('.').filter(|_| text.starts_with("..")).unwrap_or(text));
+            message.push('\n');
+        }
+    }
+}
+
+async fn read_line<R: AsyncBufReadExt + Unpin>(reader: &mut R, line: &mut String) -> Result<usize> {
+    let read = reader.take(MAX_LINE_BYTES).read_line(line).await?;
+    if read as u64 == MAX_LINE_BYTES && !line.ends_with('\n') {
+        bail!("line longer than {} bytes", MAX_LINE_BYTES);
+    }
+    Ok(read)
+}
+
+// The address in `MAIL FROM:<a@b>`, a `From:` header and the like
+fn angle_address(text: &str) -> String {
+    let inner = match (text.find('<'), text.rfind('>')) {
+        (Some(open), Some(close)) if open < close => &text[open + 1..close],
+        _ => text.split(':').nth(1).unwrap_or(text),
+    };
+    inner.trim().to_lowercase()
+}
+
+async fn handle(envelope_from: &str, recipient: &str, raw: &str, gateway: &Gateway) -> Result<()> {
+    let email = Email::parse(raw);
+    let sender = email.header("from").map(angle_address).unwrap_or_else(|| envelope_from.to_string());
+    if !gateway.allowed.contains(&sender) {
+        bail!("{} is not in {}, ignored", sender, EMAIL_ALLOW_ENV);
+    }
+    let secret = gateway.secret_address.as_deref() == Some(recipient);
+    if !secret && !gateway.authserv_id.as_deref().is_some_and(|id| authenticated(&email, &sender, id)) {
+        bail!("{} could not be verified as the sender, ignored", sender);
+    }
+    let text = strip_quoted(&email.text());
+    if text.trim().is_empty() {
+        bail!("the message has no text");
+    }
+
+    let chat = thread_file(&gateway.dir, &email).await?;
+    debug_log(&format!("detect: email from {} for {}", sender, watch::display_path(&chat)));
+    let reply = answer(&chat, &text, &gateway.services).await?;
+    send_reply(&sender, &email, &reply, gateway).await
+}
+
+// Sends `text` to the thread's chat and returns the reply to mail back. The
+// message is marked as bridged, like one from Slack or Matrix, so it can't
+// pull files, env variables or the clipboard of this machine into a reply
+// that leaves it.
+async fn answer(chat: &Path, text: &str, services: &rpc::Services) -> Result<String> {
+    let result = rpc::send(chat, Some(text), Some("email"), services).await?;
+    let reply = result["reply"]["content"].as_str().unwrap_or_default();
+    Ok(parser::take_alternatives(&parser::strip_trace(reply)).0)
+}
+
+// Whether `authserv_id` says DKIM or DMARC passed for the sender's domain.
+// Only the topmost Authentication-Results is the MTA's own; any below it
+// came with the message and could say anything.
+fn authenticated(email: &Email, sender: &str, authserv_id: &str) -> bool {
+    let Some(results) = email.header("authentication-results") else {
+        return false;
+    };
+    let (id, results) = results.split_once(';').unwrap_or((results, ""));
+    if id.split_whitespace().next().map(str::to_lowercase).as_deref() != Some(authserv_id) {
+        return false;
+    }
+    let domain = sender.rsplit_once('@').map_or("", |(_, domain)| domain);
+    results.split(';').any(|result| {
+        let words: Vec<String> = result.split_whitespace().map(str::to_lowercase).collect();
+        let passed = words.first().is_some_and(|w| w == "dkim=pass" || w == "dmarc=pass");
+        let aligned = words.iter().any(|w| match w.split_once('=') {
+            Some(("header.d" | "header.from", value)) => value == domain,
+            Some(("header.i", value)) => value.rsplit('@').next() == Some(domain),
+            _ => false,
+        });
+        passed && aligned
+    })
+}
+
+// The chat file for the thread `email` belongs to, created with the subject
+// as its title when the thread is new
+async fn thread_file(dir: &Path, email: &Email) -> Result<PathBuf> {
+    let root = email
+        .header("references")
+        .and_then(|r| r.split_whitespace().next().map(str::to_string))
+        .or_else(|| email.header("in-reply-to").map(str::to_string))
+        .or_else(|| email.header("message-id").map(str::to_string))
+        .unwrap_or_else(parser::now_timestamp);
+    let digest = sha1_smol::Sha1::from(root.trim()).digest().bytes();
+    let id: String = digest.iter().map(|b| format!("{:02x}", b)).collect::<String>()[..THREAD_ID_CHARS].to_string();
+
+    for entry in std::fs::read_dir(dir)?.filter_map(|e| e.ok()) {
+        let name = entry.file_name().to_string_lossy().into_owned();
+        if name.starts_with(&format!("{}-", id)) && name.ends_with(".md") {
+            return Ok(entry.path());
+        }
+    }
+
+    let subject = subject(email);
+    let slug: String = subject
+        .to_lowercase()
+        .chars()
+        .map(|c| if c.is_alphanumeric() { c } else { '-' })
+        .collect::<String>()
+        .split('-')
+        .filter(|w| !w.is_empty())
+        .collect::<Vec<_>>()
+        .join("-")
+        .chars()
+        .take(MAX_SLUG_CHARS)
+        .collect();
+    let path = dir.join(format!("{}-{}.md", id, if slug.is_empty() { "email" } else { &slug }));
+    let frontmatter = format!(
+        "---\ntitle: {}\ncreated: {}\nemail_thread: {}\n---\n",
+        config::quote(&subject),
+        clock::now().format("%Y-%m-%d"),
+        root.trim()
+    );
+    files::write_chat(&path, &frontmatter).await?;
+    Ok(path)
+}
+
+// The subject without "Re:" or anything that could start a new line: it
+// goes into the chat's frontmatter and the reply's headers
+fn subject(email: &Email) -> String {
+    let subject = email.header("subject").map(decode_words).unwrap_or_default();
+    let mut subject = subject
+        .split(|c: char| c.is_whitespace() || c.is_control())
+        .filter(|w| !w.is_empty())
+        .collect::<Vec<_>>()
+        .join(" ");
+    while let Some(rest) = subject.strip_prefix("Re:").or_else(|| subject.strip_prefix("RE:")) {
+        subject = rest.trim().to_string();
+    }
+    match subject.trim() {
+        "" => "Email".to_string(),
+        subject => subject.to_string(),
+    }
+}
+
+async fn send_reply(to: &str, email: &Email, reply: &str, gateway: &Gateway) -> Result<()> {
+    let message_id = email.header("message-id").unwrap_or_default();
+    let references = format!("{} {}", email.header("references").unwrap_or_default(), message_id);
+    let domain = gateway.address.split('@').nth(1).unwrap_or("localhost");
+    let headers = [
+        ("From", gateway.address.clone()),
+        ("To", to.to_string()),
+        // Answers must come back to the secret address too
+        ("Reply-To", gateway.secret_address.clone().unwrap_or_default()),
+        ("Subject", format!("Re: {}", subject(email))),
+        ("In-Reply-To", message_id.to_string()),
+        ("References", references.trim().to_string()),
+        (
+            "Message-ID",
+            format!("<{}.{}@{}>", clock::now().timestamp_millis(), std::process::id(), domain),
+        ),
+        ("Date", clock::now().to_rfc2822()),
+        ("MIME-Version", "1.0".to_string()),
+        ("Content-Type", "text/plain; charset=utf-8".to_string()),
+        ("Content-Transfer-Encoding", "8bit".to_string()),
+    ];
+    let mut message: String = headers
+        .iter()
+        .filter(|(_, value)| !value.is_empty())
+        .map(|(name, value)| format!("{}: {}\n", name, value))
+        .collect();
+    message.push('\n');
+    message.push_str(reply.trim());
+    message.push('\n');
+
+    let mut child = tokio::process::Command::new("sh")
+        .arg("-c")
+        .arg(&gateway.send_command)
+        .stdin(Stdio::piped())
+        .spawn()
+        .with_context(|| format!("cannot run {:?}", gateway.send_command))?;
+    child.stdin.take().context("no stdin")?.write_all(message.as_bytes()).await?;
+    let status = child.wait().await?;
+    if !status.success() {
+        bail!("{:?} failed with {}", gateway.send_command, status);
+    }
+    debug_log(&format!("write: replied to {} by email", to));
+    Ok(())
+}
+
+struct Email {
+    // Lower-cased names, unfolded values
+    headers: Vec<(String, String)>,
+    body: String,
+}
+
+impl Email {
+    fn parse(raw: &str) -> Self {
+        let (head, body) = raw.split_once("\n\n").unwrap_or((raw, ""));
+        let mut headers: Vec<(String, String)> = Vec::new();
+        for line in head.lines() {
+            if line.starts_with([' ', '\t']) {
+                if let Some((_, value)) = headers.last_mut() {
+                    value.push(' ');
+                    value.push_str(line.trim());
+                }
+            } else if let Some((name, value)) = line.split_once(':') {
+                headers.push((name.trim().to_lowercase(), value.trim().to_string()));
+            }
+        }
+        Self {
+            headers,
+            body: body.to_string(),
+        }
+    }
+
+    fn header(&self, name: &str) -> Option<&str> {
+        self.headers.iter().find(|(n, _)| n == name).map(|(_, v)| v.as_str())
+    }
+
+    // The first text/plain part, decoded
+    fn text(&self) -> String {
+        let content_type = self.header("content-type").unwrap_or("text/plain");
+        if content_type.to_lowercase().starts_with("multipart/") {
+            let Some(boundary) = parameter(content_type, "boundary") else {
+                return String::new();
+            };
+            return self
+                .body
+                .split(&format!("--{}", boundary))
+                .skip(1)
+                .map(|part| Email::parse(part.trim_start_matches(['\r', '\n'])))
+                .find_map(|part| {
+                    let text = part.text();
+                    let kind = part.header("content-type").unwrap_or("text/plain").to_lowercase();
+                    let plain = kind.starts_with("text/plain") || kind.starts_with("multipart/");
+                    (plain && !text.trim().is_empty()).then_some(text)
+                })
+                .unwrap_or_default();
+        }
+        match self.header("content-transfer-encoding").map(str::to_lowercase).as_deref() {
+            Some("base64") => {
+                let compact: String = self.body.split_whitespace().collect();
+                let bytes = base64::engine::general_purpose::STANDARD.decode(compact).unwrap_or_default();
+                String::from_utf8_lossy(&bytes).into_owned()
+            }
+            Some("quoted-printable") => quoted_printable(&self.body, false),
+            _ => self.body.clone(),
+        }
+    }
+}
+
+fn parameter(header: &str, name: &str) -> Option<String> {
+    header.split(';').find_map(|part| {
+        let (key, value) = part.split_once('=')?;
+        (key.trim().eq_ignore_ascii_case(name)).then(|| value.trim().trim_matches('"').to_string())
+    })
+}
+
+fn quoted_printable(text: &str, underscores: bool) -> String {
+    let mut bytes = Vec::new();
+    let mut rest = text.replace("=\r\n", "").replace("=\n", "").into_bytes().into_iter().peekable();
+    while let Some(b) = rest.next() {
+        match b {
+            b'=' => {
+                let hex: Vec<u8> = rest.by_ref().take(2).collect();
+                match u8::from_str_radix(&String::from_utf8_lossy(&hex), 16) {
+                    Ok(decoded) => bytes.push(decoded),
+                    Err(_) => {
+                        bytes.push(b'=');
+                        bytes.extend(hex);
+                    }
+                }
+            }
+            b'_' if underscores => bytes.push(b' '),
+            b => bytes.push(b),
+        }
+    }
+    String::from_utf8_lossy(&bytes).into_owned()
+}
+
+// `=?utf-8?B?...?=` and `=?utf-8?Q?...?=` words in a header
+fn decode_words(value: &str) -> String {
+    let mut out = String::new();
+    let mut rest = value;
+    while let Some(start) = rest.find("=?") {
+        let word = &rest[start + 2..];
+        let parts: Vec<&str> = word.splitn(3, '?').collect();
+        let (Some(encoding), Some(tail)) = (parts.get(1), parts.get(2)) else {
+            break;
+        };
+        let Some(end) = tail.find("?=") else {
+            break;
+        };
+        let between = &rest[..start];
+        // Whitespace between two encoded words is not part of the text
+        if !(between.trim().is_empty() && !out.is_empty()) {
+            out.push_str(between);
+        }
+        let encoded = &tail[..end];
+        out.push_str(&match encoding.to_uppercase().as_str() {
+            "B" => String::from_utf8_lossy(&base64::engine::general_purpose::STANDARD.decode(encoded).unwrap_or_default())
+                .into_owned(),
+            _ => quoted_printable(encoded, true),
+        });
+        rest = &tail[end + 2..];
+    }
+    out.push_str(rest);
+    out.trim().to_string()
+}
+
+// The new text of a reply, without the quoted message below it
+fn strip_quoted(text: &str) -> String {
+    let lines: Vec<&str> = text.lines().collect();
+    let cut = lines
+        .iter()
+        .position(|line| {
+            let line = line.trim();
+            line.starts_with('>')
+                || (line.starts_with("On ") && line.ends_with("wrote:"))
+                || line.starts_with("-----Original Message-----")
+        })
+        .unwrap_or(lines.len());
+    lines[..cut].join("\n").trim().to_string()
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::{provider, testenv};
+
+    #[tokio::test]
+    async fn mail_is_sent_without_expanding_anything() {
+        let dir = std::env::temp_dir().join(format!("chatmd-email-{}", std::process::id()));
+        std::fs::create_dir_all(&dir).unwrap();
+        let _isolated = testenv::isolate(&dir);
+        let chat = dir.join("thread.md");
+        std::fs::write(&chat, "").unwrap();
+
+        let handler: provider::Handler = Arc::new(|messages, _| Ok(format!("echo: {}", messages.last().unwrap().content)));
+        let services = rpc::Services::with_client(provider::ApiClient::with_handler(handler));
+        let reply = answer(&chat, "what is {{env:HOME}}?", &services).await.unwrap();
+        assert_eq!(reply, "echo: what is {{env:HOME}}?");
+        assert!(std::fs::read_to_string(&chat).unwrap().contains("via: email"));
+        std::fs::remove_dir_all(&dir).unwrap();
+    }
+}
@@ -0,0 +1,128 @@
+use crate::{
+    envfile, library,
+    monitor::{self, FsNotifier, Services},
+    parser, preview,
+    provider::{self, ApiClient, ChatRequest, RequestParams},
+    debug_log, reply, validate, watch, ChatContext, Message, LOG_TO_STDERR,
+};
+use anyhow::{bail, Result};
+use std::{
+    future::Future,
+    path::{Path, PathBuf},
+    sync::{
+        atomic::{AtomicBool, Ordering},
+        Arc, RwLock,
+    },
+    time::Duration,
+};
+
+// What editor plugins and bots call instead of running the binary. Settings
+// come from the environment and the chat's frontmatter, as for the watcher,
+// so a chat reads the same either way; .env files are the binary's alone.
+
+// The messages in a chat, oldest first, without its frontmatter and with
+// timestamps, pins and parameter lines taken out
+pub fn parse_conversation(content: &str) -> Vec<Message> {
+    let chat_context = ChatContext::new(PathBuf::new(), content.to_string());
+    chat_context.parse_messages(&content[chat_context.body_start..])
+}
+
+// `content` with `text` added as the next message from `role`. A user
+// message is typed after the last reply; an assistant's goes between
+// separators, as the watcher writes it. Fails when it isn't `role`'s turn.
+pub fn append_message(content: &str, role: &str, text: &str) -> Result<String> {
+    let chat_context = ChatContext::new(PathBuf::new(), content.to_string());
+    let body = &content[chat_context.body_start..];
+    // A message typed after the last reply is waiting for one
+    let waiting = !chat_context.is_last_message_from_ai(body, body.len())
+        && !chat_context.extract_new_message(body, body.len()).trim().is_empty();
+    let mut text = text.trim().to_string();
+    if chat_context.timestamps {
+        text = format!("{}\n{}", text, parser::timestamp_comment(&parser::now_timestamp()));
+    }
+    match role {
+        "user" if waiting => bail!("the chat already ends with a message waiting for a reply"),
+        "user" => {
+            let gap = match content.is_empty() || content.ends_with('\n') {
+                true => "",
+                false => "\n",
+            };
+            Ok(format!("{}{}{}\n", content, gap, text))
+        }
+        "assistant" if !waiting => bail!("there is no message to reply to"),
+        "assistant" => Ok(format!("{}{}{}{}", content, chat_context.separator, text, chat_context.separator)),
+        other => bail!("unknown role {:?}: expected user or assistant", other),
+    }
+}
+
+// The request the watcher would send to answer the message typed at the end
+// of the chat at `path`: persona, project memory and the history that fits
+// the window, for the chat's model. Rolling summaries, memories and documents
+// are added only when already at hand, since finding them may take a request.
+// Serialized, it is the JSON body that goes to the provider.
+pub async fn build_request(path: &Path, content: &str) -> Result<ChatRequest> {
+    let chat_context = ChatContext::new(path.to_path_buf(), content.to_string());
+    let body = &content[chat_context.body_start..];
+    if chat_context.is_last_message_from_ai(body, body.len()) {
+        bail!("nothing to send: the chat ends with a reply");
+    }
+    let draft = parser::strip_branch_headings(&chat_context.extract_new_message(body, body.len()));
+    let (_, params) = RequestParams::take_from(&draft);
+
+    let library = RwLock::new(library::PromptLibrary::from_env());
+    let (messages, _) = preview::pending_request(&chat_context, body).await;
+    let items = reply::prepare_request(messages, params.persona.as_deref(), &chat_context, &library).await;
+    let messages = items.into_iter().map(|(_, message)| message).collect();
+    Ok(provider::chat_request(messages, &chat_context.model, &params, false))
+}
+
+// Answers chats as they are saved, like the binary run on them
+pub struct Watcher {
+    pub(crate) watch_set: watch::WatchSet,
+    pub(crate) poll_interval: Option<Duration>,
+    pub(crate) api_client: Arc<ApiClient>,
+    // The binary's .env files, reloaded when they change
+    pub(crate) env_file: Option<envfile::EnvFile>,
+}
+
+impl Watcher {
+    // `args` as the binary takes them: chats, directories or patterns, and
+    // `--poll`, `--include` or `--exclude`, and the API key to answer with.
+    // The process environment is left as it is, and logs go to stderr, since
+    // stdout belongs to the program embedding it.
+    pub fn new(args: &[String], api_key: String) -> Result<Self> {
+        LOG_TO_STDERR.store(true, Ordering::Relaxed);
+        let (watch_set, poll_interval) = watch::parse_args(args)?;
+        Ok(Self {
+            watch_set,
+            poll_interval,
+            api_client: Arc::new(ApiClient::new(api_key)),
+            env_file: None,
+        })
+    }
+
+    // The chats being answered
+    pub fn files(&self) -> Vec<PathBuf> {
+        self.watch_set.files()
+    }
+
+    // Runs until `shutdown` completes, then waits up to a minute for the
+    // replies still on their way
+    pub async fn run(self, shutdown: impl Future<Output = ()>) -> Result<()> {
+        let library = Arc::new(RwLock::new(library::PromptLibrary::from_env()));
+        monitor::report_library(&library.read().unwrap());
+        let services = Services {
+            api_client: self.api_client,
+            validators: Arc::new(validate::Validators::from_env()),
+            library,
+            running: Arc::new(AtomicBool::new(true)),
+        };
+        if let Some(interval) = self.poll_interval {
+            debug_log(&format!("init: polling for changes every {}ms", interval.as_millis()));
+        }
+        let notifier = FsNotifier {
+            poll_interval: self.poll_interval,
+        };
+        monitor::run(&self.watch_set, services, self.env_file, &notifier, shutdown).await
+    }
+}
@@ -0,0 +1,140 @@
+use crate::{config, debug_log};
+use anyhow::{bail, Result};
+use std::{
+    collections::{HashMap, HashSet},
+    path::{Path, PathBuf},
+    sync::OnceLock,
+};
+
+// Comma separated env files to use instead of .env, like --env-file
+pub const ENV_FILE_ENV: &str = "CHAT_ENV_FILE";
+
+const ENV_FILE: &str = ".env";
+
+// The files loaded at startup, for `doctor` to report
+static LOADED: OnceLock<Vec<PathBuf>> = OnceLock::new();
+
+// The env files (`.env` unless others are named), loaded at startup and again
+// whenever one changes. Only keys that were not already set in the real
+// environment are taken from them, on reload as on startup, so an exported
+// variable always wins. Among the files, later ones win.
+pub struct EnvFile {
+    paths: Vec<PathBuf>,
+    // Keys these files set, which a reload may change or remove
+    owned: HashSet<String>,
+}
+
+impl EnvFile {
+    // Files given with --env-file, or CHAT_ENV_FILE, must exist; a missing
+    // .env just means settings come from the environment alone
+    pub fn load(named: Vec<PathBuf>) -> Result<Self> {
+        let named = if named.is_empty() {
+            std::env::var(ENV_FILE_ENV)
+                .map(|list| list.split(',').map(str::trim).filter(|p| !p.is_empty()).map(PathBuf::from).collect())
+                .unwrap_or_default()
+        } else {
+            named
+        };
+
+        let paths = if named.is_empty() {
+            // Canonical, to compare against watcher event paths
+            let path = std::env::current_dir()
+                .and_then(std::fs::canonicalize)
+                .map(|dir| dir.join(ENV_FILE))
+                .unwrap_or_else(|_| PathBuf::from(ENV_FILE));
+            vec![path]
+        } else {
+            let mut paths = Vec::new();
+            for path in named {
+                match std::fs::canonicalize(&path) {
+                    Ok(path) => paths.push(path),
+                    Err(_) => bail!("env file {} not found", path.display()),
+                }
+            }
+            paths
+        };
+
+        let mut env_file = Self {
+            paths,
+            owned: HashSet::new(),
+        };
+        env_file.apply(env_file.read());
+        let _ = LOADED.set(env_file.paths.clone());
+        Ok(env_file)
+    }
+
+    pub fn paths(&self) -> &[PathBuf] {
+        &self.paths
+    }
+
+    pub fn contains(&self, path: &Path) -> bool {
+        self.paths.iter().any(|p| p == path)
+    }
+
+    // Re-reads the files and returns the keys whose values changed
+    pub fn reload(&mut self) -> Vec<String> {
+        let values = self.read();
+        let mut changed: Vec<String> = self
+            .owned
+            .iter()
+            .filter(|key| values.get(*key) != std::env::var(key).ok().as_ref())
+            .cloned()
+            .collect();
+        changed.extend(
+            values
+                .keys()
+                .filter(|key| !self.owned.contains(*key) && std::env::var(key).is_err())
+                .cloned(),
+        );
+        changed.sort();
+
+        for key in self.owned.drain() {
+            std::env::remove_var(&key);
+        }
+        self.apply(values);
+
+        if !changed.is_empty() {
+            config::bump_generation();
+        }
+        changed
+    }
+
+    fn read(&self) -> HashMap<String, String> {
+        let mut values = HashMap::new();
+        for path in &self.paths {
+            values.extend(read(path));
+        }
+        values
+    }
+
+    fn apply(&mut self, values: HashMap<String, String>) {
+        for (key, value) in values {
+            if self.owned.contains(&key) || std::env::var(&key).is_err() {
+                std::env::set_var(&key, value);
+                self.owned.insert(key);
+            }
+        }
+    }
+}
+
+// The env files loaded at startup
+pub fn loaded() -> &'static [PathBuf] {
+    LOADED.get().map(Vec::as_slice).unwrap_or_default()
+}
+
+fn read(path: &Path) -> HashMap<String, String> {
+    let Ok(entries) = dotenv::from_path_iter(path) else {
+        return HashMap::new();
+    };
+
+    let mut values = HashMap::new();
+    for entry in entries {
+        match entry {
+            Ok((key, value)) => {
+                values.insert(key, value);
+            }
+            Err(e) => debug_log(&format!("error: skipping a line in {}: {}", path.display(), e)),
+        }
+    }
+    values
+}
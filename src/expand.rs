@@ -0,0 +1,314 @@
+use crate::{
+    debug_log,
+    library::{Kind, PromptLibrary},
+    parser,
+};
+use std::path::Path;
+
+pub const MAX_INCLUDE_BYTES: usize = 64 * 1024;
+const INCLUDE_DIRECTIVE: &str = "@include";
+const FILE_DIRECTIVE: &str = "@file";
+const GIT_DIRECTIVE: &str = "@git";
+const TEMPLATE_DIRECTIVE: &str = "/tpl";
+const TEMPLATE_TOKEN_OPEN: &str = "{{tpl:";
+const TOKEN_CLOSE: &str = "}}";
+const INPUT_PLACEHOLDER: &str = "{{input}}";
+// Templates may use other templates; this stops self-referencing ones
+const MAX_TEMPLATE_EXPANSIONS: usize = 16;
+
+// Expands directives in a user message right before it is sent. The chat
+// file itself keeps the directive, so included files never bloat it.
+pub fn expand_message(text: &str, base_dir: &Path, library: &PromptLibrary) -> String {
+    let text = expand_templates(text, library);
+    let text = expand_variables(&text, base_dir);
+    expand_files(&text, base_dir)
+}
+
+// `{{date}}`, `{{time}}`, `{{cwd}}`, `{{env:NAME}}`, `{{file:path}}` and
+// `{{clipboard}}`. Unknown names and anything inside code fences are left alone.
+fn expand_variables(text: &str, base_dir: &Path) -> String {
+    let fences = parser::fenced_ranges(text);
+    let mut expanded = String::with_capacity(text.len());
+    let mut offset = 0;
+
+    while let Some(open) = text[offset..].find("{{").map(|i| offset + i) {
+        let Some(close) = text[open..].find(TOKEN_CLOSE).map(|i| open + i) else {
+            break;
+        };
+        let token_end = close + TOKEN_CLOSE.len();
+        expanded.push_str(&text[offset..open]);
+        offset = token_end;
+
+        let value = if parser::in_fence(&fences, open) {
+            None
+        } else {
+            variable(text[open + 2..close].trim(), base_dir)
+        };
+        expanded.push_str(value.as_deref().unwrap_or(&text[open..token_end]));
+    }
+
+    expanded.push_str(&text[offset..]);
+    expanded
+}
+
+fn variable(name: &str, base_dir: &Path) -> Option<String> {
+    let (name, argument) = match name.split_once(':') {
+        Some((name, argument)) => (name.trim(), Some(argument.trim())),
+        None => (name, None),
+    };
+
+    match (name, argument) {
+        ("date", None) => Some(crate::clock::now().format("%Y-%m-%d").to_string()),
+        ("time", None) => Some(crate::clock::now().format("%H:%M").to_string()),
+        ("cwd", None) => std::env::current_dir().ok().map(|d| d.display().to_string()),
+        ("env", Some(var)) => Some(std::env::var(var).unwrap_or_default()),
+        ("file", Some(path)) => Some(match read_capped(&base_dir.join(path), path) {
+            Ok(text) => text,
+            Err(e) => {
+                debug_log(&format!("error: cannot read {}: {}", path, e));
+                format!("[file failed: {}: {}]", path, e)
+            }
+        }),
+        ("clipboard", None) => Some(clipboard().unwrap_or_else(|| {
+            debug_log("error: no clipboard tool found (pbpaste, wl-paste, xclip, xsel, powershell)");
+            String::new()
+        })),
+        _ => None,
+    }
+}
+
+fn clipboard() -> Option<String> {
+    let tools: [(&str, &[&str]); 5] = [
+        ("pbpaste", &[]),
+        ("wl-paste", &["--no-newline"]),
+        ("xclip", &["-selection", "clipboard", "-o"]),
+        ("xsel", &["--clipboard", "--output"]),
+        ("powershell", &["-NoProfile", "-Command", "Get-Clipboard"]),
+    ];
+
+    tools.iter().find_map(|(program, args)| {
+        let output = std::process::Command::new(program).args(*args).output().ok()?;
+        output
+            .status
+            .success()
+            .then(|| String::from_utf8_lossy(&output.stdout).trim_end().to_string())
+    })
+}
+
+// `/tpl name` on its own line, or `{{tpl:name}}` anywhere, pulls in a template
+// from the prompts library. A template's `{{input}}` placeholder receives the
+// rest of the message; templates without one are inserted in place.
+fn expand_templates(text: &str, library: &PromptLibrary) -> String {
+    let fences = parser::fenced_ranges(text);
+    let mut offset = 0;
+    for line in text.split_inclusive('\n') {
+        let start = offset;
+        offset += line.len();
+        if parser::in_fence(&fences, start) {
+            continue;
+        }
+
+        if let Some(name) = directive_argument(line, TEMPLATE_DIRECTIVE) {
+            let rest = format!("{}{}", &text[..start], &text[offset..]);
+            return match template(library, name) {
+                Some(template) => fill_template(template, rest.trim()),
+                None => text.to_string(),
+            };
+        }
+    }
+
+    let mut expanded = text.to_string();
+    for _ in 0..MAX_TEMPLATE_EXPANSIONS {
+        let Some(open) = expanded.find(TEMPLATE_TOKEN_OPEN) else {
+            break;
+        };
+        let Some(close) = expanded[open..].find(TOKEN_CLOSE).map(|i| open + i) else {
+            break;
+        };
+        let name = expanded[open + TEMPLATE_TOKEN_OPEN.len()..close].trim().to_string();
+        let token_end = close + TOKEN_CLOSE.len();
+
+        let Some(template) = template(library, &name) else {
+            // Leave unknown templates visible, but don't loop on them
+            expanded.replace_range(open..token_end, &format!("{{{{tpl {}}}}}", name));
+            continue;
+        };
+
+        if template.contains(INPUT_PLACEHOLDER) {
+            let rest = format!("{}{}", &expanded[..open], &expanded[token_end..]);
+            expanded = fill_template(template, rest.trim());
+        } else {
+            expanded.replace_range(open..token_end, template);
+        }
+    }
+    expanded
+}
+
+fn template<'a>(library: &'a PromptLibrary, name: &str) -> Option<&'a str> {
+    let template = library.get(Kind::Prompt, name);
+    match template {
+        Some(_) => debug_log(&format!("add: expanded template {}", name)),
+        None => debug_log(&format!("error: template {:?} not found", name)),
+    }
+    template
+}
+
+fn fill_template(template: &str, input: &str) -> String {
+    if template.contains(INPUT_PLACEHOLDER) {
+        template.replace(INPUT_PLACEHOLDER, input)
+    } else if input.is_empty() {
+        template.to_string()
+    } else {
+        format!("{}\n\n{}", template, input)
+    }
+}
+
+fn expand_files(text: &str, base_dir: &Path) -> String {
+    let fences = parser::fenced_ranges(text);
+    let mut expanded = String::with_capacity(text.len());
+    let mut offset = 0;
+
+    for line in text.split_inclusive('\n') {
+        let start = offset;
+        offset += line.len();
+
+        if parser::in_fence(&fences, start) {
+            expanded.push_str(line);
+            continue;
+        }
+
+        let replacement = if let Some(path) = directive_argument(line, INCLUDE_DIRECTIVE) {
+            include_file(&base_dir.join(path), path)
+        } else if line.trim() == GIT_DIRECTIVE {
+            git_changes("diff", base_dir)
+        } else if let Some(what) = directive_argument(line, GIT_DIRECTIVE) {
+            git_changes(what, base_dir)
+        } else if let Some(paths) = directive_argument(line, FILE_DIRECTIVE) {
+            paths
+                .split_whitespace()
+                .map(|path| attach_file(&base_dir.join(path), path))
+                .collect::<Vec<_>>()
+                .join("\n\n")
+        } else {
+            expanded.push_str(line);
+            continue;
+        };
+
+        expanded.push_str(&replacement);
+        if line.ends_with('\n') {
+            expanded.push('\n');
+        }
+    }
+
+    expanded
+}
+
+fn directive_argument<'a>(line: &'a str, directive: &str) -> Option<&'a str> {
+    line.trim()
+        .strip_prefix(directive)
+        .filter(|rest| rest.starts_with(char::is_whitespace))
+        .map(str::trim)
+        .filter(|arg| !arg.is_empty())
+}
+
+fn include_file(path: &Path, label: &str) -> String {
+    match read_capped(path, label) {
+        Ok(text) => {
+            debug_log(&format!("add: included {}", label));
+            text
+        }
+        Err(e) => {
+            debug_log(&format!("error: cannot include {}: {}", label, e));
+            format!("[include failed: {}: {}]", label, e)
+        }
+    }
+}
+
+// Wraps the file in a fence labelled with its name, so the model can tell
+// attachments apart and refer to them
+fn attach_file(path: &Path, label: &str) -> String {
+    match read_capped(path, label) {
+        Ok(text) => {
+            debug_log(&format!("add: attached {}", label));
+            let lang = path
+                .extension()
+                .map(|ext| ext.to_string_lossy().to_lowercase())
+                .unwrap_or_default();
+            format!("File: `{}`\n{}", label, fenced(&text, &lang))
+        }
+        Err(e) => {
+            debug_log(&format!("error: cannot attach {}: {}", label, e));
+            format!("[attachment failed: {}: {}]", label, e)
+        }
+    }
+}
+
+// `@git` or `@git diff` sends the unstaged changes, `@git staged` the staged
+// ones and `@git <commit>` that commit; paths may follow diff and staged
+fn git_changes(what: &str, base_dir: &Path) -> String {
+    let mut words = what.split_whitespace();
+    let first = words.next().unwrap_or("diff");
+    let paths: Vec<&str> = words.collect();
+    let (label, mut args) = match first {
+        "diff" => ("unstaged changes".to_string(), vec!["diff"]),
+        "staged" | "cached" => ("staged changes".to_string(), vec!["diff", "--cached"]),
+        // git would take a dash for an option, `--output=<file>` among them
+        commit if commit.starts_with('-') => return format!("[git failed: {} is not a commit]", commit),
+        commit => (format!("commit {}", commit), vec!["show", "--stat", "--patch", commit]),
+    };
+    if !paths.is_empty() {
+        args.push("--");
+        args.extend(&paths);
+    }
+
+    let output = std::process::Command::new("git").arg("-C").arg(base_dir).args(&args).output();
+    let stdout = match output {
+        Ok(output) if output.status.success() => output.stdout,
+        Ok(output) => {
+            let error = String::from_utf8_lossy(&output.stderr).trim().to_string();
+            debug_log(&format!("error: git {} failed: {}", args.join(" "), error));
+            return format!("[git failed: {}: {}]", label, error);
+        }
+        Err(e) => {
+            debug_log(&format!("error: cannot run git: {}", e));
+            return format!("[git failed: {}: {}]", label, e);
+        }
+    };
+    let mut diff = String::from_utf8_lossy(&stdout[..stdout.len().min(MAX_INCLUDE_BYTES)])
+        .trim_end()
+        .to_string();
+    if diff.is_empty() {
+        return format!("[git: no {}]", label);
+    }
+    debug_log(&format!("add: attached git {} ({} bytes)", label, stdout.len()));
+    if stdout.len() > MAX_INCLUDE_BYTES {
+        diff.push_str(&format!("\n[… {} truncated at {} bytes]", label, MAX_INCLUDE_BYTES));
+    }
+    format!("Git {}:\n{}", label, fenced(&diff, "diff"))
+}
+
+// A code block that holds `text` whatever backticks it contains
+fn fenced(text: &str, lang: &str) -> String {
+    let longest_run = text
+        .lines()
+        .map(|l| l.trim_start().chars().take_while(|c| *c == '`').count())
+        .max()
+        .unwrap_or(0);
+    let fence = "`".repeat(longest_run.max(2) + 1);
+    format!("{}{}\n{}\n{}", fence, lang, text, fence)
+}
+
+fn read_capped(path: &Path, label: &str) -> std::io::Result<String> {
+    let bytes = std::fs::read(path)?;
+    let mut text = String::from_utf8_lossy(&bytes[..bytes.len().min(MAX_INCLUDE_BYTES)]).into_owned();
+    if bytes.len() > MAX_INCLUDE_BYTES {
+        debug_log(&format!(
+            "trim: {} is {} bytes, using the first {}",
+            label,
+            bytes.len(),
+            MAX_INCLUDE_BYTES
+        ));
+        text.push_str(&format!("\n[… {} truncated at {} bytes]", label, MAX_INCLUDE_BYTES));
+    }
+    Ok(text.trim_end().to_string())
+}
@@ -0,0 +1,304 @@
+use crate::{config, files, jsonl::Record, parser, ChatContext, CHAT_FILE};
+use anyhow::{bail, Context, Result};
+use pulldown_cmark::{html, CodeBlockKind, Event, Options, Parser, Tag, TagEnd};
+use std::path::{Path, PathBuf};
+use tokio::{fs, process::Command};
+
+// Tried in order for --format pdf; each gets the HTML file and the PDF path
+pub const PDF_CONVERTERS: &[(&str, &[&str])] = &[
+    ("wkhtmltopdf", &["--quiet", "{html}", "{pdf}"]),
+    ("chromium", &["--headless", "--print-to-pdf={pdf}", "{html}"]),
+    ("chromium-browser", &["--headless", "--print-to-pdf={pdf}", "{html}"]),
+    ("google-chrome", &["--headless", "--print-to-pdf={pdf}", "{html}"]),
+];
+
+pub const STYLE: &str = r#"
+body { font: 16px/1.55 -apple-system, "Segoe UI", Helvetica, Arial, sans-serif; color: #1f2328; background: #f6f8fa; margin: 0; }
+main { max-width: 52rem; margin: 0 auto; padding: 2rem 1rem; }
+nav { background: #fff; border: 1px solid #d0d7de; border-radius: 6px; padding: .5rem 1.5rem; margin-bottom: 2rem; }
+nav ol { padding-left: 1.5rem; }
+.message { background: #fff; border: 1px solid #d0d7de; border-left-width: 4px; border-radius: 6px; padding: .25rem 1.25rem; margin: 1rem 0; break-inside: avoid-page; }
+.message.user { border-left-color: #0969da; }
+.message.assistant { border-left-color: #8250df; }
+.message header { font-size: .85rem; color: #656d76; margin-top: .75rem; }
+.message header .role { font-weight: 600; color: #1f2328; margin-right: .5rem; }
+.message header .branch { float: right; }
+pre { background: #f6f8fa; border-radius: 6px; padding: .75rem 1rem; overflow-x: auto; }
+code { font: .875em/1.45 ui-monospace, SFMono-Regular, Menlo, Consolas, monospace; }
+.kw { color: #cf222e; } .str { color: #0a3069; } .num { color: #0550ae; } .com { color: #6e7781; font-style: italic; }
+"#;
+
+const KEYWORDS: &[&str] = &[
+    "as", "async", "await", "break", "case", "catch", "class", "const", "continue", "def", "default", "defer", "do",
+    "elif", "else", "enum", "except", "export", "extends", "false", "fn", "for", "from", "func", "function", "go",
+    "if", "impl", "import", "in", "interface", "let", "loop", "match", "mod", "mut", "new", "nil", "None", "null",
+    "package", "pub", "return", "self", "static", "struct", "switch", "this", "throw", "trait", "true", "True",
+    "False", "try", "type", "use", "var", "where", "while", "with", "yield",
+];
+
+// `export [--format html|pdf] [--out path] [file]`: renders a chat as a
+// standalone page for sharing
+pub async fn run(args: &[String]) -> Result<()> {
+    let mut format = "html".to_string();
+    let mut out = None;
+    let mut input = CHAT_FILE.to_string();
+    let mut args = args.iter();
+    while let Some(arg) = args.next() {
+        match arg.as_str() {
+            "--format" | "-f" => format = args.next().context("--format needs html or pdf")?.to_lowercase(),
+            "--out" | "-o" => out = Some(PathBuf::from(args.next().context("--out needs a path")?)),
+            _ => input = arg.clone(),
+        }
+    }
+    if format != "html" && format != "pdf" {
+        bail!("unknown export format {:?}, expected html or pdf", format);
+    }
+    let out = out.unwrap_or_else(|| Path::new(&input).with_extension(&format));
+
+    let content = files::read_chat(Path::new(&input))
+        .await
+        .with_context(|| format!("cannot read {}", input))?;
+    let page = render_html(&content, &input);
+
+    if format == "html" {
+        fs::write(&out, page).await?;
+    } else {
+        write_pdf(&page, &out).await?;
+    }
+    println!("exported {} -> {}", input, out.display());
+    Ok(())
+}
+
+pub fn render_html(content: &str, path: &str) -> String {
+    let records = records(content, path);
+    let title = title(content, path);
+
+    let mut page = format!(
+        "<!DOCTYPE html>\n<html>\n<head>\n<meta charset=\"utf-8\">\n<title>{}</title>\n<style>{}</style>\n</head>\n<body>\n<main>\n<h1>{}</h1>\n",
+        escape(&title),
+        STYLE,
+        escape(&title)
+    );
+    page.push_str(&render_messages(&records));
+    page.push_str("</main>\n</body>\n</html>\n");
+    page
+}
+
+// The title a chat is shown under: its frontmatter title, or the file name
+pub fn title(content: &str, path: &str) -> String {
+    config::Frontmatter::parse(content)
+        .get("title")
+        .map(str::to_string)
+        .filter(|t| !t.trim().is_empty())
+        .unwrap_or_else(|| {
+            Path::new(path)
+                .file_stem()
+                .map(|s| s.to_string_lossy().into_owned())
+                .unwrap_or_else(|| "chat".to_string())
+        })
+}
+
+// The messages a chat would show, without private notes
+pub fn records(content: &str, path: &str) -> Vec<Record> {
+    let chat_context = ChatContext::new(Path::new(path).to_path_buf(), content.to_string());
+    chat_context
+        .transcript(&content[chat_context.body_start..])
+        .into_iter()
+        // Private notes stay out of shared transcripts too
+        .map(|r| Record {
+            content: parser::strip_private(&r.content),
+            ..r
+        })
+        .filter(|r| !r.content.is_empty())
+        .collect()
+}
+
+// The table of contents and the messages, as HTML
+pub fn render_messages(records: &[Record]) -> String {
+    let mut page = String::new();
+
+    // Every question gets an entry, labelled with its first line
+    let toc: Vec<String> = records
+        .iter()
+        .filter(|r| r.role == "user")
+        .map(|r| {
+            let label: String = r.content.lines().find(|l| !l.trim().is_empty()).unwrap_or_default().chars().take(80).collect();
+            format!("<li><a href=\"#m{}\">{}</a></li>\n", r.index, escape(label.trim()))
+        })
+        .collect();
+    if !toc.is_empty() {
+        page.push_str(&format!("<nav>\n<h2>Contents</h2>\n<ol>\n{}</ol>\n</nav>\n", toc.concat()));
+    }
+
+    for record in records {
+        let role = if record.role == "user" { "You" } else { "Assistant" };
+        page.push_str(&format!("<section class=\"message {}\" id=\"m{}\">\n<header><span class=\"role\">{}</span>", record.role, record.index, role));
+        if let Some(timestamp) = &record.timestamp {
+            page.push_str(&format!("<time datetime=\"{0}\">{0}</time>", escape(timestamp)));
+        }
+        if !record.branch.is_empty() {
+            page.push_str(&format!("<span class=\"branch\">{}</span>", escape(&record.branch.join(" / "))));
+        }
+        page.push_str("</header>\n");
+        page.push_str(&markdown_to_html(&record.content));
+        page.push_str("</section>\n");
+    }
+    page
+}
+
+// Markdown to HTML, with fenced code replaced by highlighted markup
+fn markdown_to_html(text: &str) -> String {
+    let options = Options::ENABLE_TABLES | Options::ENABLE_STRIKETHROUGH | Options::ENABLE_TASKLISTS;
+    let mut events = Vec::new();
+    let mut code: Option<(String, String)> = None;
+
+    for event in Parser::new_ext(text, options) {
+        match (event, code.as_mut()) {
+            (Event::Start(Tag::CodeBlock(kind)), _) => {
+                let lang = match kind {
+                    CodeBlockKind::Fenced(info) => info.split_whitespace().next().unwrap_or_default().to_lowercase(),
+                    CodeBlockKind::Indented => String::new(),
+                };
+                code = Some((lang, String::new()));
+            }
+            (Event::Text(text), Some((_, body))) => body.push_str(&text),
+            (Event::End(TagEnd::CodeBlock), Some(_)) => {
+                let (lang, body) = code.take().unwrap_or_default();
+                let class = if lang.is_empty() { String::new() } else { format!(" class=\"language-{}\"", escape(&lang)) };
+                events.push(Event::Html(format!("<pre><code{}>{}</code></pre>\n", class, highlight(&body, &lang)).into()));
+            }
+            (event, _) => events.push(event),
+        }
+    }
+
+    let mut out = String::new();
+    html::push_html(&mut out, events.into_iter());
+    out
+}
+
+// A deliberately small highlighter: comments, strings, numbers and common
+// keywords, which is enough to make shared transcripts readable
+fn highlight(code: &str, lang: &str) -> String {
+    let comment_markers: &[&str] = match lang {
+        "python" | "py" | "sh" | "bash" | "zsh" | "shell" | "yaml" | "yml" | "toml" | "ruby" | "rb" | "r" | "perl" => &["#"],
+        "sql" | "lua" | "haskell" | "hs" => &["--"],
+        "" | "text" | "txt" | "plain" | "json" | "markdown" | "md" => &[],
+        _ => &["//"],
+    };
+    let highlight_words = !matches!(lang, "" | "text" | "txt" | "plain" | "markdown" | "md");
+
+    let mut out = String::with_capacity(code.len() * 2);
+    for line in code.split_inclusive('\n') {
+        let mut rest = line;
+        while !rest.is_empty() {
+            if comment_markers.iter().any(|m| rest.starts_with(m)) {
+                let comment = rest.trim_end_matches('\n');
+                out.push_str(&format!("<span class=\"com\">{}</span>", escape(comment)));
+                rest = &rest[comment.len()..];
+                continue;
+            }
+
+            let c = rest.chars().next().unwrap_or_default();
+            let token_len = if matches!(c, '"' | '\'' | '`') {
+                // A quote without a closer on this line (a Rust lifetime, an
+                // apostrophe) is left as plain text
+                rest[1..].find(c).map(|end| end + 2)
+            } else if c.is_ascii_digit() {
+                Some(rest.find(|c: char| !(c.is_ascii_alphanumeric() || c == '.' || c == '_')).unwrap_or(rest.len()))
+            } else if c.is_alphabetic() || c == '_' {
+                Some(rest.find(|c: char| !(c.is_alphanumeric() || c == '_')).unwrap_or(rest.len()))
+            } else {
+                None
+            };
+
+            let Some(len) = token_len else {
+                out.push_str(&escape(&c.to_string()));
+                rest = &rest[c.len_utf8()..];
+                continue;
+            };
+
+            let token = &rest[..len];
+            let class = match c {
+                '"' | '\'' | '`' => Some("str"),
+                _ if c.is_ascii_digit() && highlight_words => Some("num"),
+                _ if highlight_words && KEYWORDS.contains(&token) => Some("kw"),
+                _ => None,
+            };
+            match class {
+                Some(class) => out.push_str(&format!("<span class=\"{}\">{}</span>", class, escape(token))),
+                None => out.push_str(&escape(token)),
+            }
+            rest = &rest[len..];
+        }
+    }
+    out
+}
+
+pub fn escape(text: &str) -> String {
+    text.replace('&', "&amp;")
+        .replace('<', "&lt;")
+        .replace('>', "&gt;")
+        .replace('"', "&quot;")
+}
+
+// Renders through the first HTML-to-PDF tool found on the PATH
+async fn write_pdf(page: &str, out: &Path) -> Result<()> {
+    let html_path = std::env::temp_dir().join(format!("chat-export-{}.html", std::process::id()));
+    fs::write(&html_path, page).await?;
+
+    let mut result = Err(anyhow::anyhow!(
+        "no PDF converter found; install wkhtmltopdf or chromium, or export html and print it"
+    ));
+    for (program, template) in PDF_CONVERTERS {
+        let args: Vec<String> = template
+            .iter()
+            .map(|a| {
+                a.replace("{html}", &html_path.to_string_lossy())
+                    .replace("{pdf}", &out.to_string_lossy())
+            })
+            .collect();
+
+        match Command::new(program).args(&args).output().await {
+            Ok(output) if output.status.success() => {
+                result = Ok(());
+                break;
+            }
+            Ok(output) => {
+                result = Err(anyhow::anyhow!(
+                    "{} failed: {}",
+                    program,
+                    String::from_utf8_lossy(&output.stderr).trim()
+                ));
+                break;
+            }
+            // Not installed, try the next one
+            Err(_) => continue,
+        }
+    }
+
+    let _ = fs::remove_file(&html_path).await;
+    result
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn renders_a_chat_as_a_page() {
+        let chat = "---\ntitle: Ideas <draft>\n---\nWhat is `x`?\nmore\n\n***\n```rust\nlet s = \"<b>\"; // note\n```\n***\n";
+        let page = render_html(chat, "chat.md");
+        assert!(page.contains("<title>Ideas &lt;draft&gt;</title>"), "{}", page);
+        assert!(page.contains("<li><a href=\"#m0\">What is `x`?</a></li>"), "{}", page);
+        assert!(page.contains("<code>x</code>"), "{}", page);
+        assert!(page.contains("<span class=\"kw\">let</span>"), "{}", page);
+        assert!(page.contains("<span class=\"str\">&quot;&lt;b&gt;&quot;</span>"), "{}", page);
+        assert!(page.contains("<span class=\"com\">// note</span>"), "{}", page);
+        assert!(page.contains("<section class=\"message assistant\""), "{}", page);
+    }
+
+    #[test]
+    fn untitled_chats_are_named_after_the_file() {
+        assert!(render_html("hi\n", "notes/plan.md").contains("<h1>plan</h1>"));
+    }
+}
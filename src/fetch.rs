@@ -0,0 +1,336 @@
+use anyhow::{bail, Context, Result};
+use std::{
+    net::{IpAddr, SocketAddr},
+    time::Duration,
+};
+
+const TIMEOUT: Duration = Duration::from_secs(20);
+// Pages are read up to this size; the rest is ignored
+const MAX_BYTES: usize = 2 * 1024 * 1024;
+// Text kept from a page, so one page can't fill the context window
+pub const MAX_CHARS: usize = 40_000;
+const USER_AGENT: &str = concat!("chatmd/", env!("CARGO_PKG_VERSION"));
+const MAX_REDIRECTS: usize = 10;
+
+// Elements whose content is never text worth reading
+const SKIPPED: &[&str] = &["script", "style", "noscript", "head", "svg", "template", "iframe", "nav", "footer"];
+
+pub struct Page {
+    pub title: Option<String>,
+    pub text: String,
+}
+
+// Downloads `url` and turns it into readable markdown: HTML loses its markup
+// but keeps headings, links, lists and code; other text is kept as it is.
+pub async fn fetch(url: &str) -> Result<Page> {
+    read(url, false).await
+}
+
+// For fetches the model asks for: a page it was steered to mustn't reach this
+// machine or its network, so private addresses are refused, after redirects too
+pub async fn fetch_public(url: &str) -> Result<Page> {
+    read(url, true).await
+}
+
+async fn read(url: &str, public_only: bool) -> Result<Page> {
+    if !url.starts_with("http://") && !url.starts_with("https://") {
+        bail!("{} is not an http(s) URL", url);
+    }
+    let mut response = match public_only {
+        true => get_public(url).await?,
+        false => {
+            let client = reqwest::Client::builder().timeout(TIMEOUT).user_agent(USER_AGENT).build()?;
+            client.get(url).send().await.with_context(|| format!("cannot fetch {}", url))?
+        }
+    };
+    if !response.status().is_success() {
+        bail!("{} answered {}", url, response.status());
+    }
+    let content_type = response
+        .headers()
+        .get(reqwest::header::CONTENT_TYPE)
+        .and_then(|v| v.to_str().ok())
+        .unwrap_or("text/html")
+        .to_lowercase();
+    if !(content_type.starts_with("text/") || content_type.contains("json") || content_type.contains("xml")) {
+        bail!("{} is {}, not a page that can be read as text", url, content_type);
+    }
+
+    let mut body = Vec::new();
+    while let Some(chunk) = response.chunk().await? {
+        body.extend_from_slice(&chunk);
+        if body.len() >= MAX_BYTES {
+            body.truncate(MAX_BYTES);
+            break;
+        }
+    }
+    let body = String::from_utf8_lossy(&body);
+
+    let page = match content_type.contains("html") {
+        true => Page {
+            title: title(&body),
+            text: html_to_markdown(&body),
+        },
+        false => Page {
+            title: None,
+            text: body.trim().to_string(),
+        },
+    };
+    Ok(Page {
+        text: truncate(&page.text, MAX_CHARS),
+        ..page
+    })
+}
+
+// Follows redirects by hand, checking every hop's addresses and then connecting
+// to the address checked, so a second DNS answer can't point somewhere else
+async fn get_public(url: &str) -> Result<reqwest::Response> {
+    let mut url = reqwest::Url::parse(url).with_context(|| format!("{} is not a URL", url))?;
+    for _ in 0..=MAX_REDIRECTS {
+        if !matches!(url.scheme(), "http" | "https") {
+            bail!("{} is not an http(s) URL", url);
+        }
+        let host = url.host_str().with_context(|| format!("{} has no host", url))?.to_string();
+        let port = url.port_or_known_default().unwrap_or(80);
+        let addrs: Vec<SocketAddr> = tokio::net::lookup_host((host.trim_matches(['[', ']']), port))
+            .await
+            .with_context(|| format!("cannot resolve {}", host))?
+            .collect();
+        if let Some(private) = addrs.iter().find(|addr| !is_public(addr.ip())) {
+            bail!("{} is at {}, which is not on the public internet", host, private.ip());
+        }
+        let addr = *addrs.first().with_context(|| format!("{} has no address", host))?;
+        let client = reqwest::Client::builder()
+            .timeout(TIMEOUT)
+            .user_agent(USER_AGENT)
+            .redirect(reqwest::redirect::Policy::none())
+            .resolve(&host, addr)
+            .build()?;
+        let response = client.get(url.clone()).send().await.with_context(|| format!("cannot fetch {}", url))?;
+        if !response.status().is_redirection() {
+            return Ok(response);
+        }
+        let location = response
+            .headers()
+            .get(reqwest::header::LOCATION)
+            .and_then(|v| v.to_str().ok())
+            .with_context(|| format!("{} redirected nowhere", url))?;
+        url = url.join(location).with_context(|| format!("{} redirected to {}", url, location))?;
+    }
+    bail!("{} redirected more than {} times", url, MAX_REDIRECTS)
+}
+
+fn is_public(ip: IpAddr) -> bool {
+    match ip {
+        IpAddr::V4(ip) => {
+            let [a, b, ..] = ip.octets();
+            !(ip.is_loopback()
+                || ip.is_private()
+                || ip.is_link_local()
+                || ip.is_unspecified()
+                || ip.is_broadcast()
+                || ip.is_documentation()
+                || a == 0
+                // Shared address space, used by carriers and some VPNs
+                || (a == 100 && (64..128).contains(&b)))
+        }
+        IpAddr::V6(ip) => match ip.to_ipv4_mapped() {
+            Some(ip) => is_public(IpAddr::V4(ip)),
+            None => {
+                let first = ip.segments()[0];
+                // Unique local (fc00::/7) and link-local (fe80::/10) addresses
+                !(ip.is_loopback() || ip.is_unspecified() || first & 0xfe00 == 0xfc00 || first & 0xffc0 == 0xfe80)
+            }
+        },
+    }
+}
+
+fn truncate(text: &str, max: usize) -> String {
+    match text.char_indices().nth(max) {
+        Some((cut, _)) => format!("{}\n\n[... the rest of the page was cut]", &text[..cut]),
+        None => text.to_string(),
+    }
+}
+
+fn title(html: &str) -> Option<String> {
+    let start = find_ignore_case(html, "<title")?;
+    let start = start + html[start..].find('>')? + 1;
+    let end = start + find_ignore_case(&html[start..], "</title")?;
+    let title = collapse(&decode_entities(&html[start..end]));
+    (!title.is_empty()).then_some(title)
+}
+
+// A small converter, not a browser: good enough for articles and docs
+fn html_to_markdown(html: &str) -> String {
+    let mut out = String::new();
+    let mut rest = html;
+    // The href of each open <a>, so the closing tag can add the link
+    let mut links: Vec<Option<String>> = Vec::new();
+    let mut in_pre = false;
+
+    while let Some(open) = rest.find('<') {
+        push_text(&mut out, &rest[..open], in_pre);
+        rest = &rest[open..];
+
+        if rest.starts_with("<!--") {
+            rest = rest.find("-->").map_or("", |end| &rest[end + 3..]);
+            continue;
+        }
+        let Some(close) = rest.find('>') else {
+            break;
+        };
+        let tag = &rest[1..close];
+        rest = &rest[close + 1..];
+
+        let closing = tag.starts_with('/');
+        let name = tag
+            .trim_start_matches('/')
+            .split(|c: char| c.is_whitespace() || c == '/')
+            .next()
+            .unwrap_or_default()
+            .to_lowercase();
+
+        if !closing && SKIPPED.contains(&name.as_str()) {
+            rest = find_ignore_case(rest, &format!("</{}", name))
+                .and_then(|end| rest[end..].find('>').map(|gt| &rest[end + gt + 1..]))
+                .unwrap_or("");
+            continue;
+        }
+
+        match (name.as_str(), closing) {
+            ("h1" | "h2" | "h3" | "h4" | "h5" | "h6", false) => {
+                let level = name[1..].parse().unwrap_or(1);
+                out.push_str(&format!("\n\n{} ", "#".repeat(level)));
+            }
+            ("p" | "div" | "section" | "article" | "main" | "table" | "blockquote" | "h1" | "h2" | "h3" | "h4" | "h5" | "h6", _) => {
+                out.push_str("\n\n")
+            }
+            ("br" | "tr", _) => out.push('\n'),
+            ("li", false) => out.push_str("\n- "),
+            ("td" | "th", false) => out.push_str(" | "),
+            ("pre", false) => {
+                in_pre = true;
+                out.push_str("\n\n```\n");
+            }
+            ("pre", true) => {
+                in_pre = false;
+                out.push_str("\n```\n\n");
+            }
+            ("code", _) if !in_pre => out.push('`'),
+            ("strong" | "b", _) => out.push_str("**"),
+            ("em" | "i", _) => out.push('*'),
+            ("a", false) => {
+                let href = attribute(tag, "href").filter(|h| h.starts_with("http"));
+                if href.is_some() {
+                    out.push('[');
+                }
+                links.push(href);
+            }
+            ("a", true) => {
+                if let Some(Some(href)) = links.pop() {
+                    out.push_str(&format!("]({})", href));
+                }
+            }
+            _ => {}
+        }
+    }
+    push_text(&mut out, rest, in_pre);
+    tidy(&out)
+}
+
+fn push_text(out: &mut String, text: &str, in_pre: bool) {
+    let text = decode_entities(text);
+    if in_pre {
+        out.push_str(&text);
+        return;
+    }
+    let collapsed = collapse(&text);
+    if collapsed.is_empty() {
+        return;
+    }
+    if text.starts_with(char::is_whitespace) && !out.ends_with(char::is_whitespace) {
+        out.push(' ');
+    }
+    out.push_str(&collapsed);
+    if text.ends_with(char::is_whitespace) {
+        out.push(' ');
+    }
+}
+
+fn attribute(tag: &str, name: &str) -> Option<String> {
+    let at = find_ignore_case(tag, &format!("{}=", name))? + name.len() + 1;
+    let value = &tag[at..];
+    let value = match value.chars().next()? {
+        quote @ ('"' | '\'') => value[1..].split(quote).next()?,
+        _ => value.split(char::is_whitespace).next()?,
+    };
+    Some(decode_entities(value))
+}
+
+// Finds an ASCII `needle` in place: a lowercased copy of the text can differ
+// in length, so its offsets don't always fall on the original's characters
+fn find_ignore_case(text: &str, needle: &str) -> Option<usize> {
+    let needle = needle.as_bytes();
+    text.as_bytes().windows(needle.len()).position(|window| window.eq_ignore_ascii_case(needle))
+}
+
+fn collapse(text: &str) -> String {
+    text.split_whitespace().collect::<Vec<_>>().join(" ")
+}
+
+// Trims each line and keeps at most one blank line in a row, outside code
+fn tidy(text: &str) -> String {
+    let mut lines: Vec<&str> = Vec::new();
+    let mut in_code = false;
+    for line in text.lines() {
+        if line.trim_start().starts_with("```") {
+            in_code = !in_code;
+        }
+        let line = if in_code { line.trim_end() } else { line.trim() };
+        if line.is_empty() && lines.last().map_or(true, |last| last.is_empty()) && !in_code {
+            continue;
+        }
+        lines.push(line);
+    }
+    lines.join("\n").trim().to_string()
+}
+
+fn decode_entities(text: &str) -> String {
+    if !text.contains('&') {
+        return text.to_string();
+    }
+    let mut out = String::with_capacity(text.len());
+    let mut rest = text;
+    while let Some(amp) = rest.find('&') {
+        out.push_str(&rest[..amp]);
+        rest = &rest[amp..];
+        let entity = rest[1..].find(';').filter(|&end| end <= 10).map(|end| &rest[1..end + 1]);
+        let decoded = entity.and_then(|entity| match entity {
+            "amp" => Some('&'),
+            "lt" => Some('<'),
+            "gt" => Some('>'),
+            "quot" => Some('"'),
+            "apos" => Some('\''),
+            "nbsp" => Some(' '),
+            "mdash" => Some('—'),
+            "ndash" => Some('–'),
+            "hellip" => Some('…'),
+            _ => match entity.strip_prefix("#x").or_else(|| entity.strip_prefix("#X")) {
+                Some(hex) => u32::from_str_radix(hex, 16).ok().and_then(char::from_u32),
+                None => entity.strip_prefix('#').and_then(|n| n.parse().ok()).and_then(char::from_u32),
+            },
+        });
+        match (entity, decoded) {
+            (Some(entity), Some(c)) => {
+                out.push(c);
+                rest = &rest[entity.len() + 2..];
+            }
+            _ => {
+                out.push('&');
+                rest = &rest[1..];
+            }
+        }
+    }
+    out.push_str(rest);
+    out
+}
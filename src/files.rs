@@ -0,0 +1,168 @@
+use crate::{crypt, debug_log, parser};
+use anyhow::{Context, Result};
+use std::{
+    io::ErrorKind,
+    path::{Path, PathBuf},
+    time::{Duration, Instant, SystemTime},
+};
+use tokio::{fs, io::AsyncWriteExt};
+
+const LOCK_TIMEOUT: Duration = Duration::from_secs(5);
+const LOCK_RETRY: Duration = Duration::from_millis(50);
+// A lock this old was left behind by a process that died holding it
+const LOCK_STALE_AFTER: Duration = Duration::from_secs(30);
+
+// An advisory lock on a chat file, held while it is read, modified and
+// written back. It is a `.chat.md.lock` file next to the chat rather than a
+// lock on the chat itself, which atomic writes replace. Released on drop.
+pub struct FileLock {
+    path: PathBuf,
+}
+
+pub async fn lock(path: &Path) -> Result<FileLock> {
+    // Next to the file that gets written, so a chat opened through a symlink
+    // and by its real name shares one lock
+    let target = fs::canonicalize(path).await.unwrap_or_else(|_| path.to_path_buf());
+    let lock_path = lock_path(&target)?;
+    let started = Instant::now();
+
+    loop {
+        match fs::OpenOptions::new().write(true).create_new(true).open(&lock_path).await {
+            Ok(mut file) => {
+                let _ = file.write_all(format!("{}\n", std::process::id()).as_bytes()).await;
+                return Ok(FileLock { path: lock_path });
+            }
+            Err(e) if e.kind() == ErrorKind::AlreadyExists => {
+                if is_stale(&lock_path).await {
+                    debug_log(&format!("skip: removing stale lock {}", lock_path.display()));
+                    let _ = fs::remove_file(&lock_path).await;
+                    continue;
+                }
+                if started.elapsed() > LOCK_TIMEOUT {
+                    anyhow::bail!(
+                        "{} is locked by another process (remove {} if that process is gone)",
+                        path.display(),
+                        lock_path.display()
+                    );
+                }
+                tokio::time::sleep(LOCK_RETRY).await;
+            }
+            Err(e) => return Err(e).with_context(|| format!("cannot create {}", lock_path.display())),
+        }
+    }
+}
+
+impl Drop for FileLock {
+    fn drop(&mut self) {
+        let _ = std::fs::remove_file(&self.path);
+    }
+}
+
+async fn is_stale(lock_path: &Path) -> bool {
+    fs::metadata(lock_path)
+        .await
+        .and_then(|m| m.modified())
+        .ok()
+        .and_then(|modified| modified.elapsed().ok())
+        .is_some_and(|age| age > LOCK_STALE_AFTER)
+}
+
+// Replaces `path` with `contents` all at once: the data goes to a temp file
+// next to it, which is then renamed over the original. A crash or a
+// concurrent editor save can leave the old file or the new one, never a mix.
+pub async fn write_atomic(path: &Path, contents: impl AsRef<[u8]>) -> Result<()> {
+    // Write through symlinks instead of replacing them
+    let path = fs::canonicalize(path).await.unwrap_or_else(|_| path.to_path_buf());
+    let tmp = temp_path(&path)?;
+
+    let written = async {
+        let mut file = fs::File::create(&tmp).await?;
+        file.write_all(contents.as_ref()).await?;
+        file.sync_all().await?;
+        drop(file);
+
+        if let Ok(metadata) = fs::metadata(&path).await {
+            fs::set_permissions(&tmp, metadata.permissions()).await?;
+        }
+        fs::rename(&tmp, &path).await
+    }
+    .await;
+
+    if written.is_err() {
+        let _ = fs::remove_file(&tmp).await;
+    }
+    written.with_context(|| format!("cannot write {}", path.display()))
+}
+
+// Reads a chat as `\n`-terminated text without a BOM, however it was saved,
+// decrypting it first if it is encrypted
+pub async fn read_chat(path: &Path) -> std::io::Result<String> {
+    let text = match crypt::scheme(path) {
+        Some(scheme) => crypt::open(scheme, fs::read(path).await?)
+            .await
+            .map_err(|e| std::io::Error::other(format!("cannot decrypt {}: {:#}", path.display(), e)))?,
+        None => fs::read_to_string(path).await?,
+    };
+    Ok(parser::normalize(&text))
+}
+
+// A chat checked over and over while something waits on the user. It is
+// read again only once its size or modification time changes, since every
+// read of an encrypted chat runs age or gpg.
+pub struct Poll {
+    path: PathBuf,
+    seen: Option<(SystemTime, u64)>,
+}
+
+impl Poll {
+    pub fn new(path: &Path) -> Self {
+        Self {
+            path: path.to_path_buf(),
+            seen: None,
+        }
+    }
+
+    // The chat's text if it changed since the last call, or on the first. A
+    // chat that can't be read, say because gpg gave up on its passphrase,
+    // isn't tried again until it changes.
+    pub async fn changed(&mut self) -> std::io::Result<Option<String>> {
+        let metadata = fs::metadata(&self.path).await?;
+        let stamp = (metadata.modified()?, metadata.len());
+        if self.seen == Some(stamp) {
+            return Ok(None);
+        }
+        self.seen = Some(stamp);
+        Ok(Some(read_chat(&self.path).await?))
+    }
+}
+
+// Writes a chat read with `read_chat`, keeping the line endings and BOM the
+// file has on disk. An encrypted chat is encrypted again, and never written
+// in plain text if that fails.
+pub async fn write_chat(path: &Path, content: &str) -> Result<()> {
+    if let Some(scheme) = crypt::scheme(path) {
+        let sealed = crypt::seal(scheme, content)
+            .await
+            .with_context(|| format!("cannot encrypt {}", path.display()))?;
+        return write_atomic(path, sealed).await;
+    }
+    let original = fs::read_to_string(path).await.unwrap_or_default();
+    write_atomic(path, parser::restore_line_endings(&original, content)).await
+}
+
+// chat.md -> .chat.md.tmp-<pid>, hidden and not matching `*.md`
+fn temp_path(path: &Path) -> Result<PathBuf> {
+    Ok(path.with_file_name(format!(".{}.tmp-{}", file_name(path)?, std::process::id())))
+}
+
+// chat.md -> .chat.md.lock
+fn lock_path(path: &Path) -> Result<PathBuf> {
+    Ok(path.with_file_name(format!(".{}.lock", file_name(path)?)))
+}
+
+fn file_name(path: &Path) -> Result<String> {
+    let name = path
+        .file_name()
+        .with_context(|| format!("not a file: {}", path.display()))?;
+    Ok(name.to_string_lossy().into_owned())
+}
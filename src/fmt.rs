@@ -0,0 +1,195 @@
+use crate::{config, files, parser, CHAT_FILE};
+use anyhow::{Context, Result};
+use std::path::Path;
+
+// `fmt [--check] [files...]`: rewrites chat files into the canonical shape
+// the parser expects. With --check nothing is written and the exit status
+// says whether any file would change.
+pub async fn run(args: &[String]) -> Result<()> {
+    let check = args.iter().any(|a| a == "--check");
+    let mut paths: Vec<&str> = args
+        .iter()
+        .map(String::as_str)
+        .filter(|a| !a.starts_with("--"))
+        .collect();
+    if paths.is_empty() {
+        paths.push(CHAT_FILE);
+    }
+
+    let mut unformatted = 0;
+    for path in paths {
+        let _lock = files::lock(Path::new(path)).await?;
+        let content = files::read_chat(Path::new(path))
+            .await
+            .with_context(|| format!("cannot read {}", path))?;
+        let formatted = format_chat(&content);
+
+        if formatted == content {
+            println!("{} is already formatted", path);
+        } else if check {
+            println!("{} needs formatting", path);
+            unformatted += 1;
+        } else {
+            files::write_chat(Path::new(path), &formatted).await?;
+            println!("formatted {}", path);
+        }
+    }
+
+    if unformatted > 0 {
+        anyhow::bail!("{} file(s) need formatting", unformatted);
+    }
+    Ok(())
+}
+
+pub fn format_chat(content: &str) -> String {
+    let frontmatter = config::Frontmatter::parse(content);
+    let separator = separator(&frontmatter);
+    let separator = separator.trim();
+
+    let head = trim_line_ends(&content[..frontmatter.body_start]);
+    let body = &content[frontmatter.body_start..];
+
+    // Roles come from position, exactly as the watcher sees them
+    let messages = split_loose(body, separator)
+        .into_iter()
+        .enumerate()
+        .map(|(i, part)| (i % 2 == 0, normalize_fences(&trim_line_ends(part))));
+
+    format!("{}{}", head, render_body(messages, separator))
+}
+
+// The separator a chat's frontmatter sets, or the default
+pub fn separator(frontmatter: &config::Frontmatter) -> String {
+    frontmatter
+        .get("separator")
+        .filter(|s| !s.trim().is_empty())
+        .map(str::to_string)
+        .unwrap_or_else(config::default_separator)
+}
+
+// Lays out (is_user, text) messages as a chat body. Empty messages are
+// dropped and runs of the same role merged, so every message keeps its role
+// under the position-based alternation.
+pub fn render_body(messages: impl IntoIterator<Item = (bool, String)>, separator: &str) -> String {
+    let mut merged: Vec<(bool, String)> = Vec::new();
+    for (is_user, text) in messages {
+        let text = text.trim();
+        if text.is_empty() {
+            continue;
+        }
+        match merged.last_mut() {
+            Some((last_is_user, last)) if *last_is_user == is_user => {
+                last.push_str("\n\n");
+                last.push_str(text);
+            }
+            _ => merged.push((is_user, text.to_string())),
+        }
+    }
+
+    let mut parts: Vec<&str> = merged.iter().map(|(_, text)| text.as_str()).collect();
+    if merged.first().is_some_and(|(is_user, _)| !is_user) {
+        parts.insert(0, "");
+    }
+
+    let joiner = format!("\n{}", config::separator_line(separator));
+    let mut body = parts.join(&joiner);
+    match merged.last() {
+        // A finished exchange ends with a separator, ready for the next message
+        Some((false, _)) => body.push_str(&joiner),
+        // Never leave a blank line after a pending message: it would send it
+        Some((true, _)) => body.push('\n'),
+        None => {}
+    }
+    body
+}
+
+// Like parser::split_unfenced, but also accepts separator lines with stray
+// indentation or trailing whitespace
+fn split_loose<'a>(body: &'a str, separator: &str) -> Vec<&'a str> {
+    let fences = parser::fenced_ranges(body);
+    let mut parts = Vec::new();
+    let mut start = 0;
+    let mut offset = 0;
+
+    for line in body.split_inclusive('\n') {
+        let line_start = offset;
+        offset += line.len();
+        if line.trim() == separator && !parser::in_fence(&fences, line_start) {
+            parts.push(&body[start..line_start]);
+            start = offset;
+        }
+    }
+    parts.push(&body[start..]);
+    parts
+}
+
+// Strips trailing whitespace outside code fences, where it can matter
+fn trim_line_ends(text: &str) -> String {
+    let fences = parser::fenced_ranges(text);
+    let mut trimmed = String::with_capacity(text.len());
+    let mut offset = 0;
+
+    for line in text.split_inclusive('\n') {
+        if parser::in_fence(&fences, offset) {
+            trimmed.push_str(line);
+        } else {
+            trimmed.push_str(line.trim_end());
+            if line.ends_with('\n') {
+                trimmed.push('\n');
+            }
+        }
+        offset += line.len();
+    }
+    trimmed
+}
+
+// Rewrites every fence with backticks, a matching closer and no space before
+// the info string, closing any fence left open at the end of the message
+fn normalize_fences(text: &str) -> String {
+    let mut normalized = String::with_capacity(text.len());
+    let mut offset = 0;
+
+    for fence in parser::fences(text) {
+        normalized.push_str(&text[offset..fence.range.start]);
+        let code = &text[fence.body.clone()];
+
+        let longest_run = code
+            .lines()
+            .map(|l| l.trim_start().chars().take_while(|c| *c == '`').count())
+            .max()
+            .unwrap_or(0);
+        let marker = "`".repeat(longest_run.max(2) + 1);
+
+        normalized.push_str(&format!("{}{}\n{}", marker, fence.info, code));
+        if !code.is_empty() && !code.ends_with('\n') {
+            normalized.push('\n');
+        }
+        normalized.push_str(&marker);
+        normalized.push('\n');
+        offset = fence.range.end;
+    }
+
+    normalized.push_str(&text[offset..]);
+    normalized
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn tidies_a_messy_chat() {
+        let messy = "---\nmodel: x  \n---\nhello  \n  ***  \n\n\nanswer\n~~~ rust\nfn main() {}\n~~~\n***\n\nnext\n\n\n";
+        assert_eq!(
+            format_chat(messy),
+            "---\nmodel: x\n---\nhello\n\n***\nanswer\n```rust\nfn main() {}\n```\n\n***\nnext\n"
+        );
+    }
+
+    #[test]
+    fn separators_in_code_stay_and_open_fences_close() {
+        let chat = "question\n***\n````\n***\nstill code\n";
+        assert_eq!(format_chat(chat), "question\n\n***\n```\n***\nstill code\n```\n\n***\n");
+        assert_eq!(format_chat(&format_chat(chat)), format_chat(chat));
+    }
+}
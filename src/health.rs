@@ -0,0 +1,116 @@
+use crate::{http::Response, provider::ApiClient, watch::WatchSet};
+use serde_json::{json, Value};
+use std::{
+    sync::{Arc, Mutex, OnceLock},
+    time::{Duration, Instant},
+};
+
+// The watcher's loop wakes at least this often, and is taken for stuck once
+// it has missed a few
+pub const HEARTBEAT: Duration = Duration::from_secs(10);
+const STUCK_AFTER: Duration = Duration::from_secs(35);
+// Probes come every few seconds; the provider is asked at most this often
+const PING_EVERY: Duration = Duration::from_secs(60);
+
+static HEALTH: OnceLock<Health> = OnceLock::new();
+
+struct Health {
+    watch_set: WatchSet,
+    api_client: Arc<ApiClient>,
+    // When the watcher's loop last ran, and whether its file watch was up
+    beat: Mutex<(Instant, bool)>,
+    ping: tokio::sync::Mutex<Option<(Instant, Result<String, String>)>>,
+}
+
+// Called once the watcher is running; before that both endpoints fail
+pub fn start(watch_set: WatchSet, api_client: Arc<ApiClient>) {
+    let _ = HEALTH.set(Health {
+        watch_set,
+        api_client,
+        beat: Mutex::new((Instant::now(), true)),
+        ping: tokio::sync::Mutex::new(None),
+    });
+}
+
+// Called by the watcher's loop every time round; `watching` is false while
+// a failed file watch waits to be restarted
+pub fn beat(watching: bool) {
+    if let Some(health) = HEALTH.get() {
+        *health.beat.lock().unwrap_or_else(|e| e.into_inner()) = (Instant::now(), watching);
+    }
+}
+
+// `/livez`: the watcher alone, for restarting a stuck process. `/healthz`:
+// that, the chat files and the provider, for whether it can answer chats.
+pub async fn response(path: &str) -> Option<Response> {
+    let full = match path {
+        "/healthz" => true,
+        "/livez" => false,
+        _ => return None,
+    };
+    let Some(health) = HEALTH.get() else {
+        return Some(report(vec![("watcher", Err("not started yet".to_string()))]));
+    };
+    let mut checks = vec![("watcher", health.watcher())];
+    if full {
+        checks.push(("chats", health.chats()));
+        checks.push(("provider", health.provider().await));
+    }
+    Some(report(checks))
+}
+
+impl Health {
+    fn watcher(&self) -> Result<String, String> {
+        let (beat, watching) = *self.beat.lock().unwrap_or_else(|e| e.into_inner());
+        let since = beat.elapsed();
+        if since > STUCK_AFTER {
+            return Err(format!("the watcher hasn't run for {}s", since.as_secs()));
+        }
+        if !watching {
+            return Err("the file watch failed and is being restarted".to_string());
+        }
+        Ok(format!("ran {}s ago", since.as_secs()))
+    }
+
+    fn chats(&self) -> Result<String, String> {
+        let files = self.watch_set.files();
+        let unreadable: Vec<String> = files
+            .iter()
+            .filter_map(|path| std::fs::File::open(path).err().map(|e| format!("{}: {}", crate::watch::display_path(path), e)))
+            .collect();
+        match unreadable.is_empty() {
+            true => Ok(format!("{} chat(s) readable", files.len())),
+            false => Err(unreadable.join("; ")),
+        }
+    }
+
+    async fn provider(&self) -> Result<String, String> {
+        let mut ping = self.ping.lock().await;
+        if let Some((at, result)) = ping.as_ref().filter(|(at, _)| at.elapsed() < PING_EVERY) {
+            return result.clone().map(|detail| format!("{} ({}s ago)", detail, at.elapsed().as_secs()));
+        }
+        let result = self.api_client.ping().await.map_err(|e| format!("{:#}", e));
+        *ping = Some((Instant::now(), result.clone()));
+        result
+    }
+}
+
+// 200 when every check passed, 503 otherwise, with what each one found
+fn report(checks: Vec<(&str, Result<String, String>)>) -> Response {
+    let healthy = checks.iter().all(|(_, result)| result.is_ok());
+    let checks: serde_json::Map<String, Value> = checks
+        .into_iter()
+        .map(|(name, result)| {
+            let check = match result {
+                Ok(detail) => json!({ "ok": true, "detail": detail }),
+                Err(error) => json!({ "ok": false, "error": error }),
+            };
+            (name.to_string(), check)
+        })
+        .collect();
+    let status = match healthy {
+        true => "ok",
+        false => "failing",
+    };
+    Response::json(if healthy { 200 } else { 503 }, &json!({ "status": status, "checks": checks }))
+}
@@ -0,0 +1,106 @@
+use crate::{index, logging::debug_log, metrics, parser, provider, tokens};
+use anyhow::Result;
+use rusqlite::{params, Connection};
+use std::path::Path;
+
+// Kept in the index database next to the full-text table: every request
+// sent to the provider (the usage log), and every message of every indexed
+// chat with what is known about it. Request token counts are the
+// provider's; message token counts are the estimates the logs show.
+pub const SCHEMA: &str = "
+CREATE TABLE IF NOT EXISTS requests (
+    id INTEGER PRIMARY KEY,
+    at TEXT NOT NULL,
+    path TEXT NOT NULL,
+    model TEXT NOT NULL,
+    input_tokens INTEGER NOT NULL,
+    output_tokens INTEGER NOT NULL,
+    cost REAL,
+    latency_ms INTEGER NOT NULL,
+    reply_hash TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS requests_reply ON requests (path, reply_hash);
+CREATE TABLE IF NOT EXISTS chat_messages (
+    path TEXT NOT NULL,
+    position INTEGER NOT NULL,
+    line INTEGER NOT NULL,
+    role TEXT NOT NULL,
+    content TEXT NOT NULL,
+    sent_at TEXT,
+    tokens INTEGER NOT NULL,
+    model TEXT,
+    cost REAL,
+    PRIMARY KEY (path, position)
+);
+";
+
+// Adds a request to the usage log: the reply, the repairs asked for after
+// it, and the agent steps, summaries and memory updates along the way each
+// have a row. Replies go in before the chat is synced, so the mirror can
+// tell which model wrote them.
+pub async fn record(chat: &Path, usage: &provider::Usage, reply: &str) {
+    // Counted the same for Prometheus, with or without the database
+    metrics::request(usage);
+    if index::path().is_none() {
+        return;
+    }
+    let path = chat.canonicalize().unwrap_or_else(|_| chat.to_path_buf()).to_string_lossy().into_owned();
+    let cost = tokens::cost(&usage.model, usage.input_tokens, usage.output_tokens);
+    let row = (
+        parser::now_timestamp(),
+        path,
+        usage.model.clone(),
+        usage.input_tokens,
+        usage.output_tokens,
+        cost,
+        usage.latency.as_millis() as i64,
+        content_hash(reply),
+    );
+    let stored = tokio::task::spawn_blocking(move || -> Result<()> {
+        let conn = index::open()?;
+        conn.execute(
+            "INSERT INTO requests (at, path, model, input_tokens, output_tokens, cost, latency_ms, reply_hash)
+             VALUES (?1, ?2, ?3, ?4, ?5, ?6, ?7, ?8)",
+            params![row.0, row.1, row.2, row.3, row.4, row.5, row.6, row.7],
+        )?;
+        Ok(())
+    })
+    .await;
+    match stored {
+        Ok(Ok(())) => {}
+        Ok(Err(e)) => debug_log(&format!("error: cannot record usage: {:#}", e)),
+        Err(e) => debug_log(&format!("error: cannot record usage: {}", e)),
+    }
+}
+
+// Adds a chat's new messages to the mirror, inside the index's
+// transaction, numbered on from `first`. Replies take their model and cost
+// from the usage log.
+pub fn store(conn: &Connection, path: &str, first: usize, entries: &[index::Entry]) -> Result<()> {
+    let mut insert = conn.prepare(
+        "INSERT OR REPLACE INTO chat_messages (path, position, line, role, content, sent_at, tokens, model, cost)
+         VALUES (?1, ?2, ?3, ?4, ?5, ?6, ?7,
+             (SELECT model FROM requests WHERE path = ?1 AND reply_hash = ?8 ORDER BY id DESC LIMIT 1),
+             (SELECT cost FROM requests WHERE path = ?1 AND reply_hash = ?8 ORDER BY id DESC LIMIT 1))",
+    )?;
+    for (position, entry) in (first..).zip(entries) {
+        let hash = (entry.role == "assistant").then(|| content_hash(&entry.content));
+        insert.execute(params![
+            path,
+            position,
+            entry.line,
+            entry.role,
+            entry.content,
+            entry.sent_at,
+            tokens::estimate_tokens(&entry.content),
+            hash
+        ])?;
+    }
+    Ok(())
+}
+
+// Replies are matched on their text, as trimmed when read back from the file
+fn content_hash(text: &str) -> String {
+    let digest = sha1_smol::Sha1::from(text.trim()).digest().bytes();
+    digest.iter().map(|b| format!("{:02x}", b)).collect()
+}
@@ -0,0 +1,119 @@
+use crate::{logging::debug_log, otel, subprocess, Message};
+use anyhow::{bail, Context, Result};
+use std::{path::Path, time::Duration};
+
+// Commands run after each reply, one per line
+pub const POST_RESPONSE_ENV: &str = "CHAT_POST_RESPONSE_HOOK";
+// Commands that may rewrite each request before it is sent, one per line
+pub const PRE_SEND_ENV: &str = "CHAT_PRE_SEND_HOOK";
+const TIMEOUT: Duration = Duration::from_secs(60);
+
+// What a hook is told about the exchange, as CHAT_* variables
+pub struct Exchange<'a> {
+    pub chat: &'a Path,
+    pub model: &'a str,
+    pub persona: Option<&'a str>,
+    pub question: &'a str,
+    pub sent_at: &'a str,
+}
+
+impl Exchange<'_> {
+    fn vars(&self) -> Vec<(&'static str, String)> {
+        vec![
+            ("CHAT_FILE", absolute(self.chat)),
+            ("CHAT_MODEL", self.model.to_string()),
+            ("CHAT_PERSONA", self.persona.unwrap_or_default().to_string()),
+            ("CHAT_QUESTION", self.question.to_string()),
+            ("CHAT_SENT_AT", self.sent_at.to_string()),
+        ]
+    }
+}
+
+pub fn commands(var: &str) -> Vec<String> {
+    std::env::var(var)
+        .unwrap_or_default()
+        .lines()
+        .map(str::trim)
+        .filter(|c| !c.is_empty())
+        .map(str::to_string)
+        .collect()
+}
+
+// Runs each post-response command with the reply on stdin. A failing hook
+// is logged and the others still run.
+pub async fn post_response(reply: &str, exchange: &Exchange<'_>) {
+    for command in commands(POST_RESPONSE_ENV) {
+        match run(&command, reply, exchange.chat, &exchange.vars()).await {
+            Ok(output) => debug_log(&format!("call: post-response hook {:?} ran{}", command, shown(&output))),
+            Err(e) => debug_log(&format!("error: post-response hook {:?}: {:#}", command, e)),
+        }
+    }
+}
+
+// Passes the messages about to be sent through each pre-send command in
+// turn, as a JSON array of {role, content} on stdin. A command prints the
+// array to send instead, or nothing to leave it as it is. A failing command
+// stops the request, since it may have been there to redact something.
+pub async fn pre_send(mut messages: Vec<Message>, chat: &Path, model: &str, persona: Option<&str>) -> Result<Vec<Message>> {
+    let vars = [
+        ("CHAT_FILE", absolute(chat)),
+        ("CHAT_MODEL", model.to_string()),
+        ("CHAT_PERSONA", persona.unwrap_or_default().to_string()),
+    ];
+    for command in commands(PRE_SEND_ENV) {
+        let mut span = otel::span("pre_send_hook");
+        span.attr("command", command.as_str());
+        let input = serde_json::to_string(&messages)?;
+        let output = run(&command, &input, chat, &vars)
+            .await
+            .with_context(|| format!("pre-send hook {:?} failed, so nothing was sent", command))?;
+        if output.is_empty() {
+            continue;
+        }
+        let rewritten: Vec<Message> = serde_json::from_str(&output)
+            .with_context(|| format!("pre-send hook {:?} printed something other than a message array", command))?;
+        debug_log(&format!(
+            "call: pre-send hook {:?} rewrote the request ({} messages, now {})",
+            command,
+            messages.len(),
+            rewritten.len()
+        ));
+        messages = rewritten;
+    }
+    Ok(messages)
+}
+
+fn absolute(chat: &Path) -> String {
+    chat.canonicalize().unwrap_or_else(|_| chat.to_path_buf()).display().to_string()
+}
+
+// `command` under the shell in the chat's directory, with `input` on stdin
+// and `vars` set; returns what it printed
+async fn run(command: &str, input: &str, chat: &Path, vars: &[(&str, String)]) -> Result<String> {
+    let dir = chat.parent().filter(|d| !d.as_os_str().is_empty()).unwrap_or(Path::new("."));
+    let mut shell = match cfg!(windows) {
+        true => tokio::process::Command::new("cmd"),
+        false => tokio::process::Command::new("sh"),
+    };
+    shell
+        .arg(if cfg!(windows) { "/C" } else { "-c" })
+        .arg(command)
+        .current_dir(dir)
+        .envs(vars.iter().map(|(name, value)| (*name, value)));
+    let output = subprocess::output(&mut shell, input.as_bytes(), TIMEOUT).await?;
+    if !output.status.success() {
+        let stderr = String::from_utf8_lossy(&output.stderr);
+        match stderr.trim() {
+            "" => bail!("{}", output.status),
+            stderr => bail!("{}: {}", output.status, stderr),
+        }
+    }
+    Ok(String::from_utf8_lossy(&output.stdout).trim().to_string())
+}
+
+fn shown(output: &str) -> String {
+    match output.lines().next() {
+        Some(first) => format!(": {}", first),
+        None => String::new(),
+    }
+}
@@ -0,0 +1,488 @@
+use crate::debug_log;
+use anyhow::{Context, Result};
+use std::{collections::HashMap, future::Future, time::Duration};
+use tokio::{
+    io::{AsyncBufReadExt, AsyncReadExt, AsyncWriteExt, BufReader},
+    net::{
+        tcp::{OwnedReadHalf, OwnedWriteHalf},
+        TcpListener, TcpStream,
+    },
+    sync::mpsc,
+};
+
+// Enough for any header block or chat message a browser or script sends
+const MAX_HEAD_BYTES: usize = 64 * 1024;
+const MAX_BODY_BYTES: usize = 4 * 1024 * 1024;
+const KEEPALIVE: Duration = Duration::from_secs(15);
+// For the whole request to arrive, so idle connections don't pile up
+const REQUEST_TIMEOUT: Duration = Duration::from_secs(30);
+// Where a browser keeps the token once a link with `?token=` was opened
+const TOKEN_COOKIE: &str = "chatmd_token";
+
+const WEBSOCKET_GUID: &str = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11";
+const OPCODE_TEXT: u8 = 0x1;
+const OPCODE_CLOSE: u8 = 0x8;
+const OPCODE_PING: u8 = 0x9;
+const OPCODE_PONG: u8 = 0xa;
+
+// A deliberately small HTTP/1.1 server for the local web UI and API: one
+// request per connection, no TLS, bound to localhost unless told otherwise
+pub struct Request {
+    pub method: String,
+    pub path: String,
+    pub query: HashMap<String, String>,
+    headers: Vec<(String, String)>,
+    pub body: Vec<u8>,
+}
+
+impl Request {
+    pub fn header(&self, name: &str) -> Option<&str> {
+        self.headers
+            .iter()
+            .find(|(key, _)| key.eq_ignore_ascii_case(name))
+            .map(|(_, value)| value.as_str())
+    }
+
+    // An `application/x-www-form-urlencoded` body, as an HTML form posts it
+    pub fn form(&self) -> HashMap<String, String> {
+        parse_query(&String::from_utf8_lossy(&self.body))
+    }
+
+    // The media type alone, without parameters such as charset
+    pub fn content_type(&self) -> &str {
+        self.header("Content-Type")
+            .and_then(|v| v.split(';').next())
+            .unwrap_or_default()
+            .trim()
+    }
+
+    pub fn cookie(&self, name: &str) -> Option<&str> {
+        self.header("Cookie")?
+            .split(';')
+            .filter_map(|pair| pair.trim().split_once('='))
+            .find(|(key, _)| *key == name)
+            .map(|(_, value)| value)
+    }
+
+    // The Host header names this machine: localhost, an IP address, or one
+    // of `names`. A page on some other domain that resolves to 127.0.0.1
+    // (DNS rebinding) still sends its own name, and is refused.
+    pub fn local_host(&self, names: &[String]) -> bool {
+        let Some(host) = self.header("Host") else {
+            return false;
+        };
+        let name = match host.strip_prefix('[') {
+            Some(rest) => rest.split(']').next().unwrap_or_default(),
+            None => host.rsplit_once(':').map_or(host, |(name, _)| name),
+        };
+        name.eq_ignore_ascii_case("localhost")
+            || name.parse::<std::net::IpAddr>().is_ok()
+            || names.iter().any(|n| n.eq_ignore_ascii_case(name))
+    }
+
+    // Browsers say which page a request comes from; scripts usually don't.
+    // Anything sent from another site's page is refused.
+    pub fn same_origin(&self) -> bool {
+        match (self.header("Origin"), self.header("Host")) {
+            (None, _) => true,
+            (Some(origin), Some(host)) => ["http://", "https://"]
+                .iter()
+                .any(|scheme| origin.strip_prefix(scheme).is_some_and(|rest| rest.eq_ignore_ascii_case(host))),
+            (Some(_), None) => false,
+        }
+    }
+
+    // `Authorization: Bearer <token>`, the token cookie or a `token` form
+    // field matches `token`
+    pub fn has_token(&self, token: &str) -> bool {
+        let given = match self.header("Authorization").and_then(|v| v.strip_prefix("Bearer ")) {
+            Some(given) => given.trim().to_string(),
+            None => match self.cookie(TOKEN_COOKIE) {
+                Some(given) => given.to_string(),
+                None => self.form().remove("token").unwrap_or_default(),
+            },
+        };
+        same_token(&given, token)
+    }
+}
+
+// Compared in full every time, so timing gives nothing away
+pub fn same_token(given: &str, token: &str) -> bool {
+    given.len() == token.len() && given.bytes().zip(token.bytes()).fold(0, |diff, (a, b)| diff | (a ^ b)) == 0
+}
+
+// 128 random bits as hex, for tokens that must not be guessed: from the OS
+// where it has a device for them, else from the standard library's hasher
+// keys, which are seeded from the OS too
+pub fn random_token() -> String {
+    use std::{
+        hash::{BuildHasher, Hasher},
+        io::Read,
+    };
+
+    let mut bytes = [0u8; 16];
+    let read = std::fs::File::open("/dev/urandom").and_then(|mut f| f.read_exact(&mut bytes));
+    if read.is_err() {
+        for chunk in bytes.chunks_mut(8) {
+            let mut hasher = std::collections::hash_map::RandomState::new().build_hasher();
+            hasher.write_u128(std::time::SystemTime::now().duration_since(std::time::UNIX_EPOCH).map_or(0, |d| d.as_nanos()));
+            chunk.copy_from_slice(&hasher.finish().to_le_bytes());
+        }
+    }
+    bytes.iter().map(|b| format!("{:02x}", b)).collect()
+}
+
+pub enum Reply {
+    Full(Response),
+    // Server-sent events: each string received is sent as one event, until
+    // the sender is dropped or the client goes away
+    Events(mpsc::Receiver<String>),
+    // Switches to a WebSocket (`key` is the client's Sec-WebSocket-Key)
+    // and sends each string received as a text message
+    WebSocket { key: String, events: mpsc::Receiver<String> },
+}
+
+pub struct Response {
+    status: u16,
+    content_type: &'static str,
+    headers: Vec<(&'static str, String)>,
+    body: Vec<u8>,
+}
+
+impl Response {
+    pub fn new(status: u16, content_type: &'static str, body: impl Into<Vec<u8>>) -> Self {
+        Self {
+            status,
+            content_type,
+            headers: Vec::new(),
+            body: body.into(),
+        }
+    }
+
+    pub fn html(body: impl Into<Vec<u8>>) -> Self {
+        Self::new(200, "text/html; charset=utf-8", body)
+    }
+
+    pub fn json(status: u16, value: &serde_json::Value) -> Self {
+        Self::new(status, "application/json", value.to_string())
+    }
+
+    pub fn text(status: u16, body: impl Into<Vec<u8>>) -> Self {
+        Self::new(status, "text/plain; charset=utf-8", body)
+    }
+
+    pub fn not_found() -> Self {
+        Self::text(404, "not found\n")
+    }
+
+    pub fn redirect(location: &str) -> Self {
+        let mut response = Self::new(303, "text/plain; charset=utf-8", "");
+        response.headers.push(("Location", location.to_string()));
+        response
+    }
+
+    // Sends the browser on to `location`, keeping `token` in a cookie that
+    // only this site's own requests carry
+    pub fn remember_token(location: &str, token: &str) -> Self {
+        let mut response = Self::redirect(location);
+        response
+            .headers
+            .push(("Set-Cookie", format!("{}={}; Path=/; HttpOnly; SameSite=Strict", TOKEN_COOKIE, token)));
+        response
+    }
+}
+
+impl From<Response> for Reply {
+    fn from(response: Response) -> Self {
+        Reply::Full(response)
+    }
+}
+
+// `:8080` listens on localhost only; give a host (`0.0.0.0:8080`) to accept
+// other machines
+pub async fn bind(addr: &str) -> Result<TcpListener> {
+    let addr = match addr.strip_prefix(':') {
+        Some(port) => format!("127.0.0.1:{}", port),
+        None => addr.to_string(),
+    };
+    TcpListener::bind(&addr).await.with_context(|| format!("cannot listen on {}", addr))
+}
+
+// Answers every connection on `listener` with `handler`, each on its own task
+pub async fn serve<H, F>(listener: TcpListener, handler: H)
+where
+    H: Fn(Request) -> F + Clone + Send + Sync + 'static,
+    F: Future<Output = Reply> + Send,
+{
+    loop {
+        let (stream, _) = match listener.accept().await {
+            Ok(accepted) => accepted,
+            Err(e) => {
+                debug_log(&format!("error: cannot accept a connection: {}", e));
+                continue;
+            }
+        };
+        let handler = handler.clone();
+        tokio::spawn(async move {
+            if let Err(e) = handle(stream, handler).await {
+                debug_log(&format!("skip: connection dropped: {}", e));
+            }
+        });
+    }
+}
+
+async fn handle<H, F>(stream: TcpStream, handler: H) -> Result<()>
+where
+    H: Fn(Request) -> F,
+    F: Future<Output = Reply>,
+{
+    let mut reader = BufReader::new(stream);
+    let request = tokio::time::timeout(REQUEST_TIMEOUT, read_request(&mut reader))
+        .await
+        .with_context(|| format!("no complete request within {}s", REQUEST_TIMEOUT.as_secs()))??;
+    let request = match request {
+        Some(request) => request,
+        None => return Ok(()),
+    };
+    // Clients wait for the response before sending more
+    let mut stream = reader.into_inner();
+
+    match handler(request).await {
+        Reply::Full(response) => write_response(&mut stream, response).await,
+        Reply::WebSocket { key, events } => websocket(stream, &key, events).await,
+        Reply::Events(mut events) => {
+            stream
+                .write_all(b"HTTP/1.1 200 OK\r\nContent-Type: text/event-stream\r\nCache-Control: no-cache\r\nConnection: close\r\n\r\n")
+                .await?;
+            loop {
+                // A comment now and then, so a closed tab is noticed even
+                // when nothing changes
+                let frame = match tokio::time::timeout(KEEPALIVE, events.recv()).await {
+                    Ok(Some(event)) => {
+                        let mut frame: String = event.lines().map(|line| format!("data: {}\n", line)).collect();
+                        frame.push('\n');
+                        frame
+                    }
+                    Ok(None) => return Ok(()),
+                    Err(_) => ":\n\n".to_string(),
+                };
+                stream.write_all(frame.as_bytes()).await?;
+            }
+        }
+    }
+}
+
+async fn read_request(stream: &mut BufReader<TcpStream>) -> Result<Option<Request>> {
+    let mut head = Vec::new();
+    loop {
+        let read = stream.read_until(b'\n', &mut head).await?;
+        if read == 0 {
+            return Ok(None);
+        }
+        if head.ends_with(b"\r\n\r\n") || head.ends_with(b"\n\n") {
+            break;
+        }
+        if head.len() > MAX_HEAD_BYTES {
+            anyhow::bail!("request head too large");
+        }
+    }
+
+    let head = String::from_utf8_lossy(&head);
+    let mut lines = head.lines();
+    let mut request_line = lines.next().unwrap_or_default().split_whitespace();
+    let method = request_line.next().unwrap_or_default().to_string();
+    let target = request_line.next().unwrap_or("/");
+    let (path, query) = target.split_once('?').unwrap_or((target, ""));
+    let headers: Vec<(String, String)> = lines
+        .filter_map(|line| line.split_once(':'))
+        .map(|(key, value)| (key.trim().to_string(), value.trim().to_string()))
+        .collect();
+
+    let mut request = Request {
+        method,
+        path: percent_decode(path),
+        query: parse_query(query),
+        headers,
+        body: Vec::new(),
+    };
+    let length: usize = request.header("Content-Length").and_then(|v| v.parse().ok()).unwrap_or(0);
+    if length > MAX_BODY_BYTES {
+        anyhow::bail!("request body too large");
+    }
+    request.body.resize(length, 0);
+    stream.read_exact(&mut request.body).await?;
+    Ok(Some(request))
+}
+
+async fn websocket(stream: TcpStream, key: &str, mut events: mpsc::Receiver<String>) -> Result<()> {
+    use base64::Engine;
+
+    let digest = sha1_smol::Sha1::from(format!("{}{}", key, WEBSOCKET_GUID)).digest().bytes();
+    let accept = base64::engine::general_purpose::STANDARD.encode(digest);
+    let (mut reader, mut writer) = stream.into_split();
+    writer
+        .write_all(
+            format!(
+                "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: {}\r\n\r\n",
+                accept
+            )
+            .as_bytes(),
+        )
+        .await?;
+
+    // Clients here only listen, so all that is read is pings, answered with
+    // pongs, and the closing handshake. Reads happen on their own task,
+    // since a frame read half way can't be abandoned for a write.
+    let (control_tx, mut control) = mpsc::channel(4);
+    tokio::spawn(async move {
+        while let Ok((opcode, payload)) = read_frame(&mut reader).await {
+            let reply = match opcode {
+                OPCODE_PING => OPCODE_PONG,
+                OPCODE_CLOSE => OPCODE_CLOSE,
+                _ => continue,
+            };
+            if control_tx.send((reply, payload)).await.is_err() || reply == OPCODE_CLOSE {
+                break;
+            }
+        }
+    });
+
+    loop {
+        let (opcode, payload) = tokio::select! {
+            event = events.recv() => match event {
+                Some(text) => (OPCODE_TEXT, text.into_bytes()),
+                None => (OPCODE_CLOSE, Vec::new()),
+            },
+            frame = control.recv() => match frame {
+                Some(frame) => frame,
+                // The connection is gone
+                None => return Ok(()),
+            },
+        };
+        write_frame(&mut writer, opcode, &payload).await?;
+        if opcode == OPCODE_CLOSE {
+            return Ok(());
+        }
+    }
+}
+
+async fn read_frame(reader: &mut OwnedReadHalf) -> std::io::Result<(u8, Vec<u8>)> {
+    let mut head = [0u8; 2];
+    reader.read_exact(&mut head).await?;
+    let opcode = head[0] & 0x0f;
+    let len = match head[1] & 0x7f {
+        126 => reader.read_u16().await? as u64,
+        127 => reader.read_u64().await?,
+        len => len as u64,
+    };
+    if len > MAX_BODY_BYTES as u64 {
+        return Err(std::io::Error::new(std::io::ErrorKind::InvalidData, "frame too large"));
+    }
+    // Frames from clients are always masked
+    let mut mask = [0u8; 4];
+    if head[1] & 0x80 != 0 {
+        reader.read_exact(&mut mask).await?;
+    }
+    let mut payload = vec![0; len as usize];
+    reader.read_exact(&mut payload).await?;
+    for (i, byte) in payload.iter_mut().enumerate() {
+        *byte ^= mask[i % 4];
+    }
+    Ok((opcode, payload))
+}
+
+async fn write_frame(writer: &mut OwnedWriteHalf, opcode: u8, payload: &[u8]) -> std::io::Result<()> {
+    let mut frame = vec![0x80 | opcode];
+    match payload.len() {
+        len if len < 126 => frame.push(len as u8),
+        len if len <= u16::MAX as usize => {
+            frame.push(126);
+            frame.extend_from_slice(&(len as u16).to_be_bytes());
+        }
+        len => {
+            frame.push(127);
+            frame.extend_from_slice(&(len as u64).to_be_bytes());
+        }
+    }
+    frame.extend_from_slice(payload);
+    writer.write_all(&frame).await
+}
+
+async fn write_response(stream: &mut TcpStream, response: Response) -> Result<()> {
+    let mut head = format!(
+        "HTTP/1.1 {} {}\r\nContent-Type: {}\r\nContent-Length: {}\r\nConnection: close\r\n",
+        response.status,
+        reason(response.status),
+        response.content_type,
+        response.body.len()
+    );
+    for (name, value) in &response.headers {
+        head.push_str(&format!("{}: {}\r\n", name, value));
+    }
+    head.push_str("\r\n");
+    stream.write_all(head.as_bytes()).await?;
+    stream.write_all(&response.body).await?;
+    stream.flush().await?;
+    Ok(())
+}
+
+fn reason(status: u16) -> &'static str {
+    match status {
+        200 => "OK",
+        201 => "Created",
+        202 => "Accepted",
+        303 => "See Other",
+        400 => "Bad Request",
+        401 => "Unauthorized",
+        403 => "Forbidden",
+        404 => "Not Found",
+        405 => "Method Not Allowed",
+        409 => "Conflict",
+        415 => "Unsupported Media Type",
+        500 => "Internal Server Error",
+        503 => "Service Unavailable",
+        504 => "Gateway Timeout",
+        _ => "",
+    }
+}
+
+fn parse_query(query: &str) -> HashMap<String, String> {
+    query
+        .split('&')
+        .filter(|pair| !pair.is_empty())
+        .map(|pair| {
+            let (key, value) = pair.split_once('=').unwrap_or((pair, ""));
+            (percent_decode(&key.replace('+', " ")), percent_decode(&value.replace('+', " ")))
+        })
+        .collect()
+}
+
+pub fn percent_decode(text: &str) -> String {
+    let bytes = text.as_bytes();
+    let mut out = Vec::with_capacity(bytes.len());
+    let mut i = 0;
+    while i < bytes.len() {
+        let hex = bytes.get(i + 1..i + 3).and_then(|h| std::str::from_utf8(h).ok());
+        match (bytes[i], hex.and_then(|h| u8::from_str_radix(h, 16).ok())) {
+            (b'%', Some(byte)) => {
+                out.push(byte);
+                i += 3;
+            }
+            (byte, _) => {
+                out.push(byte);
+                i += 1;
+            }
+        }
+    }
+    String::from_utf8_lossy(&out).into_owned()
+}
+
+// For chat paths in links: everything but unreserved characters and `/`
+pub fn percent_encode(text: &str) -> String {
+    text.bytes()
+        .map(|b| match b {
+            b'A'..=b'Z' | b'a'..=b'z' | b'0'..=b'9' | b'-' | b'_' | b'.' | b'~' | b'/' => (b as char).to_string(),
+            _ => format!("%{:02X}", b),
+        })
+        .collect()
+}
@@ -0,0 +1,256 @@
+use crate::{config, fmt, parser};
+use anyhow::{Context, Result};
+use serde_json::Value;
+use std::{collections::HashSet, path::PathBuf};
+use tokio::fs;
+
+const DEFAULT_OUT_DIR: &str = "imported";
+
+struct Conversation {
+    id: String,
+    title: String,
+    source: &'static str,
+    created: Option<String>,
+    // (is_user, text, timestamp)
+    messages: Vec<(bool, String, Option<String>)>,
+}
+
+// `import <export.json> [--out dir]`: converts a ChatGPT or Claude data
+// export into one chat file per conversation
+pub async fn run(args: &[String]) -> Result<()> {
+    let mut input = None;
+    let mut out_dir = PathBuf::from(DEFAULT_OUT_DIR);
+    let mut args = args.iter();
+    while let Some(arg) = args.next() {
+        match arg.as_str() {
+            "--out" | "-o" => out_dir = PathBuf::from(args.next().context("--out needs a directory")?),
+            _ => input = Some(arg.clone()),
+        }
+    }
+    let input = input.context("usage: import <conversations.json> [--out dir]")?;
+
+    let raw = fs::read_to_string(&input)
+        .await
+        .with_context(|| format!("cannot read {}", input))?;
+    let export: Value = serde_json::from_str(&raw).with_context(|| format!("{} is not JSON", input))?;
+    let conversations: Vec<Conversation> = export
+        .as_array()
+        .context("expected a list of conversations")?
+        .iter()
+        .filter_map(|c| parse_openai(c).or_else(|| parse_anthropic(c)))
+        .collect();
+
+    fs::create_dir_all(&out_dir).await?;
+    let separator = config::default_separator();
+    let mut used = HashSet::new();
+    for conversation in &conversations {
+        let mut name = slug(&conversation.title);
+        if !used.insert(name.clone()) {
+            name = format!("{}-{}", name, conversation.id.chars().take(8).collect::<String>());
+            used.insert(name.clone());
+        }
+
+        let path = out_dir.join(format!("{}.md", name));
+        fs::write(&path, render(conversation, &separator)).await?;
+        println!("imported {:?} ({} messages) -> {}", conversation.title, conversation.messages.len(), path.display());
+    }
+
+    println!("{} conversations imported into {}", conversations.len(), out_dir.display());
+    Ok(())
+}
+
+fn render(conversation: &Conversation, separator: &str) -> String {
+    let mut head = format!(
+        "---\ntitle: {}\nsource: {}\nid: {}\n",
+        config::quote(&conversation.title.replace('\n', " ")),
+        conversation.source,
+        conversation.id
+    );
+    if let Some(created) = &conversation.created {
+        head.push_str(&format!("created: {}\n", created));
+    }
+    head.push_str("---\n");
+
+    let messages = conversation.messages.iter().map(|(is_user, text, timestamp)| {
+        let text = match timestamp {
+            Some(timestamp) => format!("{}\n{}", text.trim_end(), parser::timestamp_comment(timestamp)),
+            None => text.clone(),
+        };
+        (*is_user, text)
+    });
+    format!("{}{}", head, fmt::render_body(messages, separator))
+}
+
+// ChatGPT: messages form a tree in `mapping`; follow the chosen branch from
+// `current_node` back to the root
+fn parse_openai(conversation: &Value) -> Option<Conversation> {
+    let mapping = conversation.get("mapping")?.as_object()?;
+    let mut node_id = conversation.get("current_node")?.as_str()?.to_string();
+
+    let mut messages = Vec::new();
+    let mut seen = HashSet::new();
+    while seen.insert(node_id.clone()) {
+        let Some(node) = mapping.get(&node_id) else {
+            break;
+        };
+
+        if let Some(message) = node.get("message").filter(|m| !m.is_null()) {
+            let role = message.pointer("/author/role").and_then(Value::as_str).unwrap_or_default();
+            let text = message
+                .pointer("/content/parts")
+                .and_then(Value::as_array)
+                .map(|parts| {
+                    parts
+                        .iter()
+                        .filter_map(Value::as_str)
+                        .collect::<Vec<_>>()
+                        .join("\n")
+                })
+                .unwrap_or_default();
+
+            if matches!(role, "user" | "assistant") && !text.trim().is_empty() {
+                let timestamp = message.get("create_time").and_then(Value::as_f64).and_then(epoch_to_iso);
+                messages.push((role == "user", text, timestamp));
+            }
+        }
+
+        match node.get("parent").and_then(Value::as_str) {
+            Some(parent) => node_id = parent.to_string(),
+            None => break,
+        }
+    }
+    messages.reverse();
+
+    Some(Conversation {
+        id: string_field(conversation, &["conversation_id", "id"]).unwrap_or_default(),
+        title: string_field(conversation, &["title"]).unwrap_or_else(|| "untitled".to_string()),
+        source: "chatgpt",
+        created: conversation.get("create_time").and_then(Value::as_f64).and_then(epoch_to_iso),
+        messages,
+    })
+}
+
+// Claude: a flat `chat_messages` list with `sender` human/assistant
+fn parse_anthropic(conversation: &Value) -> Option<Conversation> {
+    let chat_messages = conversation.get("chat_messages")?.as_array()?;
+
+    let messages = chat_messages
+        .iter()
+        .filter_map(|message| {
+            let is_user = match message.get("sender")?.as_str()? {
+                "human" => true,
+                "assistant" => false,
+                _ => return None,
+            };
+
+            let mut text = message.get("text").and_then(Value::as_str).unwrap_or_default().to_string();
+            if text.trim().is_empty() {
+                text = message
+                    .get("content")
+                    .and_then(Value::as_array)
+                    .map(|parts| {
+                        parts
+                            .iter()
+                            .filter(|p| p.get("type").and_then(Value::as_str) == Some("text"))
+                            .filter_map(|p| p.get("text").and_then(Value::as_str))
+                            .collect::<Vec<_>>()
+                            .join("\n")
+                    })
+                    .unwrap_or_default();
+            }
+
+            let timestamp = string_field(message, &["created_at"]);
+            Some((is_user, text, timestamp))
+        })
+        .collect();
+
+    Some(Conversation {
+        id: string_field(conversation, &["uuid", "id"]).unwrap_or_default(),
+        title: string_field(conversation, &["name", "title"])
+            .filter(|t| !t.trim().is_empty())
+            .unwrap_or_else(|| "untitled".to_string()),
+        source: "claude",
+        created: string_field(conversation, &["created_at"]),
+        messages,
+    })
+}
+
+fn string_field(value: &Value, keys: &[&str]) -> Option<String> {
+    keys.iter()
+        .find_map(|key| value.get(*key).and_then(Value::as_str))
+        .map(str::to_string)
+}
+
+fn epoch_to_iso(seconds: f64) -> Option<String> {
+    let time = chrono::DateTime::from_timestamp(seconds as i64, 0)?;
+    Some(
+        time.with_timezone(&chrono::Local)
+            .to_rfc3339_opts(chrono::SecondsFormat::Secs, false),
+    )
+}
+
+fn slug(title: &str) -> String {
+    let slug: String = title
+        .to_lowercase()
+        .chars()
+        .map(|c| if c.is_alphanumeric() { c } else { '-' })
+        .collect();
+    let slug = slug
+        .split('-')
+        .filter(|s| !s.is_empty())
+        .collect::<Vec<_>>()
+        .join("-");
+    let slug: String = slug.chars().take(60).collect();
+
+    if slug.is_empty() {
+        "untitled".to_string()
+    } else {
+        slug
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use serde_json::json;
+
+    #[test]
+    fn chatgpt_follows_the_current_branch() {
+        let export = json!({
+            "id": "c1",
+            "title": "Rust & Go",
+            "current_node": "b",
+            "mapping": {
+                "root": {"message": {"author": {"role": "system"}, "content": {"parts": ["be nice"]}}},
+                "q": {"parent": "root", "message": {"author": {"role": "user"}, "content": {"parts": ["which?"]}}},
+                "a": {"parent": "q", "message": {"author": {"role": "assistant"}, "content": {"parts": ["an abandoned answer"]}}},
+                "b": {"parent": "q", "message": {"author": {"role": "assistant"}, "content": {"parts": ["both"]}}}
+            }
+        });
+        let conversation = parse_openai(&export).unwrap();
+        assert_eq!(slug(&conversation.title), "rust-go");
+        assert_eq!(
+            render(&conversation, "***"),
+            "---\ntitle: \"Rust & Go\"\nsource: chatgpt\nid: c1\n---\nwhich?\n\n***\nboth\n\n***\n"
+        );
+    }
+
+    #[test]
+    fn claude_reads_text_or_content_parts() {
+        let export = json!({
+            "uuid": "u1",
+            "name": "",
+            "chat_messages": [
+                {"sender": "human", "text": "hi"},
+                {"sender": "assistant", "text": "", "content": [{"type": "text", "text": "hello"}, {"type": "tool_use"}]}
+            ]
+        });
+        assert!(parse_openai(&export).is_none());
+        let conversation = parse_anthropic(&export).unwrap();
+        assert_eq!(conversation.title, "untitled");
+        assert_eq!(
+            render(&conversation, "***"),
+            "---\ntitle: \"untitled\"\nsource: claude\nid: u1\n---\nhi\n\n***\nhello\n\n***\n"
+        );
+    }
+}
@@ -0,0 +1,384 @@
+use crate::{config, crypt, files, history, logging::debug_log, parser, watch, ChatContext};
+use anyhow::{Context, Result};
+use rusqlite::{params, Connection, OptionalExtension};
+use std::{
+    path::{Path, PathBuf},
+    time::{Duration, UNIX_EPOCH},
+};
+
+pub const INDEX_ENV: &str = "CHAT_INDEX";
+const DATA_FILE: &str = "chatmd/history.db";
+// Trigram tokens keep search a case-insensitive substring match, as it was
+// when every file was read line by line
+const SCHEMA: &str = "
+PRAGMA journal_mode = WAL;
+CREATE TABLE IF NOT EXISTS files (
+    path TEXT PRIMARY KEY,
+    modified INTEGER NOT NULL,
+    size INTEGER NOT NULL,
+    indexed_to INTEGER NOT NULL DEFAULT 0,
+    prefix_hash TEXT NOT NULL DEFAULT '',
+    messages INTEGER NOT NULL DEFAULT 0
+);
+CREATE VIRTUAL TABLE IF NOT EXISTS messages USING fts5(
+    text, path UNINDEXED, line UNINDEXED, role UNINDEXED, sent_at UNINDEXED,
+    tokenize = 'trigram'
+);
+";
+
+// Raised when more is stored for each chat, so every chat is read again
+const SCHEMA_VERSION: i64 = 2;
+
+// One message of a chat: the raw text as it stands in the file, and the
+// content as sent, without timestamps, traces or private notes
+#[derive(Debug, Clone)]
+pub struct Entry {
+    pub path: PathBuf,
+    // Of the message's first line, counting from 1
+    pub line: usize,
+    pub role: String,
+    pub sent_at: Option<String>,
+    pub text: String,
+    pub content: String,
+}
+
+// CHAT_INDEX, or $XDG_DATA_HOME/chatmd/history.db; None when CHAT_INDEX is
+// `off`
+pub fn path() -> Option<PathBuf> {
+    if let Some(value) = std::env::var(INDEX_ENV).ok().filter(|v| !v.trim().is_empty()) {
+        return match config::parse_bool(&value) {
+            Some(false) => None,
+            Some(true) => default_path(),
+            None => Some(watch::expand_home(value.trim())),
+        };
+    }
+    default_path()
+}
+
+fn default_path() -> Option<PathBuf> {
+    std::env::var_os("XDG_DATA_HOME")
+        .map(PathBuf::from)
+        .or_else(|| std::env::var_os("HOME").map(|home| PathBuf::from(home).join(".local/share")))
+        .map(|dir| dir.join(DATA_FILE))
+}
+
+pub fn open() -> Result<Connection> {
+    let path = path().context("the index is turned off")?;
+    if let Some(dir) = path.parent() {
+        std::fs::create_dir_all(dir).with_context(|| format!("cannot create {}", dir.display()))?;
+    }
+    let conn = Connection::open(&path).with_context(|| format!("cannot open {}", path.display()))?;
+    // The watcher and a search may both want it
+    conn.busy_timeout(Duration::from_secs(5))?;
+    conn.execute_batch(SCHEMA)?;
+    conn.execute_batch(history::SCHEMA)?;
+    let version: i64 = conn.query_row("PRAGMA user_version", params![], |row| row.get(0))?;
+    if version < SCHEMA_VERSION {
+        // `files` may lack columns added since, so it is made again
+        conn.execute_batch("DROP TABLE files; DELETE FROM messages; DELETE FROM chat_messages;")?;
+        conn.execute_batch(SCHEMA)?;
+        conn.execute_batch(&format!("PRAGMA user_version = {};", SCHEMA_VERSION))?;
+    }
+    Ok(conn)
+}
+
+// Every message in a chat's content
+pub fn entries(path: &Path, content: &str) -> Vec<Entry> {
+    let chat_context = ChatContext::new(path.to_path_buf(), content.to_string());
+    let body = &content[chat_context.body_start..];
+    chat_context
+        .parse_parts(body)
+        .into_iter()
+        .map(|(range, message)| {
+            let start = chat_context.body_start + range.start;
+            Entry {
+                path: path.to_path_buf(),
+                line: content[..start].matches('\n').count() + 1,
+                role: message.role,
+                sent_at: message.timestamp,
+                text: content[start..chat_context.body_start + range.end].to_string(),
+                content: parser::strip_private(&message.content),
+            }
+        })
+        .collect()
+}
+
+// How much of a chat the index holds: everything before `to`, a content
+// offset just past the separator that closes a reply, and `hash` of it
+#[derive(Debug, Default)]
+struct Indexed {
+    to: usize,
+    hash: String,
+    messages: usize,
+}
+
+// What the index lacks of a chat: the messages of exchanges finished since
+// it was last indexed, and whether the rows it has must go first because
+// something before them changed
+struct Addition {
+    rebuild: bool,
+    // Position of the first new message in the chat
+    first: usize,
+    entries: Vec<Entry>,
+    indexed: Indexed,
+}
+
+// Adds a chat's newly finished exchanges to the index; called by the
+// watcher on every change, so searches only read files changed while it
+// wasn't running. Only the text after what is already indexed is parsed,
+// and nothing is written until another exchange is finished.
+pub async fn update(chat_context: &ChatContext, content: &str) {
+    if self::path().is_none() || crypt::scheme(&chat_context.path).is_some() {
+        return;
+    }
+    let path = chat_context.path.canonicalize().unwrap_or_else(|_| chat_context.path.clone());
+    let key = path.to_string_lossy().into_owned();
+    let updated = async {
+        let known = tokio::task::spawn_blocking(move || progress(&open()?, &key)).await??;
+        let addition = addition(chat_context, &path, content, known);
+        if addition.rebuild || !addition.entries.is_empty() {
+            tokio::task::spawn_blocking(move || store(&mut open()?, &path, &addition)).await??;
+        }
+        anyhow::Ok(())
+    };
+    if let Err(e) = updated.await {
+        debug_log(&format!("error: cannot update the index: {:#}", e));
+    }
+}
+
+fn progress(conn: &Connection, key: &str) -> Result<Option<Indexed>> {
+    let found = conn
+        .query_row(
+            "SELECT indexed_to, prefix_hash, messages FROM files WHERE path = ?1",
+            params![key],
+            |row| {
+                Ok(Indexed {
+                    to: row.get(0)?,
+                    hash: row.get(1)?,
+                    messages: row.get(2)?,
+                })
+            },
+        )
+        .optional()?;
+    Ok(found)
+}
+
+fn addition(chat_context: &ChatContext, path: &Path, content: &str, known: Option<Indexed>) -> Addition {
+    let kept = known.filter(|known| {
+        known.to >= chat_context.body_start && content.get(..known.to).is_some_and(|prefix| prefix_hash(prefix) == known.hash)
+    });
+    let rebuild = kept.is_none();
+    let kept = kept.unwrap_or(Indexed {
+        to: chat_context.body_start,
+        ..Indexed::default()
+    });
+    let (to, entries) = finished_entries(chat_context, path, content, kept.to);
+    Addition {
+        rebuild,
+        first: kept.messages,
+        indexed: Indexed {
+            to,
+            hash: prefix_hash(&content[..to]),
+            messages: kept.messages + entries.len(),
+        },
+        entries,
+    }
+}
+
+// The messages from `from`, where a user message starts, to the end of the
+// last reply that is followed by a separator, and the offset of that end.
+// A reply still being written, or the message waiting for one, isn't
+// finished.
+fn finished_entries(chat_context: &ChatContext, path: &Path, content: &str, from: usize) -> (usize, Vec<Entry>) {
+    let tail = &content[from..];
+    let ranges = parser::split_unfenced_ranges(tail, &chat_context.separator);
+    // Replies are the odd parts; the part after one starts past its separator
+    let Some(end) = (1..ranges.len()).step_by(2).filter(|&i| i + 1 < ranges.len()).last().map(|i| ranges[i + 1].start) else {
+        return (from, Vec::new());
+    };
+
+    let mut line = content[..from].matches('\n').count() + 1;
+    let mut counted = 0;
+    let entries = chat_context
+        .parse_parts(&tail[..end])
+        .into_iter()
+        .map(|(range, message)| {
+            line += tail[counted..range.start].matches('\n').count();
+            counted = range.start;
+            Entry {
+                path: path.to_path_buf(),
+                line,
+                role: message.role,
+                sent_at: message.timestamp,
+                text: tail[range].to_string(),
+                content: parser::strip_private(&message.content),
+            }
+        })
+        .collect();
+    (from + end, entries)
+}
+
+fn prefix_hash(prefix: &str) -> String {
+    sha1_smol::Sha1::from(prefix).digest().to_string()
+}
+
+fn store(conn: &mut Connection, path: &Path, addition: &Addition) -> Result<()> {
+    let key = path.to_string_lossy().into_owned();
+    let (modified, size) = stat(path).unwrap_or((0, 0));
+    let tx = conn.transaction()?;
+    if addition.rebuild {
+        tx.execute("DELETE FROM messages WHERE path = ?1", params![key])?;
+        tx.execute("DELETE FROM chat_messages WHERE path = ?1", params![key])?;
+    }
+    for entry in &addition.entries {
+        tx.execute(
+            "INSERT INTO messages (text, path, line, role, sent_at) VALUES (?1, ?2, ?3, ?4, ?5)",
+            params![entry.text, key, entry.line, entry.role, entry.sent_at],
+        )?;
+    }
+    let indexed = &addition.indexed;
+    tx.execute(
+        "INSERT INTO files (path, modified, size, indexed_to, prefix_hash, messages) VALUES (?1, ?2, ?3, ?4, ?5, ?6)
+         ON CONFLICT (path) DO UPDATE SET modified = excluded.modified, size = excluded.size,
+             indexed_to = excluded.indexed_to, prefix_hash = excluded.prefix_hash, messages = excluded.messages",
+        params![key, modified, size, indexed.to, indexed.hash, indexed.messages],
+    )?;
+    history::store(&tx, &key, addition.first, &addition.entries)?;
+    tx.commit()?;
+    Ok(())
+}
+
+// Modification time (ms) and size, which say whether a file changed since
+// it was indexed
+fn stat(path: &Path) -> Option<(i64, i64)> {
+    let metadata = std::fs::metadata(path).ok()?;
+    let modified = metadata.modified().ok()?.duration_since(UNIX_EPOCH).ok()?.as_millis() as i64;
+    Some((modified, metadata.len() as i64))
+}
+
+// Reindexes whichever of `paths` changed since they were indexed, and
+// drops files that are gone. Returns how many were reindexed.
+pub async fn refresh(paths: &[PathBuf]) -> Result<usize> {
+    let paths = paths.to_vec();
+    let stale = tokio::task::spawn_blocking(move || changed(&mut open()?, &paths)).await??;
+
+    let mut additions = Vec::new();
+    for (path, known) in stale {
+        // Read as the watcher reads it, so offsets and hashes agree
+        let Ok(content) = files::read_chat(&path).await else {
+            continue;
+        };
+        let chat_context = ChatContext::new(path.clone(), content.clone());
+        let addition = addition(&chat_context, &path, &content, known);
+        additions.push((path, addition));
+    }
+    let reindexed = additions.len();
+    tokio::task::spawn_blocking(move || -> Result<()> {
+        let mut conn = open()?;
+        for (path, addition) in &additions {
+            store(&mut conn, path, addition)?;
+        }
+        Ok(())
+    })
+    .await??;
+    Ok(reindexed)
+}
+
+// Which of `paths` changed since they were indexed, with what the index
+// holds of each; files that are gone are dropped on the way
+fn changed(conn: &mut Connection, paths: &[PathBuf]) -> Result<Vec<(PathBuf, Option<Indexed>)>> {
+    let mut changed = Vec::new();
+    for path in paths {
+        let path = path.canonicalize().unwrap_or_else(|_| path.clone());
+        // The index isn't encrypted, so encrypted chats stay out of it
+        if crypt::scheme(&path).is_some() {
+            continue;
+        }
+        let Some(now) = stat(&path) else {
+            continue;
+        };
+        let seen: Option<(i64, i64)> = conn
+            .query_row(
+                "SELECT modified, size FROM files WHERE path = ?1",
+                params![path.to_string_lossy().into_owned()],
+                |row| Ok((row.get(0)?, row.get(1)?)),
+            )
+            .optional()?;
+        if seen == Some(now) {
+            continue;
+        }
+        let known = progress(conn, &path.to_string_lossy())?;
+        changed.push((path, known));
+    }
+
+    let gone: Vec<String> = {
+        let mut statement = conn.prepare("SELECT path FROM files")?;
+        let rows = statement.query_map(params![], |row| row.get::<_, String>(0))?;
+        rows.filter_map(|row| row.ok()).filter(|path| !Path::new(path).exists()).collect()
+    };
+    for path in gone {
+        conn.execute("DELETE FROM messages WHERE path = ?1", params![path])?;
+        conn.execute("DELETE FROM files WHERE path = ?1", params![path])?;
+        conn.execute("DELETE FROM chat_messages WHERE path = ?1", params![path])?;
+    }
+    Ok(changed)
+}
+
+// Messages in `paths` containing `query`, case-insensitively, in file and
+// line order
+pub fn search(conn: &Connection, query: &str, paths: &[PathBuf]) -> Result<Vec<Entry>> {
+    // Trigrams need three characters; shorter queries scan instead
+    let (sql, term) = match query.chars().count() >= 3 {
+        true => ("SELECT path, line, role, sent_at, text FROM messages WHERE messages MATCH ?1", format!("\"{}\"", query.replace('"', "\"\""))),
+        false => ("SELECT path, line, role, sent_at, text FROM messages WHERE instr(lower(text), lower(?1)) > 0", query.to_string()),
+    };
+    // Found by their real paths, shown by the names they were given
+    let given: Vec<(PathBuf, &PathBuf)> = paths.iter().map(|p| (p.canonicalize().unwrap_or_else(|_| p.clone()), p)).collect();
+    let mut statement = conn.prepare(sql)?;
+    let rows = statement.query_map(params![term], |row| {
+        Ok(Entry {
+            path: PathBuf::from(row.get::<_, String>(0)?),
+            line: row.get(1)?,
+            role: row.get(2)?,
+            sent_at: row.get(3)?,
+            text: row.get(4)?,
+            content: String::new(),
+        })
+    })?;
+    let mut found = Vec::new();
+    for entry in rows {
+        let entry = entry?;
+        if let Some(at) = given.iter().position(|(real, _)| *real == entry.path) {
+            found.push((at, Entry { path: given[at].1.clone(), ..entry }));
+        }
+    }
+    found.sort_by_key(|(at, entry)| (*at, entry.line));
+    Ok(found.into_iter().map(|(_, entry)| entry).collect())
+}
+
+// `index [targets...] [--rebuild]`: brings the index up to date for the
+// chats the targets name, as the watcher would have
+pub async fn run(args: &[String]) -> Result<()> {
+    let rebuild = args.iter().any(|a| a == "--rebuild");
+    let targets: Vec<String> = args.iter().filter(|a| *a != "--rebuild").cloned().collect();
+    let include = watch::env_list(watch::INCLUDE_ENV);
+    let exclude = watch::env_list(watch::EXCLUDE_ENV);
+    let paths = watch::WatchSet::from_args(&targets, include, exclude)?.files();
+    let db = path().context("the index is turned off (CHAT_INDEX)")?;
+
+    if rebuild {
+        tokio::task::spawn_blocking(|| -> Result<()> {
+            // The usage log is kept; it can't be rebuilt from the chats
+            open()?.execute_batch("DELETE FROM messages; DELETE FROM files; DELETE FROM chat_messages;")?;
+            Ok(())
+        })
+        .await??;
+    }
+    let reindexed = refresh(&paths).await?;
+    let messages: i64 = tokio::task::spawn_blocking(|| -> Result<i64> {
+        Ok(open()?.query_row("SELECT count(*) FROM messages", params![], |row| row.get(0))?)
+    })
+    .await??;
+    println!("{}: {} chat(s) indexed now, {} message(s) in all", db.display(), reindexed, messages);
+    Ok(())
+}
@@ -0,0 +1,45 @@
+use crate::files;
+use anyhow::Result;
+use serde::{Deserialize, Serialize};
+use std::path::{Path, PathBuf};
+use tokio::fs;
+
+pub const JSONL_ENV: &str = "CHAT_JSONL";
+
+// One line of the `.chat.jsonl` sidecar
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct Record {
+    pub index: usize,
+    pub role: String,
+    pub content: String,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub timestamp: Option<String>,
+    #[serde(skip_serializing_if = "Vec::is_empty", default)]
+    pub branch: Vec<String>,
+}
+
+// chat.md -> chat.chat.jsonl, notes.chat.md -> notes.chat.jsonl
+pub fn sidecar_path(chat_file: &Path) -> PathBuf {
+    let stem = chat_file
+        .file_stem()
+        .map(|s| s.to_string_lossy().into_owned())
+        .unwrap_or_else(|| "chat".to_string());
+    let stem = stem.strip_suffix(".chat").unwrap_or(&stem);
+    chat_file.with_file_name(format!("{}.chat.jsonl", stem))
+}
+
+// The sidecar is derived from the markdown and rewritten whole, so it can
+// never drift from it
+pub async fn write(chat_file: &Path, records: &[Record]) -> Result<()> {
+    let mut out = String::new();
+    for record in records {
+        out.push_str(&serde_json::to_string(record)?);
+        out.push('\n');
+    }
+
+    let path = sidecar_path(chat_file);
+    if fs::read_to_string(&path).await.ok().as_deref() != Some(out.as_str()) {
+        files::write_atomic(&path, out).await?;
+    }
+    Ok(())
+}
@@ -0,0 +1,803 @@
+mod agent;
+mod api;
+mod archive;
+mod ask;
+mod auth;
+mod autocommit;
+mod bridge;
+mod cli;
+mod clock;
+mod commands;
+mod config;
+mod configfile;
+mod cost;
+mod crypt;
+mod daemon;
+mod discord;
+mod doctor;
+mod email;
+mod embed;
+mod envfile;
+mod expand;
+mod export;
+mod fetch;
+mod files;
+mod fmt;
+mod health;
+mod history;
+mod hooks;
+mod http;
+mod import;
+mod index;
+mod jsonl;
+mod library;
+mod live;
+mod logging;
+mod matrix;
+mod memory;
+mod merge;
+mod metrics;
+mod mock;
+mod monitor;
+mod otel;
+mod parser;
+mod pending;
+mod plugins;
+mod preview;
+mod provider;
+mod rag;
+mod reply;
+mod rpc;
+mod sandbox;
+mod schedule;
+mod search;
+mod service;
+mod shell;
+mod slack;
+mod starter;
+mod stats;
+mod status;
+mod subprocess;
+mod summary;
+mod telegram;
+#[cfg(test)]
+mod testenv;
+mod tokens;
+mod validate;
+mod vcr;
+mod watch;
+mod web;
+mod webhook;
+
+use anyhow::{Context, Result};
+use commands::Command;
+// The library's interface, for programs that embed it instead of running
+// the binary
+pub use embed::{append_message, build_request, parse_conversation, Watcher};
+pub use provider::{ChatRequest, RequestParams};
+use logging::{debug_log, LogFormat, LogLevel};
+use provider::ApiClient;
+use serde::{Deserialize, Serialize};
+use std::{
+    collections::hash_map::DefaultHasher,
+    hash::{Hash, Hasher},
+    ops::Range,
+    path::{Path, PathBuf},
+    sync::{atomic::AtomicBool, Arc},
+};
+
+const CHAT_FILE: &str = "chat.md";
+const MAX_CONTEXT_MESSAGES: usize = 6;
+const MAX_LINKED_FILES: usize = 8;
+
+// Set when stdout carries output for a pipe, so logging moves out of the way
+static LOG_TO_STDERR: AtomicBool = AtomicBool::new(false);
+
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct Message {
+    pub role: String,
+    pub content: String,
+    // Parsed from the file for transcripts; never sent to the API
+    #[serde(skip)]
+    pub timestamp: Option<String>,
+    // Always sent, whatever the context window
+    #[serde(skip)]
+    pub pinned: bool,
+    // The chat service a bridged message came from; sent as written
+    #[serde(skip)]
+    pub via: Option<String>,
+}
+
+impl Message {
+    pub fn new(role: &str, content: impl Into<String>) -> Self {
+        Self {
+            role: role.to_string(),
+            content: content.into(),
+            timestamp: None,
+            pinned: false,
+            via: None,
+        }
+    }
+}
+
+#[derive(Debug)]
+struct ChatContext {
+    // The chat file this context belongs to; replies are written here
+    path: PathBuf,
+    // The file as it was when the current exchange started, to merge
+    // against if it changes before the reply is written
+    base_content: String,
+    // History sent with each message: at most this many messages (0 for no
+    // limit), and at most `context_tokens` tokens when that is set
+    default_max_messages: usize,
+    max_messages: usize,
+    default_context_tokens: Option<usize>,
+    context_tokens: Option<usize>,
+    // The model's context window, when it isn't one tokens::model_limit knows
+    default_context_limit: Option<usize>,
+    context_limit: Option<usize>,
+    // The config generation the defaults below were read in
+    generation: usize,
+    default_separator: String,
+    separator: String,
+    body_start: usize,
+    default_timestamps: bool,
+    timestamps: bool,
+    default_model: String,
+    model: String,
+    persona: Option<String>,
+    continues: Option<String>,
+    default_jsonl: bool,
+    jsonl: bool,
+    default_archive_after: Option<usize>,
+    archive_after: Option<usize>,
+    // Remember durable facts across chats, and send the relevant ones
+    default_memory: bool,
+    memory: bool,
+    // A markdown file of shared project notes sent with every request
+    default_project_memory: Option<PathBuf>,
+    project_memory: Option<PathBuf>,
+    // Documents searched for context before each request
+    default_docs_dir: Option<PathBuf>,
+    docs_dir: Option<PathBuf>,
+    // Summarize messages that leave the context window instead of dropping
+    // them, with `summary_model` if set
+    default_rolling_summary: bool,
+    rolling_summary: bool,
+    default_summary_model: Option<String>,
+    summary_model: Option<String>,
+    default_explicit_send: bool,
+    explicit_send: bool,
+    default_send_marker: Option<String>,
+    send_marker: Option<String>,
+    // Show a placeholder where the reply will go while it is on its way
+    default_typing_indicator: bool,
+    typing_indicator: bool,
+    // Keep the answer /retry replaces, folded away under the new one
+    default_keep_alternatives: bool,
+    keep_alternatives: bool,
+    // Tool steps a reply may take in agent mode, None when it is off
+    default_agent_steps: Option<usize>,
+    agent_steps: Option<usize>,
+    // Commit the chat to git after each reply
+    default_auto_commit: Option<autocommit::Target>,
+    auto_commit: Option<autocommit::Target>,
+    // Hashes of user messages that already have a reply, in file order
+    answered_hashes: Vec<u64>,
+    // End of the last separator in the file, and a hash of everything up to
+    // it. While that prefix is unchanged only the text after it is parsed.
+    settled: Option<(usize, u64)>,
+}
+
+impl ChatContext {
+    fn new(path: PathBuf, content: String) -> Self {
+        let mut ctx = Self {
+            path,
+            base_content: content.clone(),
+            default_max_messages: MAX_CONTEXT_MESSAGES,
+            max_messages: MAX_CONTEXT_MESSAGES,
+            default_context_tokens: None,
+            context_tokens: None,
+            default_context_limit: None,
+            context_limit: None,
+            generation: 0,
+            default_separator: String::new(),
+            separator: String::new(),
+            body_start: 0,
+            default_timestamps: false,
+            timestamps: false,
+            default_model: String::new(),
+            model: String::new(),
+            persona: None,
+            continues: None,
+            default_jsonl: false,
+            jsonl: false,
+            default_archive_after: None,
+            archive_after: None,
+            default_memory: false,
+            memory: false,
+            default_project_memory: None,
+            project_memory: None,
+            default_docs_dir: None,
+            docs_dir: None,
+            default_rolling_summary: false,
+            rolling_summary: false,
+            default_summary_model: None,
+            summary_model: None,
+            default_explicit_send: false,
+            explicit_send: false,
+            default_send_marker: None,
+            send_marker: None,
+            default_typing_indicator: true,
+            typing_indicator: true,
+            default_keep_alternatives: false,
+            keep_alternatives: false,
+            default_agent_steps: None,
+            agent_steps: None,
+            default_auto_commit: None,
+            auto_commit: None,
+            answered_hashes: Vec::new(),
+            settled: None,
+        };
+        ctx.load_defaults();
+        ctx.remember_history(&content);
+        ctx
+    }
+
+    // Settings the frontmatter can override, from the environment
+    fn load_defaults(&mut self) {
+        self.generation = config::generation();
+        self.default_separator = config::default_separator();
+        self.default_timestamps = config::env_flag(config::TIMESTAMPS_ENV, false);
+        self.default_model = config::default_model();
+        self.default_jsonl = config::env_flag(jsonl::JSONL_ENV, false);
+        self.default_max_messages = config::env_count(config::CONTEXT_MESSAGES_ENV).unwrap_or(MAX_CONTEXT_MESSAGES);
+        self.default_context_tokens = config::env_count(config::CONTEXT_TOKENS_ENV).filter(|&t| t > 0);
+        self.default_context_limit = config::env_count(config::CONTEXT_LIMIT_ENV).filter(|&t| t > 0);
+        self.default_archive_after = config::env_count(archive::ARCHIVE_AFTER_ENV);
+        self.default_memory = config::env_flag(memory::MEMORY_ENV, false);
+        self.default_project_memory = std::env::var(memory::PROJECT_MEMORY_ENV)
+            .ok()
+            .filter(|p| !p.trim().is_empty())
+            .map(PathBuf::from);
+        self.default_docs_dir = std::env::var(rag::DOCS_DIR_ENV)
+            .ok()
+            .filter(|d| !d.trim().is_empty())
+            .map(PathBuf::from);
+        self.default_rolling_summary = config::env_flag(summary::ROLLING_SUMMARY_ENV, false);
+        self.default_summary_model = std::env::var(summary::SUMMARY_MODEL_ENV)
+            .ok()
+            .filter(|m| !m.trim().is_empty());
+        self.default_explicit_send = config::env_flag(config::EXPLICIT_SEND_ENV, false);
+        self.default_send_marker = std::env::var(config::SEND_MARKER_ENV)
+            .ok()
+            .filter(|m| !m.trim().is_empty());
+        self.default_typing_indicator = config::env_flag(config::TYPING_INDICATOR_ENV, true);
+        self.default_keep_alternatives = config::env_flag(config::KEEP_ALTERNATIVES_ENV, false);
+        self.default_agent_steps = agent::steps_from_env();
+        self.default_auto_commit = autocommit::from_env();
+    }
+
+    // Re-read per-file settings, since the frontmatter can be edited at any time
+    fn refresh(&mut self, content: &str) {
+        if self.generation != config::generation() {
+            self.load_defaults();
+        }
+        let frontmatter = config::Frontmatter::parse(content);
+        let separator = frontmatter
+            .get("separator")
+            .filter(|s| !s.trim().is_empty())
+            .unwrap_or(&self.default_separator);
+        self.separator = config::separator_line(separator);
+        self.timestamps = frontmatter
+            .get("timestamps")
+            .and_then(config::parse_bool)
+            .unwrap_or(self.default_timestamps);
+        self.model = frontmatter
+            .get("model")
+            .filter(|m| !m.trim().is_empty())
+            .unwrap_or(&self.default_model)
+            .to_string();
+        self.persona = frontmatter
+            .get("persona")
+            .filter(|p| !p.trim().is_empty())
+            .map(str::to_string);
+        self.jsonl = frontmatter
+            .get("jsonl")
+            .and_then(config::parse_bool)
+            .unwrap_or(self.default_jsonl);
+        self.max_messages = frontmatter
+            .get("context_messages")
+            .and_then(|v| v.trim().parse().ok())
+            .unwrap_or(self.default_max_messages);
+        self.context_tokens = match frontmatter.get("context_tokens").and_then(|v| v.trim().parse().ok()) {
+            Some(0) => None,
+            Some(tokens) => Some(tokens),
+            None => self.default_context_tokens,
+        };
+        self.context_limit = frontmatter
+            .get("context_limit")
+            .and_then(|v| v.trim().parse().ok())
+            .filter(|&t| t > 0)
+            .or(self.default_context_limit);
+        self.archive_after = frontmatter
+            .get("archive_after")
+            .and_then(|v| v.trim().parse().ok())
+            .or(self.default_archive_after);
+        self.memory = frontmatter
+            .get("memory")
+            .and_then(config::parse_bool)
+            .unwrap_or(self.default_memory);
+        // Relative to the chat file, like `continues:`
+        self.project_memory = match frontmatter.get("project").filter(|p| !p.trim().is_empty()) {
+            Some(file) => Some(self.path.parent().unwrap_or(Path::new(".")).join(file)),
+            None => self.default_project_memory.clone(),
+        };
+        self.docs_dir = match frontmatter.get("docs").filter(|d| !d.trim().is_empty()) {
+            Some(dir) => Some(self.path.parent().unwrap_or(Path::new(".")).join(dir)),
+            None => self.default_docs_dir.clone(),
+        };
+        self.rolling_summary = frontmatter
+            .get("rolling_summary")
+            .and_then(config::parse_bool)
+            .unwrap_or(self.default_rolling_summary);
+        self.summary_model = frontmatter
+            .get("summary_model")
+            .filter(|m| !m.trim().is_empty())
+            .map(str::to_string)
+            .or_else(|| self.default_summary_model.clone());
+        self.explicit_send = frontmatter
+            .get("explicit_send")
+            .and_then(config::parse_bool)
+            .unwrap_or(self.default_explicit_send);
+        self.send_marker = frontmatter
+            .get("send_marker")
+            .filter(|m| !m.trim().is_empty())
+            .map(|m| config::unquote(m).to_string())
+            .or_else(|| self.default_send_marker.clone());
+        self.typing_indicator = frontmatter
+            .get("typing_indicator")
+            .and_then(config::parse_bool)
+            .unwrap_or(self.default_typing_indicator);
+        self.keep_alternatives = frontmatter
+            .get("keep_alternatives")
+            .and_then(config::parse_bool)
+            .unwrap_or(self.default_keep_alternatives);
+        self.agent_steps = match frontmatter.get("agent") {
+            Some(agent) => agent::parse_steps(agent),
+            None => self.default_agent_steps,
+        };
+        self.auto_commit = match frontmatter.get("auto_commit") {
+            Some(value) => autocommit::parse(value),
+            None => self.default_auto_commit.clone(),
+        };
+        self.continues = frontmatter
+            .get("continues")
+            .filter(|p| !p.trim().is_empty())
+            .map(str::to_string);
+        self.body_start = frontmatter.body_start;
+        // These keep messages in plain text, which an encrypted chat mustn't
+        if crypt::scheme(&self.path).is_some() {
+            self.jsonl = false;
+            self.memory = false;
+            self.rolling_summary = false;
+        }
+    }
+
+    fn answered_user_hashes(&self, body: &str) -> Vec<(usize, u64)> {
+        let parts = parser::split_unfenced(body, &self.separator);
+        (0..parts.len())
+            .step_by(2)
+            .filter(|&i| parts.get(i + 1).is_some_and(|reply| !reply.trim().is_empty()))
+            .filter(|&i| Command::parse(&parser::strip_branch_headings(parts[i])).is_none())
+            .map(|i| (i, message_hash(parts[i])))
+            .collect()
+    }
+
+    // Called after every write so later saves can be compared against it
+    fn remember_history(&mut self, content: &str) {
+        self.refresh(content);
+        let body = &content[self.body_start..];
+        self.answered_hashes = self
+            .answered_user_hashes(body)
+            .into_iter()
+            .map(|(_, hash)| hash)
+            .collect();
+        self.settle(content);
+    }
+
+    // Marks everything up to the last separator as processed
+    fn settle(&mut self, content: &str) {
+        let body = &content[self.body_start..];
+        self.settled = parser::rfind_unfenced(body, &self.separator).map(|pos| {
+            let end = self.body_start + pos + self.separator.len();
+            (end, self.prefix_hash(&content[..end]))
+        });
+    }
+
+    // Body offset of the last settled separator, if nothing up to it has
+    // changed. Answered messages all lie before it, so edits to them can't
+    // have happened, and the separator is outside any code fence, so the
+    // text from there on can be parsed on its own.
+    fn unchanged_until(&self, content: &str) -> Option<usize> {
+        let (end, hash) = self.settled?;
+        let prefix = content.get(..end)?;
+        (self.prefix_hash(prefix) == hash).then(|| end - self.separator.len() - self.body_start)
+    }
+
+    // Includes the separator, which .env or the frontmatter may change
+    fn prefix_hash(&self, prefix: &str) -> u64 {
+        let mut hasher = DefaultHasher::new();
+        self.separator.hash(&mut hasher);
+        prefix.hash(&mut hasher);
+        hasher.finish()
+    }
+
+    // Part index of the first already-answered user message that no longer
+    // matches what was sent
+    fn find_edited_message(&self, body: &str) -> Option<usize> {
+        self.answered_user_hashes(body)
+            .into_iter()
+            .zip(&self.answered_hashes)
+            .find(|((_, current), known)| current != *known)
+            .map(|((i, _), _)| i)
+    }
+
+    // Part index of the last answered user message if its reply was deleted
+    // and nothing else changed, so it is answered again
+    fn find_deleted_reply(&self, body: &str) -> Option<usize> {
+        let answered = self.answered_user_hashes(body);
+        let (last, earlier) = self.answered_hashes.split_last()?;
+        if answered.len() != earlier.len() || answered.iter().zip(earlier).any(|((_, current), known)| current != known) {
+            return None;
+        }
+        let parts = parser::split_unfenced(body, &self.separator);
+        let part = (0..parts.len()).step_by(2).rev().find(|&i| !parts[i].trim().is_empty())?;
+        let unanswered = parts[part + 1..].iter().all(|p| p.trim().is_empty());
+        (unanswered && message_hash(parts[part]) == *last).then_some(part)
+    }
+
+    fn parse_parts(&self, content: &str) -> Vec<(Range<usize>, Message)> {
+        let ranges = parser::split_unfenced_ranges(content, &self.separator);
+        let mut messages = Vec::with_capacity(ranges.len());
+
+        for (i, range) in ranges.into_iter().enumerate() {
+            let part = parser::strip_branch_headings(&content[range.clone()]);
+            if part.is_empty() {
+                continue;
+            }
+
+            let role = if i % 2 == 0 { "user" } else { "assistant" };
+            let (content, timestamp) = parser::take_timestamp(&part);
+            let content = match role {
+                "assistant" => {
+                    let (content, _) = parser::take_persona_label(&parser::take_alternatives(&content).0);
+                    parser::strip_trace(&content)
+                }
+                _ => content,
+            };
+            let (content, _) = RequestParams::take_from(&content);
+            let (content, pinned) = parser::take_pin(&content);
+            let (content, via) = parser::take_via(&content);
+            messages.push((
+                range,
+                Message {
+                    timestamp,
+                    pinned,
+                    via,
+                    ..Message::new(role, content)
+                },
+            ));
+        }
+
+        messages
+    }
+
+    fn parse_messages(&self, content: &str) -> Vec<Message> {
+        self.parse_parts(content)
+            .into_iter()
+            .map(|(_, message)| message)
+            .collect()
+    }
+
+    // Every message in the file with its branch, for sidecars and exports
+    fn transcript(&self, body: &str) -> Vec<jsonl::Record> {
+        let branches = parser::BranchMap::new(body);
+        self.parse_parts(body)
+            .into_iter()
+            .enumerate()
+            .map(|(index, (range, message))| jsonl::Record {
+                index,
+                role: message.role,
+                content: message.content,
+                timestamp: message.timestamp,
+                branch: branches.path_at(range.end).into_iter().map(|b| b.name).collect(),
+            })
+            .collect()
+    }
+
+    // Messages from the chain of `continues:` files, oldest first
+    fn linked_messages(&self) -> Vec<Message> {
+        let base_dir = self.path.parent().unwrap_or(Path::new("."));
+        let mut chain = Vec::new();
+        let mut next = self.continues.clone();
+
+        while let Some(name) = next.take() {
+            let path = base_dir.join(&name);
+            let seen = path == self.path || chain.iter().any(|(p, _)| *p == path);
+            if seen || chain.len() >= MAX_LINKED_FILES {
+                debug_log(&format!("skip: not following {} (cycle or too many linked files)", name));
+                break;
+            }
+            // Decrypting takes a process this can't wait for
+            if crypt::scheme(&path).is_some() {
+                debug_log(&format!("skip: not following {} (linked chats can't be encrypted)", name));
+                break;
+            }
+
+            let content = match std::fs::read_to_string(&path) {
+                Ok(content) => parser::normalize(&content),
+                Err(e) => {
+                    debug_log(&format!("error: cannot load linked chat {}: {}", name, e));
+                    break;
+                }
+            };
+
+            let linked = ChatContext::new(path.clone(), content.clone());
+            let messages = linked.parse_messages(&content[linked.body_start..]);
+            debug_log(&format!("load: {} messages from linked chat {}", messages.len(), name));
+            next = linked.continues.clone();
+            chain.push((path, messages));
+        }
+
+        chain.into_iter().rev().flat_map(|(_, messages)| messages).collect()
+    }
+
+    // History to send ahead of a new message at `active_pos`: linked chats,
+    // then the messages in `body[..history_end]` on the active branch,
+    // trimmed to the context window
+    fn build_history(&self, body: &str, history_end: usize, active_pos: usize) -> Vec<Message> {
+        self.split_history(body, history_end, active_pos).1
+    }
+
+    // The history split into what falls outside the context window and what
+    // fits, both oldest first
+    fn split_history(&self, body: &str, history_end: usize, active_pos: usize) -> (Vec<Message>, Vec<Message>) {
+        let branches = parser::BranchMap::new(&body[..active_pos]);
+        let active = branches.path_at(active_pos);
+
+        let mut messages = self.linked_messages();
+        let mut skipped = 0;
+        let mut skip_reply = false;
+        for (range, mut message) in self.parse_parts(&body[..history_end]) {
+            if !active.starts_with(&branches.path_at(range.end)) {
+                skipped += 1;
+                continue;
+            }
+            if std::mem::take(&mut skip_reply) && message.role == "assistant" {
+                continue;
+            }
+
+            // Command exchanges are bookkeeping, not conversation
+            match Command::parse(&message.content).filter(|_| message.role == "user" && message.via.is_none()) {
+                Some(Command::Clear) => {
+                    messages.clear();
+                    skip_reply = true;
+                    continue;
+                }
+                Some(Command::Summarize) => message.content = commands::SUMMARIZE_PROMPT.to_string(),
+                Some(command) if !command.keeps_reply() => {
+                    skip_reply = true;
+                    continue;
+                }
+                _ => {}
+            }
+            messages.push(message);
+        }
+
+        if !branches.is_empty() {
+            let name = active.last().map_or("main", |b| b.name.as_str());
+            debug_log(&format!(
+                "parse: on branch {} ({} messages from other branches skipped)",
+                name, skipped
+            ));
+        }
+
+        // Pinned messages are always kept and don't count against the
+        // window; the rest fill it newest first
+        let pinned_tokens: usize = messages.iter().filter(|m| m.pinned).map(tokens::message_tokens).sum();
+        let mut room = (self.max_messages > 0).then_some(self.max_messages);
+        let mut budget = self.context_tokens.map(|b| b.saturating_sub(pinned_tokens));
+        let mut full = false;
+        let mut keep = vec![false; messages.len()];
+        for (i, message) in messages.iter().enumerate().rev() {
+            if message.pinned {
+                keep[i] = true;
+                continue;
+            }
+            let cost = tokens::message_tokens(message);
+            full = full || room == Some(0) || budget.is_some_and(|b| cost > b);
+            if full {
+                continue;
+            }
+            keep[i] = true;
+            room = room.map(|r| r - 1);
+            budget = budget.map(|b| b - cost);
+        }
+
+        let (kept, dropped): (Vec<_>, Vec<_>) = messages.into_iter().zip(keep).partition(|(_, keep)| *keep);
+        let kept: Vec<Message> = kept.into_iter().map(|(m, _)| m).collect();
+        let dropped: Vec<Message> = dropped.into_iter().map(|(m, _)| m).collect();
+        if !dropped.is_empty() {
+            debug_log(&format!(
+                "trim: keeping {} of {} messages ({})",
+                kept.len(),
+                kept.len() + dropped.len(),
+                self.window_description()
+            ));
+        }
+        (dropped, kept)
+    }
+
+    // The context window, for /tokens
+    fn window_description(&self) -> String {
+        match (self.max_messages, self.context_tokens) {
+            (0, None) => "unlimited".to_string(),
+            (0, Some(tokens)) => format!("{} tokens", tokens),
+            (messages, None) => format!("{} messages", messages),
+            (messages, Some(tokens)) => format!("{} messages, {} tokens", messages, tokens),
+        }
+    }
+
+    fn is_last_message_from_ai(&self, content: &str, cursor_pos: usize) -> bool {
+        // Get content up to cursor
+        let content_to_cursor = &content[..cursor_pos];
+        
+        // Find the last separator before cursor
+        if let Some(last_sep) = parser::rfind_unfenced(content_to_cursor, &self.separator) {
+            // Get everything between the last separator and cursor
+            let after_sep = content_to_cursor[last_sep + self.separator.len()..].trim();
+            
+            // If there's no content after separator up to cursor, it was an AI message
+            // (because AI messages end with the separator)
+            after_sep.is_empty()
+        } else {
+            // If no separator found before cursor, it's a user message
+            false
+        }
+    }
+
+    fn extract_new_message(&self, content: &str, cursor_pos: usize) -> String {
+        let content_to_cursor = &content[..cursor_pos];
+        
+        // Find the last separator before cursor
+        if let Some(last_sep) = parser::rfind_unfenced(content_to_cursor, &self.separator) {
+            // Get everything after the last separator up to cursor
+            let message = content_to_cursor[last_sep + self.separator.len()..].trim();
+            if !message.is_empty() {
+                return message.to_string();
+            }
+            
+            // If empty after last separator, try to get the content before it
+            // (handles case where user is typing right after an AI message)
+            if let Some(second_last_sep) = parser::rfind_unfenced(&content_to_cursor[..last_sep], &self.separator) {
+                content_to_cursor[second_last_sep + self.separator.len()..last_sep].trim().to_string()
+            } else {
+                content_to_cursor[..last_sep].trim().to_string()
+            }
+        } else {
+            // No separator found, use all content up to cursor
+            content_to_cursor.trim().to_string()
+        }
+    }
+}
+
+fn message_hash(part: &str) -> u64 {
+    let (content, _) = parser::take_timestamp(part);
+    let mut hasher = DefaultHasher::new();
+    content.hash(&mut hasher);
+    hasher.finish()
+}
+
+// Everything the binary does: `args` are its command-line arguments
+pub async fn run(args: Vec<String>) -> Result<()> {
+    let env_file = envfile::EnvFile::load(cli::env_files(&args))?;
+    let settings_files = configfile::load();
+
+    if let Some(level) = std::env::var(config::LOG_LEVEL_ENV).ok().and_then(|v| LogLevel::parse(&v)) {
+        level.set();
+    }
+    if let Some(format) = std::env::var(logging::LOG_FORMAT_ENV).ok().and_then(|v| LogFormat::parse(&v)) {
+        format.set();
+    }
+    if let Some(path) = std::env::var(logging::LOG_FILE_ENV).ok().filter(|p| !p.trim().is_empty()) {
+        logging::log_to_file(Path::new(&path))?;
+    }
+
+    let Some((command, args)) = cli::parse(&args)? else {
+        return Ok(());
+    };
+    match command {
+        "ask" => return ask::run(&args).await,
+        "auth" => return auth::run(&args).await,
+        "context" => return preview::run(&args).await,
+        "cost" => return cost::run(&args).await,
+        "doctor" => return doctor::run(&args).await,
+        "email" => return email::run(&args).await,
+        "export" => return export::run(&args).await,
+        "fmt" => return fmt::run(&args).await,
+        "import" => return import::run(&args).await,
+        "index" => return index::run(&args).await,
+        "new" => return starter::run(&args).await,
+        "plugins" => return plugins::run(&args).await,
+        "rpc" => return rpc::run(&args).await,
+        "schedule" => return schedule::run(&args).await,
+        "search" => return search::run(&args).await,
+        "service" => return service::run(&args).await,
+        "stats" => return stats::run(&args).await,
+        "status" => return daemon::status(),
+        "stop" => return daemon::stop().await,
+        "tokens" => return tokens::run(&args).await,
+        _ => {}
+    }
+
+    for path in &settings_files {
+        debug_log(&format!("load: settings from {}", path.display()));
+    }
+    let api_key = auth::api_key()
+        .with_context(|| format!("{} not found; set it or run `auth login`", config::API_KEY_ENV))?;
+    let (web, args) = match command {
+        "serve" => {
+            let (addr, rest) = web::parse_args(&args)?;
+            (Some(addr), rest)
+        }
+        _ => (None, args),
+    };
+    let daemon = args.iter().any(|a| a == "--daemon");
+    let args: Vec<String> = args.into_iter().filter(|a| a != "--daemon").collect();
+    let (metrics_addr, args) = metrics::parse_args(&args)?;
+    let (watch_set, poll_interval) = watch::parse_args(&args)?;
+    let listener = match &web {
+        Some(addr) => Some(http::bind(addr).await?),
+        None => None,
+    };
+    let metrics_listener = match &metrics_addr {
+        Some(addr) => Some(http::bind(addr).await?),
+        None => None,
+    };
+    // Checked here first, so mistakes show before there's no terminal
+    if daemon {
+        drop(listener);
+        drop(metrics_listener);
+        return daemon::start();
+    }
+
+    status::enable();
+    metrics::init();
+    let api_client = Arc::new(ApiClient::new(api_key));
+    health::start(watch_set.clone(), api_client.clone());
+    if let Some(listener) = listener {
+        debug_log(&format!("init: web UI at http://{}", listener.local_addr()?));
+        tokio::spawn(web::serve(listener, watch_set.clone()));
+    }
+    if let Some(listener) = metrics_listener {
+        debug_log(&format!("init: metrics at http://{}/metrics", listener.local_addr()?));
+        tokio::spawn(metrics::serve(listener));
+    }
+    bridge::start(&watch_set);
+    schedule::start(&watch_set);
+
+    println!("Monitoring {} for new messages...", watch_set.describe());
+    println!("Type your message and press Enter twice to send.");
+    let watcher = Watcher {
+        watch_set,
+        poll_interval,
+        api_client,
+        env_file: Some(env_file),
+    };
+    watcher.run(monitor::shutdown_signal()).await?;
+
+    status::release();
+    daemon::release();
+    Ok(())
+}
@@ -0,0 +1,151 @@
+use crate::config;
+use std::{
+    collections::HashMap,
+    path::{Path, PathBuf},
+};
+
+pub const PROMPTS_DIR_ENV: &str = "CHAT_PROMPTS_DIR";
+pub const PERSONAS_DIR_ENV: &str = "CHAT_PERSONAS_DIR";
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Hash)]
+pub enum Kind {
+    Prompt,
+    Persona,
+}
+
+impl Kind {
+    fn label(self) -> &'static str {
+        match self {
+            Kind::Prompt => "prompt",
+            Kind::Persona => "persona",
+        }
+    }
+}
+
+// Named markdown snippets loaded from the prompts/ and personas/ directories.
+// Reloaded whenever a file in either directory changes.
+#[derive(Debug, Default)]
+pub struct PromptLibrary {
+    dirs: Vec<(Kind, PathBuf)>,
+    entries: HashMap<(Kind, String), String>,
+    // `model:` from a persona's frontmatter, used whenever it answers
+    models: HashMap<String, String>,
+    pub errors: Vec<String>,
+}
+
+impl PromptLibrary {
+    pub fn from_env() -> Self {
+        let dir = |env: &str, default: &str| {
+            PathBuf::from(std::env::var(env).unwrap_or_else(|_| default.to_string()))
+        };
+
+        let mut library = Self {
+            dirs: vec![
+                (Kind::Prompt, dir(PROMPTS_DIR_ENV, "prompts")),
+                (Kind::Persona, dir(PERSONAS_DIR_ENV, "personas")),
+            ],
+            ..Self::default()
+        };
+        library.reload();
+        library
+    }
+
+    pub fn dirs(&self) -> impl Iterator<Item = &Path> {
+        self.dirs.iter().map(|(_, dir)| dir.as_path())
+    }
+
+    pub fn contains_path(&self, path: &Path) -> bool {
+        self.dirs.iter().any(|(_, dir)| {
+            path.starts_with(dir)
+                || dir
+                    .canonicalize()
+                    .is_ok_and(|dir| path.starts_with(dir))
+        })
+    }
+
+    pub fn reload(&mut self) {
+        self.entries.clear();
+        self.models.clear();
+        self.errors.clear();
+
+        for (kind, dir) in self.dirs.clone() {
+            let Ok(read_dir) = std::fs::read_dir(&dir) else {
+                continue;
+            };
+
+            let mut paths: Vec<PathBuf> = read_dir
+                .filter_map(|entry| entry.ok().map(|e| e.path()))
+                .filter(|p| p.extension().is_some_and(|ext| ext == "md"))
+                .collect();
+            paths.sort();
+
+            for path in paths {
+                let Some(name) = path.file_stem().map(|s| s.to_string_lossy().to_lowercase()) else {
+                    continue;
+                };
+
+                let content = std::fs::read_to_string(&path).map_err(|e| e.to_string());
+                match content.and_then(|c| validate(&c).map(|text| (c, text))) {
+                    Ok((content, text)) => {
+                        let model = config::Frontmatter::parse(&content).get("model").map(str::to_string);
+                        if let Some(model) = model.filter(|m| kind == Kind::Persona && !m.trim().is_empty()) {
+                            self.models.insert(name.clone(), model);
+                        }
+                        self.entries.insert((kind, name), text);
+                    }
+                    Err(e) => self.errors.push(format!("{}: {}", path.display(), e)),
+                }
+            }
+        }
+    }
+
+    pub fn get(&self, kind: Kind, name: &str) -> Option<&str> {
+        self.entries
+            .get(&(kind, name.trim().to_lowercase()))
+            .map(String::as_str)
+    }
+
+    pub fn persona_model(&self, name: &str) -> Option<&str> {
+        self.models.get(&name.trim().to_lowercase()).map(String::as_str)
+    }
+
+    // Sorted names of every entry of `kind`
+    pub fn names(&self, kind: Kind) -> Vec<&str> {
+        let mut names: Vec<&str> = self
+            .entries
+            .keys()
+            .filter(|(k, _)| *k == kind)
+            .map(|(_, name)| name.as_str())
+            .collect();
+        names.sort();
+        names
+    }
+
+    pub fn summary(&self) -> String {
+        let count = |kind: Kind| self.entries.keys().filter(|(k, _)| *k == kind).count();
+        format!(
+            "{} {}s, {} {}s",
+            count(Kind::Prompt),
+            Kind::Prompt.label(),
+            count(Kind::Persona),
+            Kind::Persona.label()
+        )
+    }
+}
+
+// Returns the text to use, minus any frontmatter
+fn validate(content: &str) -> Result<String, String> {
+    if content.starts_with("---\n") && config::Frontmatter::parse(content).body_start == 0 {
+        return Err("frontmatter is not closed with ---".to_string());
+    }
+
+    let body = content[config::Frontmatter::parse(content).body_start..].trim();
+    if body.is_empty() {
+        return Err("file is empty".to_string());
+    }
+    if body.matches("{{").count() != body.matches("}}").count() {
+        return Err("unbalanced {{ }} placeholder".to_string());
+    }
+
+    Ok(body.to_string())
+}
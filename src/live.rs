@@ -0,0 +1,60 @@
+use serde_json::json;
+use std::{
+    collections::HashMap,
+    path::{Path, PathBuf},
+    sync::{Mutex, OnceLock},
+};
+use tokio::sync::broadcast;
+
+// Room for a burst of tokens while a slow browser catches up
+const CAPACITY: usize = 1024;
+
+// One channel per chat, for pages following replies as they are written
+static CHANNELS: OnceLock<Mutex<HashMap<PathBuf, broadcast::Sender<String>>>> = OnceLock::new();
+
+fn channels() -> std::sync::MutexGuard<'static, HashMap<PathBuf, broadcast::Sender<String>>> {
+    CHANNELS
+        .get_or_init(Default::default)
+        .lock()
+        .unwrap_or_else(|e| e.into_inner())
+}
+
+// Events for the chat at `path`, as JSON: `{"type": "start"}`, then
+// `{"type": "text", "text": ...}` for each piece of the reply, then
+// `{"type": "done"}`
+pub fn subscribe(path: &Path) -> broadcast::Receiver<String> {
+    channels()
+        .entry(path.to_path_buf())
+        .or_insert_with(|| broadcast::channel(CAPACITY).0)
+        .subscribe()
+}
+
+// A reply being written to the chat at `path`, if anyone is following it.
+// Nobody is most of the time, and then replies aren't streamed at all.
+pub fn following(path: &Path) -> Option<Reply> {
+    let mut channels = channels();
+    let sender = channels.get(path)?.clone();
+    if sender.receiver_count() == 0 {
+        channels.remove(path);
+        return None;
+    }
+    Some(Reply { sender })
+}
+
+pub struct Reply {
+    sender: broadcast::Sender<String>,
+}
+
+impl Reply {
+    pub fn start(&self) {
+        let _ = self.sender.send(json!({ "type": "start" }).to_string());
+    }
+
+    pub fn text(&self, text: &str) {
+        let _ = self.sender.send(json!({ "type": "text", "text": text }).to_string());
+    }
+
+    pub fn done(&self) {
+        let _ = self.sender.send(json!({ "type": "done" }).to_string());
+    }
+}
@@ -0,0 +1,287 @@
+use crate::{config, LOG_TO_STDERR};
+use anyhow::{Context, Result};
+use serde_json::{Map, Value};
+use std::{
+    fs::{self, File, OpenOptions},
+    io::Write,
+    path::{Path, PathBuf},
+    sync::{
+        atomic::{AtomicU8, Ordering},
+        Mutex,
+    },
+    time::{Duration, SystemTime},
+};
+
+pub const LOG_FORMAT_ENV: &str = "CHAT_LOG_FORMAT";
+pub const LOG_FILE_ENV: &str = "CHAT_LOG_FILE";
+pub const LOG_MAX_MB_ENV: &str = "CHAT_LOG_MAX_MB";
+pub const LOG_MAX_DAYS_ENV: &str = "CHAT_LOG_MAX_DAYS";
+pub const LOG_KEEP_ENV: &str = "CHAT_LOG_KEEP";
+
+const DEFAULT_MAX_MB: usize = 10;
+const DEFAULT_MAX_DAYS: usize = 7;
+const DEFAULT_KEEP: usize = 5;
+
+static LOG_LEVEL: AtomicU8 = AtomicU8::new(LogLevel::Normal as u8);
+static LOG_FORMAT: AtomicU8 = AtomicU8::new(LogFormat::Pretty as u8);
+// When set, logs go here instead of the terminal
+static LOG_FILE: Mutex<Option<LogFile>> = Mutex::new(None);
+
+tokio::task_local! {
+    // The chat a worker task is handling, attached to everything it logs
+    pub static CURRENT_FILE: String;
+}
+
+// How much debug_log prints: errors only, what happens to each message, why
+// changes were skipped, or every parse
+#[derive(Debug, Clone, Copy, PartialEq, Eq, PartialOrd, Ord)]
+pub enum LogLevel {
+    Quiet,
+    Normal,
+    Verbose,
+    Debug,
+}
+
+impl LogLevel {
+    pub fn parse(value: &str) -> Option<Self> {
+        match value.trim().to_lowercase().as_str() {
+            "quiet" | "error" => Some(Self::Quiet),
+            "normal" | "info" => Some(Self::Normal),
+            "verbose" => Some(Self::Verbose),
+            "debug" => Some(Self::Debug),
+            _ => None,
+        }
+    }
+
+    pub fn set(self) {
+        LOG_LEVEL.store(self as u8, Ordering::Relaxed);
+    }
+
+    fn current() -> Self {
+        match LOG_LEVEL.load(Ordering::Relaxed) {
+            0 => Self::Quiet,
+            1 => Self::Normal,
+            2 => Self::Verbose,
+            _ => Self::Debug,
+        }
+    }
+
+    fn name(self) -> &'static str {
+        match self {
+            Self::Quiet => "error",
+            Self::Normal => "info",
+            Self::Verbose => "verbose",
+            Self::Debug => "debug",
+        }
+    }
+}
+
+// Emoji lines for people, or one JSON object per line for log processors
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum LogFormat {
+    Pretty,
+    Json,
+}
+
+impl LogFormat {
+    pub fn parse(value: &str) -> Option<Self> {
+        match value.trim().to_lowercase().as_str() {
+            "pretty" | "text" => Some(Self::Pretty),
+            "json" => Some(Self::Json),
+            _ => None,
+        }
+    }
+
+    pub fn set(self) {
+        LOG_FORMAT.store(self as u8, Ordering::Relaxed);
+    }
+
+    pub fn current() -> Self {
+        match LOG_FORMAT.load(Ordering::Relaxed) {
+            0 => Self::Pretty,
+            _ => Self::Json,
+        }
+    }
+}
+
+// Events by the keyword messages start with, with how they are shown and
+// the level they need
+const EVENTS: &[(&str, &str, &str, LogLevel)] = &[
+    // Ahead of the rest, since it names the steps it timed
+    ("timing", "⏱️", "cyan", LogLevel::Verbose),
+    ("error", "❌", "red", LogLevel::Quiet),
+    ("skip", "⏭️", "yellow", LogLevel::Verbose),
+    ("parse", "🔍", "cyan", LogLevel::Debug),
+    ("add", "➕", "green", LogLevel::Verbose),
+    ("call", "🌐", "blue", LogLevel::Normal),
+    ("response", "✉️", "magenta", LogLevel::Normal),
+    ("detect", "👀", "cyan", LogLevel::Verbose),
+    ("write", "✍️", "green", LogLevel::Normal),
+    ("init", "🚀", "green", LogLevel::Normal),
+    ("load", "📂", "blue", LogLevel::Normal),
+    ("trim", "✂️", "yellow", LogLevel::Verbose),
+    ("unchanged", "🔄", "yellow", LogLevel::Debug),
+    ("monitoring", "👁️", "cyan", LogLevel::Normal),
+];
+
+// Whether logs go to a file rather than the terminal
+pub fn to_file() -> bool {
+    LOG_FILE.lock().unwrap_or_else(|e| e.into_inner()).is_some()
+}
+
+pub fn debug_log(message: &str) {
+    log(message, &[]);
+}
+
+// A `keyword: message` line plus fields such as model, tokens or
+// duration_ms. Pretty output shows only the message, which already says
+// what matters to a person; JSON output carries every field.
+pub fn log(message: &str, fields: &[(&str, Value)]) {
+    let lower = message.to_lowercase();
+    let (event, emoji, color, level) = EVENTS
+        .iter()
+        .find(|(key, ..)| lower.contains(key))
+        .copied()
+        .unwrap_or(("info", "💬", "white", LogLevel::Normal));
+    if level > LogLevel::current() {
+        return;
+    }
+
+    let mut log_file = LOG_FILE.lock().unwrap_or_else(|e| e.into_inner());
+    if let Some(log_file) = log_file.as_mut() {
+        let line = match LogFormat::current() {
+            LogFormat::Pretty => format!("{} {} {}", crate::parser::now_timestamp(), emoji, message),
+            LogFormat::Json => json(message, event, level, fields),
+        };
+        // Nowhere left to log a failure to log; say it on the terminal
+        if let Err(e) = log_file.write_line(&line) {
+            eprintln!("cannot write to {}: {}", log_file.path.display(), e);
+        }
+        return;
+    }
+
+    crate::status::clear_spinner();
+    let line = match LogFormat::current() {
+        LogFormat::Pretty => pretty(message, emoji, color),
+        LogFormat::Json => json(message, event, level, fields),
+    };
+    if LOG_TO_STDERR.load(Ordering::Relaxed) {
+        eprintln!("{}", line);
+    } else {
+        println!("{}", line);
+    }
+}
+
+fn pretty(message: &str, emoji: &str, color: &str) -> String {
+    use colored::Colorize;
+
+    let colored_message = match color {
+        "red" => message.red(),
+        "yellow" => message.yellow(),
+        "cyan" => message.cyan(),
+        "green" => message.green(),
+        "blue" => message.blue(),
+        "magenta" => message.magenta(),
+        _ => message.white(),
+    };
+    format!("{} {}", emoji, colored_message)
+}
+
+fn json(message: &str, event: &str, level: LogLevel, fields: &[(&str, Value)]) -> String {
+    // The keyword is the event, so the message doesn't repeat it
+    let text = match message.split_once(':') {
+        Some((keyword, rest)) if keyword.eq_ignore_ascii_case(event) => rest.trim(),
+        _ => message,
+    };
+
+    let mut record = Map::new();
+    record.insert("time".into(), crate::parser::now_timestamp().into());
+    record.insert("level".into(), level.name().into());
+    record.insert("event".into(), event.into());
+    record.insert("message".into(), text.into());
+    if let Ok(file) = CURRENT_FILE.try_with(String::clone) {
+        record.insert("file".into(), file.into());
+    }
+    for (key, value) in fields {
+        record.insert(key.to_string(), value.clone());
+    }
+    Value::Object(record).to_string()
+}
+
+// Sends logs to `path` from now on, rotating it by size and age. Limits come
+// from CHAT_LOG_MAX_MB, CHAT_LOG_MAX_DAYS (0 turns either off) and
+// CHAT_LOG_KEEP, the number of old files to keep as `path.1`, `path.2`, ...
+pub fn log_to_file(path: &Path) -> Result<()> {
+    let log_file = LogFile {
+        path: path.to_path_buf(),
+        max_bytes: config::env_count(LOG_MAX_MB_ENV).unwrap_or(DEFAULT_MAX_MB) as u64 * 1024 * 1024,
+        max_age: Duration::from_secs(config::env_count(LOG_MAX_DAYS_ENV).unwrap_or(DEFAULT_MAX_DAYS) as u64 * 86_400),
+        keep: config::env_count(LOG_KEEP_ENV).unwrap_or(DEFAULT_KEEP),
+        file: None,
+        size: 0,
+        started: SystemTime::now(),
+    };
+    if let Some(dir) = path.parent().filter(|d| !d.as_os_str().is_empty()) {
+        fs::create_dir_all(dir).with_context(|| format!("cannot create {}", dir.display()))?;
+    }
+    *LOG_FILE.lock().unwrap_or_else(|e| e.into_inner()) = Some(log_file);
+    Ok(())
+}
+
+struct LogFile {
+    path: PathBuf,
+    max_bytes: u64,
+    max_age: Duration,
+    keep: usize,
+    // Opened on the first line, and again after each rotation
+    file: Option<File>,
+    size: u64,
+    // When the current file was started
+    started: SystemTime,
+}
+
+impl LogFile {
+    fn write_line(&mut self, line: &str) -> std::io::Result<()> {
+        if self.file.is_none() {
+            self.open()?;
+        }
+        let too_big = self.max_bytes > 0 && self.size + line.len() as u64 + 1 > self.max_bytes && self.size > 0;
+        let too_old = !self.max_age.is_zero() && self.started.elapsed().unwrap_or_default() > self.max_age;
+        if too_big || too_old {
+            self.rotate()?;
+        }
+
+        let file = self.file.as_mut().expect("log file was just opened");
+        writeln!(file, "{}", line)?;
+        self.size += line.len() as u64 + 1;
+        Ok(())
+    }
+
+    fn open(&mut self) -> std::io::Result<()> {
+        let file = OpenOptions::new().create(true).append(true).open(&self.path)?;
+        let metadata = file.metadata()?;
+        self.size = metadata.len();
+        // An existing file carries on from when it was started
+        self.started = metadata.created().unwrap_or_else(|_| SystemTime::now());
+        self.file = Some(file);
+        Ok(())
+    }
+
+    // path.2 -> path.3, path.1 -> path.2, path -> path.1, dropping the oldest
+    fn rotate(&mut self) -> std::io::Result<()> {
+        self.file = None;
+        let numbered = |n: usize| PathBuf::from(format!("{}.{}", self.path.display(), n));
+        if self.keep == 0 {
+            fs::remove_file(&self.path)?;
+        } else {
+            let _ = fs::remove_file(numbered(self.keep));
+            for n in (1..self.keep).rev() {
+                let _ = fs::rename(numbered(n), numbered(n + 1));
+            }
+            fs::rename(&self.path, numbered(1))?;
+        }
+        self.open()?;
+        self.started = SystemTime::now();
+        Ok(())
+    }
+}
@@ -0,0 +1,194 @@
+use crate::{
+    bridge::{self, Remote},
+    http::percent_encode,
+    logging::debug_log,
+    watch,
+};
+use anyhow::{bail, Context, Result};
+use pulldown_cmark::{html, Options, Parser};
+use serde_json::{json, Value};
+use std::{path::PathBuf, time::Duration};
+
+pub const MATRIX_HOMESERVER_ENV: &str = "CHAT_MATRIX_HOMESERVER";
+pub const MATRIX_TOKEN_ENV: &str = "CHAT_MATRIX_TOKEN";
+pub const MATRIX_ROOM_ENV: &str = "CHAT_MATRIX_ROOM";
+pub const MATRIX_CHAT_ENV: &str = "CHAT_MATRIX_CHAT";
+pub const MATRIX_USERS_ENV: &str = "CHAT_MATRIX_USERS";
+pub const POLL_EVERY: Duration = Duration::from_secs(2);
+// Events are capped at 64KB; parts stay well under it once formatted twice
+const MAX_MESSAGE_CHARS: usize = 16000;
+
+pub struct Matrix {
+    client: reqwest::Client,
+    homeserver: String,
+    token: String,
+    // An ID (!abc:server) or an alias (#name:server) until the first sync
+    room: String,
+    // The bot's own user, whose messages are the ones it posted
+    user_id: String,
+    // Users (@name:server) that may write to the chat; anyone in the room could otherwise
+    users: Vec<String>,
+    // The sync token to continue from, once history from before startup is skipped
+    since: Option<String>,
+    sent: u64,
+    warned_encrypted: bool,
+}
+
+// The bridge CHAT_MATRIX_HOMESERVER, CHAT_MATRIX_TOKEN (an access token for
+// the bot's account), CHAT_MATRIX_ROOM, CHAT_MATRIX_USERS (the users allowed
+// to write) and CHAT_MATRIX_CHAT (the chat file) describe, if the token is
+// set
+pub fn from_env() -> Result<Option<(Matrix, PathBuf)>> {
+    let var = |name: &str| std::env::var(name).ok().filter(|v| !v.trim().is_empty());
+    let Some(token) = var(MATRIX_TOKEN_ENV) else {
+        return Ok(None);
+    };
+    let missing = |name: &str| format!("{} is set but {} is not", MATRIX_TOKEN_ENV, name);
+    let homeserver = var(MATRIX_HOMESERVER_ENV).with_context(|| missing(MATRIX_HOMESERVER_ENV))?;
+    let room = var(MATRIX_ROOM_ENV).with_context(|| missing(MATRIX_ROOM_ENV))?;
+    let chat = var(MATRIX_CHAT_ENV).with_context(|| missing(MATRIX_CHAT_ENV))?;
+    let users = watch::env_list(MATRIX_USERS_ENV);
+    if users.is_empty() {
+        bail!("{}", missing(MATRIX_USERS_ENV));
+    }
+    let homeserver = homeserver.trim().trim_end_matches('/');
+    let homeserver = match homeserver.contains("://") {
+        true => homeserver.to_string(),
+        false => format!("https://{}", homeserver),
+    };
+    let matrix = Matrix {
+        client: reqwest::Client::builder().timeout(Duration::from_secs(20)).build()?,
+        homeserver,
+        token: token.trim().to_string(),
+        room: room.trim().to_string(),
+        user_id: String::new(),
+        users,
+        since: None,
+        sent: 0,
+        warned_encrypted: false,
+    };
+    Ok(Some((matrix, PathBuf::from(chat))))
+}
+
+impl Matrix {
+    async fn call(&self, method: reqwest::Method, path: &str, body: Option<Value>) -> Result<Value> {
+        let url = format!("{}/_matrix/client/v3/{}", self.homeserver, path);
+        let mut request = self.client.request(method, url).bearer_auth(&self.token);
+        if let Some(body) = body {
+            request = request.json(&body);
+        }
+        let response = request.send().await?;
+        let status = response.status();
+        let body: Value = response.json().await.unwrap_or(Value::Null);
+        if !status.is_success() {
+            let reason = body["error"].as_str().unwrap_or_else(|| status.canonical_reason().unwrap_or("unknown error"));
+            bail!("{} failed: {}", path.split('?').next().unwrap_or(path), reason);
+        }
+        Ok(body)
+    }
+
+    // Looks up who the token belongs to and which room an alias names
+    async fn connect(&mut self) -> Result<()> {
+        let whoami = self.call(reqwest::Method::GET, "account/whoami", None).await?;
+        self.user_id = whoami["user_id"].as_str().context("whoami returned no user_id")?.to_string();
+        if self.room.starts_with('#') {
+            let path = format!("directory/room/{}", percent_encode(&self.room));
+            let found = self.call(reqwest::Method::GET, &path, None).await?;
+            self.room = found["room_id"].as_str().with_context(|| format!("no room called {}", self.room))?.to_string();
+        }
+        debug_log(&format!("init: matrix bridge as {} in {}", self.user_id, self.room));
+        Ok(())
+    }
+
+    async fn sync(&self, since: Option<&str>) -> Result<Value> {
+        let filter = json!({
+            "room": { "rooms": [self.room], "timeline": { "limit": 50 } },
+            "presence": { "not_types": ["*"] },
+            "account_data": { "not_types": ["*"] },
+        });
+        let mut path = format!("sync?timeout=0&filter={}", percent_encode(&filter.to_string()));
+        if let Some(since) = since {
+            path.push_str(&format!("&since={}", percent_encode(since)));
+        }
+        self.call(reqwest::Method::GET, &path, None).await
+    }
+}
+
+impl Remote for Matrix {
+    fn name(&self) -> &'static str {
+        "matrix"
+    }
+
+    // The markdown goes as the plain body, with HTML alongside for clients
+    // that render it
+    async fn post(&mut self, text: &str, from_user: bool) -> Result<()> {
+        let text = match from_user {
+            true => format!("_From the chat file:_\n\n{}", text),
+            false => text.to_string(),
+        };
+        for part in bridge::split(&text, MAX_MESSAGE_CHARS) {
+            self.sent += 1;
+            let txn = format!("chatmd-{}-{}", chrono::Utc::now().timestamp_millis(), self.sent);
+            let path = format!("rooms/{}/send/m.room.message/{}", percent_encode(&self.room), txn);
+            let content = json!({
+                "msgtype": "m.text",
+                "body": part,
+                "format": "org.matrix.custom.html",
+                "formatted_body": to_html(&part),
+            });
+            self.call(reqwest::Method::PUT, &path, Some(content)).await?;
+        }
+        Ok(())
+    }
+
+    async fn receive(&mut self) -> Result<Vec<String>> {
+        let Some(since) = self.since.clone() else {
+            self.connect().await?;
+            let sync = self.sync(None).await?;
+            self.since = sync["next_batch"].as_str().map(str::to_string);
+            return Ok(Vec::new());
+        };
+
+        let sync = self.sync(Some(&since)).await?;
+        if let Some(next) = sync["next_batch"].as_str() {
+            self.since = Some(next.to_string());
+        }
+        let mut messages = Vec::new();
+        for event in sync["rooms"]["join"][&self.room]["timeline"]["events"].as_array().into_iter().flatten() {
+            if event["sender"].as_str() == Some(self.user_id.as_str()) {
+                continue;
+            }
+            match event["type"].as_str() {
+                Some("m.room.message") => {}
+                Some("m.room.encrypted") if !self.warned_encrypted => {
+                    self.warned_encrypted = true;
+                    debug_log("error: matrix bridge: the room is encrypted; run the bridge through pantalaimon to read it");
+                    continue;
+                }
+                _ => continue,
+            }
+            // Notices are what other bots send; edits arrive as new events
+            // and are skipped along with them
+            let content = &event["content"];
+            if content["msgtype"].as_str() != Some("m.text") || content["m.relates_to"]["rel_type"].as_str() == Some("m.replace") {
+                continue;
+            }
+            let sender = event["sender"].as_str().unwrap_or_default();
+            if !self.users.iter().any(|user| user == sender) {
+                debug_log(&format!("error: matrix bridge: ignoring a message from {} (not in {})", sender, MATRIX_USERS_ENV));
+                continue;
+            }
+            if let Some(body) = content["body"].as_str() {
+                messages.push(body.to_string());
+            }
+        }
+        Ok(messages)
+    }
+}
+
+fn to_html(text: &str) -> String {
+    let options = Options::ENABLE_TABLES | Options::ENABLE_STRIKETHROUGH;
+    let mut out = String::new();
+    html::push_html(&mut out, Parser::new_ext(text, options));
+    out.trim_end().to_string()
+}
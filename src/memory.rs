@@ -0,0 +1,154 @@
+use crate::{
+    debug_log, files, history, parser,
+    provider::{ApiClient, RequestParams},
+    Message,
+};
+use anyhow::{Context, Result};
+use std::{
+    collections::HashSet,
+    path::{Path, PathBuf},
+};
+use tokio::fs;
+
+pub const MEMORY_ENV: &str = "CHAT_MEMORY";
+pub const MEMORY_FILE_ENV: &str = "CHAT_MEMORY_FILE";
+pub const PROJECT_MEMORY_ENV: &str = "CHAT_PROJECT_MEMORY";
+
+// Shared by every chat. Not a `.md` file, so a watched directory never
+// mistakes it for a chat.
+const DEFAULT_MEMORY_FILE: &str = ".chat-memory.txt";
+// A message containing this is never mined for memories
+const OPT_OUT: &str = "<!-- no-memory -->";
+const MAX_INJECTED: usize = 12;
+const NONE_REPLY: &str = "NONE";
+
+const EXTRACT_INSTRUCTIONS: &str = "You maintain a list of durable facts about the user: preferences, background, \
+ongoing projects, standing instructions. From the exchange below, list only new facts worth remembering in \
+future, unrelated conversations, one per line starting with \"- \". Skip anything temporary, already known, or \
+about the assistant. If there is nothing new, reply NONE.";
+
+pub fn path() -> PathBuf {
+    std::env::var(MEMORY_FILE_ENV)
+        .ok()
+        .filter(|p| !p.trim().is_empty())
+        .map(PathBuf::from)
+        .unwrap_or_else(|| PathBuf::from(DEFAULT_MEMORY_FILE))
+}
+
+pub fn opted_out(message: &str) -> bool {
+    message.contains(OPT_OUT)
+}
+
+// One memory per `- ` line; anything else in the file is the user's own
+async fn load() -> Vec<String> {
+    let Ok(content) = fs::read_to_string(path()).await else {
+        return Vec::new();
+    };
+    content
+        .lines()
+        .filter_map(|line| line.trim().strip_prefix("- "))
+        .map(|memory| memory.trim().to_string())
+        .filter(|memory| !memory.is_empty())
+        .collect()
+}
+
+// A system message with the memories most relevant to `query`: all of them
+// while there are few, otherwise those sharing the most words with it
+pub async fn context_for(query: &str) -> Option<Message> {
+    let mut memories = load().await;
+    if memories.is_empty() {
+        return None;
+    }
+
+    if memories.len() > MAX_INJECTED {
+        let query_words = words(query);
+        let mut scored: Vec<(usize, usize, String)> = memories
+            .into_iter()
+            .enumerate()
+            .map(|(i, memory)| (words(&memory).intersection(&query_words).count(), i, memory))
+            .collect();
+        // Most overlap first; among equals, the most recently added
+        scored.sort_by(|a, b| b.0.cmp(&a.0).then(b.1.cmp(&a.1)));
+        memories = scored.into_iter().take(MAX_INJECTED).map(|(_, _, memory)| memory).collect();
+    }
+
+    let list: Vec<String> = memories.iter().map(|m| format!("- {}", m)).collect();
+    Some(Message::new(
+        "system",
+        format!("What you remember about the user from earlier conversations:\n{}", list.join("\n")),
+    ))
+}
+
+// Asks the model for new durable facts in one exchange of `chat` and
+// appends them to the memory file, returning how many were added
+pub async fn remember(chat: &Path, user: &str, reply: &str, model: &str, api_client: &ApiClient) -> Result<usize> {
+    let known = load().await;
+    let mut prompt = String::new();
+    if !known.is_empty() {
+        prompt.push_str("Already known:\n");
+        for memory in &known {
+            prompt.push_str(&format!("- {}\n", memory));
+        }
+        prompt.push('\n');
+    }
+    prompt.push_str(&format!("User: {}\n\nAssistant: {}", user, reply));
+
+    let messages = vec![Message::new("system", EXTRACT_INSTRUCTIONS), Message::new("user", prompt)];
+    let extracted = api_client.call_api(messages, model, &RequestParams::default()).await?;
+    history::record(chat, &extracted.usage, &extracted.text).await;
+    let response = extracted.text;
+    if response.trim() == NONE_REPLY {
+        return Ok(0);
+    }
+
+    let known: HashSet<String> = known.iter().map(|m| m.to_lowercase()).collect();
+    let new: Vec<&str> = response
+        .lines()
+        .filter_map(|line| line.trim().strip_prefix("- "))
+        .map(str::trim)
+        .filter(|memory| !memory.is_empty() && !known.contains(&memory.to_lowercase()))
+        .collect();
+    if new.is_empty() {
+        return Ok(0);
+    }
+
+    let path = path();
+    let _lock = files::lock(&path).await?;
+    let mut content = fs::read_to_string(&path).await.unwrap_or_default();
+    if !content.is_empty() && !content.ends_with('\n') {
+        content.push('\n');
+    }
+    for memory in &new {
+        content.push_str(&format!("- {}\n", memory));
+    }
+    files::write_atomic(&path, content).await?;
+    debug_log(&format!("write: remembered {} new facts in {}", new.len(), path.display()));
+    Ok(new.len())
+}
+
+// A project memory is a markdown file several chats opt into and the user
+// maintains. All of it is sent, ahead of the history, except private notes.
+pub async fn project_context(path: &Path) -> Result<Option<Message>> {
+    let content = fs::read_to_string(path)
+        .await
+        .with_context(|| format!("project memory {} not found", path.display()))?;
+    let content = parser::strip_private(&parser::normalize(&content));
+    if content.trim().is_empty() {
+        return Ok(None);
+    }
+    Ok(Some(Message::new(
+        "system",
+        format!(
+            "Shared notes on the project this conversation is about. Other conversations use them too, so treat \
+             them as settled unless the user says otherwise:\n\n{}",
+            content.trim()
+        ),
+    )))
+}
+
+fn words(text: &str) -> HashSet<String> {
+    text.split(|c: char| !c.is_alphanumeric())
+        .filter(|w| w.len() > 3)
+        .map(str::to_lowercase)
+        .collect()
+}
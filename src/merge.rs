@@ -0,0 +1,103 @@
+use crate::crypt;
+use std::{
+    ops::Range,
+    path::{Path, PathBuf},
+};
+
+// Three-way merge of two edits to the same text: `theirs` is what the user
+// saved while a request was in flight, `ours` is the reply written into the
+// text as it was when the request started (`base`). Each side is reduced to
+// the one region it changed; if the regions don't overlap both are applied.
+// Returns None when they do.
+pub fn merge(base: &str, theirs: &str, ours: &str) -> Option<String> {
+    let (their_range, their_text) = changed_region(base, theirs);
+    let (our_range, our_text) = changed_region(base, ours);
+
+    // Ours goes first when both insert at the same point: text typed below a
+    // sent message belongs after the reply to it
+    let (first, first_text, second, second_text) = if our_range.end <= their_range.start {
+        (our_range, our_text, their_range, their_text)
+    } else if their_range.end <= our_range.start {
+        (their_range, their_text, our_range, our_text)
+    } else {
+        return None;
+    };
+
+    Some(format!(
+        "{}{}{}{}{}",
+        &base[..first.start],
+        first_text,
+        &base[first.end..second.start],
+        second_text,
+        &base[second.end..]
+    ))
+}
+
+// chat.md -> chat.md.conflict, where the user's version goes if it can't be
+// merged. Not an .md file, so it is never watched as a chat.
+pub fn conflict_path(chat_file: &Path) -> PathBuf {
+    let name = chat_file.file_name().unwrap_or_default().to_string_lossy();
+    // chat.md.gpg -> chat.md.conflict.gpg, so it is encrypted too
+    let plain = crypt::plain_name(&name);
+    chat_file.with_file_name(format!("{}.conflict{}", plain, &name[plain.len()..]))
+}
+
+// The span of `base` that was replaced to get `edited`, and its replacement
+fn changed_region<'a>(base: &str, edited: &'a str) -> (Range<usize>, &'a str) {
+    let mut prefix = base
+        .bytes()
+        .zip(edited.bytes())
+        .take_while(|(a, b)| a == b)
+        .count();
+    while !base.is_char_boundary(prefix) || !edited.is_char_boundary(prefix) {
+        prefix -= 1;
+    }
+
+    let max_suffix = base.len().min(edited.len()) - prefix;
+    let mut suffix = base
+        .bytes()
+        .rev()
+        .zip(edited.bytes().rev())
+        .take(max_suffix)
+        .take_while(|(a, b)| a == b)
+        .count();
+    while !base.is_char_boundary(base.len() - suffix) || !edited.is_char_boundary(edited.len() - suffix) {
+        suffix -= 1;
+    }
+
+    (prefix..base.len() - suffix, &edited[prefix..edited.len() - suffix])
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn edits_in_different_places_are_both_kept() {
+        let base = "first\n\n\n***\nreply\n***\nsecond\n\n";
+        let theirs = "first, fixed\n\n\n***\nreply\n***\nsecond\n\n";
+        let ours = "first\n\n\n***\nreply\n***\nsecond\n\n\n***\nanswer\n***\n";
+        assert_eq!(
+            merge(base, theirs, ours).as_deref(),
+            Some("first, fixed\n\n\n***\nreply\n***\nsecond\n\n\n***\nanswer\n***\n")
+        );
+    }
+
+    #[test]
+    fn text_typed_while_waiting_goes_after_the_reply() {
+        let base = "question\n\n";
+        assert_eq!(
+            merge(base, "question\n\nnext", "question\n\n\n***\nanswer\n***\n").as_deref(),
+            Some("question\n\n\n***\nanswer\n***\nnext")
+        );
+    }
+
+    #[test]
+    fn overlapping_edits_conflict() {
+        // The reply replaces a placeholder the user edited meanwhile
+        let base = "question\n\n\n***\nthinking…\n***\n";
+        let theirs = "question\n\n\n***\nnot an answer\n***\n";
+        let ours = "question\n\n\n***\nanswer\n***\n";
+        assert_eq!(merge(base, theirs, ours), None);
+    }
+}
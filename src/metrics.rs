@@ -0,0 +1,175 @@
+use crate::{
+    health,
+    http::{self, Request, Response},
+    provider, tokens,
+};
+use anyhow::{Context, Result};
+use std::{
+    collections::BTreeMap,
+    fmt::Write,
+    sync::{Mutex, OnceLock},
+    time::{SystemTime, UNIX_EPOCH},
+};
+use tokio::net::TcpListener;
+
+pub const METRICS_ADDR_ENV: &str = "CHAT_METRICS_ADDR";
+// Replies take seconds to minutes, so the buckets do too
+const LATENCY_BUCKETS: &[f64] = &[0.5, 1.0, 2.0, 5.0, 10.0, 20.0, 30.0, 60.0, 120.0, 300.0];
+
+static METRICS: OnceLock<Mutex<Metrics>> = OnceLock::new();
+
+#[derive(Default)]
+struct Model {
+    requests: u64,
+    errors: u64,
+    input_tokens: u64,
+    output_tokens: u64,
+    cost: f64,
+    // Counts per bucket in LATENCY_BUCKETS, then the sum in seconds
+    latency: Vec<u64>,
+    latency_sum: f64,
+}
+
+struct Metrics {
+    started: f64,
+    models: BTreeMap<String, Model>,
+    watcher_events: u64,
+    watcher_restarts: u64,
+}
+
+fn metrics() -> &'static Mutex<Metrics> {
+    METRICS.get_or_init(|| {
+        let started = SystemTime::now().duration_since(UNIX_EPOCH).unwrap_or_default().as_secs_f64();
+        Mutex::new(Metrics {
+            started,
+            models: BTreeMap::new(),
+            watcher_events: 0,
+            watcher_restarts: 0,
+        })
+    })
+}
+
+// Called as the watcher starts, so the start time is when it did
+pub fn init() {
+    metrics();
+}
+
+fn update(f: impl FnOnce(&mut Metrics)) {
+    f(&mut metrics().lock().unwrap_or_else(|e| e.into_inner()));
+}
+
+// A request answered, with the same counts the usage log keeps
+pub fn request(usage: &provider::Usage) {
+    let (model, input_tokens, output_tokens) = (usage.model.as_str(), usage.input_tokens, usage.output_tokens);
+    update(|m| {
+        let model_stats = m.models.entry(model.to_string()).or_default();
+        model_stats.requests += 1;
+        model_stats.input_tokens += input_tokens as u64;
+        model_stats.output_tokens += output_tokens as u64;
+        model_stats.cost += tokens::cost(model, input_tokens, output_tokens).unwrap_or(0.0);
+        if model_stats.latency.is_empty() {
+            model_stats.latency = vec![0; LATENCY_BUCKETS.len()];
+        }
+        let seconds = usage.latency.as_secs_f64();
+        for (count, bound) in model_stats.latency.iter_mut().zip(LATENCY_BUCKETS) {
+            if seconds <= *bound {
+                *count += 1;
+            }
+        }
+        model_stats.latency_sum += seconds;
+    });
+}
+
+// A request that failed, whatever the reason
+pub fn error(model: &str) {
+    update(|m| m.models.entry(model.to_string()).or_default().errors += 1);
+}
+
+// A change the file watcher reported
+pub fn watcher_event() {
+    update(|m| m.watcher_events += 1);
+}
+
+pub fn watcher_restart() {
+    update(|m| m.watcher_restarts += 1);
+}
+
+// Everything so far, in the Prometheus text format
+pub fn render() -> String {
+    let m = metrics().lock().unwrap_or_else(|e| e.into_inner());
+    let mut out = String::new();
+    let counters: [(&str, &str, fn(&Model) -> String); 5] = [
+        ("chatmd_requests_total", "Requests answered.", |s| s.requests.to_string()),
+        ("chatmd_request_errors_total", "Requests that failed.", |s| s.errors.to_string()),
+        ("chatmd_input_tokens_total", "Tokens sent.", |s| s.input_tokens.to_string()),
+        ("chatmd_output_tokens_total", "Tokens received.", |s| s.output_tokens.to_string()),
+        ("chatmd_cost_dollars_total", "Estimated spend in US dollars.", |s| s.cost.to_string()),
+    ];
+    for (name, help, value) in counters {
+        header(&mut out, name, "counter", help);
+        for (model, stats) in &m.models {
+            let _ = writeln!(out, "{}{{model=\"{}\"}} {}", name, label(model), value(stats));
+        }
+    }
+
+    let name = "chatmd_request_duration_seconds";
+    header(&mut out, name, "histogram", "Time from sending a request to the complete reply.");
+    for (model, stats) in m.models.iter().filter(|(_, s)| !s.latency.is_empty()) {
+        let model = label(model);
+        for (count, bound) in stats.latency.iter().zip(LATENCY_BUCKETS) {
+            let _ = writeln!(out, "{}_bucket{{model=\"{}\",le=\"{}\"}} {}", name, model, bound, count);
+        }
+        let _ = writeln!(out, "{}_bucket{{model=\"{}\",le=\"+Inf\"}} {}", name, model, stats.requests);
+        let _ = writeln!(out, "{}_sum{{model=\"{}\"}} {}", name, model, stats.latency_sum);
+        let _ = writeln!(out, "{}_count{{model=\"{}\"}} {}", name, model, stats.requests);
+    }
+
+    header(&mut out, "chatmd_watcher_events_total", "counter", "File changes the watcher reported.");
+    let _ = writeln!(out, "chatmd_watcher_events_total {}", m.watcher_events);
+    header(&mut out, "chatmd_watcher_restarts_total", "counter", "Times the watcher failed and was restarted.");
+    let _ = writeln!(out, "chatmd_watcher_restarts_total {}", m.watcher_restarts);
+    header(&mut out, "chatmd_start_time_seconds", "gauge", "When the watcher started, in seconds since the epoch.");
+    let _ = writeln!(out, "chatmd_start_time_seconds {}", m.started);
+    out
+}
+
+fn header(out: &mut String, name: &str, kind: &str, help: &str) {
+    let _ = writeln!(out, "# HELP {} {}\n# TYPE {} {}", name, help, name, kind);
+}
+
+fn label(value: &str) -> String {
+    value.replace('\\', "\\\\").replace('"', "\\\"").replace('\n', "\\n")
+}
+
+pub fn response() -> Response {
+    Response::new(200, "text/plain; version=0.0.4; charset=utf-8", render())
+}
+
+// `--metrics addr`, or CHAT_METRICS_ADDR: where the watcher serves
+// /metrics on its own, and the arguments left for it
+pub fn parse_args(args: &[String]) -> Result<(Option<String>, Vec<String>)> {
+    let mut addr = std::env::var(METRICS_ADDR_ENV).ok().filter(|a| !a.trim().is_empty());
+    let mut rest = Vec::new();
+    let mut args = args.iter();
+    while let Some(arg) = args.next() {
+        match arg.as_str() {
+            "--metrics" => addr = Some(args.next().context("--metrics needs an address such as :9464")?.clone()),
+            _ => rest.push(arg.clone()),
+        }
+    }
+    Ok((addr, rest))
+}
+
+// Serves /metrics and the health checks, for a watcher without the web UI
+pub async fn serve(listener: TcpListener) {
+    http::serve(listener, |request: Request| async move {
+        if request.path == "/metrics" {
+            return response().into();
+        }
+        match health::response(&request.path).await {
+            Some(response) => response.into(),
+            None => Response::not_found().into(),
+        }
+    })
+    .await
+}
@@ -0,0 +1,114 @@
+use crate::{logging::debug_log, tokens, Message};
+use anyhow::{bail, Context, Result};
+use std::{
+    collections::hash_map::RandomState,
+    hash::{BuildHasher, Hasher},
+    sync::atomic::{AtomicUsize, Ordering},
+    time::Duration,
+};
+
+pub const PROVIDER: &str = "mock";
+pub const MOCK_REPLY_ENV: &str = "CHAT_MOCK_REPLY";
+pub const MOCK_REPLIES_ENV: &str = "CHAT_MOCK_REPLIES";
+pub const MOCK_LATENCY_ENV: &str = "CHAT_MOCK_LATENCY";
+pub const MOCK_ERRORS_ENV: &str = "CHAT_MOCK_ERRORS";
+
+const DEFAULT_REPLY: &str = "Echo: {message}";
+// Between canned replies in a CHAT_MOCK_REPLIES file
+const REPLY_SEPARATOR: &str = "\n%%\n";
+
+// Requests answered so far, which picks the next canned reply
+static REQUESTS: AtomicUsize = AtomicUsize::new(0);
+
+pub fn active() -> bool {
+    crate::provider::provider_name() == PROVIDER
+}
+
+// Answers without the network: after CHAT_MOCK_LATENCY, fails with the
+// chance CHAT_MOCK_ERRORS gives, and otherwise replies with the next canned
+// reply or CHAT_MOCK_REPLY. Streamed word by word when asked to be.
+pub async fn complete(messages: &[Message], model: &str, on_text: Option<&(dyn Fn(&str) + Send + Sync)>) -> Result<String> {
+    let request = REQUESTS.fetch_add(1, Ordering::Relaxed);
+    let latency = latency()?;
+    let reply = fill(&template(request)?, messages, model, request + 1);
+    debug_log(&format!("call: mock provider answering in {}ms", latency.as_millis()));
+
+    let failure_rate = env(MOCK_ERRORS_ENV)
+        .map(|rate| rate.parse::<f64>().with_context(|| format!("{} must be a fraction like 0.2", MOCK_ERRORS_ENV)))
+        .transpose()?
+        .unwrap_or(0.0);
+    if random() < failure_rate {
+        tokio::time::sleep(latency).await;
+        bail!("API error: status 503 Service Unavailable: mock failure ({}={})", MOCK_ERRORS_ENV, failure_rate);
+    }
+
+    let Some(on_text) = on_text else {
+        tokio::time::sleep(latency).await;
+        return Ok(reply);
+    };
+    let pieces: Vec<&str> = reply.split_inclusive(' ').collect();
+    let step = latency / pieces.len().max(1) as u32;
+    for piece in pieces {
+        tokio::time::sleep(step).await;
+        on_text(piece);
+    }
+    Ok(reply)
+}
+
+// The reply for the `request`th request: its turn in the CHAT_MOCK_REPLIES
+// file, round and round, or CHAT_MOCK_REPLY
+fn template(request: usize) -> Result<String> {
+    if let Some(path) = env(MOCK_REPLIES_ENV) {
+        let path = crate::watch::expand_home(&path);
+        let raw = std::fs::read_to_string(&path).with_context(|| format!("cannot read {}", path.display()))?;
+        let replies: Vec<&str> = raw.split(REPLY_SEPARATOR).map(str::trim).filter(|r| !r.is_empty()).collect();
+        if replies.is_empty() {
+            bail!("{} has no replies", path.display());
+        }
+        return Ok(replies[request % replies.len()].to_string());
+    }
+    Ok(env(MOCK_REPLY_ENV).unwrap_or_else(|| DEFAULT_REPLY.to_string()))
+}
+
+// `{message}` is the last message, `{messages}` how many were sent,
+// `{tokens}` their estimated size, `{model}` the model asked for and `{n}`
+// the request's number
+fn fill(template: &str, messages: &[Message], model: &str, n: usize) -> String {
+    let last = messages.last().map(|m| m.content.trim()).unwrap_or_default();
+    template
+        .replace("{message}", last)
+        .replace("{messages}", &messages.len().to_string())
+        .replace("{tokens}", &tokens::estimate_messages(messages).to_string())
+        .replace("{model}", model)
+        .replace("{n}", &n.to_string())
+}
+
+// `800` (milliseconds) or a range such as `200-1500` to pick from
+fn latency() -> Result<Duration> {
+    let Some(value) = env(MOCK_LATENCY_ENV) else {
+        return Ok(Duration::ZERO);
+    };
+    let ms = |text: &str| -> Result<u64> {
+        let text = text.trim().trim_end_matches("ms");
+        text.parse().with_context(|| format!("{} must be milliseconds like 800 or 200-1500", MOCK_LATENCY_ENV))
+    };
+    let ms = match value.split_once('-') {
+        Some((low, high)) => {
+            let (low, high) = (ms(low)?, ms(high)?);
+            low + (random() * high.saturating_sub(low) as f64) as u64
+        }
+        None => ms(&value)?,
+    };
+    Ok(Duration::from_millis(ms))
+}
+
+fn env(name: &str) -> Option<String> {
+    std::env::var(name).ok().map(|v| v.trim().to_string()).filter(|v| !v.is_empty())
+}
+
+// Between 0 and 1; fresh hasher keys are random enough for this
+fn random() -> f64 {
+    let mut hasher = RandomState::new().build_hasher();
+    hasher.write_usize(REQUESTS.load(Ordering::Relaxed));
+    (hasher.finish() >> 11) as f64 / (1u64 << 53) as f64
+}
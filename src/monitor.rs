@@ -0,0 +1,475 @@
+use crate::{
+    config, envfile, files, health, library,
+    logging::{self, debug_log},
+    metrics, otel, parser, pending,
+    provider::ApiClient,
+    reply, starter, validate, watch, ChatContext,
+};
+use anyhow::Result;
+use notify::{Config, Event, PollWatcher, RecommendedWatcher, RecursiveMode, Watcher as _};
+use std::{
+    collections::HashMap,
+    path::{Path, PathBuf},
+    sync::{
+        atomic::{AtomicBool, Ordering},
+        Arc, RwLock,
+    },
+    time::Duration,
+};
+use tokio::{
+    sync::{mpsc, Mutex},
+    task::JoinHandle,
+    // Timers follow tokio's clock, so a test can pause and advance it
+    time::Instant,
+};
+
+// The watch loop: a worker for each chat, fed by file change events, with
+// the watcher restarted when it fails and settings reloaded when their files
+// are saved
+
+const MAX_QUEUED_CHANGES: usize = 4;
+// How long shutdown waits for replies that are already on their way
+const SHUTDOWN_TIMEOUT: Duration = Duration::from_secs(60);
+// Minimum time between watcher restarts, so one that keeps failing doesn't spin
+const WATCHER_RETRY: Duration = Duration::from_secs(5);
+
+// Problems are reported as soon as a file is saved, not when it is next used
+pub fn report_library(library: &library::PromptLibrary) {
+    debug_log(&format!("load: prompt library ({})", library.summary()));
+    for error in &library.errors {
+        debug_log(&format!("error: {}", error));
+    }
+}
+
+// Shared by every chat worker
+#[derive(Clone)]
+pub struct Services {
+    pub api_client: Arc<ApiClient>,
+    pub validators: Arc<validate::Validators>,
+    pub library: Arc<RwLock<library::PromptLibrary>>,
+    // Cleared on shutdown: workers finish what they are doing and stop
+    pub running: Arc<AtomicBool>,
+}
+
+// Processes one chat file's changes in order, on its own task, so a slow
+// reply in one conversation never holds up the others
+struct ChatWorker {
+    queue: mpsc::Sender<()>,
+    task: JoinHandle<()>,
+}
+
+impl ChatWorker {
+    async fn spawn(path: PathBuf, content: String, services: Services) -> Self {
+        let chat_context = ChatContext::new(path.clone(), content.clone());
+        reply::sync_sidecars(&content, &chat_context).await;
+        let chat_context = Arc::new(Mutex::new(chat_context));
+
+        // A request interrupted by a crash or restart: forget what was seen,
+        // so the unanswered message is picked up and sent again below
+        let interrupted = pending::load(&path).await;
+        if let Some(interrupted) = &interrupted {
+            debug_log(&format!(
+                "load: resuming message to {} interrupted at {}: {:?}",
+                interrupted.model, interrupted.started_at, interrupted.message
+            ));
+            // Sending again saves a fresh one
+            pending::clear(&path).await;
+
+            // A placeholder left behind would pass for the reply
+            let placeholder = parser::placeholder(&chat_context.lock().await.separator);
+            if let Some(at) = content.find(&placeholder) {
+                let restored = format!("{}{}", &content[..at], &content[at + placeholder.len()..]);
+                if let Err(e) = files::write_chat(&path, &restored).await {
+                    debug_log(&format!("error: cannot remove the typing indicator: {}", e));
+                }
+            }
+        }
+        let last_content = match interrupted {
+            Some(_) => Arc::new(Mutex::new(String::new())),
+            None => Arc::new(Mutex::new(content)),
+        };
+
+        let (queue, mut changes) = mpsc::channel(MAX_QUEUED_CHANGES);
+        let file = watch::display_path(&path);
+        let task = tokio::spawn(logging::CURRENT_FILE.scope(file, async move {
+            while changes.recv().await.is_some() {
+                if !services.running.load(Ordering::SeqCst) {
+                    break;
+                }
+                debug_log(&format!("detect: file change in {}", watch::display_path(&path)));
+                let content = match files::read_chat(&path).await {
+                    Ok(content) => content,
+                    // Renamed away mid-save; the new file brings its own event
+                    Err(e) if e.kind() == std::io::ErrorKind::NotFound => {
+                        debug_log(&format!("skip: {} is gone for now", watch::display_path(&path)));
+                        continue;
+                    }
+                    Err(e) => {
+                        debug_log(&format!("error: cannot read {}: {}", watch::display_path(&path), e));
+                        continue;
+                    }
+                };
+
+                let processed = reply::process_new_messages(
+                    content,
+                    last_content.clone(),
+                    services.api_client.clone(),
+                    chat_context.clone(),
+                    services.validators.clone(),
+                    services.library.clone(),
+                );
+                if let Err(e) = otel::exchange(&path, processed).await {
+                    debug_log(&format!("error: {}", e));
+                }
+            }
+        }));
+
+        if interrupted.is_some() {
+            let _ = queue.try_send(());
+        }
+
+        Self { queue, task }
+    }
+
+    // Every queued change re-reads the file, so when the queue is full the
+    // ones already waiting cover this change too
+    fn notify(&self, path: &Path) {
+        if let Err(mpsc::error::TrySendError::Full(_)) = self.queue.try_send(()) {
+            debug_log(&format!("skip: {} already has changes queued", watch::display_path(path)));
+        }
+    }
+}
+
+// Where file changes come from: notify for the watcher, or whatever a
+// test wants to send. Dropping what `watch` returns stops the watching.
+pub trait Notifier {
+    fn watch(&self, tx: &mpsc::Sender<Result<Event, notify::Error>>, paths: &[PathBuf]) -> Result<Box<dyn std::any::Any>>;
+}
+
+pub struct FsNotifier {
+    pub poll_interval: Option<Duration>,
+}
+
+impl Notifier for FsNotifier {
+    fn watch(&self, tx: &mpsc::Sender<Result<Event, notify::Error>>, paths: &[PathBuf]) -> Result<Box<dyn std::any::Any>> {
+        Ok(Box::new(start_watcher(self.poll_interval, tx, paths)?))
+    }
+}
+
+// Reports only the changes a test announces with `touch`
+#[cfg(test)]
+#[derive(Default)]
+struct ManualNotifier {
+    tx: std::sync::Mutex<Option<mpsc::Sender<Result<Event, notify::Error>>>>,
+}
+
+#[cfg(test)]
+impl ManualNotifier {
+    async fn touch(&self, path: &Path) {
+        let tx = self.tx.lock().unwrap().clone();
+        if let Some(tx) = tx {
+            let kind = notify::EventKind::Modify(notify::event::ModifyKind::Any);
+            let _ = tx.send(Ok(Event::new(kind).add_path(path.to_path_buf()))).await;
+        }
+    }
+}
+
+#[cfg(test)]
+impl Notifier for ManualNotifier {
+    fn watch(&self, tx: &mpsc::Sender<Result<Event, notify::Error>>, _paths: &[PathBuf]) -> Result<Box<dyn std::any::Any>> {
+        *self.tx.lock().unwrap() = Some(tx.clone());
+        Ok(Box::new(()))
+    }
+}
+
+// The watch loop: answers the chats in `watch_set` as `notifier` reports
+// changes to them, until `shutdown` completes, then waits for the replies
+// still on their way
+pub async fn run(
+    watch_set: &watch::WatchSet,
+    services: Services,
+    mut env_file: Option<envfile::EnvFile>,
+    notifier: &dyn Notifier,
+    shutdown: impl std::future::Future<Output = ()>,
+) -> Result<()> {
+    let mut chats = HashMap::new();
+    for path in watch_set.files() {
+        // Watching a file that isn't there would silently do nothing
+        if !path.exists() {
+            starter::create(&path).await?;
+            debug_log(&format!("init: created {} from the starter template", watch::display_path(&path)));
+        }
+        let content = files::read_chat(&path).await.unwrap_or_default();
+        chats.insert(path.clone(), ChatWorker::spawn(path, content, services.clone()).await);
+    }
+
+    let (tx, mut rx) = mpsc::channel(10);
+
+    let library = &services.library;
+    let mut watched = watch_set.watch_paths();
+    watched.extend(library.read().unwrap().dirs().filter(|d| d.is_dir()).map(Path::to_path_buf));
+    // The directory rather than the file, so a .env created later is seen
+    watched.extend(env_file.iter().flat_map(|f| f.paths()).filter_map(|p| p.parent()).map(Path::to_path_buf));
+    let mut watcher = Some(notifier.watch(&tx, &watched)?);
+    // Set when the watcher reported an error and must be rebuilt
+    let mut restart_at: Option<Instant> = None;
+    let mut last_restart: Option<Instant> = None;
+
+    debug_log("init: chat monitor started");
+
+    // Files with unprocessed changes, and when they may be processed. Every
+    // event pushes the deadline back, so a burst of writes from one save is
+    // parsed once, after the file settles.
+    let debounce = config::debounce_window();
+    let mut pending: HashMap<PathBuf, Instant> = HashMap::new();
+    tokio::pin!(shutdown);
+    let mut heartbeat = tokio::time::interval(health::HEARTBEAT);
+
+    while services.running.load(Ordering::SeqCst) {
+        health::beat(restart_at.is_none());
+        let next_due = pending.values().min().copied();
+        tokio::select! {
+            Some(res) = rx.recv() => {
+                // A dropped event queue or a failed watch leaves the watcher
+                // silently deaf, so start a new one rather than carry on
+                let event = match res {
+                    Ok(event) if !event.need_rescan() => {
+                        metrics::watcher_event();
+                        event
+                    }
+                    Ok(_) => {
+                        debug_log("error: watcher dropped events, restarting it");
+                        restart_at.get_or_insert(last_restart.map_or_else(Instant::now, |t| t + WATCHER_RETRY));
+                        continue;
+                    }
+                    Err(e) => {
+                        debug_log(&format!("error: watcher failed ({}), restarting it", e));
+                        restart_at.get_or_insert(last_restart.map_or_else(Instant::now, |t| t + WATCHER_RETRY));
+                        continue;
+                    }
+                };
+                if event.paths.iter().any(|p| library.read().unwrap().contains_path(p)) {
+                    let mut library = library.write().unwrap();
+                    library.reload();
+                    report_library(&library);
+                    continue;
+                }
+                if let Some(env_file) = env_file.as_mut().filter(|f| event.paths.iter().any(|p| f.contains(p))) {
+                    reload_env(env_file, &services.api_client);
+                    continue;
+                }
+                // Editors that save atomically rename a temp file over the
+                // chat, which shows up as a create or rename, not a write
+                if event.kind.is_remove() {
+                    continue;
+                }
+
+                for path in event.paths.iter().filter_map(|p| watch_set.chat_path(p)) {
+                    pending.insert(path, Instant::now() + debounce);
+                }
+            }
+            _ = tokio::time::sleep_until(next_due.unwrap_or_else(Instant::now)), if next_due.is_some() => {
+                let now = Instant::now();
+                let due: Vec<PathBuf> = pending
+                    .iter()
+                    .filter(|(_, deadline)| **deadline <= now)
+                    .map(|(path, _)| path.clone())
+                    .collect();
+
+                for path in due {
+                    pending.remove(&path);
+
+                    // A file that appeared after startup starts empty, so
+                    // whatever is in it on first save is seen as new
+                    if !chats.contains_key(&path) {
+                        debug_log(&format!("load: new chat file {}", watch::display_path(&path)));
+                        let worker = ChatWorker::spawn(path.clone(), String::new(), services.clone()).await;
+                        chats.insert(path.clone(), worker);
+                    }
+                    chats[&path].notify(&path);
+                }
+            }
+            _ = tokio::time::sleep_until(restart_at.unwrap_or_else(Instant::now)), if restart_at.is_some() => {
+                last_restart = Some(Instant::now());
+                // Release the old watches first, in case they hit the limit
+                drop(watcher.take());
+                match notifier.watch(&tx, &watched) {
+                    Ok(restarted) => {
+                        watcher.replace(restarted);
+                        restart_at = None;
+                        metrics::watcher_restart();
+                        debug_log("init: watcher restarted");
+                        // Anything saved while it was down went unseen
+                        for path in chats.keys() {
+                            pending.insert(path.clone(), Instant::now() + debounce);
+                        }
+                    }
+                    Err(e) => {
+                        debug_log(&format!("error: cannot restart watcher: {}", e));
+                        restart_at = Some(Instant::now() + WATCHER_RETRY);
+                    }
+                }
+            }
+            // Only wakes the loop, so the health check sees it alive
+            _ = heartbeat.tick() => {}
+            _ = &mut shutdown => {
+                debug_log("Shutting down...");
+                services.running.store(false, Ordering::SeqCst);
+                break;
+            }
+        }
+    }
+
+    // Closing the queues ends idle workers; busy ones write the reply they
+    // are waiting for first, since the request has already been paid for
+    let tasks: Vec<JoinHandle<()>> = chats.into_values().map(|worker| worker.task).collect();
+    let in_flight = async {
+        for task in tasks {
+            let _ = task.await;
+        }
+    };
+    tokio::select! {
+        _ = in_flight => {}
+        _ = tokio::time::sleep(SHUTDOWN_TIMEOUT) => {
+            debug_log("error: gave up waiting for replies in flight");
+        }
+        _ = shutdown_signal() => {
+            debug_log("skip: not waiting for replies in flight");
+        }
+    }
+
+    Ok(())
+}
+
+// Watches `paths`, sending every event and error to `tx`
+fn start_watcher(
+    poll_interval: Option<Duration>,
+    tx: &mpsc::Sender<Result<Event, notify::Error>>,
+    paths: &[PathBuf],
+) -> Result<Box<dyn notify::Watcher>> {
+    let tx = tx.clone();
+    let forward = move |res: Result<Event, notify::Error>| {
+        let wanted = match &res {
+            Ok(event) => {
+                event.need_rescan() || event.kind.is_modify() || event.kind.is_create() || event.kind.is_remove()
+            }
+            Err(_) => true,
+        };
+        if wanted {
+            let _ = tx.blocking_send(res);
+        }
+    };
+    let mut watcher: Box<dyn notify::Watcher> = match poll_interval {
+        Some(interval) => Box::new(PollWatcher::new(forward, Config::default().with_poll_interval(interval))?),
+        None => Box::new(RecommendedWatcher::new(forward, Config::default())?),
+    };
+
+    for path in paths {
+        watcher.watch(path, RecursiveMode::NonRecursive)?;
+    }
+    Ok(watcher)
+}
+
+// Applies an edited env file. Chat settings pick up the new values on their next
+// change; the API key is swapped here since it is held by the client.
+fn reload_env(env_file: &mut envfile::EnvFile, api_client: &ApiClient) {
+    let changed = env_file.reload();
+    if changed.is_empty() {
+        debug_log("unchanged: env file");
+        return;
+    }
+    debug_log(&format!("load: reloaded env file ({})", changed.join(", ")));
+
+    if changed.iter().any(|key| key == config::API_KEY_ENV) {
+        match std::env::var(config::API_KEY_ENV) {
+            Ok(api_key) if !api_key.trim().is_empty() => api_client.set_api_key(api_key),
+            _ => debug_log(&format!("error: {} was removed, keeping the previous key", config::API_KEY_ENV)),
+        }
+    }
+}
+
+// Ctrl-C, or SIGTERM from a service manager or `kill`
+pub async fn shutdown_signal() {
+    #[cfg(unix)]
+    {
+        use tokio::signal::unix::{signal, SignalKind};
+        match signal(SignalKind::terminate()) {
+            Ok(mut terminate) => {
+                tokio::select! {
+                    _ = tokio::signal::ctrl_c() => {}
+                    _ = terminate.recv() => {}
+                }
+            }
+            Err(_) => {
+                let _ = tokio::signal::ctrl_c().await;
+            }
+        }
+    }
+    #[cfg(not(unix))]
+    {
+        let _ = tokio::signal::ctrl_c().await;
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::{provider, testenv};
+
+    // Reads the chat until `done` says it has what the test waits for
+    async fn wait_for(chat: &Path, done: impl Fn(&str) -> bool) -> String {
+        for _ in 0..100 {
+            let content = std::fs::read_to_string(chat).unwrap();
+            if done(&content) {
+                return content;
+            }
+            tokio::time::sleep(Duration::from_millis(50)).await;
+        }
+        panic!("gave up waiting; the chat reads {:?}", std::fs::read_to_string(chat).unwrap());
+    }
+
+    #[tokio::test(start_paused = true)]
+    async fn answers_a_saved_message_once_the_file_settles() {
+        let dir = std::env::temp_dir().join(format!("chatmd-monitor-{}", std::process::id()));
+        std::fs::create_dir_all(&dir).unwrap();
+        let _isolated = testenv::isolate(&dir);
+        let chat = dir.join("chat.md");
+        std::fs::write(&chat, "").unwrap();
+
+        let watch_set = watch::WatchSet::from_args(&[chat.display().to_string()], Vec::new(), Vec::new()).unwrap();
+        let handler: provider::Handler = Arc::new(|messages, _| Ok(format!("echo: {}", messages.last().unwrap().content)));
+        let services = Services {
+            api_client: Arc::new(ApiClient::with_handler(handler)),
+            validators: Arc::new(validate::Validators::from_env()),
+            library: Arc::new(RwLock::new(library::PromptLibrary::default())),
+            running: Arc::new(AtomicBool::new(true)),
+        };
+        let notifier = ManualNotifier::default();
+        let (stop, stopped) = tokio::sync::oneshot::channel::<()>();
+        let watching = run(&watch_set, services, None, &notifier, async {
+            let _ = stopped.await;
+        });
+
+        let test = async {
+            tokio::time::sleep(Duration::from_millis(10)).await;
+            std::fs::write(&chat, "hello\n\n").unwrap();
+            notifier.touch(&chat).await;
+            // Nothing happens until the file has been quiet for the debounce window
+            tokio::time::sleep(config::debounce_window() / 2).await;
+            assert_eq!(std::fs::read_to_string(&chat).unwrap(), "hello\n\n");
+            let answered = wait_for(&chat, |content| content.contains("echo: hello")).await;
+
+            // An edited message sent again gets a new reply in place of the old one
+            let edited = answered.replacen("hello", "hello again\n", 1);
+            std::fs::write(&chat, &edited).unwrap();
+            notifier.touch(&chat).await;
+            let regenerated = wait_for(&chat, |content| content.contains("echo: hello again")).await;
+            assert!(!regenerated.contains("echo: hello\n"), "{:?}", regenerated);
+
+            stop.send(()).unwrap();
+        };
+        let (result, ()) = tokio::join!(watching, test);
+        result.unwrap();
+        std::fs::remove_dir_all(&dir).unwrap();
+    }
+}
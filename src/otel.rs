@@ -0,0 +1,227 @@
+use crate::{http, logging::debug_log, watch};
+use serde_json::{json, Value};
+use std::{
+    collections::hash_map::RandomState,
+    future::Future,
+    hash::{BuildHasher, Hasher},
+    path::Path,
+    sync::{
+        atomic::{AtomicU64, Ordering},
+        Arc, Mutex,
+    },
+    time::{Duration, Instant, SystemTime, UNIX_EPOCH},
+};
+
+// The standard OpenTelemetry variables, so a collector set up for other
+// programs works for this one too
+pub const OTLP_ENDPOINT_ENV: &str = "OTEL_EXPORTER_OTLP_ENDPOINT";
+pub const OTLP_TRACES_ENDPOINT_ENV: &str = "OTEL_EXPORTER_OTLP_TRACES_ENDPOINT";
+pub const OTLP_HEADERS_ENV: &str = "OTEL_EXPORTER_OTLP_HEADERS";
+pub const SERVICE_NAME_ENV: &str = "OTEL_SERVICE_NAME";
+
+const DEFAULT_SERVICE_NAME: &str = "chatmd";
+const EXPORT_TIMEOUT: Duration = Duration::from_secs(10);
+// Only exchanges that got as far as a request are worth reporting
+const REQUEST_SPAN: &str = "provider";
+const ROOT_SPAN: &str = "exchange";
+
+static NEXT_ID: AtomicU64 = AtomicU64::new(0);
+
+tokio::task_local! {
+    // The exchange a worker task is handling, which spans are added to
+    static CURRENT: Arc<Trace>;
+}
+
+struct Trace {
+    trace_id: String,
+    root_id: String,
+    spans: Mutex<Vec<Value>>,
+    // Names and durations, in the order spans ended, for the log line
+    timings: Mutex<Vec<(&'static str, Duration)>>,
+}
+
+// A step of an exchange, recorded when it is dropped. Outside an exchange
+// (in `ask`, or a command run from the terminal) it records nothing.
+pub struct Span {
+    trace: Option<Arc<Trace>>,
+    name: &'static str,
+    span_id: String,
+    start: SystemTime,
+    started: Instant,
+    attributes: Vec<Value>,
+    error: Option<String>,
+}
+
+pub fn span(name: &'static str) -> Span {
+    start(name, CURRENT.try_with(Arc::clone).ok(), random_id(8))
+}
+
+fn start(name: &'static str, trace: Option<Arc<Trace>>, span_id: String) -> Span {
+    Span {
+        trace,
+        name,
+        span_id,
+        start: SystemTime::now(),
+        started: Instant::now(),
+        attributes: Vec::new(),
+        error: None,
+    }
+}
+
+impl Span {
+    pub fn attr(&mut self, key: &str, value: impl Into<Value>) {
+        if self.trace.is_some() {
+            self.attributes.push(attribute(key, value.into()));
+        }
+    }
+
+    pub fn fail(&mut self, error: &anyhow::Error) {
+        self.error = Some(format!("{:#}", error));
+    }
+
+    pub fn end(self) {}
+
+    fn to_json(&self, trace: &Trace, elapsed: Duration) -> Value {
+        let start = self.start.duration_since(UNIX_EPOCH).unwrap_or_default().as_nanos();
+        let parent = match self.span_id == trace.root_id {
+            true => "",
+            false => trace.root_id.as_str(),
+        };
+        let status = match &self.error {
+            Some(message) => json!({ "code": 2, "message": message }),
+            None => json!({ "code": 0 }),
+        };
+        json!({
+            "traceId": trace.trace_id,
+            "spanId": self.span_id,
+            "parentSpanId": parent,
+            "name": self.name,
+            // Internal, except the call out to the provider
+            "kind": if self.name == REQUEST_SPAN { 3 } else { 1 },
+            "startTimeUnixNano": start.to_string(),
+            "endTimeUnixNano": (start + elapsed.as_nanos()).to_string(),
+            "attributes": self.attributes,
+            "status": status,
+        })
+    }
+}
+
+impl Drop for Span {
+    fn drop(&mut self) {
+        let Some(trace) = self.trace.take() else {
+            return;
+        };
+        let elapsed = self.started.elapsed();
+        let span = self.to_json(&trace, elapsed);
+        trace.spans.lock().unwrap_or_else(|e| e.into_inner()).push(span);
+        trace.timings.lock().unwrap_or_else(|e| e.into_inner()).push((self.name, elapsed));
+    }
+}
+
+// Runs one pass over a changed chat as a trace. If it sent a request, the
+// time each step took is logged, and the trace exported when an OTLP
+// endpoint is set.
+pub async fn exchange<F>(path: &Path, future: F) -> anyhow::Result<()>
+where
+    F: Future<Output = anyhow::Result<()>>,
+{
+    let trace = Arc::new(Trace {
+        trace_id: random_id(16),
+        root_id: random_id(8),
+        spans: Mutex::new(Vec::new()),
+        timings: Mutex::new(Vec::new()),
+    });
+    let mut root = start(ROOT_SPAN, Some(trace.clone()), trace.root_id.clone());
+    let result = CURRENT.scope(trace.clone(), future).await;
+    root.attr("chat.file", watch::display_path(path));
+    if let Err(e) = &result {
+        root.fail(e);
+    }
+    let elapsed = root.started.elapsed();
+    drop(root);
+
+    let timings = std::mem::take(&mut *trace.timings.lock().unwrap_or_else(|e| e.into_inner()));
+    if !timings.iter().any(|(name, _)| *name == REQUEST_SPAN) {
+        return result;
+    }
+    let steps: Vec<String> = timings
+        .iter()
+        .filter(|(name, _)| *name != ROOT_SPAN)
+        .map(|(name, took)| format!("{} {}", name, duration(*took)))
+        .collect();
+    debug_log(&format!("timing: {} in {} ({})", watch::display_path(path), duration(elapsed), steps.join(", ")));
+
+    if let Some(endpoint) = endpoint() {
+        let spans = std::mem::take(&mut *trace.spans.lock().unwrap_or_else(|e| e.into_inner()));
+        tokio::spawn(export(endpoint, spans));
+    }
+    result
+}
+
+// OTEL_EXPORTER_OTLP_TRACES_ENDPOINT as given, or /v1/traces under
+// OTEL_EXPORTER_OTLP_ENDPOINT
+fn endpoint() -> Option<String> {
+    let var = |name: &str| std::env::var(name).ok().map(|v| v.trim().to_string()).filter(|v| !v.is_empty());
+    if let Some(url) = var(OTLP_TRACES_ENDPOINT_ENV) {
+        return Some(url);
+    }
+    var(OTLP_ENDPOINT_ENV).map(|base| format!("{}/v1/traces", base.trim_end_matches('/')))
+}
+
+// OTLP over HTTP, JSON encoded, which every collector accepts on :4318
+async fn export(endpoint: String, spans: Vec<Value>) {
+    let service = std::env::var(SERVICE_NAME_ENV).ok().filter(|s| !s.trim().is_empty()).unwrap_or_else(|| DEFAULT_SERVICE_NAME.to_string());
+    let body = json!({
+        "resourceSpans": [{
+            "resource": { "attributes": [
+                attribute("service.name", service.into()),
+                attribute("service.version", env!("CARGO_PKG_VERSION").into()),
+            ] },
+            "scopeSpans": [{ "scope": { "name": DEFAULT_SERVICE_NAME }, "spans": spans }],
+        }]
+    });
+    let mut request = reqwest::Client::new().post(&endpoint).timeout(EXPORT_TIMEOUT).json(&body);
+    // `key=value,key2=value2`, percent-encoded as the spec has it
+    for pair in std::env::var(OTLP_HEADERS_ENV).unwrap_or_default().split(',') {
+        if let Some((key, value)) = pair.split_once('=') {
+            request = request.header(key.trim(), http::percent_decode(value.trim()));
+        }
+    }
+    match request.send().await {
+        Ok(response) if response.status().is_success() => {}
+        Ok(response) => debug_log(&format!("error: cannot export trace to {}: {}", endpoint, response.status())),
+        Err(e) => debug_log(&format!("error: cannot export trace to {}: {}", endpoint, e)),
+    }
+}
+
+fn attribute(key: &str, value: Value) -> Value {
+    let value = match value {
+        Value::Bool(b) => json!({ "boolValue": b }),
+        Value::Number(n) if n.is_f64() => json!({ "doubleValue": n }),
+        Value::Number(n) => json!({ "intValue": n.to_string() }),
+        Value::String(s) => json!({ "stringValue": s }),
+        other => json!({ "stringValue": other.to_string() }),
+    };
+    json!({ "key": key, "value": value })
+}
+
+// `bytes` random bytes as hex; the standard library's hasher keys are
+// random enough for IDs that only have to be unique
+fn random_id(bytes: usize) -> String {
+    let mut id = String::new();
+    while id.len() < bytes * 2 {
+        let mut hasher = RandomState::new().build_hasher();
+        hasher.write_u64(NEXT_ID.fetch_add(1, Ordering::Relaxed));
+        hasher.write_u128(SystemTime::now().duration_since(UNIX_EPOCH).unwrap_or_default().as_nanos());
+        id.push_str(&format!("{:016x}", hasher.finish()));
+    }
+    id.truncate(bytes * 2);
+    id
+}
+
+fn duration(took: Duration) -> String {
+    match took.as_millis() {
+        ms if ms < 1000 => format!("{}ms", ms),
+        _ => format!("{:.1}s", took.as_secs_f64()),
+    }
+}
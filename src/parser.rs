@@ -0,0 +1,567 @@
+use std::ops::Range;
+
+#[derive(Debug, Clone)]
+pub struct Fence {
+    pub range: Range<usize>,
+    pub body: Range<usize>,
+    pub info: String,
+}
+
+impl Fence {
+    pub fn lang(&self) -> String {
+        self.info
+            .split_whitespace()
+            .next()
+            .unwrap_or_default()
+            .to_lowercase()
+    }
+}
+
+const BOM: char = '\u{feff}';
+
+// Chats saved on Windows may start with a byte order mark and end lines with
+// CRLF; everything else works on plain `\n` text
+pub fn normalize(content: &str) -> String {
+    content.strip_prefix(BOM).unwrap_or(content).replace("\r\n", "\n")
+}
+
+// Puts back the BOM and line endings `original` used
+pub fn restore_line_endings(original: &str, content: &str) -> String {
+    let mut restored = String::with_capacity(content.len() + 1);
+    if original.starts_with(BOM) {
+        restored.push(BOM);
+    }
+    if original.contains("\r\n") {
+        restored.push_str(&content.replace('\n', "\r\n"));
+    } else {
+        restored.push_str(content);
+    }
+    restored
+}
+
+// Fenced code blocks (``` or ~~~). An unclosed fence runs to the end of the
+// content, which is what an editor shows while typing.
+pub fn fences(content: &str) -> Vec<Fence> {
+    let mut fences = Vec::new();
+    let mut open: Option<(usize, usize, char, usize, String)> = None;
+    let mut offset = 0;
+
+    for line in content.split_inclusive('\n') {
+        let start = offset;
+        offset += line.len();
+
+        let trimmed = line.trim_start_matches(' ');
+        if line.len() - trimmed.len() > 3 {
+            continue;
+        }
+        let Some(fence_char) = trimmed.chars().next().filter(|c| *c == '`' || *c == '~') else {
+            continue;
+        };
+        let run = trimmed.chars().take_while(|c| *c == fence_char).count();
+        if run < 3 {
+            continue;
+        }
+
+        match &open {
+            None => open = Some((start, offset, fence_char, run, trimmed[run..].trim().to_string())),
+            Some((open_start, body_start, open_char, open_run, info)) => {
+                // Closing fences use the same character, are at least as long
+                // and carry no info string
+                if fence_char == *open_char && run >= *open_run && trimmed[run..].trim().is_empty() {
+                    fences.push(Fence {
+                        range: *open_start..offset,
+                        body: *body_start..start,
+                        info: info.clone(),
+                    });
+                    open = None;
+                }
+            }
+        }
+    }
+
+    if let Some((start, body_start, _, _, info)) = open {
+        fences.push(Fence {
+            range: start..content.len(),
+            body: body_start..content.len(),
+            info,
+        });
+    }
+    fences
+}
+
+pub fn fenced_ranges(content: &str) -> Vec<Range<usize>> {
+    fences(content).into_iter().map(|f| f.range).collect()
+}
+
+pub fn in_fence(ranges: &[Range<usize>], pos: usize) -> bool {
+    ranges.iter().any(|r| r.contains(&pos))
+}
+
+// Start offsets of `pattern` whose line is not inside a code fence.
+// Patterns are newline-framed, so the line itself starts one byte in.
+fn unfenced_matches(content: &str, pattern: &str) -> Vec<usize> {
+    let ranges = fenced_ranges(content);
+    let line_offset = usize::from(pattern.starts_with('\n'));
+    content
+        .match_indices(pattern)
+        .map(|(i, _)| i)
+        .filter(|i| !in_fence(&ranges, i + line_offset))
+        .collect()
+}
+
+// Byte ranges of the parts between unfenced separators
+pub fn split_unfenced_ranges(content: &str, separator: &str) -> Vec<Range<usize>> {
+    let mut ranges = Vec::new();
+    let mut start = 0;
+    for i in unfenced_matches(content, separator) {
+        // match_indices never overlaps, but be defensive about the cursor
+        if i < start {
+            continue;
+        }
+        ranges.push(start..i);
+        start = i + separator.len();
+    }
+    ranges.push(start..content.len());
+    ranges
+}
+
+pub fn split_unfenced<'a>(content: &'a str, separator: &str) -> Vec<&'a str> {
+    split_unfenced_ranges(content, separator)
+        .into_iter()
+        .map(|r| &content[r])
+        .collect()
+}
+
+pub fn rfind_unfenced(content: &str, pattern: &str) -> Option<usize> {
+    unfenced_matches(content, pattern).last().copied()
+}
+
+// True when the trailing blank line sits outside any code fence, i.e. the
+// user really pressed Enter twice at the end of prose and not mid-snippet.
+pub fn ends_with_unfenced(content: &str, suffix: &str) -> bool {
+    content.ends_with(suffix)
+        && !in_fence(&fenced_ranges(content), content.len().saturating_sub(1))
+}
+
+const DRAFT_MARKER: &str = "[draft]";
+const SEND_LINES: &[&str] = &["-->send", "SEND"];
+const SEND_SUFFIX: &str = ";;";
+
+// A message ending in `[draft]` is still being written and is never sent
+pub fn is_draft(message: &str) -> bool {
+    message.trim_end().to_lowercase().ends_with(DRAFT_MARKER)
+}
+
+// If the content ends with a send marker outside any code fence, returns it
+// without the marker. Markers are a line of its own (`-->send`, `SEND` or
+// `custom`) or `;;` at the very end of the message.
+pub fn take_send_marker(content: &str, custom: Option<&str>) -> Option<String> {
+    let trimmed = content.trim_end();
+    let line_start = trimmed.rfind('\n').map_or(0, |i| i + 1);
+    if in_fence(&fenced_ranges(content), line_start) {
+        return None;
+    }
+
+    let last_line = trimmed[line_start..].trim();
+    if SEND_LINES.contains(&last_line) || custom.is_some_and(|c| c.trim() == last_line) {
+        return Some(trimmed[..line_start].to_string());
+    }
+    trimmed.strip_suffix(SEND_SUFFIX).map(str::to_string)
+}
+
+const TIMESTAMP_OPEN: &str = "<!-- time:";
+const COMMENT_OPEN: &str = "<!--";
+const COMMENT_CLOSE: &str = "-->";
+const PRIVATE_OPEN: &str = "<!-- private:";
+const NOTE_MARKER: &str = "%%";
+const PIN_COMMENT: &str = "<!-- pin -->";
+const PIN_PREFIX: &str = "📌";
+const VIA_KEY: &str = "via";
+
+pub fn timestamp_comment(timestamp: &str) -> String {
+    format!("{} {} {}", TIMESTAMP_OPEN, timestamp, COMMENT_CLOSE)
+}
+
+const THINKING: &str = "▍assistant is thinking…";
+const ALTERNATIVE_OPEN: &str = "<details class=\"alternative\">";
+const TRACE_OPEN: &str = "<details class=\"agent-trace\">";
+const DETAILS_CLOSE: &str = "</details>";
+
+// Written where a reply will go while it is on its way, and replaced by it
+pub fn placeholder(separator: &str) -> String {
+    format!("{}{}{}", separator, THINKING, separator)
+}
+
+// An answer replaced by /retry, folded away under the one that replaced it
+pub fn alternative(text: &str) -> String {
+    format!("{}\n<summary>Earlier answer</summary>\n\n{}\n\n{}", ALTERNATIVE_OPEN, text.trim(), DETAILS_CLOSE)
+}
+
+// Splits a reply into the answer and the earlier answers kept below it,
+// which are never sent as context
+pub fn take_alternatives(text: &str) -> (String, String) {
+    match unfenced_matches(text, ALTERNATIVE_OPEN).first() {
+        Some(&at) => (text[..at].trim().to_string(), text[at..].trim().to_string()),
+        None => (text.to_string(), String::new()),
+    }
+}
+
+// The steps an agent took before answering, folded away above the answer
+pub fn agent_trace(summary: &str, steps: &str) -> String {
+    format!("{}\n<summary>{}</summary>\n\n{}\n\n{}", TRACE_OPEN, summary, steps.trim(), DETAILS_CLOSE)
+}
+
+// A reply without its agent trace, which is never sent as context
+pub fn strip_trace(text: &str) -> String {
+    let Some(&start) = unfenced_matches(text, TRACE_OPEN).first() else {
+        return text.to_string();
+    };
+    let end = unfenced_matches(&text[start..], DETAILS_CLOSE)
+        .first()
+        .map_or(text.len(), |&i| start + i + DETAILS_CLOSE.len());
+    format!("{}{}", &text[..start], &text[end..]).trim().to_string()
+}
+
+// A note kept in the file but never sent, like the user's own `%%` notes
+pub fn private_note(text: &str) -> String {
+    format!("{} {} {}", NOTE_MARKER, text, NOTE_MARKER)
+}
+
+pub fn now_timestamp() -> String {
+    crate::clock::now().to_rfc3339_opts(chrono::SecondsFormat::Secs, false)
+}
+
+// Removes `<!-- time: ... -->` lines from a message, returning the cleaned
+// text and the last timestamp found.
+pub fn take_timestamp(text: &str) -> (String, Option<String>) {
+    let mut timestamp = None;
+    let kept: Vec<&str> = text
+        .lines()
+        .filter(|line| {
+            let stamp = line
+                .trim()
+                .strip_prefix(TIMESTAMP_OPEN)
+                .and_then(|rest| rest.strip_suffix(COMMENT_CLOSE));
+            match stamp {
+                Some(stamp) => {
+                    timestamp = Some(stamp.trim().to_string());
+                    false
+                }
+                None => true,
+            }
+        })
+        .collect();
+
+    (kept.join("\n").trim().to_string(), timestamp)
+}
+
+// Whether a message is pinned, by a leading 📌 or a `<!-- pin -->` line, and
+// the message without the marker
+pub fn take_pin(text: &str) -> (String, bool) {
+    if let Some(rest) = text.trim_start().strip_prefix(PIN_PREFIX) {
+        return (rest.trim().to_string(), true);
+    }
+    if !text.lines().any(|line| line.trim() == PIN_COMMENT) {
+        return (text.to_string(), false);
+    }
+    let kept: Vec<&str> = text.lines().filter(|line| line.trim() != PIN_COMMENT).collect();
+    (kept.join("\n").trim().to_string(), true)
+}
+
+// Marks a message that came in from another chat service
+pub fn via_comment(service: &str) -> String {
+    format!("{} {}: {} {}", COMMENT_OPEN, VIA_KEY, service, COMMENT_CLOSE)
+}
+
+// The service a bridged message came from, and the message without its
+// marker. Such messages are sent as written: no includes, no commands.
+pub fn take_via(text: &str) -> (String, Option<String>) {
+    let mut via = None;
+    let kept: Vec<&str> = text
+        .lines()
+        .filter(|line| match comment_fields(line).as_deref() {
+            Some([(key, service)]) if key == VIA_KEY => {
+                via = Some(service.clone());
+                false
+            }
+            _ => true,
+        })
+        .collect();
+    match via {
+        Some(_) => (kept.join("\n").trim().to_string(), via),
+        None => (text.to_string(), None),
+    }
+}
+
+// The persona a message opens with `@name`, lowercased, and the message
+// without it
+pub fn take_mention(text: &str) -> Option<(String, String)> {
+    let rest = text.trim_start().strip_prefix('@')?;
+    let end = rest
+        .find(|c: char| !(c.is_alphanumeric() || c == '-' || c == '_'))
+        .unwrap_or(rest.len());
+    let name = &rest[..end];
+    let message = rest[end..].trim_start_matches([',', ':']).trim();
+    (!name.is_empty()).then(|| (name.to_lowercase(), message.to_string()))
+}
+
+// The first line of a reply from a persona addressed by name
+pub fn persona_label(name: &str) -> String {
+    format!("**@{}**", name)
+}
+
+// A reply without its persona label, and the persona
+pub fn take_persona_label(text: &str) -> (String, Option<String>) {
+    let (first, rest) = text.trim_start().split_once('\n').unwrap_or((text.trim_start(), ""));
+    match first.trim().strip_prefix("**@").and_then(|l| l.strip_suffix("**")) {
+        Some(name) if !name.is_empty() && !name.contains(char::is_whitespace) => (rest.trim().to_string(), Some(name.to_string())),
+        _ => (text.to_string(), None),
+    }
+}
+
+// Removes `<!-- private: ... -->` and `%% ... %%` notes outside code fences.
+// An unclosed note runs to the end of the text, so nothing meant to stay
+// private leaks because of a typo.
+pub fn strip_private(text: &str) -> String {
+    let mut opens: Vec<(usize, &str, &str)> = unfenced_matches(text, PRIVATE_OPEN)
+        .into_iter()
+        .map(|i| (i, PRIVATE_OPEN, COMMENT_CLOSE))
+        .chain(unfenced_matches(text, NOTE_MARKER).into_iter().map(|i| (i, NOTE_MARKER, NOTE_MARKER)))
+        .collect();
+    if opens.is_empty() {
+        return text.to_string();
+    }
+    opens.sort();
+
+    let mut stripped = String::with_capacity(text.len());
+    let mut pos = 0;
+    for (start, open, close) in opens {
+        // Already inside the previous note (e.g. its closing %%)
+        if start < pos {
+            continue;
+        }
+
+        let body = start + open.len();
+        let mut end = text[body..].find(close).map_or(text.len(), |i| body + i + close.len());
+        // A note on lines of its own takes its line break with it
+        if (start == 0 || text[..start].ends_with('\n')) && text[end..].starts_with('\n') {
+            end += 1;
+        }
+
+        stripped.push_str(&text[pos..start]);
+        pos = end;
+    }
+    stripped.push_str(&text[pos..]);
+    stripped.trim().to_string()
+}
+
+// Reads a `<!-- key: value, key: value -->` line into lowercase keys and
+// trimmed values. None if the line is anything else.
+pub fn comment_fields(line: &str) -> Option<Vec<(String, String)>> {
+    let inner = line
+        .trim()
+        .strip_prefix(COMMENT_OPEN)?
+        .strip_suffix(COMMENT_CLOSE)?;
+
+    inner
+        .split(',')
+        .map(|field| {
+            let (key, value) = field.split_once(':')?;
+            let key = key.trim();
+            let valid = !key.is_empty() && key.chars().all(|c| c.is_ascii_alphanumeric() || c == '_');
+            valid.then(|| (key.to_lowercase(), value.trim().to_string()))
+        })
+        .collect()
+}
+
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct Branch {
+    pub level: usize,
+    pub name: String,
+}
+
+#[derive(Debug, Clone)]
+struct BranchHeading {
+    offset: usize,
+    branch: Branch,
+}
+
+fn parse_branch_heading(line: &str) -> Option<Branch> {
+    let line = line.trim();
+    let level = line.chars().take_while(|c| *c == '#').count();
+    if !(1..=6).contains(&level) {
+        return None;
+    }
+    let rest = line[level..].strip_prefix(char::is_whitespace)?.trim_start();
+    let (label, name) = rest.split_once(':')?;
+    if !label.trim().eq_ignore_ascii_case("branch") || name.trim().is_empty() {
+        return None;
+    }
+    Some(Branch {
+        level,
+        name: name.trim().to_string(),
+    })
+}
+
+fn branch_headings(content: &str) -> Vec<BranchHeading> {
+    let fences = fenced_ranges(content);
+    let mut headings = Vec::new();
+    let mut offset = 0;
+    for line in content.split_inclusive('\n') {
+        if !in_fence(&fences, offset) {
+            if let Some(branch) = parse_branch_heading(line) {
+                headings.push(BranchHeading { offset, branch });
+            }
+        }
+        offset += line.len();
+    }
+    headings
+}
+
+// Maps positions in a chat body to the chain of `# Branch: name` sections
+// enclosing them. A heading closes any open branch at the same or a deeper
+// level, so `## Branch:` nests under the `# Branch:` above it.
+pub struct BranchMap {
+    headings: Vec<BranchHeading>,
+}
+
+impl BranchMap {
+    pub fn new(content: &str) -> Self {
+        Self {
+            headings: branch_headings(content),
+        }
+    }
+
+    pub fn path_at(&self, pos: usize) -> Vec<Branch> {
+        let mut path: Vec<Branch> = Vec::new();
+        for heading in self.headings.iter().take_while(|h| h.offset < pos) {
+            while path.last().is_some_and(|b| b.level >= heading.branch.level) {
+                path.pop();
+            }
+            path.push(heading.branch.clone());
+        }
+        path
+    }
+
+    pub fn is_empty(&self) -> bool {
+        self.headings.is_empty()
+    }
+}
+
+pub fn strip_branch_headings(text: &str) -> String {
+    let fences = fenced_ranges(text);
+    let mut offset = 0;
+    let mut kept = String::with_capacity(text.len());
+    for line in text.split_inclusive('\n') {
+        if in_fence(&fences, offset) || parse_branch_heading(line).is_none() {
+            kept.push_str(line);
+        }
+        offset += line.len();
+    }
+    kept.trim().to_string()
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    const SEP: &str = "\n---\n";
+
+    #[test]
+    fn separators_split_only_outside_fences() {
+        let cases: &[(&str, &[&str])] = &[
+            ("a\n---\nb", &["a", "b"]),
+            ("a\n```\n---\n```\nb", &["a\n```\n---\n```\nb"]),
+            ("a\n~~~\n---\n~~~\n---\nb", &["a\n~~~\n---\n~~~", "b"]),
+            ("```\ncode\n```\nq\n---\nr", &["```\ncode\n```\nq", "r"]),
+            // An unclosed fence runs to the end
+            ("a\n```\n---\nb", &["a\n```\n---\nb"]),
+        ];
+        for (content, parts) in cases {
+            assert_eq!(split_unfenced(content, SEP), *parts, "{content:?}");
+        }
+    }
+
+    #[test]
+    fn send_markers_at_the_end() {
+        let cases: &[(&str, Option<&str>, Option<&str>)] = &[
+            ("hello\n-->send\n", None, Some("hello\n")),
+            ("hello\nSEND", None, Some("hello\n")),
+            ("hello;;", None, Some("hello")),
+            ("hello;;\n\n", None, Some("hello")),
+            ("hi\ngo!", Some("go!"), Some("hi\n")),
+            ("```\ncode\n```\n-->send\n", None, Some("```\ncode\n```\n")),
+            ("hello", None, None),
+            ("-->send\nhello", None, None),
+            ("```\n-->send\n```\n", None, None),
+            ("```\nx;;\n", None, None),
+        ];
+        for (content, custom, taken) in cases {
+            assert_eq!(take_send_marker(content, *custom).as_deref(), *taken, "{content:?}");
+        }
+    }
+
+    #[test]
+    fn private_notes_are_removed_outside_fences() {
+        let cases = [
+            ("a <!-- private: x --> b", "a  b"),
+            ("a\n%% note %%\nb", "a\nb"),
+            ("keep\n<!-- private: rest", "keep"),
+            ("```\n%% not a note %%\n```", "```\n%% not a note %%\n```"),
+            // A note around a fence takes the fence with it
+            ("q\n%%\n```\nsecret\n```\n%%\nr", "q\nr"),
+            // A note that runs into a fence is removed up to its close
+            ("a\n<!-- private: x\n```\ny -->\n```\nb", "a\n```\nb"),
+        ];
+        for (text, kept) in cases {
+            assert_eq!(strip_private(text), kept, "{text:?}");
+        }
+    }
+
+    #[test]
+    fn pins() {
+        let cases = [
+            ("📌 remember this", "remember this", true),
+            ("<!-- pin -->\nkeep", "keep", true),
+            ("text\n<!-- pin -->", "text", true),
+            ("plain 📌", "plain 📌", false),
+        ];
+        for (text, kept, pinned) in cases {
+            assert_eq!(take_pin(text), (kept.to_string(), pinned), "{text:?}");
+        }
+    }
+
+    #[test]
+    fn via_comments_stay_with_their_message() {
+        let cases: &[(&str, &[(&str, Option<&str>)])] = &[
+            ("<!-- via: slack -->\nhi\n---\nreply", &[("hi", Some("slack")), ("reply", None)]),
+            ("q\n---\n<!-- via: matrix -->\nhey", &[("q", None), ("hey", Some("matrix"))]),
+            ("hi <!-- via: slack -->", &[("hi <!-- via: slack -->", None)]),
+        ];
+        for (content, messages) in cases {
+            let taken: Vec<(String, Option<String>)> =
+                split_unfenced(content, SEP).into_iter().map(take_via).collect();
+            let expected: Vec<(String, Option<String>)> = messages
+                .iter()
+                .map(|(text, via)| (text.to_string(), via.map(str::to_string)))
+                .collect();
+            assert_eq!(taken, expected, "{content:?}");
+        }
+    }
+
+    #[test]
+    fn branch_paths() {
+        let content = "intro\n# Branch: a\nx\n## Branch: b\ny\n# Branch: c\nz\n```\n# Branch: no\n```\nw";
+        let map = BranchMap::new(content);
+        let cases: &[(&str, &[&str])] = &[("intro", &[]), ("x", &["a"]), ("y", &["a", "b"]), ("z", &["c"]), ("w", &["c"])];
+        for (word, names) in cases {
+            let path = map.path_at(content.find(word).unwrap());
+            let path: Vec<&str> = path.iter().map(|b| b.name.as_str()).collect();
+            assert_eq!(path, *names, "{word:?}");
+        }
+        assert_eq!(
+            strip_branch_headings(content),
+            "intro\nx\ny\nz\n```\n# Branch: no\n```\nw"
+        );
+    }
+}
@@ -0,0 +1,42 @@
+use crate::{crypt, files};
+use anyhow::Result;
+use serde::{Deserialize, Serialize};
+use std::path::{Path, PathBuf};
+use tokio::fs;
+
+// A request that was sent but not yet answered. It is saved before the call
+// and removed once the reply is written (or the call fails), so finding one
+// at startup means the process died waiting.
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct Pending {
+    pub message: String,
+    pub model: String,
+    pub started_at: String,
+}
+
+// chat.md -> .chat.md.pending.json
+pub fn state_path(chat_file: &Path) -> PathBuf {
+    let name = chat_file
+        .file_name()
+        .map(|s| s.to_string_lossy().into_owned())
+        .unwrap_or_else(|| "chat.md".to_string());
+    chat_file.with_file_name(format!(".{}.pending.json", name))
+}
+
+pub async fn save(chat_file: &Path, pending: &Pending) -> Result<()> {
+    // This file is never encrypted, so an encrypted chat's message is left out
+    let mut pending = pending.clone();
+    if crypt::scheme(chat_file).is_some() {
+        pending.message.clear();
+    }
+    files::write_atomic(&state_path(chat_file), serde_json::to_string_pretty(&pending)?).await
+}
+
+pub async fn load(chat_file: &Path) -> Option<Pending> {
+    let raw = fs::read_to_string(state_path(chat_file)).await.ok()?;
+    serde_json::from_str(&raw).ok()
+}
+
+pub async fn clear(chat_file: &Path) {
+    let _ = fs::remove_file(state_path(chat_file)).await;
+}
@@ -0,0 +1,280 @@
+use crate::{logging::debug_log, provider::RequestParams, Message};
+use anyhow::{bail, Context, Result};
+use serde::Deserialize;
+use serde_json::{json, Value};
+use std::{
+    collections::HashMap,
+    path::{Path, PathBuf},
+    process::Stdio,
+    sync::Mutex,
+    time::{Duration, SystemTime},
+};
+use tokio::io::{AsyncBufReadExt, AsyncWriteExt, BufReader};
+
+pub const PLUGINS_DIR_ENV: &str = "CHAT_PLUGINS_DIR";
+const USER_DIR: &str = "chatmd/plugins";
+const DESCRIBE_TIMEOUT: Duration = Duration::from_secs(5);
+const CALL_TIMEOUT: Duration = Duration::from_secs(120);
+
+// What a plugin says it offers, in answer to `{"method": "describe"}`
+#[derive(Debug, Clone, Default, Deserialize)]
+pub struct Description {
+    #[serde(default)]
+    pub tools: Vec<Tool>,
+    #[serde(default)]
+    pub providers: Vec<String>,
+}
+
+#[derive(Debug, Clone, Deserialize)]
+pub struct Tool {
+    pub name: String,
+    #[serde(default)]
+    pub description: String,
+    // Argument names and what they mean, shown to the model
+    #[serde(default)]
+    pub arguments: HashMap<String, String>,
+}
+
+pub struct Plugin {
+    pub path: PathBuf,
+    pub description: Description,
+}
+
+// Descriptions by executable, asked for again only when the file changes
+static DESCRIBED: Mutex<Option<HashMap<PathBuf, (SystemTime, Description)>>> = Mutex::new(None);
+
+// CHAT_PLUGINS_DIR, or ~/.config/chatmd/plugins
+pub fn dir() -> Option<PathBuf> {
+    if let Some(dir) = std::env::var_os(PLUGINS_DIR_ENV).filter(|d| !d.is_empty()) {
+        return Some(PathBuf::from(dir));
+    }
+    std::env::var_os("XDG_CONFIG_HOME")
+        .map(PathBuf::from)
+        .or_else(|| std::env::var_os("HOME").map(|home| PathBuf::from(home).join(".config")))
+        .map(|dir| dir.join(USER_DIR))
+}
+
+// Every executable in the plugins directory that answers `describe`
+pub async fn discover() -> Vec<Plugin> {
+    let Some(dir) = dir() else {
+        return Vec::new();
+    };
+    let Ok(entries) = std::fs::read_dir(&dir) else {
+        return Vec::new();
+    };
+    let mut paths: Vec<(PathBuf, SystemTime)> = entries
+        .filter_map(|e| e.ok())
+        .filter(|e| is_executable(&e.path()))
+        .filter_map(|e| Some((e.path(), e.metadata().ok()?.modified().ok()?)))
+        .collect();
+    paths.sort();
+
+    let mut plugins = Vec::new();
+    for (path, modified) in paths {
+        let cached = DESCRIBED
+            .lock()
+            .unwrap()
+            .as_ref()
+            .and_then(|d| d.get(&path))
+            .filter(|(at, _)| *at == modified)
+            .map(|(_, description)| description.clone());
+        let description = match cached {
+            Some(description) => description,
+            None => match describe(&path).await {
+                Ok(description) => {
+                    debug_log(&format!(
+                        "load: plugin {} ({} tools, {} providers)",
+                        path.display(),
+                        description.tools.len(),
+                        description.providers.len()
+                    ));
+                    DESCRIBED
+                        .lock()
+                        .unwrap()
+                        .get_or_insert_with(HashMap::new)
+                        .insert(path.clone(), (modified, description.clone()));
+                    description
+                }
+                Err(e) => {
+                    debug_log(&format!("error: plugin {}: {:#}", path.display(), e));
+                    continue;
+                }
+            },
+        };
+        plugins.push(Plugin { path, description });
+    }
+    plugins
+}
+
+async fn describe(path: &Path) -> Result<Description> {
+    let mut description = None;
+    exchange(path, &json!({ "method": "describe" }), DESCRIBE_TIMEOUT, |reply| {
+        description = Some(reply);
+        Ok(())
+    })
+    .await?;
+    let description = description.context("no answer to describe")?;
+    Ok(serde_json::from_value(description)?)
+}
+
+// The tools all plugins offer, with the plugin that runs each
+pub async fn tools() -> Vec<(PathBuf, Tool)> {
+    discover()
+        .await
+        .into_iter()
+        .flat_map(|plugin| {
+            let path = plugin.path;
+            plugin.description.tools.into_iter().map(move |tool| (path.clone(), tool))
+        })
+        .collect()
+}
+
+// The plugin that provides `name`, for CHAT_PROVIDER
+pub async fn provider(name: &str) -> Option<PathBuf> {
+    discover()
+        .await
+        .into_iter()
+        .find(|plugin| plugin.description.providers.iter().any(|p| p.eq_ignore_ascii_case(name)))
+        .map(|plugin| plugin.path)
+}
+
+// Runs a plugin tool with the model's call (`tool` plus its arguments) and
+// returns the text result
+pub async fn call_tool(path: &Path, call: &Value, chat: &Path) -> Result<String> {
+    let request = json!({
+        "method": "call_tool",
+        "tool": call["tool"],
+        "arguments": call,
+        "chat": chat.canonicalize().unwrap_or_else(|_| chat.to_path_buf()),
+    });
+    let mut result = None;
+    exchange(path, &request, CALL_TIMEOUT, |reply| {
+        result = reply["result"].as_str().map(str::to_string);
+        Ok(())
+    })
+    .await?;
+    result.context("the plugin answered without a result")
+}
+
+// Asks a provider plugin for a reply. It may send the text in pieces as
+// `{"delta": "..."}` lines before a final `{"content": "..."}`; either is
+// enough on its own.
+pub async fn complete(
+    path: &Path,
+    provider: &str,
+    messages: &[Message],
+    model: &str,
+    params: &RequestParams,
+    on_text: Option<&(dyn Fn(&str) + Send + Sync)>,
+) -> Result<String> {
+    let request = json!({
+        "method": "complete",
+        "provider": provider,
+        "model": model,
+        "messages": messages,
+        "params": params,
+        "stream": on_text.is_some(),
+    });
+    let mut streamed = String::new();
+    let mut content = None;
+    exchange(path, &request, CALL_TIMEOUT, |reply| {
+        if let Some(delta) = reply["delta"].as_str() {
+            streamed.push_str(delta);
+            if let Some(on_text) = on_text {
+                on_text(delta);
+            }
+        }
+        if let Some(text) = reply["content"].as_str() {
+            content = Some(text.to_string());
+        }
+        Ok(())
+    })
+    .await?;
+    match content {
+        Some(content) => Ok(content),
+        None if !streamed.is_empty() => Ok(streamed),
+        None => bail!("the plugin answered without any content"),
+    }
+}
+
+// One request on stdin, one JSON object per line on stdout until the
+// plugin exits. `{"error": "..."}` on any line fails the call.
+async fn exchange(
+    path: &Path,
+    request: &Value,
+    timeout: Duration,
+    mut on_reply: impl FnMut(Value) -> Result<()>,
+) -> Result<()> {
+    let mut child = tokio::process::Command::new(path)
+        .stdin(Stdio::piped())
+        .stdout(Stdio::piped())
+        .stderr(Stdio::inherit())
+        .kill_on_drop(true)
+        .spawn()
+        .with_context(|| format!("cannot start {}", path.display()))?;
+
+    // Written while replies are read, since a plugin may start answering
+    // before it has read the whole conversation
+    let mut stdin = child.stdin.take().context("no stdin")?;
+    let request = format!("{}\n", request);
+    let write = async move {
+        // A plugin that doesn't need all of it closes the pipe early; that's fine
+        let _ = stdin.write_all(request.as_bytes()).await;
+    };
+
+    let stdout = child.stdout.take().context("no stdout")?;
+    let read = async {
+        let mut lines = BufReader::new(stdout).lines();
+        while let Some(line) = lines.next_line().await? {
+            if line.trim().is_empty() {
+                continue;
+            }
+            let reply: Value = serde_json::from_str(&line).with_context(|| format!("not JSON: {}", line))?;
+            if let Some(error) = reply.get("error") {
+                bail!("{}", error.as_str().map_or_else(|| error.to_string(), str::to_string));
+            }
+            on_reply(reply)?;
+        }
+        let status = child.wait().await?;
+        if !status.success() {
+            bail!("exited with {}", status);
+        }
+        Ok(())
+    };
+    tokio::time::timeout(timeout, async { tokio::join!(write, read).1 })
+        .await
+        .with_context(|| format!("no answer after {}s", timeout.as_secs()))?
+}
+
+#[cfg(unix)]
+fn is_executable(path: &Path) -> bool {
+    use std::os::unix::fs::PermissionsExt;
+    path.metadata().is_ok_and(|m| m.is_file() && m.permissions().mode() & 0o111 != 0)
+}
+
+#[cfg(not(unix))]
+fn is_executable(path: &Path) -> bool {
+    path.is_file()
+}
+
+// `plugins`: what the plugins directory offers
+pub async fn run(_args: &[String]) -> Result<()> {
+    let dir = dir().context("no plugins directory: set CHAT_PLUGINS_DIR or HOME")?;
+    let plugins = discover().await;
+    if plugins.is_empty() {
+        println!("No plugins in {}", dir.display());
+        return Ok(());
+    }
+    println!("Plugins in {}:", dir.display());
+    for plugin in plugins {
+        let name = plugin.path.file_name().unwrap_or_default().to_string_lossy().into_owned();
+        println!("\n{}", name);
+        for provider in &plugin.description.providers {
+            println!("  provider  {}", provider);
+        }
+        for tool in &plugin.description.tools {
+            println!("  tool      {}  {}", tool.name, tool.description);
+        }
+    }
+    Ok(())
+}
@@ -0,0 +1,116 @@
+use crate::{
+    commands::Command,
+    files, library, parser,
+    provider::RequestParams,
+    reply, summary, tokens, ChatContext, Message, CHAT_FILE, LOG_TO_STDERR,
+};
+use anyhow::{Context, Result};
+use std::{
+    path::PathBuf,
+    sync::{atomic::Ordering, RwLock},
+};
+
+const PREVIEW_CHARS: usize = 60;
+
+// `context [file]`: prints what the next message in a chat would send, item
+// by item with token counts. Whatever is typed after the last reply counts
+// as that message.
+pub async fn run(args: &[String]) -> Result<()> {
+    LOG_TO_STDERR.store(true, Ordering::Relaxed);
+
+    let path = PathBuf::from(args.first().map(String::as_str).unwrap_or(CHAT_FILE));
+    let content = files::read_chat(&path)
+        .await
+        .with_context(|| format!("cannot read {}", path.display()))?;
+    let chat_context = ChatContext::new(path, content.clone());
+    let library = RwLock::new(library::PromptLibrary::from_env());
+
+    let (messages, notes) = pending_request(&chat_context, &content[chat_context.body_start..]).await;
+    let items = reply::prepare_request(messages, None, &chat_context, &library).await;
+    println!("{}", render(&items, &chat_context, &notes));
+    Ok(())
+}
+
+// The messages the next send from `body` would start from, and notes on
+// anything that can't be shown without calling the API
+pub async fn pending_request(chat_context: &ChatContext, body: &str) -> (Vec<Message>, Vec<String>) {
+    let end = body.len();
+    let draft = (!chat_context.is_last_message_from_ai(body, end))
+        .then(|| parser::strip_branch_headings(&chat_context.extract_new_message(body, end)))
+        .filter(|draft| !draft.is_empty() && Command::parse(draft).is_none());
+
+    let history_end = match draft {
+        Some(_) => parser::rfind_unfenced(body, &chat_context.separator).unwrap_or(0),
+        None => end,
+    };
+    let (mut dropped, mut messages) = chat_context.split_history(body, history_end, end);
+
+    let mut notes = Vec::new();
+    if !dropped.is_empty() {
+        if chat_context.rolling_summary {
+            reply::strip_private(&mut dropped);
+            match summary::cached(&chat_context.path, &dropped).await {
+                Some(summary) => messages.insert(0, summary),
+                None => notes.push(format!(
+                    "{} older messages would first be summarized (not shown: that takes a request)",
+                    dropped.len()
+                )),
+            }
+        } else {
+            notes.push(format!("{} older messages fall outside the window and are not sent", dropped.len()));
+        }
+    }
+
+    match draft {
+        Some(draft) => {
+            let (draft, _) = RequestParams::take_from(&draft);
+            let (draft, _) = parser::take_pin(&draft);
+            messages.push(Message::new("user", draft));
+        }
+        None => notes.push("Nothing typed yet; the new message would come last.".to_string()),
+    }
+    (messages, notes)
+}
+
+pub fn render(items: &[(String, Message)], chat_context: &ChatContext, notes: &[String]) -> String {
+    let mut out = format!(
+        "Context for the next message (model {}, window: {})\n\n",
+        chat_context.model,
+        chat_context.window_description()
+    );
+    out.push_str(&format!("{:>3}  {:<18} {:>7}  {}\n", "#", "item", "tokens", "preview"));
+
+    let mut total = 0;
+    for (i, (label, message)) in items.iter().enumerate() {
+        let count = tokens::message_tokens(message);
+        total += count;
+        out.push_str(&format!("{:>3}  {:<18} {:>7}  {}\n", i + 1, label, count, preview(&message.content)));
+
+        // Retrieved excerpts start with a `[n] path:lines` source line
+        if label == "documents" {
+            for source in message.content.lines().filter(|l| is_source_line(l)) {
+                out.push_str(&format!("{:>33}{}\n", "", source));
+            }
+        }
+    }
+    out.push_str(&format!("\nTotal: ~{} tokens in {} messages\n", total, items.len()));
+    for note in notes {
+        out.push_str(&format!("Note: {}\n", note));
+    }
+    out
+}
+
+fn preview(text: &str) -> String {
+    let line = text.lines().map(str::trim).find(|l| !l.is_empty()).unwrap_or_default();
+    if line.chars().count() <= PREVIEW_CHARS {
+        return line.to_string();
+    }
+    let cut: String = line.chars().take(PREVIEW_CHARS).collect();
+    format!("{}…", cut)
+}
+
+fn is_source_line(line: &str) -> bool {
+    line.strip_prefix('[')
+        .and_then(|rest| rest.split_once("] "))
+        .is_some_and(|(n, _)| !n.is_empty() && n.chars().all(|c| c.is_ascii_digit()))
+}
@@ -0,0 +1,694 @@
+use crate::{debug_log, mock, parser, plugins, tokens, vcr, Message};
+use anyhow::{Context, Result};
+use serde::{Deserialize, Serialize};
+use serde_json::Value;
+use std::{
+    collections::HashMap,
+    sync::{Arc, RwLock},
+    time::{Duration, Instant},
+};
+
+pub const PROVIDER_ENV: &str = "CHAT_PROVIDER";
+pub const API_URL_ENV: &str = "CHAT_API_URL";
+
+const DEFAULT_PROVIDER: &str = "deepseek";
+// Chat completions endpoints of known providers. Any other OpenAI-compatible
+// endpoint works through CHAT_API_URL.
+const PROVIDER_URLS: &[(&str, &str)] = &[
+    ("deepseek", "https://api.deepseek.com/v1/chat/completions"),
+    ("openai", "https://api.openai.com/v1/chat/completions"),
+    ("openrouter", "https://openrouter.ai/api/v1/chat/completions"),
+    ("anthropic", "https://api.anthropic.com/v1/chat/completions"),
+    ("ollama", "http://localhost:11434/v1/chat/completions"),
+];
+const MAX_LOGGED_BODY: usize = 2000;
+const CONNECT_TIMEOUT: Duration = Duration::from_secs(10);
+// A whole reply that isn't streamed; long ones can take minutes
+const REPLY_TIMEOUT: Duration = Duration::from_secs(300);
+// A streamed reply may run as long as it likes, but not go quiet for longer
+const STALL_TIMEOUT: Duration = Duration::from_secs(60);
+// Health checks are asked for often and want an answer quickly
+const PING_TIMEOUT: Duration = Duration::from_secs(5);
+
+// One chat completions request; serialized, it is the JSON body sent
+#[derive(Debug, Clone, Serialize)]
+pub struct ChatRequest {
+    pub model: String,
+    pub messages: Vec<Message>,
+    #[serde(flatten)]
+    pub params: RequestParams,
+    #[serde(skip_serializing_if = "std::ops::Not::not")]
+    pub stream: bool,
+}
+
+// Sampling parameters for a single request, set from a comment line in the
+// message being sent: `<!-- max_tokens: 4000, temperature: 1.2 -->`.
+// Anything left unset falls back to CHAT_TEMPERATURE and friends, then to the
+// provider's defaults.
+#[derive(Debug, Clone, Default, PartialEq, Serialize)]
+pub struct RequestParams {
+    #[serde(skip)]
+    pub model: Option<String>,
+    // Answers as this persona instead of the chat's, e.g. from `@coder`
+    #[serde(skip)]
+    pub persona: Option<String>,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub max_tokens: Option<u32>,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub temperature: Option<f32>,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub top_p: Option<f32>,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub presence_penalty: Option<f32>,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub frequency_penalty: Option<f32>,
+}
+
+impl RequestParams {
+    const KEYS: &'static [&'static str] = &[
+        "model",
+        "persona",
+        "max_tokens",
+        "temperature",
+        "top_p",
+        "presence_penalty",
+        "frequency_penalty",
+    ];
+
+    // Removes parameter comment lines from a message, returning the cleaned
+    // text and the parameters they set. Other comments are left alone.
+    pub fn take_from(text: &str) -> (String, Self) {
+        let mut params = Self::default();
+        let mut found = false;
+        let kept: Vec<&str> = text
+            .lines()
+            .filter(|line| {
+                let fields = parser::comment_fields(line)
+                    .filter(|fields| fields.iter().all(|(key, _)| Self::KEYS.contains(&key.as_str())));
+                let Some(fields) = fields else {
+                    return true;
+                };
+
+                for (key, value) in fields {
+                    if let Err(e) = params.set(&key, &value) {
+                        debug_log(&format!("error: ignoring {}: {}", key, e));
+                    }
+                }
+                found = true;
+                false
+            })
+            .collect();
+
+        if !found {
+            return (text.to_string(), params);
+        }
+        (kept.join("\n").trim().to_string(), params)
+    }
+
+    fn set(&mut self, key: &str, value: &str) -> Result<()> {
+        let value = value.trim_matches(|c| c == '"' || c == '\'');
+        match key {
+            "model" => self.model = Some(value.to_string()),
+            "persona" => self.persona = Some(value.to_string()),
+            "max_tokens" => self.max_tokens = Some(value.parse()?),
+            "temperature" => self.temperature = Some(value.parse()?),
+            "top_p" => self.top_p = Some(value.parse()?),
+            "presence_penalty" => self.presence_penalty = Some(value.parse()?),
+            "frequency_penalty" => self.frequency_penalty = Some(value.parse()?),
+            _ => anyhow::bail!("unknown parameter"),
+        }
+        Ok(())
+    }
+
+    // Defaults from CHAT_MAX_TOKENS, CHAT_TEMPERATURE, etc. Read on every
+    // request so edits to .env apply without a restart. The model and
+    // persona have their own defaults and are left out.
+    pub fn from_env() -> Self {
+        let mut params = Self::default();
+        for key in Self::KEYS.iter().filter(|&&key| key != "model" && key != "persona") {
+            let name = format!("CHAT_{}", key.to_uppercase());
+            let Some(value) = std::env::var(&name).ok().filter(|v| !v.trim().is_empty()) else {
+                continue;
+            };
+            if let Err(e) = params.set(key, value.trim()) {
+                debug_log(&format!("error: ignoring {}: {}", name, e));
+            }
+        }
+        params
+    }
+
+    // Fills anything unset here from `fallback`
+    pub fn or(&self, fallback: Self) -> Self {
+        Self {
+            model: self.model.clone().or(fallback.model),
+            persona: self.persona.clone().or(fallback.persona),
+            max_tokens: self.max_tokens.or(fallback.max_tokens),
+            temperature: self.temperature.or(fallback.temperature),
+            top_p: self.top_p.or(fallback.top_p),
+            presence_penalty: self.presence_penalty.or(fallback.presence_penalty),
+            frequency_penalty: self.frequency_penalty.or(fallback.frequency_penalty),
+        }
+    }
+
+    pub fn is_empty(&self) -> bool {
+        *self == Self::default()
+    }
+}
+
+// Decoded leniently: every field is optional and unknown ones are kept so
+// they can be inspected when a provider changes its response shape.
+#[derive(Debug, Default, Deserialize)]
+struct ApiResponse {
+    #[serde(default)]
+    choices: Vec<Choice>,
+    #[serde(default)]
+    content: Option<Content>,
+    #[serde(default)]
+    error: Option<ApiError>,
+    #[serde(default)]
+    usage: Value,
+    #[serde(flatten)]
+    extra: HashMap<String, Value>,
+}
+
+#[derive(Debug, Deserialize)]
+struct Choice {
+    #[serde(default)]
+    message: Option<ChoiceMessage>,
+    // Legacy completions endpoints put the text directly on the choice
+    #[serde(default)]
+    text: Option<String>,
+    #[serde(flatten)]
+    extra: HashMap<String, Value>,
+}
+
+#[derive(Debug, Deserialize)]
+struct ChoiceMessage {
+    #[serde(default)]
+    content: Option<Content>,
+    #[serde(flatten)]
+    extra: HashMap<String, Value>,
+}
+
+// Either a plain string or a list of typed parts ({"type": "text", "text": ...})
+#[derive(Debug, Deserialize)]
+#[serde(untagged)]
+enum Content {
+    Text(String),
+    Parts(Vec<ContentPart>),
+}
+
+#[derive(Debug, Deserialize)]
+struct ContentPart {
+    #[serde(default, rename = "type")]
+    kind: Option<String>,
+    #[serde(default)]
+    text: Option<String>,
+}
+
+impl Content {
+    fn text(&self) -> Option<String> {
+        let text = match self {
+            Content::Text(text) => text.clone(),
+            Content::Parts(parts) => parts
+                .iter()
+                .filter(|p| p.kind.as_deref().map_or(true, |k| k == "text"))
+                .filter_map(|p| p.text.as_deref())
+                .collect::<Vec<_>>()
+                .join(""),
+        };
+        (!text.is_empty()).then_some(text)
+    }
+}
+
+#[derive(Debug, Deserialize)]
+#[serde(untagged)]
+enum ApiError {
+    Message(String),
+    Object {
+        #[serde(default)]
+        message: Option<String>,
+        #[serde(default, rename = "type")]
+        kind: Option<String>,
+    },
+}
+
+impl ApiError {
+    fn describe(&self) -> String {
+        match self {
+            ApiError::Message(message) => message.clone(),
+            ApiError::Object { message, kind } => match (kind, message) {
+                (Some(kind), Some(message)) => format!("{}: {}", kind, message),
+                (None, Some(message)) => message.clone(),
+                (Some(kind), None) => kind.clone(),
+                (None, None) => "unknown error".to_string(),
+            },
+        }
+    }
+}
+
+// Pulls the reply text out of one response shape. Providers list the
+// adapters they are known to need first; the rest act as fallbacks.
+trait ResponseAdapter: Send + Sync {
+    fn name(&self) -> &'static str;
+    fn extract(&self, response: &ApiResponse) -> Option<String>;
+}
+
+struct ChatCompletionsAdapter;
+
+impl ResponseAdapter for ChatCompletionsAdapter {
+    fn name(&self) -> &'static str {
+        "chat-completions"
+    }
+
+    fn extract(&self, response: &ApiResponse) -> Option<String> {
+        response.choices.iter().find_map(|choice| {
+            choice
+                .message
+                .as_ref()
+                .and_then(|m| m.content.as_ref())
+                .and_then(Content::text)
+                .or_else(|| choice.text.clone().filter(|t| !t.is_empty()))
+        })
+    }
+}
+
+struct ContentArrayAdapter;
+
+impl ResponseAdapter for ContentArrayAdapter {
+    fn name(&self) -> &'static str {
+        "content-array"
+    }
+
+    fn extract(&self, response: &ApiResponse) -> Option<String> {
+        response.content.as_ref().and_then(Content::text)
+    }
+}
+
+fn adapters_for(provider: &str) -> Vec<Box<dyn ResponseAdapter>> {
+    match provider {
+        "anthropic" => vec![Box::new(ContentArrayAdapter), Box::new(ChatCompletionsAdapter)],
+        _ => vec![Box::new(ChatCompletionsAdapter), Box::new(ContentArrayAdapter)],
+    }
+}
+
+pub fn provider_name() -> String {
+    std::env::var(PROVIDER_ENV)
+        .ok()
+        .filter(|v| !v.trim().is_empty())
+        .unwrap_or_else(|| DEFAULT_PROVIDER.to_string())
+        .to_lowercase()
+}
+
+pub fn builtin(provider: &str) -> bool {
+    provider == mock::PROVIDER || PROVIDER_URLS.iter().any(|(name, _)| *name == provider)
+}
+
+// The provider and its endpoint, from the environment on every request so
+// edits to .env apply without a restart
+pub fn endpoint() -> (String, String) {
+    let var = |name: &str| std::env::var(name).ok().filter(|v| !v.trim().is_empty());
+    let provider = provider_name();
+    let url = var(API_URL_ENV).unwrap_or_else(|| {
+        let known = PROVIDER_URLS.iter().find(|(name, _)| *name == provider);
+        if known.is_none() {
+            debug_log(&format!("error: unknown provider {:?} and no {}, using DeepSeek", provider, API_URL_ENV));
+        }
+        known.unwrap_or(&PROVIDER_URLS[0]).1.to_string()
+    });
+    (provider, url)
+}
+
+// The request for an OpenAI-compatible endpoint: `params` fill in what the
+// environment doesn't, and pick the model when they name one
+pub fn chat_request(messages: Vec<Message>, model: &str, params: &RequestParams, stream: bool) -> ChatRequest {
+    ChatRequest {
+        model: params.model.clone().unwrap_or_else(|| model.to_string()),
+        messages,
+        params: params.or(RequestParams::from_env()),
+        stream,
+    }
+}
+
+// The JSON sent for `chat_request`
+pub fn request_body(messages: Vec<Message>, model: &str, params: &RequestParams, stream: bool) -> Result<Value> {
+    Ok(serde_json::to_value(chat_request(messages, model, params, stream))?)
+}
+
+// A reply and what it cost to get
+#[derive(Debug, Clone)]
+pub struct Reply {
+    pub text: String,
+    pub usage: Usage,
+}
+
+// One request, as the provider bills it: token counts are the ones it
+// reported, or estimates when it reported none (mock, plugins and some
+// streams)
+#[derive(Debug, Clone)]
+pub struct Usage {
+    pub model: String,
+    pub input_tokens: usize,
+    pub output_tokens: usize,
+    pub latency: Duration,
+}
+
+// Token counts in a response's `usage`: `prompt_tokens` and
+// `completion_tokens`, or `input_tokens` and `output_tokens`
+fn reported_usage(usage: &Value) -> Option<(usize, usize)> {
+    let count = |names: [&str; 2]| names.iter().find_map(|name| usage[*name].as_u64()).map(|n| n as usize);
+    Some((count(["prompt_tokens", "input_tokens"])?, count(["completion_tokens", "output_tokens"])?))
+}
+
+// Answers a request in place of the provider, given the messages and model
+pub type Handler = Arc<dyn Fn(&[Message], &str) -> Result<String> + Send + Sync>;
+
+pub struct ApiClient {
+    client: reqwest::Client,
+    // Swapped when .env is reloaded
+    api_key: RwLock<String>,
+    // Set by tests, which drive the watcher without a provider
+    handler: Option<Handler>,
+}
+
+impl ApiClient {
+    pub fn new(api_key: String) -> Self {
+        Self {
+            client: reqwest::Client::builder()
+                .connect_timeout(CONNECT_TIMEOUT)
+                .build()
+                .expect("Failed to create HTTP client"),
+            api_key: RwLock::new(api_key),
+            handler: None,
+        }
+    }
+
+    #[cfg(test)]
+    pub fn with_handler(handler: Handler) -> Self {
+        Self {
+            handler: Some(handler),
+            ..Self::new(String::new())
+        }
+    }
+
+    pub fn set_api_key(&self, api_key: String) {
+        *self.api_key.write().unwrap() = api_key;
+    }
+
+    fn api_key(&self) -> String {
+        self.api_key.read().unwrap().clone()
+    }
+
+    pub async fn call_api(&self, messages: Vec<Message>, model: &str, params: &RequestParams) -> Result<Reply> {
+        self.send(messages, model, params, None).await
+    }
+
+    // Like call_api, but passes the reply to `on_text` piece by piece as the
+    // provider streams it. Providers that don't stream answer all at once.
+    pub async fn call_api_streaming(
+        &self,
+        messages: Vec<Message>,
+        model: &str,
+        params: &RequestParams,
+        on_text: &(dyn Fn(&str) + Send + Sync),
+    ) -> Result<Reply> {
+        self.send(messages, model, params, Some(on_text)).await
+    }
+
+    // Whether the provider answers and takes the key, from its model list,
+    // which costs nothing, rather than a completion. Returns what was checked.
+    pub async fn ping(&self) -> Result<String> {
+        if self.handler.is_some() {
+            return Ok("requests are answered in-process".to_string());
+        }
+        let provider = provider_name();
+        if provider == mock::PROVIDER {
+            return Ok("the mock provider is always there".to_string());
+        }
+        if !builtin(&provider) && plugins::provider(&provider).await.is_some() {
+            return Ok(format!("{} comes from a plugin and isn't checked", provider));
+        }
+        let (provider, url) = endpoint();
+        let url = match url.trim_end_matches('/').strip_suffix("chat/completions") {
+            Some(base) => format!("{}models", base),
+            None => url,
+        };
+        let response = self
+            .client
+            .get(&url)
+            .header("Authorization", format!("Bearer {}", self.api_key()))
+            .timeout(PING_TIMEOUT)
+            .send()
+            .await?;
+        let status = response.status();
+        match status.as_u16() {
+            401 | 403 => anyhow::bail!("{} rejected the API key ({})", provider, status),
+            code if code >= 500 => anyhow::bail!("{} answered {}", provider, status),
+            // Reachable, even where there is no model list to read
+            _ => Ok(format!("{} answered {} at {}", provider, status, url)),
+        }
+    }
+
+    async fn send(
+        &self,
+        messages: Vec<Message>,
+        model: &str,
+        params: &RequestParams,
+        on_text: Option<&(dyn Fn(&str) + Send + Sync)>,
+    ) -> Result<Reply> {
+        let started = Instant::now();
+        let estimate = tokens::estimate_messages(&messages);
+        let answered_by = params.model.clone().unwrap_or_else(|| model.to_string());
+        let (text, reported) = self.complete(messages, model, params, on_text).await?;
+        let (input_tokens, output_tokens) = reported.unwrap_or_else(|| (estimate, tokens::estimate_tokens(&text)));
+        Ok(Reply {
+            text,
+            usage: Usage {
+                model: answered_by,
+                input_tokens,
+                output_tokens,
+                latency: started.elapsed(),
+            },
+        })
+    }
+
+    // The reply text, and the token counts the provider reported if it did
+    async fn complete(
+        &self,
+        messages: Vec<Message>,
+        model: &str,
+        params: &RequestParams,
+        on_text: Option<&(dyn Fn(&str) + Send + Sync)>,
+    ) -> Result<(String, Option<(usize, usize)>)> {
+        if let Some(handler) = &self.handler {
+            let model = params.model.clone().unwrap_or_else(|| model.to_string());
+            let reply = handler(&messages, &model)?;
+            if let Some(on_text) = on_text {
+                on_text(&reply);
+            }
+            return Ok((reply, None));
+        }
+        // Providers that aren't built in may come from a plugin
+        let provider = provider_name();
+        if provider == mock::PROVIDER {
+            let model = params.model.clone().unwrap_or_else(|| model.to_string());
+            return Ok((mock::complete(&messages, &model, on_text).await?, None));
+        }
+        if !builtin(&provider) {
+            if let Some(plugin) = plugins::provider(&provider).await {
+                let model = params.model.clone().unwrap_or_else(|| model.to_string());
+                let params = params.or(RequestParams::from_env());
+                return Ok((plugins::complete(&plugin, &provider, &messages, &model, &params, on_text).await?, None));
+            }
+        }
+
+        let (provider, url) = endpoint();
+        let adapters = adapters_for(&provider);
+        let request = request_body(messages, model, params, on_text.is_some())?;
+
+        if let Some(recorded) = vcr::replay(&request)? {
+            if recorded.event_stream && (200..300).contains(&recorded.status) {
+                let mut events = EventParser::default();
+                events.feed(recorded.body.as_bytes(), on_text.unwrap_or(&|_| {}))?;
+                return events.finish();
+            }
+            return self.read_body(reqwest::StatusCode::from_u16(recorded.status)?, &recorded.body, &adapters);
+        }
+
+        let mut post = self
+            .client
+            .post(&url)
+            .header("Authorization", format!("Bearer {}", self.api_key()))
+            .header("Content-Type", "application/json")
+            .json(&request);
+        if on_text.is_none() {
+            post = post.timeout(REPLY_TIMEOUT);
+        }
+        let response = tokio::time::timeout(REPLY_TIMEOUT, post.send())
+            .await
+            .with_context(|| format!("no answer from {} in {}s", provider, REPLY_TIMEOUT.as_secs()))??;
+
+        let status = response.status();
+        let event_stream = response
+            .headers()
+            .get("content-type")
+            .and_then(|v| v.to_str().ok())
+            .is_some_and(|v| v.starts_with("text/event-stream"));
+        if let (Some(on_text), true, true) = (on_text, status.is_success(), event_stream) {
+            let mut capture = vcr::recording().then(Vec::new);
+            let answer = read_stream(response, on_text, capture.as_mut()).await?;
+            if let Some(body) = capture {
+                let body = String::from_utf8_lossy(&body).into_owned();
+                vcr::record(&url, &request, vcr::Recording { status: status.as_u16(), event_stream, body });
+            }
+            return Ok(answer);
+        }
+        let body = response.text().await?;
+        let answer = self.read_body(status, &body, &adapters)?;
+        if vcr::recording() {
+            vcr::record(&url, &request, vcr::Recording { status: status.as_u16(), event_stream: false, body });
+        }
+        Ok(answer)
+    }
+
+    // The reply in a provider's JSON answer with its reported usage, or the
+    // error it reports
+    fn read_body(
+        &self,
+        status: reqwest::StatusCode,
+        body: &str,
+        adapters: &[Box<dyn ResponseAdapter>],
+    ) -> Result<(String, Option<(usize, usize)>)> {
+        let api_resp: ApiResponse = serde_json::from_str(body).unwrap_or_default();
+
+        if let Some(error) = &api_resp.error {
+            anyhow::bail!("API error: status {}: {}", status, error.describe());
+        }
+        if !status.is_success() {
+            debug_log(&format!("error: raw response body: {}", self.redact(body)));
+            anyhow::bail!("API error: status {}", status);
+        }
+
+        for adapter in adapters {
+            if let Some(text) = adapter.extract(&api_resp) {
+                return Ok((text, reported_usage(&api_resp.usage)));
+            }
+        }
+
+        debug_log(&format!(
+            "error: no reply text found (tried {}; {} choice(s), unknown fields: {:?}); raw body: {}",
+            adapters
+                .iter()
+                .map(|a| a.name())
+                .collect::<Vec<_>>()
+                .join(", "),
+            api_resp.choices.len(),
+            unknown_fields(&api_resp),
+            self.redact(body)
+        ));
+        anyhow::bail!("No response from API: unrecognised response shape")
+    }
+
+    fn redact(&self, body: &str) -> String {
+        let api_key = self.api_key();
+        let mut body = if api_key.is_empty() {
+            body.to_string()
+        } else {
+            body.replace(&api_key, "[redacted]")
+        };
+
+        if body.len() > MAX_LOGGED_BODY {
+            let mut end = MAX_LOGGED_BODY;
+            while !body.is_char_boundary(end) {
+                end -= 1;
+            }
+            body.truncate(end);
+            body.push_str("…");
+        }
+        body
+    }
+}
+
+// Server-sent chat completion chunks, each with the next piece of the reply
+// in `choices[0].delta.content`, until `data: [DONE]`. Providers that
+// report usage put it on the last chunk.
+async fn read_stream(
+    mut response: reqwest::Response,
+    on_text: &(dyn Fn(&str) + Send + Sync),
+    mut capture: Option<&mut Vec<u8>>,
+) -> Result<(String, Option<(usize, usize)>)> {
+    let mut events = EventParser::default();
+    while !events.done {
+        let chunk = tokio::time::timeout(STALL_TIMEOUT, response.chunk())
+            .await
+            .with_context(|| format!("the reply stopped for {}s", STALL_TIMEOUT.as_secs()))??;
+        let Some(chunk) = chunk else {
+            break;
+        };
+        if let Some(capture) = capture.as_mut() {
+            capture.extend_from_slice(&chunk);
+        }
+        events.feed(&chunk, on_text)?;
+    }
+    events.finish()
+}
+
+#[derive(Default)]
+struct EventParser {
+    text: String,
+    pending: Vec<u8>,
+    usage: Option<(usize, usize)>,
+    done: bool,
+}
+
+impl EventParser {
+    fn feed(&mut self, chunk: &[u8], on_text: &(dyn Fn(&str) + Send + Sync)) -> Result<()> {
+        self.pending.extend_from_slice(chunk);
+        // Lines can be split across chunks, and so can UTF-8 characters
+        while let Some(end) = self.pending.iter().position(|&b| b == b'\n') {
+            let line: Vec<u8> = self.pending.drain(..=end).collect();
+            let line = String::from_utf8_lossy(&line);
+            let Some(data) = line.trim().strip_prefix("data:").map(str::trim) else {
+                continue;
+            };
+            if data == "[DONE]" {
+                self.done = true;
+                return Ok(());
+            }
+            let Ok(event) = serde_json::from_str::<Value>(data) else {
+                continue;
+            };
+            if let Some(error) = event.get("error") {
+                anyhow::bail!("API error: {}", error);
+            }
+            if let Some(usage) = reported_usage(&event["usage"]) {
+                self.usage = Some(usage);
+            }
+            if let Some(piece) = event["choices"][0]["delta"]["content"].as_str().filter(|p| !p.is_empty()) {
+                on_text(piece);
+                self.text.push_str(piece);
+            }
+        }
+        Ok(())
+    }
+
+    fn finish(self) -> Result<(String, Option<(usize, usize)>)> {
+        if !self.done && self.text.is_empty() {
+            anyhow::bail!("No response from API: the stream ended without any text");
+        }
+        Ok((self.text, self.usage))
+    }
+}
+
+fn unknown_fields(response: &ApiResponse) -> Vec<String> {
+    let mut fields: Vec<String> = response.extra.keys().cloned().collect();
+    for choice in &response.choices {
+        fields.extend(choice.extra.keys().map(|k| format!("choices[].{}", k)));
+        if let Some(message) = &choice.message {
+            fields.extend(message.extra.keys().map(|k| format!("choices[].message.{}", k)));
+        }
+    }
+    fields.sort();
+    fields.dedup();
+    fields
+}
@@ -0,0 +1,339 @@
+use crate::{debug_log, files, Message};
+use anyhow::{Context, Result};
+use serde::{Deserialize, Serialize};
+use std::{
+    collections::{hash_map::DefaultHasher, HashMap, HashSet},
+    hash::{Hash, Hasher},
+    path::{Path, PathBuf},
+    sync::OnceLock,
+    time::{Duration, SystemTime},
+};
+use tokio::{fs, sync::Mutex};
+
+pub const DOCS_DIR_ENV: &str = "CHAT_DOCS_DIR";
+pub const TOP_K_ENV: &str = "CHAT_DOCS_TOP_K";
+pub const EMBEDDINGS_URL_ENV: &str = "CHAT_EMBEDDINGS_URL";
+pub const EMBEDDINGS_MODEL_ENV: &str = "CHAT_EMBEDDINGS_MODEL";
+pub const EMBEDDINGS_KEY_ENV: &str = "CHAT_EMBEDDINGS_API_KEY";
+
+// Any OpenAI-compatible embeddings endpoint works; the default is a local
+// Ollama, so documents don't leave the machine unless configured to
+const DEFAULT_EMBEDDINGS_URL: &str = "http://localhost:11434/v1/embeddings";
+const DEFAULT_EMBEDDINGS_MODEL: &str = "nomic-embed-text";
+const DEFAULT_TOP_K: usize = 4;
+
+// Kept next to the documents, so restarts only embed what changed
+const CACHE_FILE: &str = ".chat-index.json";
+const CHUNK_CHARS: usize = 1500;
+const MAX_FILE_BYTES: u64 = 1024 * 1024;
+const MAX_FILES: usize = 5000;
+const EMBED_BATCH: usize = 32;
+const TEXT_EXTENSIONS: &[&str] = &[
+    "md", "markdown", "txt", "rst", "org", "adoc", "rs", "go", "py", "js", "ts", "tsx", "jsx", "java", "kt", "c", "h",
+    "cc", "cpp", "hpp", "cs", "rb", "php", "swift", "sh", "sql", "toml", "yaml", "yml", "json", "html", "css",
+];
+
+// One piece of a document, with the lines it came from for the citation
+#[derive(Debug, Clone)]
+struct Chunk {
+    hash: u64,
+    start_line: usize,
+    end_line: usize,
+    text: String,
+}
+
+#[derive(Debug)]
+struct IndexedFile {
+    modified: SystemTime,
+    chunks: Vec<Chunk>,
+}
+
+#[derive(Debug, Default, Serialize, Deserialize)]
+struct Cache {
+    model: String,
+    // Chunk hash (as a string, for JSON keys) -> embedding
+    embeddings: HashMap<String, Vec<f32>>,
+}
+
+// Every chunk of every document under `dir`, re-read when a file's
+// modification time changes
+#[derive(Debug)]
+struct Index {
+    dir: PathBuf,
+    files: HashMap<PathBuf, IndexedFile>,
+    cache: Cache,
+}
+
+// Indexes are shared by every chat using the same directory
+static INDEXES: OnceLock<Mutex<HashMap<PathBuf, Index>>> = OnceLock::new();
+
+// A system message with the `top_k` chunks of `dir` closest to `query`,
+// each annotated with its source, or None when nothing is indexed
+pub async fn context_for(dir: &Path, query: &str) -> Result<Option<Message>> {
+    let dir = dir
+        .canonicalize()
+        .with_context(|| format!("docs directory {} not found", dir.display()))?;
+    let embedder = Embedder::from_env();
+    let top_k = crate::config::env_count(TOP_K_ENV).unwrap_or(DEFAULT_TOP_K);
+
+    let mut indexes = INDEXES.get_or_init(|| Mutex::new(HashMap::new())).lock().await;
+    if !indexes.contains_key(&dir) {
+        let index = Index::load(&dir).await;
+        indexes.insert(dir.clone(), index);
+    }
+    let index = indexes.get_mut(&dir).expect("index was just inserted");
+    index.refresh(&embedder).await?;
+
+    let query = embedder.embed(&[query.to_string()]).await?.pop().context("no embedding for the query")?;
+    let hits = index.search(&query, top_k);
+    if hits.is_empty() {
+        return Ok(None);
+    }
+    debug_log(&format!("load: {} relevant chunks from {}", hits.len(), dir.display()));
+
+    let mut text = String::from(
+        "Excerpts from the user's documents that may be relevant. Cite the source in brackets when you use one.\n",
+    );
+    for (i, (path, chunk)) in hits.iter().enumerate() {
+        let source = path.strip_prefix(&dir).unwrap_or(path).display();
+        text.push_str(&format!(
+            "\n[{}] {}:{}-{}\n```\n{}\n```\n",
+            i + 1,
+            source,
+            chunk.start_line,
+            chunk.end_line,
+            chunk.text.trim_end()
+        ));
+    }
+    Ok(Some(Message::new("system", text)))
+}
+
+impl Index {
+    async fn load(dir: &Path) -> Self {
+        let cache = match fs::read_to_string(dir.join(CACHE_FILE)).await {
+            Ok(raw) => serde_json::from_str(&raw).unwrap_or_default(),
+            Err(_) => Cache::default(),
+        };
+        Self {
+            dir: dir.to_path_buf(),
+            files: HashMap::new(),
+            cache,
+        }
+    }
+
+    // Re-chunks files that changed and embeds chunks not seen before
+    async fn refresh(&mut self, embedder: &Embedder) -> Result<()> {
+        if self.cache.model != embedder.model {
+            self.cache = Cache {
+                model: embedder.model.clone(),
+                ..Cache::default()
+            };
+        }
+
+        let paths = document_paths(&self.dir);
+        let present: HashSet<&PathBuf> = paths.iter().collect();
+        self.files.retain(|path, _| present.contains(path));
+
+        for path in &paths {
+            let Ok(modified) = std::fs::metadata(path).and_then(|m| m.modified()) else {
+                continue;
+            };
+            if self.files.get(path).is_some_and(|f| f.modified == modified) {
+                continue;
+            }
+            let Ok(text) = fs::read_to_string(path).await else {
+                continue;
+            };
+            self.files.insert(path.clone(), IndexedFile { modified, chunks: chunk(&text) });
+        }
+
+        let missing: Vec<&Chunk> = self
+            .files
+            .values()
+            .flat_map(|f| &f.chunks)
+            .filter(|c| !self.cache.embeddings.contains_key(&c.hash.to_string()))
+            .collect();
+        if missing.is_empty() {
+            return Ok(());
+        }
+
+        debug_log(&format!("call: embedding {} new chunks from {}", missing.len(), self.dir.display()));
+        let mut embedded = Vec::new();
+        for batch in missing.chunks(EMBED_BATCH) {
+            let texts: Vec<String> = batch.iter().map(|c| c.text.clone()).collect();
+            let vectors = embedder.embed(&texts).await?;
+            embedded.extend(batch.iter().map(|c| c.hash.to_string()).zip(vectors));
+        }
+        self.cache.embeddings.extend(embedded);
+
+        // Forget chunks that no longer exist before saving
+        let live: HashSet<String> = self
+            .files
+            .values()
+            .flat_map(|f| &f.chunks)
+            .map(|c| c.hash.to_string())
+            .collect();
+        self.cache.embeddings.retain(|hash, _| live.contains(hash));
+        if let Err(e) = files::write_atomic(&self.dir.join(CACHE_FILE), serde_json::to_string(&self.cache)?).await {
+            debug_log(&format!("error: cannot save the docs index: {}", e));
+        }
+        Ok(())
+    }
+
+    fn search(&self, query: &[f32], top_k: usize) -> Vec<(&PathBuf, &Chunk)> {
+        let mut scored: Vec<(f32, &PathBuf, &Chunk)> = self
+            .files
+            .iter()
+            .flat_map(|(path, file)| file.chunks.iter().map(move |c| (path, c)))
+            .filter_map(|(path, c)| {
+                let embedding = self.cache.embeddings.get(&c.hash.to_string())?;
+                Some((cosine(query, embedding), path, c))
+            })
+            .collect();
+        scored.sort_by(|a, b| b.0.total_cmp(&a.0));
+        scored.into_iter().take(top_k).map(|(_, path, c)| (path, c)).collect()
+    }
+}
+
+// Text files under `dir`, skipping hidden entries and anything too large
+pub fn document_paths(dir: &Path) -> Vec<PathBuf> {
+    let mut found = Vec::new();
+    let mut pending = vec![dir.to_path_buf()];
+    while let Some(dir) = pending.pop() {
+        let Ok(entries) = std::fs::read_dir(&dir) else {
+            continue;
+        };
+        for entry in entries.filter_map(|e| e.ok()) {
+            let path = entry.path();
+            if entry.file_name().to_string_lossy().starts_with('.') {
+                continue;
+            }
+            let Ok(metadata) = entry.metadata() else {
+                continue;
+            };
+            if metadata.is_dir() {
+                pending.push(path);
+            } else if metadata.len() <= MAX_FILE_BYTES
+                && path
+                    .extension()
+                    .is_some_and(|ext| TEXT_EXTENSIONS.contains(&ext.to_string_lossy().to_lowercase().as_str()))
+            {
+                found.push(path);
+            }
+            if found.len() >= MAX_FILES {
+                debug_log(&format!("skip: indexing only the first {} files", MAX_FILES));
+                return found;
+            }
+        }
+    }
+    found.sort();
+    found
+}
+
+// Splits on line boundaries into pieces of about CHUNK_CHARS, preferring to
+// break at a blank line
+fn chunk(text: &str) -> Vec<Chunk> {
+    let mut chunks = Vec::new();
+    let mut current = String::new();
+    let mut start_line = 1;
+
+    let lines: Vec<&str> = text.lines().collect();
+    for (i, line) in lines.iter().enumerate() {
+        current.push_str(line);
+        current.push('\n');
+
+        let at_break = line.trim().is_empty() && current.len() >= CHUNK_CHARS / 2;
+        if at_break || current.len() >= CHUNK_CHARS || i + 1 == lines.len() {
+            if !current.trim().is_empty() {
+                let mut hasher = DefaultHasher::new();
+                current.hash(&mut hasher);
+                chunks.push(Chunk {
+                    hash: hasher.finish(),
+                    start_line,
+                    end_line: i + 1,
+                    text: std::mem::take(&mut current),
+                });
+            }
+            current.clear();
+            start_line = i + 2;
+        }
+    }
+    chunks
+}
+
+fn cosine(a: &[f32], b: &[f32]) -> f32 {
+    let dot: f32 = a.iter().zip(b).map(|(x, y)| x * y).sum();
+    let norm = |v: &[f32]| v.iter().map(|x| x * x).sum::<f32>().sqrt();
+    let denominator = norm(a) * norm(b);
+    if denominator == 0.0 {
+        0.0
+    } else {
+        dot / denominator
+    }
+}
+
+struct Embedder {
+    client: reqwest::Client,
+    url: String,
+    model: String,
+    api_key: Option<String>,
+}
+
+#[derive(Serialize)]
+struct EmbeddingRequest<'a> {
+    model: &'a str,
+    input: &'a [String],
+}
+
+#[derive(Deserialize)]
+struct EmbeddingResponse {
+    data: Vec<EmbeddingData>,
+}
+
+#[derive(Deserialize)]
+struct EmbeddingData {
+    #[serde(default)]
+    index: usize,
+    embedding: Vec<f32>,
+}
+
+impl Embedder {
+    fn from_env() -> Self {
+        let var = |name: &str| std::env::var(name).ok().filter(|v| !v.trim().is_empty());
+        Self {
+            client: reqwest::Client::builder()
+                .timeout(Duration::from_secs(60))
+                .build()
+                .expect("Failed to create HTTP client"),
+            url: var(EMBEDDINGS_URL_ENV).unwrap_or_else(|| DEFAULT_EMBEDDINGS_URL.to_string()),
+            model: var(EMBEDDINGS_MODEL_ENV).unwrap_or_else(|| DEFAULT_EMBEDDINGS_MODEL.to_string()),
+            api_key: var(EMBEDDINGS_KEY_ENV),
+        }
+    }
+
+    async fn embed(&self, texts: &[String]) -> Result<Vec<Vec<f32>>> {
+        let mut request = self.client.post(&self.url).json(&EmbeddingRequest {
+            model: &self.model,
+            input: texts,
+        });
+        if let Some(key) = &self.api_key {
+            request = request.header("Authorization", format!("Bearer {}", key));
+        }
+
+        let response = request
+            .send()
+            .await
+            .with_context(|| format!("cannot reach the embeddings endpoint {}", self.url))?;
+        let status = response.status();
+        if !status.is_success() {
+            anyhow::bail!("embeddings error: status {}", status);
+        }
+
+        let mut data = response.json::<EmbeddingResponse>().await?.data;
+        if data.len() != texts.len() {
+            anyhow::bail!("embeddings error: asked for {}, got {}", texts.len(), data.len());
+        }
+        data.sort_by_key(|d| d.index);
+        Ok(data.into_iter().map(|d| d.embedding).collect())
+    }
+}
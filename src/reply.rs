@@ -0,0 +1,879 @@
+use crate::{
+    agent, archive, autocommit,
+    commands::{self, Command},
+    config, crypt, expand, fetch, files, history, hooks, index, jsonl, library, live,
+    logging::{self, debug_log},
+    memory, merge, metrics, otel, parser, pending, preview,
+    provider::{self, ApiClient, RequestParams},
+    rag, status, summary, tokens, validate, watch, webhook, ChatContext, Message,
+};
+use anyhow::{Context, Result};
+use std::{
+    path::Path,
+    sync::{Arc, RwLock},
+    time::Duration,
+};
+use tokio::{sync::Mutex, time::Instant};
+
+// How a saved chat becomes a reply: what changed and whether it asks for
+// one, the request that answers it, and writing the answer back
+
+const DOUBLE_NEWLINE: &str = "\n\n";
+// Ends a reply stopped with /stop, after whatever had arrived
+const CANCELLED: &str = "[cancelled]";
+// How often a chat is checked for /stop while a reply is on its way
+const STOP_CHECK: Duration = Duration::from_millis(250);
+
+// Looks at `content`, the chat as just read, and answers what it asks for:
+// a new message, an edited one, or a command
+pub async fn process_new_messages(
+    content: String,
+    last_content: Arc<Mutex<String>>,
+    api_client: Arc<ApiClient>,
+    chat_context: Arc<Mutex<ChatContext>>,
+    validators: Arc<validate::Validators>,
+    library: Arc<RwLock<library::PromptLibrary>>,
+) -> Result<()> {
+    let mut last_content = last_content.lock().await;
+    
+    if content == *last_content {
+        debug_log("unchanged: no new content");
+        return Ok(());
+    }
+
+    let mut chat_context = chat_context.lock().await;
+    chat_context.refresh(&content);
+    chat_context.base_content = content.clone();
+    sync_sidecars(&content, &chat_context).await;
+    let parse = otel::span("parse");
+
+    // Large chats are mostly finished exchanges; when none of them changed,
+    // only the tail after the last one is looked at
+    let unchanged = chat_context.unchanged_until(&content);
+    let tail_start = unchanged.unwrap_or(0);
+    let scan_from = chat_context.body_start + tail_start;
+
+    // A send marker sends right away, in either mode; it is dropped from the
+    // file and stands in for the double enter
+    let (content, send_marked) = match parser::take_send_marker(&content[scan_from..], chat_context.send_marker.as_deref()) {
+        Some(unmarked) => (format!("{}{}{}", &content[..scan_from], unmarked.trim_end(), DOUBLE_NEWLINE), true),
+        None => (content, false),
+    };
+
+    // Everything below works on the body, past any frontmatter
+    let body = &content[chat_context.body_start..];
+    let tail = &body[tail_start..];
+
+    if unchanged.is_none() {
+        if let Some(edited) = chat_context.find_edited_message(body) {
+            debug_log(&format!("detect: message {} was edited", edited / 2 + 1));
+            parse.end();
+            let written = regenerate_from(&content, edited, false, &api_client, &chat_context, &validators, &library).await?;
+            chat_context.remember_history(&written);
+            sync_sidecars(&written, &chat_context).await;
+            *last_content = written;
+            return Ok(());
+        }
+        if let Some(part) = chat_context.find_deleted_reply(body) {
+            debug_log(&format!("detect: reply to message {} was deleted", part / 2 + 1));
+            parse.end();
+            let written = regenerate_from(&content, part, false, &api_client, &chat_context, &validators, &library).await?;
+            chat_context.remember_history(&written);
+            sync_sidecars(&written, &chat_context).await;
+            *last_content = written;
+            return Ok(());
+        }
+        chat_context.settle(&content);
+    }
+
+    if chat_context.explicit_send && !send_marked {
+        debug_log("skip: waiting for a send marker");
+        *last_content = content;
+        return Ok(());
+    }
+
+    if !parser::ends_with_unfenced(tail, DOUBLE_NEWLINE) {
+        debug_log("skip: waiting for double enter");
+        *last_content = content;
+        return Ok(());
+    }
+
+    // Keep the first newline of the trigger so a separator right before it
+    // is still seen whole
+    let cursor_pos = body
+        .rfind(DOUBLE_NEWLINE)
+        .context("Invalid content format")?
+        + 1;
+
+    if chat_context.is_last_message_from_ai(tail, cursor_pos - tail_start) {
+        debug_log("skip: last message was from AI");
+        *last_content = content.clone();
+        return Ok(());
+    }
+
+    let message_content = parser::strip_branch_headings(&chat_context.extract_new_message(tail, cursor_pos - tail_start));
+    let (message_content, mut params) = RequestParams::take_from(&message_content);
+    let (message_content, _) = parser::take_pin(&message_content);
+    let (message_content, via) = parser::take_via(&message_content);
+    let message_content = take_mention(message_content, &mut params, &library);
+    if parser::strip_private(&message_content).is_empty() {
+        debug_log("skip: empty message");
+        *last_content = content;
+        return Ok(());
+    }
+    if parser::is_draft(&message_content) {
+        debug_log("skip: message is marked [draft]");
+        *last_content = content;
+        return Ok(());
+    }
+
+    let history_end = parser::rfind_unfenced(&body[..cursor_pos], &chat_context.separator).unwrap_or(0);
+    let (dropped, mut messages) = chat_context.split_history(body, history_end, cursor_pos);
+
+    if let Some(timestamp) = messages.last().and_then(|m| m.timestamp.as_deref()) {
+        debug_log(&format!("load: {} history messages, last at {}", messages.len(), timestamp));
+    }
+    parse.end();
+
+    // Commands typed on a bridged service are sent as plain messages
+    let written = if let Some(command) = Command::parse(&message_content).filter(|_| via.is_none()) {
+        debug_log(&format!("parse: running command {}", crypt::loggable(&chat_context.path, &message_content)));
+        if command == Command::Retry {
+            match last_answered_message(body, &chat_context.separator) {
+                Some(part) => {
+                    let keep = chat_context.keep_alternatives;
+                    regenerate_from(&content, part, keep, &api_client, &chat_context, &validators, &library).await?
+                }
+                None => append_reply(content, "Nothing to retry yet.", &chat_context, &parser::now_timestamp()).await?,
+            }
+        } else {
+            run_command(command, content, messages, &api_client, &chat_context, &validators, &library).await?
+        }
+    } else {
+        add_rolling_summary(&mut messages, &dropped, &chat_context, &api_client).await;
+        messages.push(Message {
+            via,
+            ..Message::new("user", message_content.clone())
+        });
+        debug_log(&format!("parse: sending message: {}", crypt::loggable(&chat_context.path, &message_content)));
+
+        // Left behind only if the process dies before the reply is written
+        let state = pending::Pending {
+            message: message_content.clone(),
+            model: params.model.clone().unwrap_or_else(|| chat_context.model.clone()),
+            started_at: parser::now_timestamp(),
+        };
+        if let Err(e) = pending::save(&chat_context.path, &state).await {
+            debug_log(&format!("error: cannot save request state: {}", e));
+        }
+        let written = send_and_append(content, messages, &params, None, &api_client, &chat_context, &validators, &library).await;
+        pending::clear(&chat_context.path).await;
+        written?
+    };
+
+    chat_context.remember_history(&written);
+    sync_sidecars(&written, &chat_context).await;
+    *last_content = written;
+    Ok(())
+}
+
+// Files derived from the chat, kept up to date on every change
+pub async fn sync_sidecars(content: &str, chat_context: &ChatContext) {
+    let _span = otel::span("sidecars");
+    index::update(chat_context, content).await;
+    if chat_context.jsonl {
+        let records = chat_context.transcript(&content[chat_context.body_start..]);
+        if let Err(e) = jsonl::write(&chat_context.path, &records).await {
+            debug_log(&format!("error: cannot write {}: {}", jsonl::sidecar_path(&chat_context.path).display(), e));
+        }
+    }
+}
+
+// Part index of the most recent user message that has a reply, skipping
+// command exchanges
+fn last_answered_message(body: &str, separator: &str) -> Option<usize> {
+    let parts = parser::split_unfenced(body, separator);
+    (0..parts.len())
+        .step_by(2)
+        .filter(|&i| parts.get(i + 1).is_some_and(|reply| !reply.trim().is_empty()))
+        .filter(|&i| Command::parse(&parser::strip_branch_headings(parts[i])).is_none())
+        .last()
+}
+
+// Cuts the conversation after user message `part` and sends it again. With
+// `keep`, the reply it had is kept, folded away under the new one.
+async fn regenerate_from(
+    content: &str,
+    part: usize,
+    keep: bool,
+    api_client: &ApiClient,
+    chat_context: &ChatContext,
+    validators: &validate::Validators,
+    library: &RwLock<library::PromptLibrary>,
+) -> Result<String> {
+    let body_start = chat_context.body_start;
+    let body = &content[body_start..];
+    let ranges = parser::split_unfenced_ranges(body, &chat_context.separator);
+    let discarded = ranges[part + 1..]
+        .iter()
+        .filter(|r| !body[(*r).clone()].trim().is_empty())
+        .count();
+    debug_log(&format!(
+        "call: regenerating reply to message {} ({} later messages discarded)",
+        part / 2 + 1,
+        discarded
+    ));
+
+    let text = parser::strip_branch_headings(&body[ranges[part].clone()]);
+    let (message_content, _) = parser::take_timestamp(&text);
+    let (message_content, mut params) = RequestParams::take_from(&message_content);
+    let (message_content, _) = parser::take_pin(&message_content);
+    let (message_content, via) = parser::take_via(&message_content);
+    let message_content = take_mention(message_content, &mut params, library);
+    let history_end = if part > 0 { ranges[part - 1].end } else { 0 };
+    let (dropped, mut messages) = chat_context.split_history(body, history_end, ranges[part].end);
+    add_rolling_summary(&mut messages, &dropped, chat_context, api_client).await;
+    messages.push(Message {
+        via,
+        ..Message::new("user", message_content)
+    });
+
+    // The old answer first, then any it had replaced
+    let earlier = ranges.get(part + 1).filter(|_| keep).map(|range| {
+        let (reply, _) = parser::take_timestamp(&body[range.clone()]);
+        let (answer, alternatives) = parser::take_alternatives(&reply);
+        format!("{}\n\n{}", parser::alternative(&answer), alternatives).trim_end().to_string()
+    });
+
+    let prefix = format!("{}{}", content[..body_start + ranges[part].end].trim_end(), DOUBLE_NEWLINE);
+    send_and_append(prefix, messages, &params, earlier.as_deref(), api_client, chat_context, validators, library).await
+}
+
+// With rolling summaries on, messages that fell out of the context window
+// are summarized into a system message at the front instead of being lost
+async fn add_rolling_summary(
+    messages: &mut Vec<Message>,
+    dropped: &[Message],
+    chat_context: &ChatContext,
+    api_client: &ApiClient,
+) {
+    if !chat_context.rolling_summary || dropped.is_empty() {
+        return;
+    }
+    let _span = otel::span("summary");
+    let mut dropped = dropped.to_vec();
+    strip_private(&mut dropped);
+    let model = chat_context.summary_model.as_deref().unwrap_or(&chat_context.model);
+    match summary::summarize(&chat_context.path, &dropped, model, api_client).await {
+        Ok(summary) => messages.insert(0, summary),
+        Err(e) => debug_log(&format!("error: cannot summarize older messages, leaving them out: {}", e)),
+    }
+}
+
+async fn run_command(
+    command: Command,
+    content: String,
+    mut history: Vec<Message>,
+    api_client: &ApiClient,
+    chat_context: &ChatContext,
+    validators: &validate::Validators,
+    library: &RwLock<library::PromptLibrary>,
+) -> Result<String> {
+    let now = parser::now_timestamp();
+    match command {
+        Command::Archive(keep) => {
+            let keep = keep.unwrap_or(archive::DEFAULT_KEEP_EXCHANGES);
+            let body_start = chat_context.body_start;
+            let Some(cut) = archive::archive_cut(&content[body_start..], &chat_context.separator, keep) else {
+                let reply = format!("Nothing to archive: {} exchanges or fewer.", keep);
+                return append_reply(content, &reply, chat_context, &now).await;
+            };
+
+            let count = chat_context.parse_messages(&content[body_start..body_start + cut]).len();
+            let content = archive::archive(&chat_context.path, &content, body_start, cut).await?;
+            let reply = format!(
+                "Archived {} messages to `{}`.",
+                count,
+                watch::display_path(&archive::archive_path(&chat_context.path))
+            );
+            append_reply(content, &reply, chat_context, &now).await
+        }
+        Command::Clear => {
+            append_reply(content, "Context cleared. Messages above this point will not be sent.", chat_context, &now).await
+        }
+        Command::Model(Some(model)) => {
+            let content = config::set_frontmatter_value(&content, "model", &model);
+            append_reply(content, &format!("Model set to `{}` for this chat.", model), chat_context, &now).await
+        }
+        Command::Model(None) => {
+            append_reply(content, &format!("Current model: `{}`", chat_context.model), chat_context, &now).await
+        }
+        Command::Persona(Some(name)) if matches!(name.as_str(), "none" | "off") => {
+            let content = config::set_frontmatter_value(&content, "persona", "");
+            append_reply(content, "Persona cleared for this chat.", chat_context, &now).await
+        }
+        Command::Persona(Some(name)) => {
+            let found = library.read().unwrap().get(library::Kind::Persona, &name).is_some();
+            if !found {
+                let reply = format!("No persona named `{}`. {}", name, persona_list(library));
+                return append_reply(content, &reply, chat_context, &now).await;
+            }
+            let content = config::set_frontmatter_value(&content, "persona", &name);
+            append_reply(content, &format!("Persona set to `{}` for this chat.", name), chat_context, &now).await
+        }
+        Command::Persona(None) => {
+            let current = match &chat_context.persona {
+                Some(persona) => format!("Current persona: `{}`.", persona),
+                None => "No persona set.".to_string(),
+            };
+            let reply = format!("{} {}", current, persona_list(library));
+            append_reply(content, &reply, chat_context, &now).await
+        }
+        Command::Context => {
+            let body = &content[chat_context.body_start..];
+            let (messages, notes) = preview::pending_request(chat_context, body).await;
+            let items = prepare_request(messages, None, chat_context, library).await;
+            let reply = format!("```\n{}```", preview::render(&items, chat_context, &notes));
+            append_reply(content, &reply, chat_context, &now).await
+        }
+        Command::Tokens => {
+            strip_private(&mut history);
+            if let Some(system) = system_prompt(chat_context.persona.as_deref(), library) {
+                history.insert(0, system);
+            }
+            let reply = format!(
+                "About {} tokens in {} messages would be sent as context with the next message (window: {}).",
+                tokens::estimate_messages(&history),
+                history.len(),
+                chat_context.window_description()
+            );
+            append_reply(content, &reply, chat_context, &now).await
+        }
+        Command::Summarize => {
+            history.push(Message::new("user", commands::SUMMARIZE_PROMPT));
+            send_and_append(content, history, &RequestParams::default(), None, api_client, chat_context, validators, library).await
+        }
+        Command::Fetch(Some(url)) => {
+            let reply = match fetch::fetch(&url).await {
+                Ok(page) => {
+                    debug_log(&format!("load: fetched {} ({} characters)", crypt::loggable(&chat_context.path, &url), page.text.len()));
+                    // A separator line in the page would end the reply early
+                    let separator = chat_context.separator.trim();
+                    let text: Vec<&str> = page.text.lines().filter(|line| line.trim() != separator).collect();
+                    format!(
+                        "Fetched [{}]({}); it is part of the context from here on.\n\n<details>\n<summary>Page text</summary>\n\n{}\n\n</details>",
+                        page.title.as_deref().unwrap_or(&url),
+                        url,
+                        text.join("\n").trim()
+                    )
+                }
+                Err(e) => format!("Cannot fetch {}: {:#}", url, e),
+            };
+            append_reply(content, &reply, chat_context, &now).await
+        }
+        Command::Fetch(None) => append_reply(content, "Usage: `/fetch <url>`", chat_context, &now).await,
+        Command::Retry => unreachable!("retry is handled by regenerate_from"),
+        Command::Stop => append_reply(content, "Nothing to stop: no reply is on its way.", chat_context, &now).await,
+    }
+}
+
+fn persona_list(library: &RwLock<library::PromptLibrary>) -> String {
+    let library = library.read().unwrap();
+    let names = library.names(library::Kind::Persona);
+    if names.is_empty() {
+        return "No personas found; add markdown files to the personas directory.".to_string();
+    }
+    let names: Vec<String> = names.iter().map(|n| format!("`{}`", n)).collect();
+    format!("Available: {}.", names.join(", "))
+}
+
+pub fn strip_private(messages: &mut Vec<Message>) {
+    for message in messages.iter_mut() {
+        message.content = parser::strip_private(&message.content);
+    }
+    messages.retain(|m| !m.content.is_empty());
+}
+
+// `@coder ...` has the coder persona answer this one message. Only known
+// personas count, so a message opening with a handle is sent as typed.
+pub fn take_mention(text: String, params: &mut RequestParams, library: &RwLock<library::PromptLibrary>) -> String {
+    match parser::take_mention(&text) {
+        Some((name, rest)) if library.read().unwrap().get(library::Kind::Persona, &name).is_some() => {
+            params.persona = Some(name);
+            rest
+        }
+        _ => text,
+    }
+}
+
+fn system_prompt(persona: Option<&str>, library: &RwLock<library::PromptLibrary>) -> Option<Message> {
+    let name = persona?;
+    match library.read().unwrap().get(library::Kind::Persona, name) {
+        Some(persona) => Some(Message::new("system", persona)),
+        None => {
+            debug_log(&format!("error: persona {:?} not found, sending without it", name));
+            None
+        }
+    }
+}
+
+// Sends `messages`, appends the reply after `content` (which ends with the
+// user's message) and returns the file as written. `params` apply to this
+// request only; `earlier` answers are kept below the reply.
+async fn send_and_append(
+    content: String,
+    messages: Vec<Message>,
+    params: &RequestParams,
+    earlier: Option<&str>,
+    api_client: &ApiClient,
+    chat_context: &ChatContext,
+    validators: &validate::Validators,
+    library: &RwLock<library::PromptLibrary>,
+) -> Result<String> {
+    let sent_at = parser::now_timestamp();
+    let question = messages
+        .last()
+        .map(|m| m.content.clone())
+        .filter(|q| q != commands::SUMMARIZE_PROMPT);
+    let asked = question.as_deref().map(parser::strip_private).unwrap_or_default();
+    let persona_model = params.persona.as_deref().and_then(|p| library.read().unwrap().persona_model(p).map(str::to_string));
+    let model = params.model.clone().or(persona_model).unwrap_or_else(|| chat_context.model.clone());
+    let event = |event, fields| webhook::notify(event, &chat_context.path, &model, fields);
+    event(webhook::Event::MessageSent, serde_json::json!({ "message": asked, "persona": params.persona }));
+    let placeholder = chat_context.typing_indicator && show_placeholder(&content, chat_context).await;
+    // What has streamed in so far, kept if the reply is stopped
+    let partial = std::sync::Mutex::new(String::new());
+    let on_text = |text: &str| partial.lock().unwrap_or_else(|e| e.into_inner()).push_str(text);
+    let request = request_reply(messages, params, api_client, chat_context, validators, library, &on_text);
+    let outcome = tokio::select! {
+        outcome = request => outcome,
+        // Dropping the request closes the connection, so generation stops
+        // and nothing more is billed
+        _ = stop_requested(&content, placeholder, chat_context) => {
+            if let Some(live) = live::following(&chat_context.path) {
+                live.done();
+            }
+            let partial = partial.into_inner().unwrap_or_else(|e| e.into_inner());
+            let reply = format!("{}\n\n{}", partial.trim_end(), CANCELLED).trim_start().to_string();
+            return append_reply(content, &reply, chat_context, &sent_at).await;
+        }
+    };
+    if let Err(e) = &outcome {
+        metrics::error(&model);
+        event(webhook::Event::Error, serde_json::json!({ "message": asked, "error": format!("{:#}", e) }));
+    }
+    let (response, warning) = match outcome {
+        Ok(reply) => reply,
+        // The placeholder promised a reply, so say what happened instead
+        Err(e) if placeholder => {
+            debug_log(&format!("error: {}", e));
+            let note = parser::private_note(&format!("⚠ Request failed: {}. Send /retry to try again.", e));
+            let note = match earlier {
+                Some(earlier) => format!("{}\n\n{}", note, earlier),
+                None => note,
+            };
+            return append_reply(content, &note, chat_context, &sent_at).await;
+        }
+        Err(e) => return Err(e),
+    };
+    // Kept out of the context like the user's own notes
+    let mut reply = match warning.as_deref().map(parser::private_note) {
+        Some(note) if response.is_empty() => note,
+        Some(note) => format!("{}\n\n{}", response.trim_end(), note),
+        None => response.clone(),
+    };
+    if let Some(name) = params.persona.as_deref().filter(|_| !response.is_empty()) {
+        reply = format!("{}\n\n{}", parser::persona_label(name), reply);
+    }
+    if let Some(earlier) = earlier {
+        reply = format!("{}\n\n{}", reply.trim_end(), earlier);
+    }
+    let written = append_reply(content, &reply, chat_context, &sent_at).await?;
+
+    // After the write, so the reply never waits on it
+    let question = question.filter(|_| !response.is_empty());
+    if let Some(target) = chat_context.auto_commit.as_ref().filter(|_| !response.is_empty()) {
+        if let Err(e) = autocommit::commit(&chat_context.path, target, question.as_deref()).await {
+            debug_log(&format!("error: cannot commit {}: {:#}", watch::display_path(&chat_context.path), e));
+        }
+    }
+    if !response.is_empty() {
+        event(
+            webhook::Event::ResponseReceived,
+            serde_json::json!({ "message": asked, "response": response, "persona": params.persona }),
+        );
+        let exchange = hooks::Exchange {
+            chat: &chat_context.path,
+            model: &model,
+            persona: params.persona.as_deref(),
+            question: &asked,
+            sent_at: &sent_at,
+        };
+        hooks::post_response(&response, &exchange).await;
+    }
+    if let Some(question) = question.filter(|q| chat_context.memory && !memory::opted_out(q)) {
+        let model = chat_context.summary_model.as_deref().unwrap_or(&chat_context.model);
+        if let Err(e) = memory::remember(&chat_context.path, &parser::strip_private(&question), &response, model, api_client).await {
+            debug_log(&format!("error: cannot update memories: {}", e));
+        }
+    }
+    Ok(written)
+}
+
+// Resolves once the user stops the reply on its way to `content`, by typing
+// /stop on a line below it or deleting the placeholder. The /stop line is
+// taken out of the file again.
+async fn stop_requested(content: &str, placeholder: bool, chat_context: &ChatContext) {
+    let shown = parser::placeholder(&chat_context.separator);
+    let mut chat_file = files::Poll::new(&chat_context.path);
+    loop {
+        tokio::time::sleep(STOP_CHECK).await;
+        let Ok(Some(latest)) = chat_file.changed().await else {
+            continue;
+        };
+        let below = match latest.find(&shown) {
+            Some(at) => &latest[at + shown.len()..],
+            None if placeholder => {
+                debug_log("detect: typing indicator deleted, stopping the reply");
+                return;
+            }
+            None => latest.strip_prefix(content).unwrap_or_default(),
+        };
+        if below.lines().any(|line| line.trim() == commands::STOP) {
+            debug_log("detect: /stop typed, stopping the reply");
+            if let Err(e) = remove_stop_line(&chat_context.path).await {
+                debug_log(&format!("error: cannot remove /stop: {}", e));
+            }
+            return;
+        }
+    }
+}
+
+async fn remove_stop_line(path: &Path) -> Result<()> {
+    let _lock = files::lock(path).await?;
+    let content = files::read_chat(path).await?;
+    let mut lines: Vec<&str> = content.split_inclusive('\n').collect();
+    if let Some(i) = lines.iter().rposition(|line| line.trim() == commands::STOP) {
+        lines.remove(i);
+    }
+    files::write_chat(path, &lines.concat()).await
+}
+
+// Everything that goes to the API for `messages` (history, then the new
+// user message), each with a label saying where it came from. `persona`
+// answers instead of the chat's own.
+pub async fn prepare_request(
+    mut messages: Vec<Message>,
+    persona: Option<&str>,
+    chat_context: &ChatContext,
+    library: &RwLock<library::PromptLibrary>,
+) -> Vec<(String, Message)> {
+    // Private notes never leave the file, and are gone before anything they
+    // mention could be expanded
+    strip_private(&mut messages);
+
+    let base_dir = chat_context.path.parent().unwrap_or(Path::new("."));
+    {
+        let library = library.read().unwrap();
+        // Bridged messages may not read files from this machine
+        for message in messages.iter_mut().filter(|m| m.role == "user" && m.via.is_none()) {
+            message.content = expand::expand_message(&message.content, base_dir, &library);
+        }
+    }
+    let current = if messages.last().is_some_and(|m| m.role == "user") {
+        messages.pop()
+    } else {
+        None
+    };
+    let query = current.as_ref().map(|m| m.content.as_str());
+
+    let mut items = Vec::new();
+    let persona = persona.or(chat_context.persona.as_deref());
+    if let Some(system) = system_prompt(persona, library) {
+        items.push((format!("persona {}", persona.unwrap_or_default()), system));
+    }
+    if let Some(path) = &chat_context.project_memory {
+        match memory::project_context(path).await {
+            Ok(Some(notes)) => items.push(("project memory".to_string(), notes)),
+            Ok(None) => {}
+            Err(e) => debug_log(&format!("error: {}", e)),
+        }
+    }
+    if chat_context.memory {
+        if let Some(memories) = memory::context_for(query.unwrap_or_default()).await {
+            items.push(("memories".to_string(), memories));
+        }
+    }
+    for message in messages {
+        let label = match (message.role.as_str(), message.pinned) {
+            ("system", _) => "summary".to_string(),
+            (role, true) => format!("{} (pinned)", role),
+            (role, false) => role.to_string(),
+        };
+        items.push((label, message));
+    }
+
+    // Excerpts go right before the message they were retrieved for
+    if let (Some(dir), Some(query)) = (&chat_context.docs_dir, query) {
+        match rag::context_for(dir, query).await {
+            Ok(Some(excerpts)) => items.push(("documents".to_string(), excerpts)),
+            Ok(None) => {}
+            Err(e) => debug_log(&format!("error: cannot search {}: {}", dir.display(), e)),
+        }
+    }
+    if let Some(current) = current {
+        items.push(("new message".to_string(), current));
+    }
+    items
+}
+
+// Prepares `messages` for the API, sends them and returns the reply, once
+// its code blocks pass validation or the repair attempts run out, with a
+// warning when the request nears the model's context window. Past the
+// window nothing is sent and the reply is empty.
+pub async fn request_reply(
+    messages: Vec<Message>,
+    params: &RequestParams,
+    api_client: &ApiClient,
+    chat_context: &ChatContext,
+    validators: &validate::Validators,
+    library: &RwLock<library::PromptLibrary>,
+    on_text: &(dyn Fn(&str) + Send + Sync),
+) -> Result<(String, Option<String>)> {
+    // A persona with a model of its own answers with it, unless the message
+    // names one
+    let persona = params.persona.as_deref().or(chat_context.persona.as_deref());
+    let persona_model = persona.and_then(|p| library.read().unwrap().persona_model(p).map(str::to_string));
+    let params = &RequestParams {
+        model: params.model.clone().or(persona_model),
+        ..params.clone()
+    };
+
+    let trim = otel::span("trim");
+    let mut messages: Vec<Message> = prepare_request(messages, params.persona.as_deref(), chat_context, library)
+        .await
+        .into_iter()
+        .map(|(_, message)| message)
+        .collect();
+    trim.end();
+    let model = params.model.as_deref().unwrap_or(&chat_context.model);
+    messages = hooks::pre_send(messages, &chat_context.path, model, persona).await?;
+
+    // Call API
+    let estimate = tokens::estimate_messages(&messages);
+    logging::log(
+        &format!("call: sending request with {} messages (~{} tokens)", messages.len(), estimate),
+        &[("model", model.into()), ("messages", messages.len().into()), ("tokens", estimate.into())],
+    );
+    if let Some(budget) = chat_context.context_tokens.filter(|&budget| estimate > budget) {
+        debug_log(&format!(
+            "error: request is ~{} tokens, over the {} token budget (the new message alone may be too long)",
+            estimate, budget
+        ));
+    }
+
+    // Say so in the chat before the provider truncates or rejects the request
+    let limit = chat_context.context_limit.or_else(|| tokens::model_limit(model));
+    let warning = match limit {
+        Some(limit) if estimate > limit => {
+            debug_log(&format!(
+                "error: request is ~{} tokens, over the {} token window of {}; not sending",
+                estimate, limit, model
+            ));
+            let note = format!(
+                "⚠ Not sent: this request is ~{} tokens, more than the {} tokens {} accepts. \
+                 Send /summarize or /archive to make room, then /retry.",
+                estimate, limit, model
+            );
+            return Ok((String::new(), Some(note)));
+        }
+        Some(limit) if tokens::near_limit(estimate, limit) => Some(format!(
+            "⚠ This request was ~{} of the {} tokens {} accepts ({}%). \
+             Send /summarize or /archive soon to make room.",
+            estimate,
+            limit,
+            model,
+            estimate * 100 / limit
+        )),
+        _ => None,
+    };
+
+    if !params.is_empty() {
+        debug_log(&format!("call: with parameter overrides {:?}", params));
+    }
+    let started = Instant::now();
+    let status = status::begin(&chat_context.path, model);
+    // Always streamed, so a reply stopped with /stop has what came so far;
+    // the file still gets the reply once it is complete
+    let live = live::following(&chat_context.path);
+    let mut trace = String::new();
+    let mut provider = otel::span("provider");
+    provider.attr("model", model);
+    provider.attr("input_tokens", estimate);
+    provider.attr("streamed", chat_context.agent_steps.is_none());
+    // The agent logs its own steps; other replies are logged below
+    let mut usage = None;
+    let mut answered = |reply: provider::Reply| {
+        usage = Some(reply.usage);
+        reply.text
+    };
+    let outcome = match (chat_context.agent_steps, live) {
+        // Tool steps go back and forth before there is anything to stream
+        (Some(steps), _) => {
+            agent::run(&mut messages, steps, &chat_context.path, api_client, &chat_context.model, params)
+                .await
+                .map(|(answer, steps)| {
+                    trace = steps;
+                    answer
+                })
+        }
+        (None, live) => {
+            if let Some(live) = &live {
+                live.start();
+            }
+            let on_text = |text: &str| {
+                on_text(text);
+                status.text(text);
+                if let Some(live) = &live {
+                    live.text(text);
+                }
+            };
+            let response = api_client
+                .call_api_streaming(messages.clone(), &chat_context.model, params, &on_text)
+                .await
+                .map(&mut answered);
+            if let Some(live) = &live {
+                live.done();
+            }
+            response
+        }
+    };
+    if let Err(e) = &outcome {
+        provider.fail(e);
+    }
+    let mut response = outcome?;
+    if let Some(usage) = &usage {
+        history::record(&chat_context.path, usage, &response).await;
+    }
+    provider.attr("output_tokens", tokens::estimate_tokens(&response));
+    provider.end();
+    status.done(&response);
+    let elapsed = started.elapsed();
+    let reply_tokens = tokens::estimate_tokens(&response);
+    logging::log(
+        &format!("response: ~{} tokens in {:.1}s", reply_tokens, elapsed.as_secs_f64()),
+        &[
+            ("model", model.into()),
+            ("tokens", reply_tokens.into()),
+            ("duration_ms", (elapsed.as_millis() as u64).into()),
+        ],
+    );
+
+    // Ask the model to fix code blocks that don't parse before writing anything
+    for attempt in 1..=validate::MAX_REPAIR_ATTEMPTS {
+        let problems = validators.check(&response).await;
+        if problems.is_empty() {
+            break;
+        }
+        debug_log(&format!(
+            "error: {} code block(s) failed validation, requesting fix (attempt {})",
+            problems.len(),
+            attempt
+        ));
+        messages.push(Message::new("assistant", response));
+        messages.push(Message::new("user", validate::repair_prompt(&problems)));
+        let mut repair = otel::span("repair");
+        repair.attr("attempt", attempt);
+        let repaired = api_client.call_api(messages.clone(), &chat_context.model, params).await?;
+        history::record(&chat_context.path, &repaired.usage, &repaired.text).await;
+        response = repaired.text;
+    }
+
+    if !trace.is_empty() {
+        response = format!("{}\n\n{}", trace, response.trim_start());
+    }
+    Ok((response, warning))
+}
+
+// Writes a placeholder where the reply to `content` will go, unless the
+// file has changed since the exchange started. Returns whether it did.
+async fn show_placeholder(content: &str, chat_context: &ChatContext) -> bool {
+    let _span = otel::span("placeholder");
+    let Ok(_lock) = files::lock(&chat_context.path).await else {
+        return false;
+    };
+    let latest = files::read_chat(&chat_context.path).await.unwrap_or_default();
+    if latest != chat_context.base_content {
+        return false;
+    }
+    let shown = format!("{}{}", content, parser::placeholder(&chat_context.separator));
+    match files::write_chat(&chat_context.path, &shown).await {
+        Ok(()) => true,
+        Err(e) => {
+            debug_log(&format!("error: cannot show the typing indicator: {}", e));
+            false
+        }
+    }
+}
+
+// Writes `reply` as the assistant message after `content` and returns the
+// file as written
+async fn append_reply(content: String, reply: &str, chat_context: &ChatContext, sent_at: &str) -> Result<String> {
+    debug_log("write: adding assistant response");
+    let _span = otel::span("write");
+    // With the placeholder showing, the file was last written as `content`
+    // plus the placeholder, so that is what edits are compared against
+    let placeholder = parser::placeholder(&chat_context.separator);
+    let planned = content.clone();
+    let (content, reply) = if chat_context.timestamps {
+        (
+            format!("{}\n{}\n", content.trim_end(), parser::timestamp_comment(sent_at)),
+            format!("{}\n{}", reply.trim_end(), parser::timestamp_comment(&parser::now_timestamp())),
+        )
+    } else {
+        (content, reply.to_string())
+    };
+    // Open with a separator too, so the reply gets its own (odd) slot in the
+    // user/assistant alternation instead of merging into the user message
+    let response_text = format!("{}{}{}", chat_context.separator, reply, chat_context.separator);
+    let mut written = format!("{}{}", content, response_text);
+
+    // Another instance (or a second terminal) must not write in between
+    let _lock = files::lock(&chat_context.path).await?;
+
+    // The user may have kept typing while the request was in flight
+    let latest = files::read_chat(&chat_context.path).await.unwrap_or_default();
+    let (base, latest) = match latest.find(&placeholder) {
+        Some(at) => (planned, format!("{}{}", &latest[..at], &latest[at + placeholder.len()..])),
+        None => (chat_context.base_content.clone(), latest),
+    };
+    if latest != base {
+        match merge::merge(&base, &latest, &written) {
+            Some(merged) => {
+                debug_log("write: merging edits made while waiting for the reply");
+                written = merged;
+            }
+            None => {
+                let conflict = merge::conflict_path(&chat_context.path);
+                files::write_chat(&conflict, &latest).await?;
+                debug_log(&format!(
+                    "error: edits made while waiting overlap the reply; your version was saved to {}",
+                    watch::display_path(&conflict)
+                ));
+            }
+        }
+    }
+
+    if let Some(keep) = chat_context.archive_after {
+        // Commands like /model may have just rewritten the frontmatter
+        let body_start = config::Frontmatter::parse(&written).body_start;
+        if let Some(cut) = archive::archive_cut(&written[body_start..], &chat_context.separator, keep) {
+            debug_log(&format!("write: archiving exchanges beyond the last {}", keep));
+            written = archive::archive(&chat_context.path, &written, body_start, cut).await?;
+        }
+    }
+
+    files::write_chat(&chat_context.path, &written).await?;
+
+    Ok(files::read_chat(&chat_context.path).await?)
+}
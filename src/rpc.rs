@@ -0,0 +1,239 @@
+use crate::{
+    auth, config, export, files, library, pending, preview,
+    provider::ApiClient,
+    reply, tokens, validate, web, ChatContext, LOG_TO_STDERR,
+};
+use anyhow::{bail, Context, Result};
+use serde_json::{json, Value};
+use std::{
+    path::{Path, PathBuf},
+    sync::{atomic::Ordering, Arc, RwLock},
+};
+use tokio::{
+    io::{AsyncBufReadExt, AsyncReadExt, AsyncWriteExt, BufReader},
+    sync::{mpsc, Mutex},
+};
+
+// JSON-RPC error codes
+const PARSE_ERROR: i64 = -32700;
+const METHOD_NOT_FOUND: i64 = -32601;
+const INVALID_PARAMS: i64 = -32602;
+const REQUEST_FAILED: i64 = -32000;
+
+const METHODS: &[&str] = &["send", "regenerate", "status", "tokens"];
+
+pub struct Services {
+    api_client: Arc<ApiClient>,
+    validators: Arc<validate::Validators>,
+    library: Arc<RwLock<library::PromptLibrary>>,
+}
+
+impl Services {
+    pub fn from_env() -> Result<Self> {
+        let api_key = auth::api_key()
+            .with_context(|| format!("{} not found; set it or run `auth login`", config::API_KEY_ENV))?;
+        Ok(Self {
+            api_client: Arc::new(ApiClient::new(api_key)),
+            validators: Arc::new(validate::Validators::from_env()),
+            library: Arc::new(RwLock::new(library::PromptLibrary::from_env())),
+        })
+    }
+
+    #[cfg(test)]
+    pub fn with_client(api_client: ApiClient) -> Self {
+        Self {
+            api_client: Arc::new(api_client),
+            validators: Arc::new(validate::Validators::from_env()),
+            library: Arc::new(RwLock::new(library::PromptLibrary::default())),
+        }
+    }
+}
+
+// `rpc`: JSON-RPC 2.0 on stdin and stdout, for editor extensions. Messages
+// are framed with `Content-Length` headers as in LSP, or one per line; each
+// response is framed like its request. Methods:
+//
+//   send        {file, text?}  appends `text` (or sends the draft already at
+//                              the end of the file) and returns the reply
+//   regenerate  {file}         answers the last message again, like /retry
+//   status      {file}         model, message count, the next request's size
+//                              and whether a reply is on its way
+//   tokens      {text, model?} the token count of a selection, with the
+//                              model's tokenizer when one is named
+//
+// Requests run concurrently, so status works while a send is waiting. Logs
+// go to stderr.
+pub async fn run(_args: &[String]) -> Result<()> {
+    LOG_TO_STDERR.store(true, Ordering::Relaxed);
+
+    let services = Arc::new(Services::from_env()?);
+
+    // One writer, so concurrent responses never interleave
+    let (out, mut responses) = mpsc::channel::<(Value, bool)>(16);
+    let writer = tokio::spawn(async move {
+        let mut stdout = tokio::io::stdout();
+        while let Some((response, framed)) = responses.recv().await {
+            let body = response.to_string();
+            let message = match framed {
+                true => format!("Content-Length: {}\r\n\r\n{}", body.len(), body),
+                false => format!("{}\n", body),
+            };
+            if stdout.write_all(message.as_bytes()).await.is_err() || stdout.flush().await.is_err() {
+                break;
+            }
+        }
+    });
+
+    let mut stdin = BufReader::new(tokio::io::stdin());
+    while let Some((body, framed)) = read_message(&mut stdin).await? {
+        let request: Value = match serde_json::from_str(&body) {
+            Ok(request) => request,
+            Err(e) => {
+                let _ = out.send((error(Value::Null, PARSE_ERROR, &e.to_string()), framed)).await;
+                continue;
+            }
+        };
+        let method = request["method"].as_str().unwrap_or_default().to_string();
+        if method == "exit" {
+            break;
+        }
+
+        let (services, out) = (services.clone(), out.clone());
+        tokio::spawn(async move {
+            let id = request.get("id").cloned();
+            let result = handle(&method, &request["params"], &services).await;
+            // Notifications (no id) get no response
+            let Some(id) = id else {
+                return;
+            };
+            let response = match result {
+                Ok(result) => json!({ "jsonrpc": "2.0", "id": id, "result": result }),
+                Err((code, message)) => error(id, code, &message),
+            };
+            let _ = out.send((response, framed)).await;
+        });
+    }
+
+    drop(out);
+    let _ = writer.await;
+    Ok(())
+}
+
+async fn handle(method: &str, params: &Value, services: &Services) -> Result<Value, (i64, String)> {
+    let file = || -> Result<PathBuf, (i64, String)> {
+        params["file"]
+            .as_str()
+            .map(PathBuf::from)
+            .ok_or((INVALID_PARAMS, "\"file\" is required".to_string()))
+    };
+    let failed = |e: anyhow::Error| (REQUEST_FAILED, format!("{:#}", e));
+
+    match method {
+        "initialize" => Ok(json!({ "name": env!("CARGO_PKG_NAME"), "version": env!("CARGO_PKG_VERSION"), "methods": METHODS })),
+        "shutdown" => Ok(Value::Null),
+        "send" => send(&file()?, params["text"].as_str(), None, services).await.map_err(failed),
+        "regenerate" => send(&file()?, Some("/retry"), None, services).await.map_err(failed),
+        "status" => status(&file()?, services).await.map_err(failed),
+        "tokens" => {
+            let text = params["text"].as_str().ok_or((INVALID_PARAMS, "\"text\" is required".to_string()))?;
+            match params["model"].as_str() {
+                Some(model) => Ok(json!({ "tokens": tokens::model_tokens(model, text), "tokenizer": tokens::tokenizer_name(model).0 })),
+                None => Ok(json!({ "tokens": tokens::estimate_tokens(text), "exact": tokens::exact() })),
+            }
+        }
+        _ => Err((METHOD_NOT_FOUND, format!("unknown method {:?}", method))),
+    }
+}
+
+// Sends `text` as the next message, or what is already typed below the last
+// reply, exactly as the watcher would on a double Enter, and returns the
+// reply once it is in the file. Text from another service names it in `via`,
+// and is sent as written, like a bridged message.
+pub async fn send(path: &Path, text: Option<&str>, via: Option<&str>, services: &Services) -> Result<Value> {
+    if let Some(text) = text.filter(|t| !t.trim().is_empty()) {
+        match via {
+            Some(via) => web::send_bridged(path, text, via).await.map(|_| ())?,
+            None => web::send_message(path, text).await?,
+        }
+    }
+    let on_disk = files::read_chat(path)
+        .await
+        .with_context(|| format!("cannot read {}", path.display()))?;
+    let content = match text {
+        Some(_) => on_disk.clone(),
+        None => format!("{}\n-->send\n", on_disk.trim_end()),
+    };
+
+    let chat_context = ChatContext::new(path.to_path_buf(), content.clone());
+    reply::process_new_messages(
+        content,
+        Arc::new(Mutex::new(String::new())),
+        services.api_client.clone(),
+        Arc::new(Mutex::new(chat_context)),
+        services.validators.clone(),
+        services.library.clone(),
+    )
+    .await?;
+
+    let name = path.display().to_string();
+    let written = files::read_chat(path).await.unwrap_or_default();
+    let records = export::records(&written, &name);
+    match records.last() {
+        Some(reply) if written != on_disk && reply.role == "assistant" => Ok(json!({ "file": name, "reply": reply })),
+        _ => bail!("nothing was sent: the end of {} holds no new message", name),
+    }
+}
+
+async fn status(path: &Path, services: &Services) -> Result<Value> {
+    let content = files::read_chat(path)
+        .await
+        .with_context(|| format!("cannot read {}", path.display()))?;
+    let chat_context = ChatContext::new(path.to_path_buf(), content.clone());
+    let (messages, _) = preview::pending_request(&chat_context, &content[chat_context.body_start..]).await;
+    let items = reply::prepare_request(messages, None, &chat_context, &services.library).await;
+    let next_request: usize = items.iter().map(|(_, message)| tokens::message_tokens(message)).sum();
+    let limit = chat_context.context_limit.or_else(|| tokens::model_limit(&chat_context.model));
+
+    Ok(json!({
+        "file": path.display().to_string(),
+        "model": chat_context.model,
+        "messages": export::records(&content, &path.display().to_string()).len(),
+        "next_request_tokens": next_request,
+        "context_limit": limit,
+        "replying": pending::load(path).await.is_some(),
+    }))
+}
+
+// The next message and whether it came with a Content-Length header, or None
+// at the end of input
+async fn read_message<R: AsyncBufReadExt + AsyncReadExt + Unpin>(input: &mut R) -> Result<Option<(String, bool)>> {
+    let mut line = String::new();
+    loop {
+        line.clear();
+        if input.read_line(&mut line).await? == 0 {
+            return Ok(None);
+        }
+        if !line.trim().is_empty() {
+            break;
+        }
+    }
+
+    let Some(length) = line.trim().strip_prefix("Content-Length:") else {
+        return Ok(Some((line.trim().to_string(), false)));
+    };
+    let length: usize = length.trim().parse().context("bad Content-Length")?;
+    // Any other headers, up to the blank line
+    loop {
+        line.clear();
+        if input.read_line(&mut line).await? == 0 || line.trim().is_empty() {
+            break;
+        }
+    }
+    let mut body = vec![0; length];
+    input.read_exact(&mut body).await?;
+    Ok(Some((String::from_utf8_lossy(&body).into_owned(), true)))
+}
+
+fn error(id: Value, code: i64, message: &str) -> Value {
+    json!({ "jsonrpc": "2.0", "id": id, "error": { "code": code, "message": message } })
+}
@@ -0,0 +1,175 @@
+use crate::{logging::debug_log, shell};
+use anyhow::{bail, Context, Result};
+use std::{
+    path::{Path, PathBuf},
+    process::Stdio,
+    time::{Duration, SystemTime, UNIX_EPOCH},
+};
+
+const RUN_TIMEOUT: Duration = Duration::from_secs(60);
+const CPU_SECONDS: u32 = 30;
+// In KiB, as ulimit takes them
+const MEMORY_KB: u32 = 1024 * 1024;
+// Go reserves far more address space than it uses, so its cap on that is
+// higher, and its heap is held to the same 1 GB by the runtime instead
+const GO_ADDRESS_KB: u32 = 4 * 1024 * 1024;
+const GO_MEMORY_LIMIT: &str = "1GiB";
+const FILE_KB: u32 = 50 * 1024;
+
+// Runs a Python or Go snippet in a fresh temporary directory, without network
+// access and with CPU time, memory and file sizes limited, and returns its
+// output. `project` is readable through $PROJECT_DIR for data to analyse.
+// Where the files outside those two can't be hidden, the snippet is shown in
+// `chat` to be approved first, like a shell command.
+pub async fn run(language: &str, code: &str, project: &Path, chat: &Path) -> Result<String> {
+    let (file, program, lang) = match language.trim().to_lowercase().as_str() {
+        "python" | "py" | "python3" => ("main.py", "python3", "python"),
+        "go" | "golang" => ("main.go", "go", "go"),
+        other => bail!("cannot run {:?}; use python or go", other),
+    };
+    if !isolates_files() {
+        if !chat.is_file() {
+            bail!("without bwrap, code needs a chat file to be approved in");
+        }
+        if !shell::approve_code(chat, lang, code).await? {
+            return Ok("The user did not approve running this code, so it was not run.".to_string());
+        }
+    }
+    let command = match program {
+        "go" => "go run main.go",
+        _ => "python3 main.py",
+    };
+    let dir = temp_dir();
+    std::fs::create_dir_all(&dir).with_context(|| format!("cannot create {}", dir.display()))?;
+    let result = run_in(&dir, file, program, command, code, project).await;
+    if let Err(e) = std::fs::remove_dir_all(&dir) {
+        debug_log(&format!("error: cannot remove sandbox {}: {}", dir.display(), e));
+    }
+    result
+}
+
+async fn run_in(dir: &Path, file: &str, program: &str, command: &str, code: &str, project: &Path) -> Result<String> {
+    std::fs::write(dir.join(file), code)?;
+
+    let memory = match file.ends_with(".go") {
+        true => GO_ADDRESS_KB,
+        false => MEMORY_KB,
+    };
+    let script = format!("ulimit -t {}; ulimit -f {}; ulimit -v {}; exec {}", CPU_SECONDS, FILE_KB, memory, command);
+
+    let project = project.canonicalize().unwrap_or_else(|_| project.to_path_buf());
+    let mut sandbox = isolated(&script, dir, &project, program)?;
+    sandbox
+        .current_dir(dir)
+        .env_clear()
+        .env("PATH", std::env::var("PATH").unwrap_or_default())
+        .env("HOME", dir)
+        .env("TMPDIR", dir)
+        .env("GOCACHE", dir.join(".gocache"))
+        .env("GOPATH", dir.join(".gopath"))
+        .env("GOTOOLCHAIN", "local")
+        .env("GOMEMLIMIT", GO_MEMORY_LIMIT)
+        .env("PROJECT_DIR", &project)
+        .stdin(Stdio::null())
+        .kill_on_drop(true);
+
+    debug_log(&format!("call: running {} in sandbox {}", file, dir.display()));
+    let output = tokio::time::timeout(RUN_TIMEOUT, sandbox.output())
+        .await
+        .with_context(|| format!("still running after {}s, stopped", RUN_TIMEOUT.as_secs()))?
+        .context("cannot start the sandbox")?;
+    Ok(shell::report(&output))
+}
+
+// Whether snippets can be kept from every file but their own directory and
+// the project: with bwrap on Linux, and always on macOS
+pub fn isolates_files() -> bool {
+    match std::env::consts::OS {
+        "linux" => find_program("bwrap").is_some(),
+        os => os == "macos",
+    }
+}
+
+// `script` under sh without network access: in bwrap on Linux, where the
+// system is read-only, the home directory hidden except for the project and
+// the toolchain, and only `dir` writable, or in just a network namespace of
+// its own without bwrap. On macOS sandbox-exec does the same as bwrap.
+// Elsewhere there is no way to cut the network, so nothing runs.
+fn isolated(script: &str, dir: &Path, project: &Path, program: &str) -> Result<tokio::process::Command> {
+    // Sandbox rules see paths with their links resolved
+    let dir = &dir.canonicalize()?;
+    let home = std::env::var_os("HOME").map(PathBuf::from).and_then(|h| h.canonicalize().ok());
+    let toolchains = toolchain_dirs(program, home.as_deref());
+    let mut command = match std::env::consts::OS {
+        "linux" if isolates_files() => {
+            let mut command = tokio::process::Command::new("bwrap");
+            command.args(["--ro-bind", "/", "/", "--dev", "/dev", "--proc", "/proc", "--tmpfs", "/tmp"]);
+            if let Some(home) = &home {
+                command.arg("--tmpfs").arg(home);
+            }
+            for toolchain in &toolchains {
+                command.arg("--ro-bind").arg(toolchain).arg(toolchain);
+            }
+            command.arg("--ro-bind").arg(project).arg(project);
+            command.arg("--bind").arg(dir).arg(dir).arg("--chdir").arg(dir);
+            command.args(["--unshare-all", "--die-with-parent"]);
+            command
+        }
+        "linux" => {
+            let mut command = tokio::process::Command::new("unshare");
+            command.args(["--map-root-user", "--net"]);
+            command
+        }
+        "macos" => {
+            let mut command = tokio::process::Command::new("sandbox-exec");
+            command.arg("-p").arg(macos_profile(dir, project, home.as_deref(), &toolchains));
+            command
+        }
+        other => bail!("code can only be run in a sandbox on Linux and macOS, not {}", other),
+    };
+    command.args(["sh", "-c", script]);
+    Ok(command)
+}
+
+// No network, writes only to `dir` (and devices like /dev/null), and nothing
+// read from the home directory but the project and the toolchain. Later
+// rules win.
+fn macos_profile(dir: &Path, project: &Path, home: Option<&Path>, toolchains: &[PathBuf]) -> String {
+    let quote = |path: &Path| format!("\"{}\"", path.display().to_string().replace('\\', "\\\\").replace('"', "\\\""));
+    let mut profile = String::from("(version 1)(allow default)(deny network*)(deny file-write*)(allow file-write* (subpath \"/dev\"))");
+    profile.push_str(&format!("(allow file-write* (subpath {}))", quote(dir)));
+    if let Some(home) = home {
+        profile.push_str(&format!("(deny file-read* (subpath {}))", quote(home)));
+    }
+    for readable in toolchains.iter().map(PathBuf::as_path).chain([project, dir]) {
+        profile.push_str(&format!("(allow file-read* (subpath {}))", quote(readable)));
+    }
+    profile
+}
+
+// Where `program` is installed, when that is inside the hidden home
+// directory: the top directory under home holding it (say ~/.pyenv or
+// ~/go), both for the name on PATH and what it links to
+fn toolchain_dirs(program: &str, home: Option<&Path>) -> Vec<PathBuf> {
+    let (Some(home), Some(found)) = (home, find_program(program)) else {
+        return Vec::new();
+    };
+    let mut dirs: Vec<PathBuf> = [found.clone(), found.canonicalize().unwrap_or(found)]
+        .iter()
+        .filter_map(|path| path.strip_prefix(home).ok()?.components().next())
+        .map(|top| home.join(top))
+        .collect();
+    dirs.dedup();
+    dirs
+}
+
+fn find_program(program: &str) -> Option<PathBuf> {
+    std::env::split_paths(&std::env::var_os("PATH")?)
+        .map(|dir| dir.join(program))
+        .find(|path| path.is_file())
+}
+
+fn temp_dir() -> PathBuf {
+    let nanos = SystemTime::now().duration_since(UNIX_EPOCH).map_or(0, |d| d.as_nanos());
+    std::env::temp_dir().join(format!("chatmd-sandbox-{}-{}", std::process::id(), nanos))
+}
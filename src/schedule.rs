@@ -0,0 +1,327 @@
+use crate::{files, logging::debug_log, rpc, watch, web};
+use anyhow::{bail, Context, Result};
+use chrono::{DateTime, Datelike, Local, NaiveDate, NaiveTime, Timelike, Weekday};
+use serde::Deserialize;
+use std::{path::PathBuf, time::Duration};
+
+pub const SCHEDULE_ENV: &str = "CHAT_SCHEDULE";
+const USER_FILE: &str = "chatmd/schedule.toml";
+// Waits are cut into steps this long, so a prompt due while the machine
+// slept runs soon after it wakes
+const CHECK_EVERY: Duration = Duration::from_secs(30);
+// Far enough ahead for any cron date that exists, 29 February included
+const LOOKAHEAD_DAYS: i64 = 366 * 4 + 1;
+
+#[derive(Deserialize)]
+struct ScheduleFile {
+    #[serde(default)]
+    prompt: Vec<Entry>,
+}
+
+#[derive(Deserialize)]
+struct Entry {
+    chat: String,
+    when: String,
+    text: String,
+}
+
+pub struct Prompt {
+    pub chat: PathBuf,
+    pub spec: String,
+    pub when: When,
+    pub text: String,
+}
+
+pub enum When {
+    // `every 30m`: counted from when the watcher started
+    Every(chrono::Duration),
+    // `18:00`, `mon 09:00`, `weekdays 08:30`: days indexed from Monday
+    Weekly { days: [bool; 7], time: NaiveTime },
+    Cron(Cron),
+}
+
+// The five fields of a crontab line
+pub struct Cron {
+    minutes: Vec<bool>,
+    hours: Vec<bool>,
+    days: Vec<bool>,
+    months: Vec<bool>,
+    weekdays: Vec<bool>,
+    any_day: bool,
+    any_weekday: bool,
+}
+
+// CHAT_SCHEDULE, or the user's `~/.config/chatmd/schedule.toml`
+pub fn path() -> Option<PathBuf> {
+    if let Some(path) = std::env::var(SCHEDULE_ENV).ok().filter(|p| !p.trim().is_empty()) {
+        return Some(watch::expand_home(path.trim()));
+    }
+    std::env::var_os("XDG_CONFIG_HOME")
+        .map(PathBuf::from)
+        .or_else(|| std::env::var_os("HOME").map(|home| PathBuf::from(home).join(".config")))
+        .map(|dir| dir.join(USER_FILE))
+}
+
+// The prompts in the schedule file; none if there is no file
+pub fn load() -> Result<Vec<Prompt>> {
+    let Some(path) = path().filter(|p| p.is_file()) else {
+        return Ok(Vec::new());
+    };
+    let raw = std::fs::read_to_string(&path).with_context(|| format!("cannot read {}", path.display()))?;
+    let file: ScheduleFile = toml::from_str(&raw).with_context(|| format!("{} is not a valid schedule", path.display()))?;
+    file.prompt
+        .into_iter()
+        .map(|entry| {
+            let when = When::parse(&entry.when).with_context(|| format!("{}: bad `when` {:?}", path.display(), entry.when))?;
+            Ok(Prompt {
+                chat: watch::expand_home(entry.chat.trim()),
+                spec: entry.when.trim().to_string(),
+                when,
+                text: entry.text.trim().to_string(),
+            })
+        })
+        .collect()
+}
+
+// Runs every scheduled prompt while the watcher does
+pub fn start(watch_set: &watch::WatchSet) {
+    let prompts = match load() {
+        Ok(prompts) => prompts,
+        Err(e) => {
+            debug_log(&format!("error: schedule: {:#}", e));
+            return;
+        }
+    };
+    if prompts.is_empty() {
+        return;
+    }
+    debug_log(&format!("init: {} scheduled prompt(s)", prompts.len()));
+    for prompt in prompts {
+        tokio::spawn(run_prompt(prompt, watch_set.clone()));
+    }
+}
+
+async fn run_prompt(prompt: Prompt, watch_set: watch::WatchSet) {
+    let mut next = prompt.when.next(Local::now());
+    while let Some(at) = next {
+        let now = Local::now();
+        if now < at {
+            let wait = (at - now).to_std().unwrap_or_default();
+            tokio::time::sleep(wait.min(CHECK_EVERY)).await;
+            continue;
+        }
+        debug_log(&format!("call: scheduled prompt ({}) for {}", prompt.spec, watch::display_path(&prompt.chat)));
+        if let Err(e) = fire(&prompt, &watch_set).await {
+            debug_log(&format!("error: scheduled prompt for {}: {:#}", watch::display_path(&prompt.chat), e));
+        }
+        next = prompt.when.next(Local::now());
+    }
+}
+
+// A watched chat gets the message like any other and the watcher answers
+// it; any other chat is answered here
+async fn fire(prompt: &Prompt, watch_set: &watch::WatchSet) -> Result<()> {
+    if !prompt.chat.exists() {
+        if let Some(dir) = prompt.chat.parent().filter(|d| !d.as_os_str().is_empty()) {
+            tokio::fs::create_dir_all(dir).await?;
+        }
+        files::write_chat(&prompt.chat, "").await?;
+    }
+    if let Some(chat) = watch_set.find(&prompt.chat) {
+        return web::send_message(&chat, &prompt.text).await;
+    }
+    let services = rpc::Services::from_env()?;
+    rpc::send(&prompt.chat, Some(&prompt.text), None, &services).await?;
+    Ok(())
+}
+
+impl When {
+    pub fn parse(spec: &str) -> Result<Self> {
+        let spec = spec.trim().to_lowercase();
+        if let Some(interval) = spec.strip_prefix("every ") {
+            return Ok(When::Every(parse_interval(interval.trim())?));
+        }
+        let fields: Vec<&str> = spec.split_whitespace().collect();
+        if fields.len() == 5 {
+            return Ok(When::Cron(Cron::parse(&fields)?));
+        }
+        let Some((time, days)) = fields.split_last() else {
+            bail!("empty schedule");
+        };
+        let time = NaiveTime::parse_from_str(time, "%H:%M").with_context(|| format!("{:?} is not a time like 18:00", time))?;
+        let days = match days {
+            [] => [true; 7],
+            [days] => parse_days(days)?,
+            _ => bail!("expected `[days] HH:MM`, `every <interval>` or a crontab line"),
+        };
+        Ok(When::Weekly { days, time })
+    }
+
+    // The first run strictly after `after`, if there is one
+    pub fn next(&self, after: DateTime<Local>) -> Option<DateTime<Local>> {
+        match self {
+            When::Every(interval) => Some(after + *interval),
+            When::Weekly { days, time } => (0..=7).find_map(|offset| {
+                let date = after.date_naive() + chrono::Duration::days(offset);
+                if !days[date.weekday().num_days_from_monday() as usize] {
+                    return None;
+                }
+                local(date, *time).filter(|at| *at > after)
+            }),
+            When::Cron(cron) => (0..LOOKAHEAD_DAYS).find_map(|offset| {
+                let date = after.date_naive() + chrono::Duration::days(offset);
+                if !cron.day_matches(date) {
+                    return None;
+                }
+                let hours = (0..24).filter(|h| cron.hours[*h as usize]);
+                hours
+                    .flat_map(|h| (0..60).filter(|m| cron.minutes[*m as usize]).map(move |m| (h, m)))
+                    .filter_map(|(h, m)| local(date, NaiveTime::from_hms_opt(h, m, 0)?))
+                    .find(|at| *at > after)
+            }),
+        }
+    }
+}
+
+// None for a time skipped by a daylight saving change
+fn local(date: NaiveDate, time: NaiveTime) -> Option<DateTime<Local>> {
+    date.and_time(time).and_local_timezone(Local).earliest()
+}
+
+// `90s`, `30m`, `2h`, `1d`, `1w`
+fn parse_interval(text: &str) -> Result<chrono::Duration> {
+    let split = text.find(|c: char| !c.is_ascii_digit()).unwrap_or(text.len());
+    let (count, unit) = text.split_at(split);
+    let count: i64 = count.parse().with_context(|| format!("{:?} is not an interval like 30m", text))?;
+    let interval = match unit.trim() {
+        "s" => chrono::Duration::seconds(count),
+        "m" | "min" => chrono::Duration::minutes(count),
+        "h" => chrono::Duration::hours(count),
+        "d" => chrono::Duration::days(count),
+        "w" => chrono::Duration::weeks(count),
+        other => bail!("unknown interval unit {:?} (use s, m, h, d or w)", other),
+    };
+    if interval < chrono::Duration::minutes(1) {
+        bail!("intervals under a minute are too short");
+    }
+    Ok(interval)
+}
+
+// `daily`, `weekdays`, `weekends`, `mon`, `mon,thu` or `mon-fri`
+fn parse_days(text: &str) -> Result<[bool; 7]> {
+    let mut days = [false; 7];
+    match text {
+        "daily" => return Ok([true; 7]),
+        "weekdays" => return Ok([true, true, true, true, true, false, false]),
+        "weekends" => return Ok([false, false, false, false, false, true, true]),
+        _ => {}
+    }
+    let day = |name: &str| -> Result<usize> {
+        let day: Weekday = name.parse().map_err(|_| anyhow::anyhow!("{:?} is not a day", name))?;
+        Ok(day.num_days_from_monday() as usize)
+    };
+    for item in text.split(',') {
+        match item.split_once('-') {
+            Some((first, last)) => {
+                let (first, last) = (day(first)?, day(last)?);
+                let mut d = first;
+                loop {
+                    days[d] = true;
+                    if d == last {
+                        break;
+                    }
+                    d = (d + 1) % 7;
+                }
+            }
+            None => days[day(item)?] = true,
+        }
+    }
+    Ok(days)
+}
+
+impl Cron {
+    fn parse(fields: &[&str]) -> Result<Self> {
+        let mut weekdays = parse_field(fields[4], 0, 7).context("day of week")?;
+        // 0 and 7 are both Sunday
+        weekdays[0] |= weekdays[7];
+        weekdays.truncate(7);
+        Ok(Cron {
+            minutes: parse_field(fields[0], 0, 59).context("minute")?,
+            hours: parse_field(fields[1], 0, 23).context("hour")?,
+            days: parse_field(fields[2], 1, 31).context("day of month")?,
+            months: parse_field(fields[3], 1, 12).context("month")?,
+            weekdays,
+            any_day: fields[2] == "*",
+            any_weekday: fields[4] == "*",
+        })
+    }
+
+    // As cron has it, a restricted day of month and day of week match
+    // either one
+    fn day_matches(&self, date: NaiveDate) -> bool {
+        if !self.months[date.month() as usize] {
+            return false;
+        }
+        let day = self.days[date.day() as usize];
+        let weekday = self.weekdays[date.weekday().num_days_from_sunday() as usize];
+        match (self.any_day, self.any_weekday) {
+            (true, true) => true,
+            (true, false) => weekday,
+            (false, true) => day,
+            (false, false) => day || weekday,
+        }
+    }
+}
+
+// A crontab field as a table indexed by value: `*`, `5`, `1-5`, `*/15`,
+// `0-30/10` and comma lists of those
+fn parse_field(field: &str, min: u32, max: u32) -> Result<Vec<bool>> {
+    let mut table = vec![false; max as usize + 1];
+    for item in field.split(',') {
+        let (range, step) = match item.split_once('/') {
+            Some((range, step)) => (range, step.parse::<u32>().with_context(|| format!("bad step in {:?}", item))?),
+            None => (item, 1),
+        };
+        let (first, last) = match range {
+            "*" => (min, max),
+            _ => match range.split_once('-') {
+                Some((first, last)) => (first.parse()?, last.parse()?),
+                None => {
+                    let value: u32 = range.parse().with_context(|| format!("{:?} is not a number", range))?;
+                    (value, if step > 1 { max } else { value })
+                }
+            },
+        };
+        if step == 0 || first < min || last > max || first > last {
+            bail!("{:?} is out of range {}-{}", item, min, max);
+        }
+        for value in (first..=last).step_by(step as usize) {
+            table[value as usize] = true;
+        }
+    }
+    Ok(table)
+}
+
+// `schedule`: the scheduled prompts and when each runs next
+pub async fn run(_args: &[String]) -> Result<()> {
+    let path = path().context("no schedule file: set CHAT_SCHEDULE or HOME")?;
+    let prompts = load()?;
+    if prompts.is_empty() {
+        println!("No scheduled prompts in {}", path.display());
+        return Ok(());
+    }
+    println!("Scheduled prompts in {}:", path.display());
+    let now = Local::now();
+    for prompt in prompts {
+        let next = match prompt.when.next(now) {
+            Some(at) if at.second() == 0 => at.format("%a %Y-%m-%d %H:%M").to_string(),
+            Some(at) => at.format("%a %Y-%m-%d %H:%M:%S").to_string(),
+            None => "never".to_string(),
+        };
+        let first_line = prompt.text.lines().next().unwrap_or_default();
+        println!("\n{}  ({})", watch::display_path(&prompt.chat), prompt.spec);
+        println!("  next  {}", next);
+        println!("  text  {}", first_line);
+    }
+    Ok(())
+}
@@ -0,0 +1,170 @@
+use crate::{files, index, logging::debug_log, watch};
+use anyhow::{bail, Context, Result};
+use chrono::{DateTime, Local, NaiveDate, NaiveTime};
+use std::{collections::HashMap, path::PathBuf};
+
+const USAGE: &str = "usage: search <query> [file|dir|glob...] [--role user|assistant] [--since date] [--until date]";
+// Longer lines are cut down to this much around the match
+const EXCERPT_CHARS: usize = 160;
+
+// `search <query> [targets...] [--role user|assistant] [--since date]
+// [--until date]`: every line of a message containing the query,
+// case-insensitively, as `file:line: role: text`. Targets are resolved like
+// the watcher's, so a directory searches every chat in it and no targets
+// means CHAT_WATCH or chat.md.
+pub async fn run(args: &[String]) -> Result<()> {
+    let mut role = None;
+    let mut since = None;
+    let mut until = None;
+    let mut words = Vec::new();
+    let mut targets = Vec::new();
+    let mut args = args.iter();
+    while let Some(arg) = args.next() {
+        match arg.as_str() {
+            "--role" | "-r" => role = Some(args.next().context("--role needs user or assistant")?.to_lowercase()),
+            "--since" => since = Some(parse_date(args.next().context("--since needs a date")?, false)?),
+            "--until" => until = Some(parse_date(args.next().context("--until needs a date")?, true)?),
+            // The first free argument is the query; quote it to search for
+            // several words
+            _ if words.is_empty() => words.push(arg.clone()),
+            _ => targets.push(arg.clone()),
+        }
+    }
+    let query = words.join(" ").to_lowercase();
+    if query.trim().is_empty() {
+        bail!("{}", USAGE);
+    }
+    if role.as_deref().is_some_and(|r| r != "user" && r != "assistant") {
+        bail!("--role needs user or assistant");
+    }
+
+    let include = watch::env_list(watch::INCLUDE_ENV);
+    let exclude = watch::env_list(watch::EXCLUDE_ENV);
+    let watch_set = watch::WatchSet::from_args(&targets, include, exclude)?;
+
+    let paths = watch_set.files();
+    let entries = match indexed(&query, &paths).await {
+        Ok(Some(entries)) => entries,
+        Ok(None) => scan(&paths).await,
+        Err(e) => {
+            debug_log(&format!("error: cannot use the index, reading every chat: {:#}", e));
+            scan(&paths).await
+        }
+    };
+
+    let mut hits = 0;
+    let mut changed = HashMap::new();
+    for entry in entries {
+        if role.as_deref().is_some_and(|r| r != entry.role) {
+            continue;
+        }
+        if since.is_some() || until.is_some() {
+            // Messages sent without a timestamp go by the file's last change
+            let modified = changed.entry(entry.path.clone()).or_insert_with(|| {
+                std::fs::metadata(&entry.path).and_then(|m| m.modified()).map(DateTime::<Local>::from).ok()
+            });
+            let stamped = entry.sent_at.as_deref().and_then(|t| DateTime::parse_from_rfc3339(t).ok());
+            let Some(sent) = stamped.map(|t| t.with_timezone(&Local)).or(*modified) else {
+                continue;
+            };
+            if since.is_some_and(|since| sent < since) || until.is_some_and(|until| sent > until) {
+                continue;
+            }
+        }
+        let shown = watch::display_path(&entry.path);
+        for (i, line) in entry.text.lines().enumerate() {
+            if let Some(at) = line.to_lowercase().find(&query) {
+                println!("{}:{}: {}: {}", shown, entry.line + i, entry.role, excerpt(line, at));
+                hits += 1;
+            }
+        }
+    }
+
+    if hits == 0 {
+        bail!("no messages match {:?}", words.join(" "));
+    }
+    Ok(())
+}
+
+// Matching messages from the index, brought up to date first; None when
+// the index is turned off
+async fn indexed(query: &str, paths: &[PathBuf]) -> Result<Option<Vec<index::Entry>>> {
+    if index::path().is_none() {
+        return Ok(None);
+    }
+    let reindexed = index::refresh(paths).await?;
+    if reindexed > 0 {
+        debug_log(&format!("load: indexed {} changed chat(s)", reindexed));
+    }
+    let (query, paths) = (query.to_string(), paths.to_vec());
+    tokio::task::spawn_blocking(move || {
+        let conn = index::open()?;
+        let entries = index::search(&conn, &query, &paths)?;
+        Ok(Some(entries))
+    })
+    .await?
+}
+
+// Every message of every chat, read from the files
+async fn scan(paths: &[PathBuf]) -> Vec<index::Entry> {
+    let mut entries = Vec::new();
+    for path in paths {
+        if let Ok(content) = files::read_chat(path).await {
+            entries.extend(index::entries(path, &content));
+        }
+    }
+    entries
+}
+
+// `2024-05-01`, `today`, `yesterday`, an age like `7d`, `2w` or `12h`, or a
+// full RFC 3339 time. A bare date stands for its start, or its end for
+// `--until`.
+pub fn parse_date(text: &str, end_of_day: bool) -> Result<DateTime<Local>> {
+    let text = text.trim().to_lowercase();
+    let now = Local::now();
+    let day = match text.as_str() {
+        "today" => Some(now.date_naive()),
+        "yesterday" => Some(now.date_naive() - chrono::Duration::days(1)),
+        _ => NaiveDate::parse_from_str(&text, "%Y-%m-%d").ok(),
+    };
+    if let Some(day) = day {
+        let time = match end_of_day {
+            true => NaiveTime::from_hms_opt(23, 59, 59).unwrap_or_default(),
+            false => NaiveTime::MIN,
+        };
+        return day.and_time(time).and_local_timezone(Local).earliest().context("no such local time");
+    }
+    if let Ok(time) = DateTime::parse_from_rfc3339(&text.to_uppercase().replace(' ', "T")) {
+        return Ok(time.with_timezone(&Local));
+    }
+    let split = text.find(|c: char| !c.is_ascii_digit()).unwrap_or(text.len());
+    let (count, unit) = text.split_at(split);
+    let age = match (count.parse::<i64>(), unit) {
+        (Ok(n), "h") => chrono::Duration::hours(n),
+        (Ok(n), "d") => chrono::Duration::days(n),
+        (Ok(n), "w") => chrono::Duration::weeks(n),
+        _ => bail!("{:?} is not a date (2024-05-01, today, yesterday, 7d, 2w or 12h)", text),
+    };
+    Ok(now - age)
+}
+
+// The line, or for a long one the part around `at` (a byte offset into
+// its lowercase form, which is close enough for a window)
+fn excerpt(line: &str, at: usize) -> String {
+    let line = line.trim();
+    let chars: Vec<char> = line.chars().collect();
+    if chars.len() <= EXCERPT_CHARS {
+        return line.to_string();
+    }
+    let at = line.char_indices().take_while(|(i, _)| *i < at).count().min(chars.len());
+    let start = at.saturating_sub(EXCERPT_CHARS / 3).min(chars.len() - EXCERPT_CHARS);
+    let end = start + EXCERPT_CHARS;
+    let mut text: String = chars[start..end].iter().collect();
+    if start > 0 {
+        text.insert(0, '…');
+    }
+    if end < chars.len() {
+        text.push('…');
+    }
+    text
+}
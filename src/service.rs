@@ -0,0 +1,177 @@
+use anyhow::{bail, Context, Result};
+use std::{
+    path::{Path, PathBuf},
+    process::Command,
+};
+
+const NAME: &str = "chatmd";
+const LAUNCHD_LABEL: &str = "com.chatmd.watch";
+
+// `service install [targets...] [--print]` / `service uninstall`: runs the
+// watcher on login as a systemd user unit, or a launchd agent on macOS. It
+// starts in the current directory, so this directory's .env and
+// .chatmd.toml apply as they do here, as does ~/.config/chatmd/config.toml.
+pub async fn run(args: &[String]) -> Result<()> {
+    let print = args.iter().any(|a| a == "--print");
+    let rest: Vec<String> = args.iter().skip(1).filter(|a| *a != "--print").cloned().collect();
+    match args.first().map(String::as_str) {
+        Some("install") => install(&rest, print),
+        Some("uninstall") => uninstall(),
+        _ => bail!("expected `service install [targets...]` or `service uninstall`"),
+    }
+}
+
+fn install(targets: &[String], print: bool) -> Result<()> {
+    let exe = std::env::current_exe().context("cannot find this program")?;
+    let dir = std::env::current_dir()?;
+    let log_file = log_dir()?.join(format!("{}.log", NAME));
+    let mut command = vec![exe.display().to_string(), "watch".to_string()];
+    command.extend(targets.iter().cloned());
+    command.extend(["--log-file".to_string(), log_file.display().to_string()]);
+
+    let (path, contents) = if cfg!(target_os = "macos") {
+        (launchd_path()?, plist(&command, &dir, &log_file))
+    } else {
+        (systemd_path()?, unit(&command, &dir))
+    };
+    if print {
+        print!("{}", contents);
+        return Ok(());
+    }
+
+    if let Some(parent) = path.parent() {
+        std::fs::create_dir_all(parent).with_context(|| format!("cannot create {}", parent.display()))?;
+    }
+    std::fs::write(&path, contents).with_context(|| format!("cannot write {}", path.display()))?;
+    println!("wrote {}", path.display());
+
+    if cfg!(target_os = "macos") {
+        // Reloading picks up a changed plist
+        let _ = Command::new("launchctl").args(["unload", &path.display().to_string()]).status();
+        run_tool("launchctl", &["load", "-w", &path.display().to_string()])?;
+    } else {
+        run_tool("systemctl", &["--user", "daemon-reload"])?;
+        run_tool("systemctl", &["--user", "enable", "--now", &format!("{}.service", NAME)])?;
+    }
+    println!("watching from {}, logging to {}", dir.display(), log_file.display());
+    Ok(())
+}
+
+fn uninstall() -> Result<()> {
+    let path = if cfg!(target_os = "macos") {
+        let path = launchd_path()?;
+        let _ = Command::new("launchctl").args(["unload", "-w", &path.display().to_string()]).status();
+        path
+    } else {
+        let _ = Command::new("systemctl")
+            .args(["--user", "disable", "--now", &format!("{}.service", NAME)])
+            .status();
+        systemd_path()?
+    };
+    match std::fs::remove_file(&path) {
+        Ok(()) => println!("removed {}", path.display()),
+        Err(e) if e.kind() == std::io::ErrorKind::NotFound => println!("no service was installed"),
+        Err(e) => return Err(e).with_context(|| format!("cannot remove {}", path.display())),
+    }
+    if !cfg!(target_os = "macos") {
+        let _ = Command::new("systemctl").args(["--user", "daemon-reload"]).status();
+    }
+    Ok(())
+}
+
+fn unit(command: &[String], dir: &Path) -> String {
+    let exec: Vec<String> = command.iter().map(|arg| systemd_quote(arg)).collect();
+    format!(
+        "[Unit]\n\
+         Description=Chat with a model from markdown files\n\
+         After=network-online.target\n\n\
+         [Service]\n\
+         WorkingDirectory={}\n\
+         ExecStart={}\n\
+         Restart=on-failure\n\
+         RestartSec=5\n\n\
+         [Install]\n\
+         WantedBy=default.target\n",
+        systemd_quote(&dir.display().to_string()),
+        exec.join(" ")
+    )
+}
+
+fn plist(command: &[String], dir: &Path, log_file: &Path) -> String {
+    let args: String = command
+        .iter()
+        .map(|arg| format!("        <string>{}</string>\n", xml_escape(arg)))
+        .collect();
+    format!(
+        "<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n\
+         <!DOCTYPE plist PUBLIC \"-//Apple//DTD PLIST 1.0//EN\" \"http://www.apple.com/DTDs/PropertyList-1.0.dtd\">\n\
+         <plist version=\"1.0\">\n\
+         <dict>\n    \
+             <key>Label</key>\n    <string>{}</string>\n    \
+             <key>ProgramArguments</key>\n    <array>\n{}    </array>\n    \
+             <key>WorkingDirectory</key>\n    <string>{}</string>\n    \
+             <key>RunAtLoad</key>\n    <true/>\n    \
+             <key>KeepAlive</key>\n    <dict>\n        <key>SuccessfulExit</key>\n        <false/>\n    </dict>\n    \
+             <key>StandardErrorPath</key>\n    <string>{}</string>\n\
+         </dict>\n\
+         </plist>\n",
+        LAUNCHD_LABEL,
+        args,
+        xml_escape(&dir.display().to_string()),
+        // Anything printed before logging is set up, such as a startup error
+        xml_escape(&log_file.with_extension("err").display().to_string())
+    )
+}
+
+fn systemd_quote(arg: &str) -> String {
+    if arg.chars().any(|c| c.is_whitespace() || matches!(c, '"' | '\\' | '\'' | '%' | '$')) {
+        // systemd expands % specifiers and $ variables even inside quotes
+        let escaped = arg.replace('\\', "\\\\").replace('"', "\\\"").replace('%', "%%").replace('$', "$$");
+        format!("\"{}\"", escaped)
+    } else {
+        arg.to_string()
+    }
+}
+
+fn xml_escape(text: &str) -> String {
+    text.replace('&', "&amp;").replace('<', "&lt;").replace('>', "&gt;")
+}
+
+fn home() -> Result<PathBuf> {
+    std::env::var_os("HOME").map(PathBuf::from).context("HOME is not set")
+}
+
+fn systemd_path() -> Result<PathBuf> {
+    let config = match std::env::var_os("XDG_CONFIG_HOME") {
+        Some(dir) => PathBuf::from(dir),
+        None => home()?.join(".config"),
+    };
+    Ok(config.join("systemd/user").join(format!("{}.service", NAME)))
+}
+
+fn launchd_path() -> Result<PathBuf> {
+    Ok(home()?.join("Library/LaunchAgents").join(format!("{}.plist", LAUNCHD_LABEL)))
+}
+
+// ~/Library/Logs on macOS, $XDG_STATE_HOME/chatmd elsewhere
+fn log_dir() -> Result<PathBuf> {
+    if cfg!(target_os = "macos") {
+        return Ok(home()?.join("Library/Logs"));
+    }
+    let state = match std::env::var_os("XDG_STATE_HOME") {
+        Some(dir) => PathBuf::from(dir),
+        None => home()?.join(".local/state"),
+    };
+    Ok(state.join(NAME))
+}
+
+fn run_tool(program: &str, args: &[&str]) -> Result<()> {
+    let status = Command::new(program)
+        .args(args)
+        .status()
+        .with_context(|| format!("cannot run {}", program))?;
+    if !status.success() {
+        bail!("`{} {}` failed", program, args.join(" "));
+    }
+    Ok(())
+}
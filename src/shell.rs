@@ -0,0 +1,153 @@
+use crate::{files, http, logging::debug_log};
+use anyhow::{Context, Result};
+use std::{
+    path::Path,
+    process::Stdio,
+    time::{Duration, Instant},
+};
+
+// Shown above each command waiting for a decision, with a nonce that ties
+// the decision to this one request
+const REQUEST_OPEN: &str = "<!-- run_shell";
+const REQUEST_CLOSE: &str = ": change [ ] to [approve] or [deny] and save -->";
+const DECISION_PREFIX: &str = "Decision:";
+const CHECK_EVERY: Duration = Duration::from_millis(250);
+// Unanswered requests count as denied after this
+const APPROVAL_TIMEOUT: Duration = Duration::from_secs(600);
+const RUN_TIMEOUT: Duration = Duration::from_secs(120);
+
+// Writes `command` at the end of the chat and waits for the user to mark it
+// [approve] or [deny]. Deleting the request, or leaving it for ten minutes,
+// denies it. The request is taken out of the file again either way.
+//
+// Only the first block with this request's nonce counts, and only while it
+// still shows `command`: a reply or a message appended below it can't
+// answer it, even by copying it.
+pub async fn approve(chat: &Path, command: &str) -> Result<bool> {
+    approve_code(chat, "sh", command).await
+}
+
+// Like `approve`, for `code` shown in a block of language `lang`
+pub async fn approve_code(chat: &Path, lang: &str, code: &str) -> Result<bool> {
+    let request = Request {
+        line: format!("{} {}{}", REQUEST_OPEN, http::random_token(), REQUEST_CLOSE),
+        command: code.trim().to_string(),
+    };
+    {
+        let _lock = files::lock(chat).await?;
+        let mut content = files::read_chat(chat).await?;
+        if !content.ends_with('\n') {
+            content.push('\n');
+        }
+        content.push_str(&format!(
+            "\n{}\n```{}\n{}\n```\n{} [ ]\n",
+            request.line, lang, request.command, DECISION_PREFIX
+        ));
+        files::write_chat(chat, &content).await?;
+    }
+    debug_log(&format!("detect: waiting for approval to run {:?}", request.command.lines().next().unwrap_or_default()));
+
+    let started = Instant::now();
+    let mut chat_file = files::Poll::new(chat);
+    let approved = loop {
+        tokio::time::sleep(CHECK_EVERY).await;
+        match chat_file.changed().await {
+            Ok(Some(content)) => {
+                let Some(decision) = request.decision(&content) else {
+                    break false;
+                };
+                match decision.as_deref() {
+                    Some("approve") => break true,
+                    Some("deny") => break false,
+                    _ => {}
+                }
+            }
+            Ok(None) => {}
+            Err(_) => break false,
+        }
+        if started.elapsed() > APPROVAL_TIMEOUT {
+            break false;
+        }
+    };
+
+    let _lock = files::lock(chat).await?;
+    let content = files::read_chat(chat).await?;
+    if let Some(range) = request.range(&content) {
+        let removed = format!("{}{}", content[..range.start].trim_end_matches('\n'), &content[range.end..]);
+        files::write_chat(chat, &format!("{}\n", removed.trim_end_matches('\n'))).await?;
+    }
+    Ok(approved)
+}
+
+struct Request {
+    line: String,
+    command: String,
+}
+
+impl Request {
+    // None when the request is gone or its command was changed, otherwise
+    // what the box says once it holds something other than a blank
+    fn decision(&self, content: &str) -> Option<Option<String>> {
+        let range = self.range(content)?;
+        let block = &content[range];
+        let shown = block.split_once("\n```")?.1.split_once('\n')?.1.rsplit_once("\n```")?.0;
+        if shown.trim() != self.command {
+            return None;
+        }
+        let line = block.lines().last().unwrap_or_default();
+        let mark = line
+            .trim()
+            .strip_prefix(DECISION_PREFIX)
+            .map(|rest| rest.trim().trim_start_matches('[').trim_end_matches(']').trim().to_lowercase())
+            .unwrap_or_default();
+        Some((!mark.is_empty()).then_some(mark))
+    }
+
+    // From the request line through its decision line
+    fn range(&self, content: &str) -> Option<std::ops::Range<usize>> {
+        let start = content.find(&self.line)?;
+        let decision = start + content[start..].find(&format!("\n{}", DECISION_PREFIX))? + 1;
+        let end = content[decision..].find('\n').map_or(content.len(), |i| decision + i + 1);
+        Some(start..end)
+    }
+}
+
+// Whether `text` holds something that looks like a run_shell request, which
+// text from outside the editor (the web page, the API, bridges) never may
+pub fn mentions_request(text: &str) -> bool {
+    text.contains(REQUEST_OPEN)
+}
+
+// Runs `command` with the shell in `dir` and returns what it printed and how
+// it exited. A command that outlives RUN_TIMEOUT, or a reply that is stopped,
+// kills it.
+pub async fn run(command: &str, dir: &Path) -> Result<String> {
+    let mut shell = match cfg!(windows) {
+        true => tokio::process::Command::new("cmd"),
+        false => tokio::process::Command::new("sh"),
+    };
+    shell
+        .arg(if cfg!(windows) { "/C" } else { "-c" })
+        .arg(command)
+        .current_dir(dir)
+        .stdin(Stdio::null())
+        .kill_on_drop(true);
+
+    let output = tokio::time::timeout(RUN_TIMEOUT, shell.output())
+        .await
+        .with_context(|| format!("still running after {}s, stopped", RUN_TIMEOUT.as_secs()))?
+        .context("cannot start the shell")?;
+
+    Ok(report(&output))
+}
+
+// stdout, then stderr under a marker, then how the process exited
+pub fn report(output: &std::process::Output) -> String {
+    let mut result = String::from_utf8_lossy(&output.stdout).trim_end().to_string();
+    let stderr = String::from_utf8_lossy(&output.stderr);
+    if !stderr.trim().is_empty() {
+        result.push_str(&format!("\n[stderr]\n{}", stderr.trim_end()));
+    }
+    result.push_str(&format!("\n[{}]", output.status));
+    result.trim_start().to_string()
+}
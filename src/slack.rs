@@ -0,0 +1,178 @@
+use crate::{bridge::Remote, logging::debug_log, watch};
+use anyhow::{bail, Context, Result};
+use serde_json::{json, Value};
+use std::{
+    path::PathBuf,
+    time::{Duration, SystemTime, UNIX_EPOCH},
+};
+
+pub const SLACK_TOKEN_ENV: &str = "CHAT_SLACK_TOKEN";
+pub const SLACK_CHANNEL_ENV: &str = "CHAT_SLACK_CHANNEL";
+pub const SLACK_CHAT_ENV: &str = "CHAT_SLACK_CHAT";
+pub const SLACK_USERS_ENV: &str = "CHAT_SLACK_USERS";
+// conversations.history allows about 50 calls a minute
+pub const POLL_EVERY: Duration = Duration::from_secs(3);
+const API: &str = "https://slack.com/api";
+
+pub struct Slack {
+    client: reqwest::Client,
+    token: String,
+    channel: String,
+    // Member IDs that may write to the chat; anyone in the channel could otherwise
+    users: Vec<String>,
+    // Timestamp of the newest message seen, in Slack's "seconds.micros" form
+    oldest: String,
+}
+
+// The bridge CHAT_SLACK_TOKEN (a bot token), CHAT_SLACK_CHANNEL (a channel
+// ID), CHAT_SLACK_USERS (the member IDs allowed to write) and
+// CHAT_SLACK_CHAT (the chat file) describe, if the token is set
+pub fn from_env() -> Result<Option<(Slack, PathBuf)>> {
+    let var = |name: &str| std::env::var(name).ok().filter(|v| !v.trim().is_empty());
+    let Some(token) = var(SLACK_TOKEN_ENV) else {
+        return Ok(None);
+    };
+    let channel = var(SLACK_CHANNEL_ENV).with_context(|| format!("{} is set but {} is not", SLACK_TOKEN_ENV, SLACK_CHANNEL_ENV))?;
+    let chat = var(SLACK_CHAT_ENV).with_context(|| format!("{} is set but {} is not", SLACK_TOKEN_ENV, SLACK_CHAT_ENV))?;
+    let users = watch::env_list(SLACK_USERS_ENV);
+    if users.is_empty() {
+        bail!("{} is set but {} is not", SLACK_TOKEN_ENV, SLACK_USERS_ENV);
+    }
+    let now = SystemTime::now().duration_since(UNIX_EPOCH).unwrap_or_default();
+    let slack = Slack {
+        client: reqwest::Client::builder().timeout(Duration::from_secs(20)).build()?,
+        token,
+        channel,
+        users,
+        oldest: format!("{}.{:06}", now.as_secs(), now.subsec_micros()),
+    };
+    Ok(Some((slack, PathBuf::from(chat))))
+}
+
+impl Slack {
+    async fn call(&self, method: &str, request: reqwest::RequestBuilder) -> Result<Value> {
+        let response: Value = request.bearer_auth(&self.token).send().await?.json().await?;
+        if response["ok"].as_bool() != Some(true) {
+            bail!("{} failed: {}", method, response["error"].as_str().unwrap_or("unknown error"));
+        }
+        Ok(response)
+    }
+}
+
+impl Remote for Slack {
+    fn name(&self) -> &'static str {
+        "slack"
+    }
+
+    async fn post(&mut self, text: &str, from_user: bool) -> Result<()> {
+        let text = match from_user {
+            true => format!("_From the chat file:_\n{}", to_mrkdwn(text)),
+            false => to_mrkdwn(text),
+        };
+        let request = self
+            .client
+            .post(format!("{}/chat.postMessage", API))
+            .json(&json!({ "channel": self.channel, "text": text }));
+        self.call("chat.postMessage", request).await?;
+        Ok(())
+    }
+
+    async fn receive(&mut self) -> Result<Vec<String>> {
+        let request = self
+            .client
+            .get(format!("{}/conversations.history", API))
+            .query(&[("channel", self.channel.as_str()), ("oldest", self.oldest.as_str()), ("limit", "100")]);
+        let response = self.call("conversations.history", request).await?;
+
+        // Newest first; bots (this one included) and joins, edits and the
+        // like are left out
+        let mut messages = Vec::new();
+        for message in response["messages"].as_array().into_iter().flatten().rev() {
+            if let Some(ts) = message["ts"].as_str() {
+                if ts.parse::<f64>().unwrap_or(0.0) > self.oldest.parse::<f64>().unwrap_or(0.0) {
+                    self.oldest = ts.to_string();
+                }
+            }
+            if message.get("bot_id").is_some() || message.get("subtype").is_some() {
+                continue;
+            }
+            let author = message["user"].as_str().unwrap_or_default();
+            if !self.users.iter().any(|user| user == author) {
+                debug_log(&format!("error: slack bridge: ignoring a message from user {} (not in {})", author, SLACK_USERS_ENV));
+                continue;
+            }
+            if let Some(text) = message["text"].as_str() {
+                messages.push(from_mrkdwn(text));
+            }
+        }
+        Ok(messages)
+    }
+}
+
+// Markdown as Slack shows it: *bold*, headings as bold lines, <url|links>
+// and code blocks without a language
+fn to_mrkdwn(markdown: &str) -> String {
+    let mut lines = Vec::new();
+    let mut in_code = false;
+    for line in markdown.lines() {
+        if line.trim_start().starts_with("```") {
+            in_code = !in_code;
+            lines.push("```".to_string());
+            continue;
+        }
+        if in_code {
+            lines.push(escape(line));
+            continue;
+        }
+        let line = escape(line);
+        let line = match line.trim_start().strip_prefix('#') {
+            Some(heading) => format!("*{}*", heading.trim_start_matches('#').trim()),
+            None => line,
+        };
+        lines.push(links(&line.replace("**", "*")));
+    }
+    lines.join("\n")
+}
+
+fn escape(text: &str) -> String {
+    text.replace('&', "&amp;").replace('<', "&lt;").replace('>', "&gt;")
+}
+
+// [text](url) -> <url|text>
+fn links(line: &str) -> String {
+    let mut out = String::new();
+    let mut rest = line;
+    while let Some(open) = rest.find('[') {
+        let Some(mid) = rest[open..].find("](").map(|i| open + i) else {
+            break;
+        };
+        let Some(close) = rest[mid..].find(')').map(|i| mid + i) else {
+            break;
+        };
+        out.push_str(&rest[..open]);
+        out.push_str(&format!("<{}|{}>", &rest[mid + 2..close], &rest[open + 1..mid]));
+        rest = &rest[close + 1..];
+    }
+    out.push_str(rest);
+    out
+}
+
+// Slack's escaping and <url|text> links back to markdown
+fn from_mrkdwn(text: &str) -> String {
+    let mut out = String::new();
+    let mut rest = text;
+    while let Some(open) = rest.find('<') {
+        let Some(close) = rest[open..].find('>').map(|i| open + i) else {
+            break;
+        };
+        out.push_str(&rest[..open]);
+        let inner = &rest[open + 1..close];
+        match inner.split_once('|') {
+            Some((url, label)) => out.push_str(&format!("[{}]({})", label, url)),
+            None => out.push_str(inner),
+        }
+        rest = &rest[close + 1..];
+    }
+    out.push_str(rest);
+    out.replace("&lt;", "<").replace("&gt;", ">").replace("&amp;", "&")
+}
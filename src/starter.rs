@@ -0,0 +1,56 @@
+use crate::files;
+use anyhow::{Context, Result};
+use std::path::{Path, PathBuf};
+use tokio::fs;
+
+pub const TEMPLATE_ENV: &str = "CHAT_TEMPLATE";
+
+// Used when CHAT_TEMPLATE isn't set. The note is private, so it stays in the
+// file as a reminder but is never sent.
+const DEFAULT_TEMPLATE: &str = "---
+title: {{title}}
+created: {{date}}
+---
+%% Type below and press Enter twice to send. Settings such as model, persona and
+timestamps go in the frontmatter above. %%
+";
+
+// `new <name>`: scaffolds a chat file from the starter template
+pub async fn run(args: &[String]) -> Result<()> {
+    let name = args.first().context("usage: new <name>")?;
+    let mut path = PathBuf::from(name);
+    if path.extension().is_none() {
+        path.set_extension("md");
+    }
+    if fs::try_exists(&path).await.unwrap_or(false) {
+        anyhow::bail!("{} already exists", path.display());
+    }
+
+    create(&path).await?;
+    println!("created {}", path.display());
+    Ok(())
+}
+
+pub async fn create(path: &Path) -> Result<()> {
+    if let Some(dir) = path.parent().filter(|d| !d.as_os_str().is_empty()) {
+        fs::create_dir_all(dir).await?;
+    }
+    files::write_chat(path, &render(path).await?).await
+}
+
+async fn render(path: &Path) -> Result<String> {
+    let template = match std::env::var(TEMPLATE_ENV).ok().filter(|t| !t.trim().is_empty()) {
+        Some(template_path) => fs::read_to_string(&template_path)
+            .await
+            .with_context(|| format!("cannot read template {}", template_path))?,
+        None => DEFAULT_TEMPLATE.to_string(),
+    };
+
+    let title = path
+        .file_stem()
+        .map(|s| s.to_string_lossy().replace(['-', '_'], " "))
+        .unwrap_or_default();
+    Ok(template
+        .replace("{{title}}", &title)
+        .replace("{{date}}", &crate::clock::now().format("%Y-%m-%d").to_string()))
+}
@@ -0,0 +1,174 @@
+use crate::{index, watch};
+use anyhow::{bail, Context, Result};
+use rusqlite::{params_from_iter, Connection};
+use std::path::PathBuf;
+
+const DEFAULT_DAYS: i64 = 14;
+const LONGEST: usize = 10;
+
+// `stats [targets...] [--days n]`: activity from the history database.
+// Targets are brought up to date first and limit the report to those
+// chats; without any it covers everything recorded.
+pub async fn run(args: &[String]) -> Result<()> {
+    let mut days = DEFAULT_DAYS;
+    let mut targets = Vec::new();
+    let mut args = args.iter();
+    while let Some(arg) = args.next() {
+        match arg.as_str() {
+            "--days" => days = args.next().and_then(|d| d.parse().ok()).context("--days needs a number")?,
+            _ => targets.push(arg.clone()),
+        }
+    }
+    if index::path().is_none() {
+        bail!("the history database is turned off (CHAT_INDEX)");
+    }
+    let paths = match targets.is_empty() {
+        true => None,
+        false => {
+            let include = watch::env_list(watch::INCLUDE_ENV);
+            let exclude = watch::env_list(watch::EXCLUDE_ENV);
+            Some(watch::WatchSet::from_args(&targets, include, exclude)?.files())
+        }
+    };
+
+    if let Some(paths) = &paths {
+        index::refresh(paths).await?;
+    }
+    let report = tokio::task::spawn_blocking(move || -> Result<String> {
+        let conn = index::open()?;
+        let keys: Option<Vec<String>> = paths.map(|paths| {
+            paths
+                .iter()
+                .map(|p| p.canonicalize().unwrap_or_else(|_| p.clone()).to_string_lossy().into_owned())
+                .collect()
+        });
+        report(&conn, keys.as_deref(), days)
+    })
+    .await??;
+    print!("{}", report);
+    Ok(())
+}
+
+fn report(conn: &Connection, paths: Option<&[String]>, days: i64) -> Result<String> {
+    // Limits a query to the chats asked about, as `path IN (...)`
+    let scope = match paths {
+        Some(paths) if paths.is_empty() => bail!("no chats match the targets"),
+        Some(paths) => format!("path IN ({})", vec!["?"; paths.len()].join(", ")),
+        None => "1".to_string(),
+    };
+    let bound = paths.unwrap_or_default();
+    let mut out = String::new();
+
+    let since = (chrono::Local::now() - chrono::Duration::days(days - 1)).format("%Y-%m-%d").to_string();
+    out.push_str(&format!("Last {} days\n", days));
+    let mut statement = conn.prepare(&format!(
+        "SELECT day, sum(messages), sum(calls), sum(tokens), sum(cost) FROM (
+             SELECT substr(sent_at, 1, 10) AS day, 1 AS messages, 0 AS calls, 0 AS tokens, NULL AS cost
+                 FROM chat_messages WHERE sent_at IS NOT NULL AND {0}
+             UNION ALL
+             SELECT substr(at, 1, 10), 0, 1, input_tokens + output_tokens, cost FROM requests WHERE {0}
+         ) WHERE day >= '{1}' GROUP BY day ORDER BY day",
+        scope, since
+    ))?;
+    let rows = statement.query_map(params_from_iter(bound.iter().chain(bound)), |row| {
+        Ok((
+            row.get::<_, String>(0)?,
+            row.get::<_, i64>(1)?,
+            row.get::<_, i64>(2)?,
+            row.get::<_, i64>(3)?,
+            row.get::<_, Option<f64>>(4)?,
+        ))
+    })?;
+    let mut table = vec![row(&["day", "messages", "requests", "tokens", "cost"])];
+    for day in rows {
+        let (day, messages, requests, tokens, cost) = day?;
+        table.push(row(&[&day, &messages.to_string(), &requests.to_string(), &tokens.to_string(), &dollars(cost)]));
+    }
+    out.push_str(&columns(&table, "  no activity"));
+    out.push_str("  (messages count those with timestamps; requests come from the usage log)\n");
+
+    out.push_str("\nBy model\n");
+    let mut statement = conn.prepare(&format!(
+        "SELECT model, count(*), sum(input_tokens), sum(output_tokens), sum(cost), avg(latency_ms)
+         FROM requests WHERE {} GROUP BY model ORDER BY count(*) DESC",
+        scope
+    ))?;
+    let rows = statement.query_map(params_from_iter(bound), |row| {
+        Ok((
+            row.get::<_, String>(0)?,
+            row.get::<_, i64>(1)?,
+            row.get::<_, i64>(2)?,
+            row.get::<_, i64>(3)?,
+            row.get::<_, Option<f64>>(4)?,
+            row.get::<_, f64>(5)?,
+        ))
+    })?;
+    let mut table = vec![row(&["model", "requests", "input", "output", "cost", "latency"])];
+    for model in rows {
+        let (model, requests, input, output, cost, latency) = model?;
+        let latency = format!("{:.1}s", latency / 1000.0);
+        table.push(row(&[&model, &requests.to_string(), &input.to_string(), &output.to_string(), &dollars(cost), &latency]));
+    }
+    out.push_str(&columns(&table, "  no requests recorded"));
+
+    let (requests, latency): (i64, Option<f64>) =
+        conn.query_row(&format!("SELECT count(*), avg(latency_ms) FROM requests WHERE {}", scope), params_from_iter(bound), |row| {
+            Ok((row.get(0)?, row.get(1)?))
+        })?;
+    if let Some(latency) = latency {
+        out.push_str(&format!("  average response time {:.1}s over {} requests\n", latency / 1000.0, requests));
+    }
+
+    out.push_str("\nLongest chats\n");
+    let mut statement = conn.prepare(&format!(
+        "SELECT path, count(*), sum(tokens) FROM chat_messages WHERE {} GROUP BY path
+         ORDER BY sum(tokens) DESC LIMIT {}",
+        scope, LONGEST
+    ))?;
+    let rows = statement.query_map(params_from_iter(bound), |row| {
+        Ok((row.get::<_, String>(0)?, row.get::<_, i64>(1)?, row.get::<_, i64>(2)?))
+    })?;
+    let mut table = vec![row(&["chat", "messages", "tokens"])];
+    for chat in rows {
+        let (path, messages, tokens) = chat?;
+        table.push(row(&[&watch::display_path(&PathBuf::from(path)), &messages.to_string(), &tokens.to_string()]));
+    }
+    out.push_str(&columns(&table, "  no chats indexed"));
+
+    Ok(out)
+}
+
+pub fn row(cells: &[&str]) -> Vec<String> {
+    cells.iter().map(|c| c.to_string()).collect()
+}
+
+pub fn dollars(cost: Option<f64>) -> String {
+    match cost {
+        Some(cost) if cost < 0.01 && cost > 0.0 => format!("${:.4}", cost),
+        Some(cost) => format!("${:.2}", cost),
+        None => "-".to_string(),
+    }
+}
+
+// A table with the first column left-aligned and the rest right-aligned,
+// or `empty` when it has only its header
+pub fn columns(table: &[Vec<String>], empty: &str) -> String {
+    if table.len() < 2 {
+        return format!("{}\n", empty);
+    }
+    let widths: Vec<usize> = (0..table[0].len())
+        .map(|i| table.iter().map(|row| row[i].chars().count()).max().unwrap_or(0))
+        .collect();
+    let mut out = String::new();
+    for row in table {
+        out.push_str(" ");
+        for (i, cell) in row.iter().enumerate() {
+            match i {
+                0 => out.push_str(&format!(" {:<width$}", cell, width = widths[i])),
+                _ => out.push_str(&format!("  {:>width$}", cell, width = widths[i])),
+            }
+        }
+        out.push('\n');
+    }
+    out
+}
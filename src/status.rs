@@ -0,0 +1,286 @@
+use crate::{files, logging, parser, tokens};
+use serde_json::{json, Value};
+use std::{
+    io::{IsTerminal, Write},
+    path::{Path, PathBuf},
+    sync::{Mutex, OnceLock},
+    time::{Duration, Instant},
+};
+
+pub const STATUS_FILE_ENV: &str = "CHAT_STATUS_FILE";
+
+const DEFAULT_STATUS_FILE: &str = ".chatmd/status.json";
+const TICK: Duration = Duration::from_millis(100);
+// The file is rewritten on every change of state, and this often while
+// a reply streams in
+const WRITE_EVERY: Duration = Duration::from_secs(1);
+const FRAMES: &[char] = &['⠋', '⠙', '⠹', '⠸', '⠼', '⠴', '⠦', '⠧', '⠇', '⠏'];
+
+static TRACKER: OnceLock<Mutex<Tracker>> = OnceLock::new();
+
+#[derive(Clone, Copy, PartialEq)]
+enum State {
+    Sending,
+    Streaming,
+}
+
+struct Request {
+    id: u64,
+    file: PathBuf,
+    model: String,
+    state: State,
+    started: Instant,
+    started_at: String,
+    first_text: Option<Instant>,
+    tokens: usize,
+}
+
+impl Request {
+    fn tokens_per_sec(&self) -> Option<f64> {
+        let streaming = self.first_text?.elapsed().as_secs_f64();
+        (streaming > 0.0 && self.tokens > 0).then(|| (self.tokens as f64 / streaming * 10.0).round() / 10.0)
+    }
+
+    fn to_json(&self) -> Value {
+        json!({
+            "file": crate::watch::display_path(&self.file),
+            "model": self.model,
+            "started": self.started_at,
+            "elapsed_ms": self.started.elapsed().as_millis() as u64,
+            "tokens": self.tokens,
+            "tokens_per_sec": self.tokens_per_sec(),
+        })
+    }
+}
+
+struct Tracker {
+    path: PathBuf,
+    spinner: bool,
+    next_id: u64,
+    requests: Vec<Request>,
+    // The request that finished last, kept for status bars that show it
+    last: Option<Value>,
+    changed: bool,
+}
+
+// Starts keeping the status file (CHAT_STATUS_FILE, or .chatmd/status.json;
+// `off` for none) and, when stderr is a terminal that logs go to, a spinner
+// while replies are on their way. Only the watcher calls this; elsewhere
+// `begin` does nothing.
+pub fn enable() {
+    let path = match std::env::var(STATUS_FILE_ENV) {
+        Ok(p) if matches!(p.trim().to_lowercase().as_str(), "off" | "false" | "0" | "none") => return,
+        Ok(p) if !p.trim().is_empty() => PathBuf::from(p.trim()),
+        _ => PathBuf::from(DEFAULT_STATUS_FILE),
+    };
+    if let Some(dir) = path.parent().filter(|d| !d.as_os_str().is_empty()) {
+        if let Err(e) = std::fs::create_dir_all(dir) {
+            logging::debug_log(&format!("error: cannot create {}: {}", dir.display(), e));
+            return;
+        }
+    }
+
+    let spinner = std::io::stderr().is_terminal()
+        && !logging::to_file()
+        && logging::LogFormat::current() == logging::LogFormat::Pretty;
+    let tracker = Tracker {
+        path,
+        spinner,
+        next_id: 0,
+        requests: Vec::new(),
+        last: None,
+        changed: true,
+    };
+    if TRACKER.set(Mutex::new(tracker)).is_ok() {
+        tokio::spawn(tick());
+    }
+}
+
+pub fn enabled() -> bool {
+    TRACKER.get().is_some()
+}
+
+// Removes the status file, so nothing reads a watcher that has stopped as
+// idle
+pub fn release() {
+    if let Some(mut tracker) = TRACKER.get().map(lock) {
+        tracker.requests.clear();
+        if tracker.spinner {
+            clear_line();
+        }
+        let _ = std::fs::remove_file(&tracker.path);
+    }
+}
+
+// A request to `model` for the chat at `file`, tracked until the handle is
+// dropped
+pub fn begin(file: &Path, model: &str) -> Handle {
+    let Some(mut tracker) = TRACKER.get().map(lock) else {
+        return Handle { id: None };
+    };
+    tracker.next_id += 1;
+    let id = tracker.next_id;
+    tracker.requests.push(Request {
+        id,
+        file: file.to_path_buf(),
+        model: model.to_string(),
+        state: State::Sending,
+        started: Instant::now(),
+        started_at: parser::now_timestamp(),
+        first_text: None,
+        tokens: 0,
+    });
+    tracker.changed = true;
+    Handle { id: Some(id) }
+}
+
+pub struct Handle {
+    id: Option<u64>,
+}
+
+impl Handle {
+    // Another piece of the reply has arrived
+    pub fn text(&self, text: &str) {
+        let Some(id) = self.id else {
+            return;
+        };
+        let mut tracker = lock(TRACKER.get().expect("tracked requests need a tracker"));
+        let tracker = &mut *tracker;
+        if let Some(request) = tracker.requests.iter_mut().find(|r| r.id == id) {
+            if request.state == State::Sending {
+                request.state = State::Streaming;
+                request.first_text = Some(Instant::now());
+                tracker.changed = true;
+            }
+            request.tokens += tokens::estimate_tokens(text);
+        }
+    }
+
+    // The whole reply, for providers that sent it in one piece
+    pub fn done(self, reply: &str) {
+        let Some(id) = self.id else {
+            return;
+        };
+        let mut tracker = lock(TRACKER.get().expect("tracked requests need a tracker"));
+        if let Some(request) = tracker.requests.iter_mut().find(|r| r.id == id && r.first_text.is_none()) {
+            request.first_text = Some(request.started);
+            request.tokens = tokens::estimate_tokens(reply);
+        }
+    }
+}
+
+impl Drop for Handle {
+    fn drop(&mut self) {
+        let Some(id) = self.id else {
+            return;
+        };
+        let mut tracker = lock(TRACKER.get().expect("tracked requests need a tracker"));
+        if let Some(i) = tracker.requests.iter().position(|r| r.id == id) {
+            let request = tracker.requests.remove(i);
+            tracker.last = Some(request.to_json());
+            tracker.changed = true;
+        }
+    }
+}
+
+fn lock(tracker: &Mutex<Tracker>) -> std::sync::MutexGuard<'_, Tracker> {
+    tracker.lock().unwrap_or_else(|e| e.into_inner())
+}
+
+// Called before a log line goes to the terminal, so it doesn't land in the
+// middle of the spinner; the next tick draws it again below
+pub fn clear_spinner() {
+    if let Some(tracker) = TRACKER.get().and_then(|t| t.try_lock().ok()) {
+        if tracker.spinner && !tracker.requests.is_empty() {
+            clear_line();
+        }
+    }
+}
+
+fn clear_line() {
+    let mut stderr = std::io::stderr();
+    let _ = write!(stderr, "\r\x1b[2K");
+    let _ = stderr.flush();
+}
+
+async fn tick() {
+    let mut frame = 0;
+    let mut last_write: Option<Instant> = None;
+    let mut was_busy = false;
+    loop {
+        let (path, status, line) = {
+            let mut tracker = lock(TRACKER.get().expect("ticking needs a tracker"));
+            let busy = !tracker.requests.is_empty();
+            let due = tracker.changed || (busy && last_write.map_or(true, |t| t.elapsed() >= WRITE_EVERY));
+            tracker.changed = false;
+
+            let line = match (tracker.spinner, busy, was_busy) {
+                (true, true, _) => Some(spinner_line(&tracker, FRAMES[frame % FRAMES.len()])),
+                (true, false, true) => Some(String::new()),
+                _ => None,
+            };
+            was_busy = busy;
+            (tracker.path.clone(), due.then(|| snapshot(&tracker)), line)
+        };
+
+        if let Some(line) = line {
+            let mut stderr = std::io::stderr();
+            let _ = write!(stderr, "\r\x1b[2K{}", line);
+            let _ = stderr.flush();
+            frame += 1;
+        }
+        if let Some(status) = status {
+            last_write = Some(Instant::now());
+            let body = format!("{:#}\n", status);
+            if let Err(e) = files::write_atomic(&path, body).await {
+                logging::debug_log(&format!("error: {:#}", e));
+            }
+        }
+        tokio::time::sleep(TICK).await;
+    }
+}
+
+// The newest request on top, with any others listed under `requests`
+fn snapshot(tracker: &Tracker) -> Value {
+    let mut status = match tracker.requests.last() {
+        Some(request) => {
+            let mut status = request.to_json();
+            status["state"] = match request.state {
+                State::Sending => "sending",
+                State::Streaming => "streaming",
+            }
+            .into();
+            status
+        }
+        None => json!({ "state": "idle" }),
+    };
+    status["pid"] = std::process::id().into();
+    status["updated"] = parser::now_timestamp().into();
+    status["requests"] = tracker.requests.iter().map(Request::to_json).collect();
+    status["last"] = tracker.last.clone().unwrap_or(Value::Null);
+    status
+}
+
+fn spinner_line(tracker: &Tracker, frame: char) -> String {
+    let Some(request) = tracker.requests.last() else {
+        return String::new();
+    };
+    let doing = match request.state {
+        State::Sending => format!("waiting for {}", request.model),
+        State::Streaming => format!("receiving from {}", request.model),
+    };
+    let mut line = format!(
+        "{} {}: {} {:.1}s",
+        frame,
+        crate::watch::display_path(&request.file),
+        doing,
+        request.started.elapsed().as_secs_f64()
+    );
+    if let Some(rate) = request.tokens_per_sec() {
+        line.push_str(&format!(", {} tokens, {} tok/s", request.tokens, rate));
+    }
+    if tracker.requests.len() > 1 {
+        line.push_str(&format!(" (+{} more)", tracker.requests.len() - 1));
+    }
+    line
+}
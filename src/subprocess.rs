@@ -0,0 +1,35 @@
+use anyhow::{Context, Result};
+use std::{
+    process::{Output, Stdio},
+    time::Duration,
+};
+use tokio::{io::AsyncWriteExt, process::Command};
+
+// Runs `command` with `input` on stdin until it exits, and returns what it
+// printed. Input is written while output is read: a program that streams,
+// like jq, sed or gpg, stops reading once its stdout pipe is full, so
+// writing everything first would leave both sides waiting. It is killed if
+// the whole exchange takes longer than `timeout`.
+pub async fn output(command: &mut Command, input: &[u8], timeout: Duration) -> Result<Output> {
+    let program = command.as_std().get_program().to_string_lossy().into_owned();
+    command
+        .stdin(Stdio::piped())
+        .stdout(Stdio::piped())
+        .stderr(Stdio::piped())
+        .kill_on_drop(true);
+    let mut child = command
+        .spawn()
+        .with_context(|| format!("cannot run {} (is it installed?)", program))?;
+    let stdin = child.stdin.take();
+    let write = async move {
+        // A program that doesn't want its input closes the pipe early; that's fine
+        if let Some(mut stdin) = stdin {
+            let _ = stdin.write_all(input).await;
+        }
+    };
+    let exchange = async { tokio::join!(write, child.wait_with_output()).1 };
+    let output = tokio::time::timeout(timeout, exchange)
+        .await
+        .with_context(|| format!("{} still running after {}s, stopped", program, timeout.as_secs()))??;
+    Ok(output)
+}
@@ -0,0 +1,112 @@
+use crate::{debug_log, files, history, provider::ApiClient, provider::RequestParams, Message};
+use anyhow::Result;
+use serde::{Deserialize, Serialize};
+use std::{
+    collections::hash_map::DefaultHasher,
+    hash::{Hash, Hasher},
+    path::{Path, PathBuf},
+};
+use tokio::fs;
+
+pub const ROLLING_SUMMARY_ENV: &str = "CHAT_ROLLING_SUMMARY";
+pub const SUMMARY_MODEL_ENV: &str = "CHAT_SUMMARY_MODEL";
+
+const INSTRUCTIONS: &str = "You maintain a running summary of a conversation whose oldest messages no longer fit in \
+the context window. Update the summary with the new messages. Keep facts, decisions, names, numbers and open \
+questions; drop pleasantries. Reply with the summary only.";
+
+// The summary so far and which messages it covers: the first `covered`
+// messages that fell out of the window, identified by their hash. As more
+// messages fall out, only the new ones are folded in.
+#[derive(Debug, Clone, Serialize, Deserialize)]
+struct Saved {
+    covered: usize,
+    hash: u64,
+    summary: String,
+}
+
+// chat.md -> .chat.md.summary.json
+pub fn state_path(chat_file: &Path) -> PathBuf {
+    let name = chat_file
+        .file_name()
+        .map(|s| s.to_string_lossy().into_owned())
+        .unwrap_or_else(|| "chat.md".to_string());
+    chat_file.with_file_name(format!(".{}.summary.json", name))
+}
+
+// A system message summarizing `dropped`, the messages cut from the front of
+// the history, oldest first
+pub async fn summarize(chat_file: &Path, dropped: &[Message], model: &str, api_client: &ApiClient) -> Result<Message> {
+    let path = state_path(chat_file);
+    let saved = load(&path, dropped).await;
+
+    let summary = match saved {
+        Some(saved) if saved.covered == dropped.len() => saved.summary,
+        saved => {
+            let (previous, new) = match &saved {
+                Some(saved) => (Some(saved.summary.as_str()), &dropped[saved.covered..]),
+                None => (None, dropped),
+            };
+            debug_log(&format!("call: summarizing {} messages that left the context window", new.len()));
+            let reply = api_client.call_api(prompt(previous, new), model, &RequestParams::default()).await?;
+            history::record(chat_file, &reply.usage, &reply.text).await;
+            let summary = reply.text.trim().to_string();
+
+            let saved = Saved {
+                covered: dropped.len(),
+                hash: hash_messages(dropped),
+                summary: summary.clone(),
+            };
+            if let Err(e) = files::write_atomic(&path, serde_json::to_string_pretty(&saved)?).await {
+                debug_log(&format!("error: cannot save summary: {}", e));
+            }
+            summary
+        }
+    };
+
+    Ok(as_message(&summary))
+}
+
+// The saved summary, only if it already covers all of `dropped`; never
+// calls the API
+pub async fn cached(chat_file: &Path, dropped: &[Message]) -> Option<Message> {
+    load(&state_path(chat_file), dropped)
+        .await
+        .filter(|saved| saved.covered == dropped.len())
+        .map(|saved| as_message(&saved.summary))
+}
+
+// The saved summary, if it covers a prefix of `dropped`
+async fn load(path: &Path, dropped: &[Message]) -> Option<Saved> {
+    let raw = fs::read_to_string(path).await.ok()?;
+    let saved: Saved = serde_json::from_str(&raw).ok()?;
+    (saved.covered <= dropped.len() && saved.hash == hash_messages(&dropped[..saved.covered])).then_some(saved)
+}
+
+fn as_message(summary: &str) -> Message {
+    Message::new(
+        "system",
+        format!("Summary of the earlier conversation, no longer shown in full:\n\n{}", summary),
+    )
+}
+
+fn prompt(previous: Option<&str>, new: &[Message]) -> Vec<Message> {
+    let mut text = String::new();
+    if let Some(previous) = previous {
+        text.push_str(&format!("Summary so far:\n{}\n\n", previous));
+    }
+    text.push_str("New messages:\n");
+    for message in new {
+        text.push_str(&format!("\n{}: {}\n", message.role, message.content));
+    }
+    vec![Message::new("system", INSTRUCTIONS), Message::new("user", text)]
+}
+
+fn hash_messages(messages: &[Message]) -> u64 {
+    let mut hasher = DefaultHasher::new();
+    for message in messages {
+        message.role.hash(&mut hasher);
+        message.content.hash(&mut hasher);
+    }
+    hasher.finish()
+}
@@ -0,0 +1,136 @@
+use crate::{
+    bridge::{self, Remote},
+    logging::debug_log,
+    watch,
+};
+use anyhow::{bail, Context, Result};
+use serde_json::{json, Value};
+use std::{path::PathBuf, time::Duration};
+
+pub const TELEGRAM_TOKEN_ENV: &str = "CHAT_TELEGRAM_TOKEN";
+pub const TELEGRAM_CHAT_ID_ENV: &str = "CHAT_TELEGRAM_CHAT_ID";
+pub const TELEGRAM_CHAT_ENV: &str = "CHAT_TELEGRAM_CHAT";
+pub const TELEGRAM_USERS_ENV: &str = "CHAT_TELEGRAM_USERS";
+pub const POLL_EVERY: Duration = Duration::from_secs(2);
+const API: &str = "https://api.telegram.org";
+const MAX_MESSAGE_CHARS: usize = 4096;
+
+pub struct Telegram {
+    client: reqwest::Client,
+    token: String,
+    // Only this chat may talk to the bot; anyone can find a bot and write to it
+    chat_id: i64,
+    // User IDs that may write, even in a group chat
+    users: Vec<String>,
+    // The next update to ask for, once updates from before startup are skipped
+    offset: Option<i64>,
+}
+
+// The bridge CHAT_TELEGRAM_TOKEN (from @BotFather), CHAT_TELEGRAM_CHAT_ID
+// (the Telegram chat to talk to), CHAT_TELEGRAM_USERS (who in it may
+// write) and CHAT_TELEGRAM_CHAT (the chat file) describe, if the
+// token is set
+pub fn from_env() -> Result<Option<(Telegram, PathBuf)>> {
+    let var = |name: &str| std::env::var(name).ok().filter(|v| !v.trim().is_empty());
+    let Some(token) = var(TELEGRAM_TOKEN_ENV) else {
+        return Ok(None);
+    };
+    let chat_id = var(TELEGRAM_CHAT_ID_ENV)
+        .with_context(|| format!("{} is set but {} is not", TELEGRAM_TOKEN_ENV, TELEGRAM_CHAT_ID_ENV))?
+        .trim()
+        .parse()
+        .with_context(|| format!("{} must be a number", TELEGRAM_CHAT_ID_ENV))?;
+    let chat = var(TELEGRAM_CHAT_ENV)
+        .with_context(|| format!("{} is set but {} is not", TELEGRAM_TOKEN_ENV, TELEGRAM_CHAT_ENV))?;
+    let users = watch::env_list(TELEGRAM_USERS_ENV);
+    if users.is_empty() {
+        bail!("{} is set but {} is not", TELEGRAM_TOKEN_ENV, TELEGRAM_USERS_ENV);
+    }
+    let telegram = Telegram {
+        client: reqwest::Client::builder().timeout(Duration::from_secs(20)).build()?,
+        token,
+        chat_id,
+        users,
+        offset: None,
+    };
+    Ok(Some((telegram, PathBuf::from(chat))))
+}
+
+impl Telegram {
+    async fn call(&self, method: &str, body: Value) -> Result<Value> {
+        let url = format!("{}/bot{}/{}", API, self.token, method);
+        // The URL holds the token, so it's left out of errors that get logged
+        let response: Value = self
+            .client
+            .post(url)
+            .json(&body)
+            .send()
+            .await
+            .map_err(|e| e.without_url())?
+            .json()
+            .await
+            .map_err(|e| e.without_url())?;
+        if response["ok"].as_bool() != Some(true) {
+            bail!("{} failed: {}", method, response["description"].as_str().unwrap_or("unknown error"));
+        }
+        Ok(response["result"].clone())
+    }
+}
+
+impl Remote for Telegram {
+    fn name(&self) -> &'static str {
+        "telegram"
+    }
+
+    // Sent as plain text; Telegram's markdown needs escaping that model
+    // replies rarely get right
+    async fn post(&mut self, text: &str, from_user: bool) -> Result<()> {
+        let text = match from_user {
+            true => format!("From the chat file:\n{}", text),
+            false => text.to_string(),
+        };
+        for part in bridge::split(&text, MAX_MESSAGE_CHARS) {
+            self.call("sendMessage", json!({ "chat_id": self.chat_id, "text": part })).await?;
+        }
+        Ok(())
+    }
+
+    async fn receive(&mut self) -> Result<Vec<String>> {
+        let Some(offset) = self.offset else {
+            // The newest update only, to start after it
+            let updates = self.call("getUpdates", json!({ "offset": -1, "timeout": 0 })).await?;
+            let last = updates.as_array().and_then(|u| u.last()).and_then(|u| u["update_id"].as_i64());
+            self.offset = Some(last.map_or(0, |id| id + 1));
+            return Ok(Vec::new());
+        };
+
+        let updates = self.call("getUpdates", json!({ "offset": offset, "timeout": 0 })).await?;
+        let mut messages = Vec::new();
+        for update in updates.as_array().into_iter().flatten() {
+            if let Some(id) = update["update_id"].as_i64() {
+                self.offset = Some(self.offset.unwrap_or(0).max(id + 1));
+            }
+            let message = &update["message"];
+            let Some(text) = message["text"].as_str() else {
+                continue;
+            };
+            if message["chat"]["id"].as_i64() != Some(self.chat_id) {
+                debug_log(&format!(
+                    "error: telegram bridge: ignoring a message from chat {} (only {} may write)",
+                    message["chat"]["id"], self.chat_id
+                ));
+                continue;
+            }
+            let sender = message["from"]["id"].to_string();
+            if !self.users.contains(&sender) {
+                debug_log(&format!(
+                    "error: telegram bridge: ignoring a message from user {} (not in {})",
+                    sender, TELEGRAM_USERS_ENV
+                ));
+                continue;
+            }
+            messages.push(text.to_string());
+        }
+        Ok(messages)
+    }
+}
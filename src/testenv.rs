@@ -0,0 +1,61 @@
+// Tests that change the environment take turns, and put it back as they
+// found it, so tests on other threads never see it half changed
+use crate::index;
+use std::{
+    ffi::{OsStr, OsString},
+    path::Path,
+    sync::{Mutex, MutexGuard},
+};
+
+static TURN: Mutex<()> = Mutex::new(());
+
+pub struct Isolated {
+    saved: Vec<(OsString, Option<OsString>)>,
+    _turn: MutexGuard<'static, ()>,
+}
+
+// Keeps the code under test to `dir` until the result is dropped: settings
+// that send chats elsewhere (hooks, webhooks, bridges, traces) are cleared,
+// the index is turned off, and anything else kept lands under `dir` rather
+// than the user's home
+pub fn isolate(dir: &Path) -> Isolated {
+    // A test that failed while holding its turn has still put things back
+    let turn = TURN.lock().unwrap_or_else(|poisoned| poisoned.into_inner());
+    let mut isolated = Isolated { saved: Vec::new(), _turn: turn };
+    let cleared: Vec<OsString> = std::env::vars_os()
+        .map(|(key, _)| key)
+        .filter(|key| {
+            let name = key.to_string_lossy();
+            name.starts_with("CHAT_") || name.starts_with("OTEL_")
+        })
+        .collect();
+    for key in cleared {
+        isolated.set(&key, None);
+    }
+    for var in ["HOME", "XDG_CONFIG_HOME", "XDG_DATA_HOME", "XDG_STATE_HOME", "XDG_RUNTIME_DIR"] {
+        isolated.set(OsStr::new(var), Some(dir.as_os_str()));
+    }
+    isolated.set(OsStr::new(index::INDEX_ENV), Some(OsStr::new("off")));
+    isolated
+}
+
+impl Isolated {
+    fn set(&mut self, key: &OsStr, value: Option<&OsStr>) {
+        self.saved.push((key.to_os_string(), std::env::var_os(key)));
+        match value {
+            Some(value) => std::env::set_var(key, value),
+            None => std::env::remove_var(key),
+        }
+    }
+}
+
+impl Drop for Isolated {
+    fn drop(&mut self) {
+        for (key, value) in self.saved.drain(..).rev() {
+            match value {
+                Some(value) => std::env::set_var(&key, value),
+                None => std::env::remove_var(&key),
+            }
+        }
+    }
+}
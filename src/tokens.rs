@@ -0,0 +1,250 @@
+use crate::{debug_log, files, index, library, preview, reply, watch, ChatContext, Message, CHAT_FILE, LOG_TO_STDERR};
+use anyhow::{bail, Context, Result};
+use std::{
+    path::PathBuf,
+    sync::{atomic::Ordering, OnceLock, RwLock},
+};
+use tiktoken_rs::CoreBPE;
+
+// Counts come from the cl100k tokenizer. Providers each have their own, so
+// they are close rather than exact, but far better than a character count.
+// If the tokenizer can't be loaded, fall back to about four characters per
+// token.
+const CHARS_PER_TOKEN: usize = 4;
+// Per-message framing (role markers and the like)
+const TOKENS_PER_MESSAGE: usize = 4;
+// Characters of each message shown by `tokens`
+const PREVIEW_CHARS: usize = 50;
+// Share of the context window past which the chat gets a warning
+const WARN_PERCENT: usize = 80;
+
+// Context windows of well-known models, matched by name prefix. Others are
+// only checked when CHAT_CONTEXT_LIMIT or `context_limit:` is set.
+const MODEL_LIMITS: &[(&str, usize)] = &[
+    ("deepseek", 128_000),
+    ("gpt-4o", 128_000),
+    ("gpt-4.1", 1_047_576),
+    ("claude", 200_000),
+    ("gemini", 1_048_576),
+];
+
+pub const PRICES_ENV: &str = "CHAT_PRICES";
+
+// US dollars per million input and output tokens, matched by name prefix
+// with the more specific names first. Prices change; CHAT_PRICES overrides
+// these (`model=input/output`, comma-separated).
+const MODEL_PRICES: &[(&str, f64, f64)] = &[
+    ("deepseek-reasoner", 0.55, 2.19),
+    ("deepseek", 0.27, 1.10),
+    ("gpt-4o-mini", 0.15, 0.60),
+    ("gpt-4o", 2.50, 10.00),
+    ("gpt-4.1-nano", 0.10, 0.40),
+    ("gpt-4.1-mini", 0.40, 1.60),
+    ("gpt-4.1", 2.00, 8.00),
+    ("claude-3-haiku", 0.25, 1.25),
+    ("claude-3-5-haiku", 0.80, 4.00),
+    ("claude-3-opus", 15.00, 75.00),
+    ("claude-opus", 15.00, 75.00),
+    ("claude", 3.00, 15.00),
+    ("gemini-1.5-flash", 0.075, 0.30),
+    ("gemini-1.5-pro", 1.25, 5.00),
+    ("gemini-2.0-flash", 0.10, 0.40),
+];
+
+// OpenAI's newer models use o200k; cl100k is kept for the rest, being
+// close for most of them
+const O200K_MODELS: &[&str] = &["gpt-4o", "chatgpt-4o", "gpt-4.1", "gpt-5", "o1", "o3", "o4"];
+
+static TOKENIZER: OnceLock<Option<CoreBPE>> = OnceLock::new();
+static O200K_TOKENIZER: OnceLock<Option<CoreBPE>> = OnceLock::new();
+
+fn tokenizer() -> Option<&'static CoreBPE> {
+    TOKENIZER
+        .get_or_init(|| match tiktoken_rs::cl100k_base() {
+            Ok(bpe) => Some(bpe),
+            Err(e) => {
+                debug_log(&format!("error: cannot load tokenizer, estimating from length: {}", e));
+                None
+            }
+        })
+        .as_ref()
+}
+
+fn o200k_tokenizer() -> Option<&'static CoreBPE> {
+    O200K_TOKENIZER
+        .get_or_init(|| match tiktoken_rs::o200k_base() {
+            Ok(bpe) => Some(bpe),
+            Err(e) => {
+                debug_log(&format!("error: cannot load the o200k tokenizer, estimating from length: {}", e));
+                None
+            }
+        })
+        .as_ref()
+}
+
+// The encoding `model` is counted with, and whether it is the model's own
+pub fn tokenizer_name(model: &str) -> (&'static str, bool) {
+    let model = model.to_lowercase();
+    match O200K_MODELS.iter().any(|prefix| model.starts_with(prefix)) {
+        true => ("o200k_base", true),
+        false => ("cl100k_base", model.starts_with("gpt-4") || model.starts_with("gpt-3.5")),
+    }
+}
+
+// Like `estimate_tokens`, with the tokenizer closest to `model`'s
+pub fn model_tokens(model: &str, text: &str) -> usize {
+    let bpe = match tokenizer_name(model).0 {
+        "o200k_base" => o200k_tokenizer(),
+        _ => tokenizer(),
+    };
+    match bpe {
+        Some(bpe) => bpe.encode_with_special_tokens(text).len(),
+        None => text.chars().count().div_ceil(CHARS_PER_TOKEN),
+    }
+}
+
+// False when counts fall back to the length estimate
+pub fn exact() -> bool {
+    tokenizer().is_some()
+}
+
+pub fn estimate_tokens(text: &str) -> usize {
+    match tokenizer() {
+        Some(bpe) => bpe.encode_with_special_tokens(text).len(),
+        None => text.chars().count().div_ceil(CHARS_PER_TOKEN),
+    }
+}
+
+pub fn message_tokens(message: &Message) -> usize {
+    estimate_tokens(&message.content) + TOKENS_PER_MESSAGE
+}
+
+pub fn estimate_messages(messages: &[Message]) -> usize {
+    messages.iter().map(message_tokens).sum()
+}
+
+pub fn model_limit(model: &str) -> Option<usize> {
+    let model = model.to_lowercase();
+    MODEL_LIMITS
+        .iter()
+        .find(|(prefix, _)| model.starts_with(prefix))
+        .map(|&(_, limit)| limit)
+}
+
+// What a request probably cost, in US dollars, or None for models with no
+// known price (local ones, for a start)
+pub fn cost(model: &str, input_tokens: usize, output_tokens: usize) -> Option<f64> {
+    let model = model.to_lowercase();
+    let configured = std::env::var(PRICES_ENV).ok().and_then(|prices| {
+        prices.split(',').find_map(|entry| {
+            let (name, price) = entry.split_once('=')?;
+            let (input, output) = price.split_once('/')?;
+            let matches = model.starts_with(&name.trim().to_lowercase());
+            matches.then(|| Some((input.trim().parse().ok()?, output.trim().parse().ok()?)))?
+        })
+    });
+    let (input, output) = configured.or_else(|| {
+        MODEL_PRICES
+            .iter()
+            .find(|(prefix, _, _)| model.starts_with(prefix))
+            .map(|&(_, input, output)| (input, output))
+    })?;
+    Some((input * input_tokens as f64 + output * output_tokens as f64) / 1_000_000.0)
+}
+
+// True when a request of about `estimate` tokens is close enough to `limit`
+// to warn about
+pub fn near_limit(estimate: usize, limit: usize) -> bool {
+    estimate * 100 >= limit * WARN_PERCENT
+}
+
+// `tokens [file] [--select start:end] [--model name]`: the tokens in each
+// message and in the request the next message would send, counted with the
+// tokenizer of the chat's model. `--select` counts lines of the file
+// instead, as an editor selection would.
+pub async fn run(args: &[String]) -> Result<()> {
+    LOG_TO_STDERR.store(true, Ordering::Relaxed);
+
+    let mut path = None;
+    let mut select = None;
+    let mut model = None;
+    let mut args = args.iter();
+    while let Some(arg) = args.next() {
+        match arg.as_str() {
+            "--select" | "-s" => select = Some(parse_lines(args.next().context("--select needs start:end")?)?),
+            "--model" | "-m" => model = Some(args.next().context("--model needs a name")?.clone()),
+            _ if path.is_none() => path = Some(PathBuf::from(arg)),
+            _ => bail!("usage: tokens [file] [--select start:end] [--model name]"),
+        }
+    }
+    let path = path.unwrap_or_else(|| PathBuf::from(CHAT_FILE));
+    let content = files::read_chat(&path)
+        .await
+        .with_context(|| format!("cannot read {}", path.display()))?;
+    let chat_context = ChatContext::new(path.clone(), content.clone());
+    let model = model.unwrap_or_else(|| chat_context.model.clone());
+    let (encoding, own) = tokenizer_name(&model);
+    let count = |text: &str| model_tokens(&model, text);
+
+    println!(
+        "{} (model {}, {} tokenizer{})\n",
+        watch::display_path(&path),
+        model,
+        encoding,
+        if own { "" } else { ", an approximation for this model" }
+    );
+
+    if let Some((start, end)) = select {
+        let lines: Vec<&str> = content.lines().collect();
+        if start > lines.len() {
+            bail!("{} has only {} lines", path.display(), lines.len());
+        }
+        let selected = lines[start - 1..end.min(lines.len())].join("\n");
+        println!("Lines {}-{}: {} tokens", start, end.min(lines.len()), count(&selected));
+        return Ok(());
+    }
+
+    let entries = index::entries(&path, &content);
+    println!("{:>3}  {:<9} {:>5} {:>7}  {}", "#", "role", "line", "tokens", "preview");
+    let mut total = 0;
+    for (i, entry) in entries.iter().enumerate() {
+        let tokens = count(&entry.content);
+        total += tokens;
+        let first = entry.content.lines().map(str::trim).find(|l| !l.is_empty()).unwrap_or_default();
+        let preview: String = first.chars().take(PREVIEW_CHARS).collect();
+        let more = if first.chars().count() > PREVIEW_CHARS { "…" } else { "" };
+        println!("{:>3}  {:<9} {:>5} {:>7}  {}{}", i + 1, entry.role, entry.line, tokens, preview, more);
+    }
+    println!("\nMessages: {} tokens in {} messages", total, entries.len());
+
+    let library = RwLock::new(library::PromptLibrary::from_env());
+    let (messages, _) = preview::pending_request(&chat_context, &content[chat_context.body_start..]).await;
+    let items = reply::prepare_request(messages, None, &chat_context, &library).await;
+    let request: usize = items.iter().map(|(_, message)| count(&message.content) + TOKENS_PER_MESSAGE).sum();
+    let limit = chat_context.context_limit.or_else(|| model_limit(&model));
+    match limit {
+        Some(limit) => println!(
+            "Next request: {} tokens in {} messages, {}% of the {} token window",
+            request,
+            items.len(),
+            request * 100 / limit.max(1),
+            limit
+        ),
+        None => println!("Next request: {} tokens in {} messages", request, items.len()),
+    }
+    Ok(())
+}
+
+// `start:end` as 1-based lines, both included; `start:` runs to the end
+fn parse_lines(range: &str) -> Result<(usize, usize)> {
+    let (start, end) = range.split_once(':').context("--select needs start:end")?;
+    let start: usize = start.trim().parse().context("--select needs line numbers")?;
+    let end: usize = match end.trim() {
+        "" => usize::MAX,
+        end => end.parse().context("--select needs line numbers")?,
+    };
+    if start == 0 || end < start {
+        bail!("--select needs start:end with 1 <= start <= end");
+    }
+    Ok((start, end))
+}
@@ -0,0 +1,250 @@
+use crate::{config, logging::debug_log, parser, subprocess};
+use serde::Deserialize;
+use std::{future::Future, pin::Pin, time::Duration};
+use tokio::process::Command;
+
+pub const VALIDATE_ENV: &str = "CHAT_VALIDATE_CODE";
+pub const VALIDATOR_ENV_PREFIX: &str = "CHAT_VALIDATOR_";
+pub const MAX_REPAIR_ATTEMPTS: usize = 2;
+// A checker that takes longer is given up on, and the block passes
+const CHECK_TIMEOUT: Duration = Duration::from_secs(10);
+
+// Resolves to a human-readable description of the problem, if any
+pub type Check<'a> = Pin<Box<dyn Future<Output = Option<String>> + Send + 'a>>;
+
+pub trait Validator: Send + Sync {
+    fn languages(&self) -> Vec<String>;
+
+    fn validate<'a>(&'a self, code: &'a str) -> Check<'a>;
+}
+
+struct JsonValidator;
+
+impl Validator for JsonValidator {
+    fn languages(&self) -> Vec<String> {
+        vec!["json".to_string()]
+    }
+
+    fn validate<'a>(&'a self, code: &'a str) -> Check<'a> {
+        let problem = serde_json::from_str::<serde_json::Value>(code)
+            .err()
+            .map(|e| e.to_string());
+        Box::pin(std::future::ready(problem))
+    }
+}
+
+struct YamlValidator;
+
+impl Validator for YamlValidator {
+    fn languages(&self) -> Vec<String> {
+        vec!["yaml".to_string()]
+    }
+
+    fn validate<'a>(&'a self, code: &'a str) -> Check<'a> {
+        // Multi-document streams are common in k8s snippets
+        let problem = serde_yaml::Deserializer::from_str(code)
+            .find_map(|document| serde_yaml::Value::deserialize(document).err())
+            .map(|e| e.to_string());
+        Box::pin(std::future::ready(problem))
+    }
+}
+
+struct TomlValidator;
+
+impl Validator for TomlValidator {
+    fn languages(&self) -> Vec<String> {
+        vec!["toml".to_string()]
+    }
+
+    fn validate<'a>(&'a self, code: &'a str) -> Check<'a> {
+        Box::pin(std::future::ready(code.parse::<toml::Table>().err().map(|e| e.to_string())))
+    }
+}
+
+// Pipes the snippet into an external checker on stdin; a non-zero exit means
+// the code is broken and stderr explains why. Missing tools, and checkers
+// that hang, are not an error.
+pub struct CommandValidator {
+    languages: Vec<String>,
+    program: String,
+    args: Vec<String>,
+}
+
+impl CommandValidator {
+    pub fn new(language: &str, command_line: &str) -> Option<Self> {
+        let mut words = command_line.split_whitespace();
+        let program = words.next()?;
+        Some(Self::with_args(language, program, &words.collect::<Vec<_>>()))
+    }
+
+    pub fn with_args(language: &str, program: &str, args: &[&str]) -> Self {
+        Self {
+            languages: vec![language.to_lowercase()],
+            program: program.to_string(),
+            args: args.iter().map(|a| a.to_string()).collect(),
+        }
+    }
+}
+
+impl Validator for CommandValidator {
+    fn languages(&self) -> Vec<String> {
+        self.languages.clone()
+    }
+
+    fn validate<'a>(&'a self, code: &'a str) -> Check<'a> {
+        Box::pin(async move {
+            let mut command = Command::new(&self.program);
+            command.args(&self.args);
+            let output = match subprocess::output(&mut command, code.as_bytes(), CHECK_TIMEOUT).await {
+                Ok(output) => output,
+                Err(e) => {
+                    debug_log(&format!("validate: skipped: {:#}", e));
+                    return None;
+                }
+            };
+            if output.status.success() {
+                return None;
+            }
+
+            let stderr = String::from_utf8_lossy(&output.stderr).trim().to_string();
+            Some(if stderr.is_empty() {
+                format!("{} exited with {}", self.program, output.status)
+            } else {
+                stderr
+            })
+        })
+    }
+}
+
+pub struct Validators {
+    enabled: bool,
+    validators: Vec<Box<dyn Validator>>,
+}
+
+impl Validators {
+    pub fn from_env() -> Self {
+        let mut validators = Self {
+            enabled: config::env_flag(VALIDATE_ENV, true),
+            validators: Vec::new(),
+        };
+        validators.register(Box::new(JsonValidator));
+        validators.register(Box::new(YamlValidator));
+        validators.register(Box::new(TomlValidator));
+        // Not `go vet`: it type-checks a whole package, so it fails on the
+        // fragments replies are mostly made of and on imports not downloaded
+        validators.register(Box::new(CommandValidator::with_args("go", "gofmt", &["-e"])));
+        validators.register(Box::new(CommandValidator::with_args(
+            "python",
+            "python3",
+            &["-c", "import ast, sys; ast.parse(sys.stdin.read())"],
+        )));
+
+        // CHAT_VALIDATOR_RUST="rustfmt --emit stdout" etc. adds or overrides checkers
+        for (key, command) in std::env::vars() {
+            if let Some(lang) = key.strip_prefix(VALIDATOR_ENV_PREFIX) {
+                validators.register_command(lang, &command);
+            }
+        }
+
+        validators
+    }
+
+    // Later registrations win for languages they share with earlier ones
+    pub fn register(&mut self, validator: Box<dyn Validator>) {
+        let languages = validator.languages();
+        self.validators
+            .retain(|v| !v.languages().iter().any(|l| languages.contains(l)));
+        self.validators.push(validator);
+    }
+
+    pub fn register_command(&mut self, language: &str, command_line: &str) {
+        if let Some(validator) = CommandValidator::new(language, command_line) {
+            self.register(Box::new(validator));
+        }
+    }
+
+    // One entry per broken code block, ready to be shown to the model
+    pub async fn check(&self, text: &str) -> Vec<String> {
+        if !self.enabled {
+            return Vec::new();
+        }
+
+        let mut problems = Vec::new();
+        for (i, fence) in parser::fences(text).iter().enumerate() {
+            let lang = normalize_language(&fence.lang());
+            let Some(validator) = self
+                .validators
+                .iter()
+                .find(|v| v.languages().contains(&lang))
+            else {
+                continue;
+            };
+
+            if let Some(problem) = validator.validate(&text[fence.body.clone()]).await {
+                problems.push(format!("code block {} ({}): {}", i + 1, lang, problem));
+            }
+        }
+        problems
+    }
+}
+
+fn normalize_language(lang: &str) -> String {
+    match lang {
+        "golang" => "go",
+        "yml" => "yaml",
+        "py" | "python3" => "python",
+        "rs" => "rust",
+        other => other,
+    }
+    .to_string()
+}
+
+pub fn repair_prompt(problems: &[String]) -> String {
+    format!(
+        "Some code blocks in your previous reply do not parse:\n{}\n\nPlease send the full reply again with these errors fixed.",
+        problems
+            .iter()
+            .map(|p| format!("- {}", p))
+            .collect::<Vec<_>>()
+            .join("\n")
+    )
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn validators(enabled: bool) -> Validators {
+        let mut validators = Validators {
+            enabled,
+            validators: Vec::new(),
+        };
+        validators.register(Box::new(JsonValidator));
+        validators.register(Box::new(TomlValidator));
+        validators
+    }
+
+    #[tokio::test]
+    async fn reports_blocks_that_do_not_parse() {
+        let text = "```json\n{\"a\": 1}\n```\n\n```toml\nkey = \n```\n\n```rust\nnot checked(\n```";
+        let problems = validators(true).check(text).await;
+        assert_eq!(problems.len(), 1);
+        assert!(problems[0].starts_with("code block 2 (toml):"), "{}", problems[0]);
+        assert!(repair_prompt(&problems).contains("\n- code block 2 (toml):"));
+    }
+
+    #[tokio::test]
+    async fn checks_nothing_when_disabled() {
+        assert!(validators(false).check("```json\n{\n```").await.is_empty());
+    }
+
+    #[tokio::test]
+    async fn command_failure_explains_itself() {
+        let failing = CommandValidator::with_args("sh", "sh", &["-c", "cat >/dev/null; echo broken >&2; exit 1"]);
+        assert_eq!(failing.validate("x").await.as_deref(), Some("broken"));
+        let passing = CommandValidator::with_args("sh", "sh", &["-c", "cat >/dev/null"]);
+        assert_eq!(passing.validate("x").await, None);
+        let missing = CommandValidator::with_args("sh", "chatmd-no-such-checker", &[]);
+        assert_eq!(missing.validate("x").await, None);
+    }
+}
@@ -0,0 +1,89 @@
+use crate::{logging::debug_log, watch};
+use anyhow::{bail, Context, Result};
+use serde::{Deserialize, Serialize};
+use serde_json::Value;
+use std::path::PathBuf;
+
+pub const RECORD_ENV: &str = "CHAT_RECORD";
+pub const REPLAY_ENV: &str = "CHAT_REPLAY";
+
+// A provider's answer to one request, as it came over the wire
+#[derive(Serialize, Deserialize)]
+pub struct Recording {
+    pub status: u16,
+    // Server-sent events rather than one JSON body
+    pub event_stream: bool,
+    pub body: String,
+}
+
+// What a fixture file holds: the request for people reading it, and the
+// response to play back
+#[derive(Serialize, Deserialize)]
+struct Fixture {
+    url: String,
+    request: Value,
+    response: Recording,
+}
+
+fn dir(name: &str) -> Option<PathBuf> {
+    std::env::var(name).ok().filter(|d| !d.trim().is_empty()).map(|d| watch::expand_home(d.trim()))
+}
+
+pub fn recording() -> bool {
+    dir(RECORD_ENV).is_some()
+}
+
+// Requests are matched on everything sent but whether to stream, so a
+// recording made with the web UI open replays without it and the other way
+// round
+fn file_name(request: &Value) -> String {
+    let mut request = request.clone();
+    if let Some(fields) = request.as_object_mut() {
+        fields.remove("stream");
+    }
+    let digest = sha1_smol::Sha1::from(request.to_string()).digest().bytes();
+    let hex: String = digest.iter().map(|b| format!("{:02x}", b)).collect();
+    format!("{}.json", &hex[..16])
+}
+
+// The recorded response to `request` when CHAT_REPLAY is set. A request
+// never recorded is an error, unless CHAT_RECORD is set too and it should
+// be recorded now.
+pub fn replay(request: &Value) -> Result<Option<Recording>> {
+    let Some(dir) = dir(REPLAY_ENV) else {
+        return Ok(None);
+    };
+    let path = dir.join(file_name(request));
+    if !path.exists() {
+        if recording() {
+            return Ok(None);
+        }
+        bail!("no recording of this request in {} (looked for {})", dir.display(), path.display());
+    }
+    let raw = std::fs::read_to_string(&path).with_context(|| format!("cannot read {}", path.display()))?;
+    let fixture: Fixture = serde_json::from_str(&raw).with_context(|| format!("{} is not a recording", path.display()))?;
+    debug_log(&format!("load: replaying {}", path.display()));
+    Ok(Some(fixture.response))
+}
+
+// Saves a successful response under CHAT_RECORD; failures aren't kept, so
+// a passing outage never replays
+pub fn record(url: &str, request: &Value, response: Recording) {
+    let Some(dir) = dir(RECORD_ENV) else {
+        return;
+    };
+    let path = dir.join(file_name(request));
+    let fixture = Fixture {
+        url: url.to_string(),
+        request: request.clone(),
+        response,
+    };
+    let written = std::fs::create_dir_all(&dir)
+        .map_err(anyhow::Error::from)
+        .and_then(|()| Ok(serde_json::to_string_pretty(&fixture)?))
+        .and_then(|json| Ok(std::fs::write(&path, json + "\n")?));
+    match written {
+        Ok(()) => debug_log(&format!("write: recorded the response in {}", path.display())),
+        Err(e) => debug_log(&format!("error: cannot record {}: {}", path.display(), e)),
+    }
+}
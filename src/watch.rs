@@ -0,0 +1,315 @@
+use crate::{config, crypt, CHAT_FILE};
+use anyhow::{Context, Result};
+use std::{
+    collections::{HashMap, HashSet},
+    path::{Path, PathBuf},
+    time::Duration,
+};
+
+pub const WATCH_ENV: &str = "CHAT_WATCH";
+pub const INCLUDE_ENV: &str = "CHAT_INCLUDE";
+pub const EXCLUDE_ENV: &str = "CHAT_EXCLUDE";
+pub const POLL_ENV: &str = "CHAT_POLL";
+pub const POLL_INTERVAL_ENV: &str = "CHAT_POLL_INTERVAL_MS";
+pub const DEFAULT_POLL_INTERVAL_MS: u64 = 1000;
+
+// Files the monitor writes next to a chat, which must never be taken for one
+const DERIVED_SUFFIXES: &[&str] = &[".archive.md"];
+
+// One watched location: a single file, or every file in `dir` whose name
+// matches `pattern` (`*` and `?` wildcards)
+#[derive(Debug, Clone)]
+struct Target {
+    dir: PathBuf,
+    pattern: String,
+    is_glob: bool,
+}
+
+#[derive(Debug, Clone)]
+pub struct WatchSet {
+    targets: Vec<Target>,
+    // Name patterns narrowing what directories and globs pick up. Files
+    // named outright are always watched.
+    include: Vec<String>,
+    exclude: Vec<String>,
+    // Where symlinked chats really live, mapped back to the chat path, so
+    // edits made through the target (say, from a notes vault) are seen too
+    links: HashMap<PathBuf, PathBuf>,
+}
+
+// Monitor arguments: `[--poll] [--poll-interval ms] [--include pattern]
+// [--exclude pattern] [files, dirs or patterns...]`.
+// Returns the watch set and, when polling, the interval. Polling is for
+// filesystems that never deliver change events (network mounts, containers,
+// WSL paths into Windows).
+pub fn parse_args(args: &[String]) -> Result<(WatchSet, Option<Duration>)> {
+    let mut poll = config::env_flag(POLL_ENV, false);
+    let mut interval = std::env::var(POLL_INTERVAL_ENV)
+        .ok()
+        .and_then(|v| v.trim().parse().ok())
+        .unwrap_or(DEFAULT_POLL_INTERVAL_MS);
+    let mut specs = Vec::new();
+    let mut include = Vec::new();
+    let mut exclude = Vec::new();
+
+    let mut args = args.iter();
+    while let Some(arg) = args.next() {
+        match arg.as_str() {
+            "--poll" => poll = true,
+            "--poll-interval" => {
+                poll = true;
+                interval = args
+                    .next()
+                    .and_then(|v| v.parse().ok())
+                    .context("--poll-interval needs a number of milliseconds")?;
+            }
+            "--include" => include.push(args.next().context("--include needs a pattern")?.clone()),
+            "--exclude" => exclude.push(args.next().context("--exclude needs a pattern")?.clone()),
+            _ => specs.push(arg.clone()),
+        }
+    }
+
+    if include.is_empty() {
+        include = env_list(INCLUDE_ENV);
+    }
+    if exclude.is_empty() {
+        exclude = env_list(EXCLUDE_ENV);
+    }
+
+    let watch_set = WatchSet::from_args(&specs, include, exclude)?;
+    Ok((watch_set, poll.then(|| Duration::from_millis(interval.max(1)))))
+}
+
+impl WatchSet {
+    // Targets come from the command line, then CHAT_WATCH (comma separated),
+    // then the default chat.md. A directory means every `.md` file in it.
+    pub fn from_args(args: &[String], include: Vec<String>, exclude: Vec<String>) -> Result<Self> {
+        let mut specs: Vec<String> = args.to_vec();
+        if specs.is_empty() {
+            specs = env_list(WATCH_ENV);
+        }
+        if specs.is_empty() {
+            specs.push(CHAT_FILE.to_string());
+        }
+
+        let targets = specs
+            .iter()
+            .map(|spec| Target::parse(spec))
+            .collect::<Result<Vec<_>>>()?;
+        let mut watch_set = Self {
+            targets,
+            include,
+            exclude,
+            links: HashMap::new(),
+        };
+        watch_set.links = watch_set
+            .files()
+            .into_iter()
+            .filter_map(|file| Some((link_target(&file)?, file)))
+            .collect();
+        Ok(watch_set)
+    }
+
+    // The chat an event path belongs to, if any: the path itself, or the
+    // chat linking to it
+    pub fn chat_path(&self, path: &Path) -> Option<PathBuf> {
+        if self.matches(path) {
+            return Some(path.to_path_buf());
+        }
+        self.links.get(path).cloned()
+    }
+
+    // The watched chat `path` names, however it's spelled
+    pub fn find(&self, path: &Path) -> Option<PathBuf> {
+        let path = path.canonicalize().ok()?;
+        let mut files = self.files().into_iter();
+        files.find(|f| f.canonicalize().is_ok_and(|f| f == path)).or_else(|| self.chat_path(&path))
+    }
+
+    pub fn matches(&self, path: &Path) -> bool {
+        let (Some(dir), Some(name)) = (path.parent(), path.file_name()) else {
+            return false;
+        };
+        let name = name.to_string_lossy();
+        // Patterns pick up encrypted chats by the plain names they stand for
+        let plain = crypt::plain_name(&name);
+        if DERIVED_SUFFIXES.iter().any(|s| plain.ends_with(s)) {
+            return false;
+        }
+        self.targets.iter().filter(|t| t.dir == dir).any(|t| match t.is_glob {
+            true => [&*name, plain].iter().any(|n| wildcard_match(&t.pattern, n) && self.passes_filters(n)),
+            false => t.pattern == name,
+        })
+    }
+
+    fn passes_filters(&self, name: &str) -> bool {
+        let included = self.include.is_empty() || self.include.iter().any(|p| wildcard_match(p, name));
+        included && !self.exclude.iter().any(|p| wildcard_match(p, name))
+    }
+
+    // Chat files that exist right now
+    pub fn files(&self) -> Vec<PathBuf> {
+        let mut files = Vec::new();
+        for target in &self.targets {
+            if !target.is_glob {
+                files.push(target.dir.join(&target.pattern));
+                continue;
+            }
+            let Ok(entries) = std::fs::read_dir(&target.dir) else {
+                continue;
+            };
+            let mut matched: Vec<PathBuf> = entries
+                .filter_map(|e| e.ok())
+                .map(|e| e.path())
+                .filter(|p| p.is_file() && self.matches(p))
+                .collect();
+            matched.sort();
+            files.extend(matched);
+        }
+        // A file can be named outright and matched by a directory too
+        let mut seen = HashSet::new();
+        files.retain(|f| seen.insert(f.clone()));
+        files
+    }
+
+    // What to hand the file watcher. Always directories: an editor that saves
+    // by renaming a temp file over the chat replaces the file, and a watch on
+    // the file itself would silently go with it. Symlinked chats add the
+    // directory of their target.
+    pub fn watch_paths(&self) -> Vec<PathBuf> {
+        let mut paths: Vec<PathBuf> = self.targets.iter().map(|t| t.dir.clone()).collect();
+        paths.extend(self.links.keys().filter_map(|t| t.parent()).map(Path::to_path_buf));
+        paths.sort();
+        paths.dedup();
+        paths
+    }
+
+    pub fn describe(&self) -> String {
+        self.targets
+            .iter()
+            .map(|t| display_path(&t.dir.join(&t.pattern)))
+            .collect::<Vec<_>>()
+            .join(", ")
+    }
+}
+
+impl Target {
+    fn parse(spec: &str) -> Result<Self> {
+        let path = expand_home(spec);
+        let path = path.as_path();
+        let (dir, pattern) = if path.is_dir() {
+            (path.to_path_buf(), "*.md".to_string())
+        } else {
+            let dir = match path.parent() {
+                Some(dir) if !dir.as_os_str().is_empty() => dir.to_path_buf(),
+                _ => PathBuf::from("."),
+            };
+            let name = path
+                .file_name()
+                .with_context(|| format!("not a file or directory: {}", spec))?;
+            (dir, name.to_string_lossy().into_owned())
+        };
+
+        // Event paths from the watcher are absolute. A chat named outright
+        // may be in a directory that doesn't exist yet; it is created along
+        // with the chat.
+        let is_glob = pattern.contains(['*', '?']);
+        let dir = if is_glob {
+            dir.canonicalize()
+                .with_context(|| format!("cannot watch {}: directory not found", spec))?
+        } else {
+            absolute(&dir).with_context(|| format!("cannot watch {}", spec))?
+        };
+        Ok(Self { dir, pattern, is_glob })
+    }
+}
+
+// Paths from the config file or CHAT_WATCH haven't been through a shell
+pub fn expand_home(spec: &str) -> PathBuf {
+    match (spec.strip_prefix("~/"), std::env::var_os("HOME")) {
+        (Some(rest), Some(home)) => PathBuf::from(home).join(rest),
+        _ => PathBuf::from(spec),
+    }
+}
+
+// `dir` made absolute through its nearest existing ancestor
+fn absolute(dir: &Path) -> Result<PathBuf> {
+    if let Ok(dir) = dir.canonicalize() {
+        return Ok(dir);
+    }
+    let parent = match dir.parent() {
+        Some(parent) if !parent.as_os_str().is_empty() => parent,
+        _ => Path::new("."),
+    };
+    let name = dir.file_name().context("not a directory name")?;
+    Ok(absolute(parent)?.join(name))
+}
+
+// The file a symlinked chat points at, fully resolved
+fn link_target(path: &Path) -> Option<PathBuf> {
+    let is_link = std::fs::symlink_metadata(path)
+        .map(|m| m.file_type().is_symlink())
+        .unwrap_or(false);
+    if !is_link {
+        return None;
+    }
+    path.canonicalize().ok()
+}
+
+// A comma separated list from the environment
+pub fn env_list(name: &str) -> Vec<String> {
+    std::env::var(name)
+        .map(|value| {
+            value
+                .split(',')
+                .map(|s| s.trim().to_string())
+                .filter(|s| !s.is_empty())
+                .collect()
+        })
+        .unwrap_or_default()
+}
+
+// Relative to the working directory when possible, for log lines
+pub fn display_path(path: &Path) -> String {
+    std::env::current_dir()
+        .ok()
+        .and_then(|cwd| path.strip_prefix(cwd).ok().map(Path::to_path_buf))
+        .unwrap_or_else(|| path.to_path_buf())
+        .display()
+        .to_string()
+}
+
+fn wildcard_match(pattern: &str, name: &str) -> bool {
+    let pattern: Vec<char> = pattern.chars().collect();
+    let name: Vec<char> = name.chars().collect();
+    let (mut p, mut n) = (0, 0);
+    // Position of the last `*` and the name position it was tried at
+    let mut star: Option<(usize, usize)> = None;
+
+    while n < name.len() {
+        match pattern.get(p) {
+            Some('*') => {
+                star = Some((p, n));
+                p += 1;
+            }
+            Some('?') => {
+                p += 1;
+                n += 1;
+            }
+            Some(c) if *c == name[n] => {
+                p += 1;
+                n += 1;
+            }
+            _ => match star {
+                // Let the last `*` swallow one more character
+                Some((star_p, star_n)) => {
+                    p = star_p + 1;
+                    n = star_n + 1;
+                    star = Some((star_p, star_n + 1));
+                }
+                None => return false,
+            },
+        }
+    }
+    pattern[p..].iter().all(|c| *c == '*')
+}
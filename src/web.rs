@@ -0,0 +1,334 @@
+use crate::{
+    api, config, export, files, fmt, health,
+    http::{self, Reply, Request, Response},
+    live, metrics, parser, shell,
+    watch::{self, WatchSet},
+};
+use anyhow::{bail, Context, Result};
+use std::{
+    path::{Path, PathBuf},
+    sync::Arc,
+    time::Duration,
+};
+use tokio::{
+    net::TcpListener,
+    sync::{broadcast, mpsc},
+};
+
+// The token pages and API clients send with every request, instead of a
+// new random one each start
+pub const WEB_TOKEN_ENV: &str = "CHAT_WEB_TOKEN";
+// Host names, besides localhost and IP addresses, the server answers to
+// (comma separated), for a server reached by name
+pub const WEB_HOSTS_ENV: &str = "CHAT_WEB_HOSTS";
+
+const DEFAULT_ADDR: &str = ":8080";
+// How often an open page checks its chat for changes
+const REFRESH: Duration = Duration::from_millis(500);
+
+const WEB_STYLE: &str = r#"
+ul.chats { list-style: none; padding: 0; }
+ul.chats li { background: #fff; border: 1px solid #d0d7de; border-radius: 6px; margin: .5rem 0; padding: .75rem 1.25rem; }
+form.send { position: sticky; bottom: 0; background: #f6f8fa; padding: 1rem 0; }
+form.send textarea { width: 100%; box-sizing: border-box; font: inherit; padding: .5rem .75rem; border: 1px solid #d0d7de; border-radius: 6px; }
+form.send button { margin-top: .5rem; }
+.message.typing p { white-space: pre-wrap; }
+"#;
+
+const SCRIPT: &str = r#"
+const chat = document.getElementById('chat');
+const form = document.querySelector('form.send');
+const box = form.querySelector('textarea');
+const name = location.pathname.slice('/chat/'.length);
+const atBottom = () => window.innerHeight + window.scrollY >= document.body.scrollHeight - 40;
+// The reply being streamed, shown until the file has it
+let typing = null;
+const events = new EventSource('/events/' + name);
+events.onmessage = e => {
+  const follow = atBottom();
+  chat.innerHTML = e.data;
+  // Once finished, the streamed reply is replaced by the one in the file
+  if (typing && typing.finished) typing = null;
+  if (typing) chat.appendChild(typing);
+  if (follow) window.scrollTo(0, document.body.scrollHeight);
+};
+const live = new WebSocket((location.protocol === 'https:' ? 'wss://' : 'ws://') + location.host + '/ws/' + name);
+live.onmessage = e => {
+  const event = JSON.parse(e.data);
+  const follow = atBottom();
+  if (event.type === 'start') {
+    typing = document.createElement('section');
+    typing.className = 'message assistant typing';
+    typing.innerHTML = '<header><span class="role">Assistant</span>typing…</header><p></p>';
+    chat.appendChild(typing);
+  } else if (event.type === 'text' && typing) {
+    typing.querySelector('p').textContent += event.text;
+  } else if (event.type === 'done' && typing) {
+    typing.finished = true;
+  }
+  if (follow) window.scrollTo(0, document.body.scrollHeight);
+};
+form.addEventListener('submit', async e => {
+  e.preventDefault();
+  if (!box.value.trim()) return;
+  const res = await fetch(location.pathname, { method: 'POST', body: new URLSearchParams({ message: box.value }) });
+  if (res.ok) box.value = ''; else alert(await res.text());
+});
+box.addEventListener('keydown', e => {
+  if (e.key === 'Enter' && (e.ctrlKey || e.metaKey)) form.requestSubmit();
+});
+window.scrollTo(0, document.body.scrollHeight);
+"#;
+
+// `serve [targets...] [--web addr]`: the address to listen on and the
+// arguments left for the watcher
+pub fn parse_args(args: &[String]) -> Result<(String, Vec<String>)> {
+    let mut addr = DEFAULT_ADDR.to_string();
+    let mut rest = Vec::new();
+    let mut args = args.iter();
+    while let Some(arg) = args.next() {
+        match arg.as_str() {
+            "--web" => addr = args.next().context("--web needs an address such as :8080")?.clone(),
+            _ => rest.push(arg.clone()),
+        }
+    }
+    Ok((addr, rest))
+}
+
+// What requests are checked against
+struct Site {
+    watch_set: WatchSet,
+    token: String,
+    hosts: Vec<String>,
+}
+
+// Shows every watched chat as a page that follows the file as it changes,
+// and serves the JSON API. Messages typed there are appended to the file
+// with a send marker, so the watcher answers them exactly as if they had been
+// typed in an editor.
+pub async fn serve(listener: TcpListener, watch_set: WatchSet) {
+    let token = match configured_token() {
+        Some(token) => token,
+        None => {
+            let token = http::random_token();
+            // Shown once on the terminal and never logged, since log files
+            // outlive the run and may be read by others
+            if let Ok(addr) = listener.local_addr() {
+                println!("Web UI at http://{}/?token={} (set {} to choose the token)", addr, token, WEB_TOKEN_ENV);
+            }
+            token
+        }
+    };
+    let site = Arc::new(Site {
+        watch_set,
+        token,
+        hosts: watch::env_list(WEB_HOSTS_ENV),
+    });
+    http::serve(listener, move |request| handle(request, site.clone())).await
+}
+
+pub fn configured_token() -> Option<String> {
+    std::env::var(WEB_TOKEN_ENV).ok().map(|t| t.trim().to_string()).filter(|t| !t.is_empty())
+}
+
+async fn handle(request: Request, site: Arc<Site>) -> Reply {
+    // Another site's pages can reach a local server too, through the
+    // browser, so only pages served here may talk to it
+    if !request.local_host(&site.hosts) {
+        return Response::text(403, format!("unknown host; add it to {} to allow it\n", WEB_HOSTS_ENV)).into();
+    }
+    if !request.same_origin() {
+        return Response::text(403, "requests from other sites are refused\n").into();
+    }
+    // The printed link carries the token once; the browser keeps it from
+    // there, and the address bar loses it
+    if let Some(given) = request.query.get("token") {
+        if request.method == "GET" && http::same_token(given, &site.token) {
+            return Response::remember_token(&http::percent_encode(&request.path), &site.token).into();
+        }
+    }
+    if !request.has_token(&site.token) {
+        return Response::text(401, "missing or wrong token; open the link the server printed\n").into();
+    }
+
+    let watch_set = &site.watch_set;
+    if request.path == "/" {
+        return index(watch_set).into();
+    }
+    if request.path == "/metrics" {
+        return metrics::response().into();
+    }
+    if let Some(response) = health::response(&request.path).await {
+        return response.into();
+    }
+    if request.path == "/conversations" || request.path.starts_with("/conversations/") {
+        return api::handle(&request, watch_set).await;
+    }
+    let (route, name) = match request.path[1..].split_once('/') {
+        Some(split) => split,
+        None => return Response::not_found().into(),
+    };
+    let Some(path) = find_chat(watch_set, name) else {
+        return Response::not_found().into();
+    };
+
+    match (request.method.as_str(), route) {
+        ("GET", "chat") => page(&path, name).await.into(),
+        ("POST", "chat") => {
+            let message = request.form().remove("message").unwrap_or_default();
+            if message.trim().is_empty() {
+                return Response::text(400, "empty message\n").into();
+            }
+            match send_message(&path, &message).await {
+                Ok(()) => Response::redirect(&format!("/chat/{}", http::percent_encode(name))).into(),
+                Err(e) => Response::text(500, format!("{}\n", e)).into(),
+            }
+        }
+        ("GET", "events") => Reply::Events(follow(path, name.to_string())),
+        ("GET", "ws") => match request.header("Sec-WebSocket-Key") {
+            Some(key) => Reply::WebSocket {
+                key: key.to_string(),
+                events: relay(path),
+            },
+            None => Response::text(400, "expected a WebSocket upgrade\n").into(),
+        },
+        _ => Response::not_found().into(),
+    }
+}
+
+// A watched chat by the name it is shown under
+pub fn find_chat(watch_set: &WatchSet, name: &str) -> Option<PathBuf> {
+    watch_set.files().into_iter().find(|path| watch::display_path(path) == name)
+}
+
+// Appends `message` as the next user message, sent straight away. Text
+// already waiting below the last reply becomes part of it.
+pub async fn send_message(path: &Path, message: &str) -> Result<()> {
+    append_message(path, message, None).await.map(|_| ())
+}
+
+// A message typed on another chat service, marked so the watcher sends it
+// as written. Returns the text as it now reads in the chat.
+pub async fn send_bridged(path: &Path, message: &str, via: &str) -> Result<String> {
+    append_message(path, message, Some(via)).await
+}
+
+async fn append_message(path: &Path, message: &str, via: Option<&str>) -> Result<String> {
+    if shell::mentions_request(message) {
+        bail!("run_shell requests can only be answered in the chat file");
+    }
+    let _lock = files::lock(path).await?;
+    let mut content = files::read_chat(path).await.unwrap_or_default();
+    if !content.is_empty() && !content.ends_with('\n') {
+        content.push('\n');
+    }
+    let separator = fmt::separator(&config::Frontmatter::parse(&content));
+    let message = escape_separators(message.trim(), &separator);
+    if let Some(via) = via {
+        content.push_str(&parser::via_comment(via));
+        content.push('\n');
+    }
+    content.push_str(&message);
+    content.push_str("\n-->send\n");
+    files::write_chat(path, &content).await?;
+    Ok(message)
+}
+
+// Text from outside the editor can't end its message early: separator
+// lines outside code blocks are escaped
+fn escape_separators(message: &str, separator: &str) -> String {
+    let separator = separator.trim();
+    let fences = parser::fenced_ranges(message);
+    let mut offset = 0;
+    let mut lines = Vec::new();
+    for line in message.split('\n') {
+        match line.trim() == separator && !parser::in_fence(&fences, offset) {
+            true => lines.push(format!("\\{}", line.trim())),
+            false => lines.push(line.to_string()),
+        }
+        offset += line.len() + 1;
+    }
+    lines.join("\n")
+}
+
+fn index(watch_set: &WatchSet) -> Response {
+    let items: String = watch_set
+        .files()
+        .iter()
+        .map(|path| {
+            let name = watch::display_path(path);
+            format!("<li><a href=\"/chat/{}\">{}</a></li>\n", http::percent_encode(&name), export::escape(&name))
+        })
+        .collect();
+    Response::html(format!(
+        "<!DOCTYPE html>\n<html>\n<head>\n<meta charset=\"utf-8\">\n<title>Chats</title>\n<style>{}{}</style>\n</head>\n<body>\n<main>\n<h1>Chats</h1>\n<ul class=\"chats\">\n{}</ul>\n</main>\n</body>\n</html>\n",
+        export::STYLE,
+        WEB_STYLE,
+        items
+    ))
+}
+
+async fn page(path: &Path, name: &str) -> Response {
+    let content = files::read_chat(path).await.unwrap_or_default();
+    let title = export::title(&content, name);
+    let messages = export::render_messages(&export::records(&content, name));
+    Response::html(format!(
+        "<!DOCTYPE html>\n<html>\n<head>\n<meta charset=\"utf-8\">\n<title>{0}</title>\n<style>{1}{2}</style>\n</head>\n<body>\n<main>\n<p><a href=\"/\">All chats</a></p>\n<h1>{0}</h1>\n<div id=\"chat\">{3}</div>\n<form class=\"send\" method=\"post\">\n<textarea name=\"message\" rows=\"4\" placeholder=\"Message (Ctrl+Enter to send)\"></textarea>\n<button>Send</button>\n</form>\n</main>\n<script>{4}</script>\n</body>\n</html>\n",
+        export::escape(&title),
+        export::STYLE,
+        WEB_STYLE,
+        messages,
+        SCRIPT
+    ))
+}
+
+// The rendered messages of `path` each time it changes, starting now
+fn follow(path: PathBuf, name: String) -> mpsc::Receiver<String> {
+    let (tx, rx) = mpsc::channel(4);
+    tokio::spawn(async move {
+        let mut chat_file = files::Poll::new(&path);
+        let mut last = None;
+        while !tx.is_closed() {
+            let content = match chat_file.changed().await {
+                Ok(Some(content)) => Some(content),
+                Ok(None) => None,
+                // Shown empty, as a chat that was deleted
+                Err(_) => Some(String::new()),
+            };
+            if let Some(content) = content.filter(|content| last.as_ref() != Some(content)) {
+                let messages = export::render_messages(&export::records(&content, &name));
+                if tx.send(messages).await.is_err() {
+                    break;
+                }
+                last = Some(content);
+            }
+            tokio::time::sleep(REFRESH).await;
+        }
+    });
+    rx
+}
+
+// Replies to `path` as they stream in, for as long as the socket is open
+fn relay(path: PathBuf) -> mpsc::Receiver<String> {
+    let (tx, rx) = mpsc::channel(64);
+    let mut events = live::subscribe(&path);
+    tokio::spawn(async move {
+        loop {
+            tokio::select! {
+                _ = tx.closed() => break,
+                event = events.recv() => match event {
+                    Ok(event) => {
+                        if tx.send(event).await.is_err() {
+                            break;
+                        }
+                    }
+                    // A slow page misses some text; the finished reply
+                    // replaces it anyway
+                    Err(broadcast::error::RecvError::Lagged(_)) => continue,
+                    Err(broadcast::error::RecvError::Closed) => break,
+                },
+            }
+        }
+    });
+    rx
+}
@@ -0,0 +1,77 @@
+use crate::{crypt, logging::debug_log, parser};
+use serde_json::{json, Value};
+use std::{path::Path, time::Duration};
+
+// URLs to POST events to, comma-separated
+pub const WEBHOOK_ENV: &str = "CHAT_WEBHOOK";
+// Events to send, comma-separated; all of them when unset
+pub const WEBHOOK_EVENTS_ENV: &str = "CHAT_WEBHOOK_EVENTS";
+const TIMEOUT: Duration = Duration::from_secs(10);
+
+#[derive(Debug, Clone, Copy, PartialEq)]
+pub enum Event {
+    MessageSent,
+    ResponseReceived,
+    Error,
+}
+
+impl Event {
+    fn name(self) -> &'static str {
+        match self {
+            Event::MessageSent => "message_sent",
+            Event::ResponseReceived => "response_received",
+            Event::Error => "error",
+        }
+    }
+}
+
+fn list(var: &str) -> Vec<String> {
+    std::env::var(var)
+        .unwrap_or_default()
+        .split(',')
+        .map(str::trim)
+        .filter(|v| !v.is_empty())
+        .map(str::to_string)
+        .collect()
+}
+
+// Tells every configured webhook about `event` in `chat`. `fields` are
+// merged into the payload. Sending happens in the background, so a slow
+// endpoint never holds up the chat; failures are only logged.
+pub fn notify(event: Event, chat: &Path, model: &str, fields: Value) {
+    // Payloads carry the messages, which an encrypted chat keeps to itself
+    if crypt::scheme(chat).is_some() {
+        return;
+    }
+    let urls = list(WEBHOOK_ENV);
+    let events = list(WEBHOOK_EVENTS_ENV);
+    if urls.is_empty() || !(events.is_empty() || events.iter().any(|e| e == event.name())) {
+        return;
+    }
+
+    let mut payload = json!({
+        "event": event.name(),
+        "file": chat.canonicalize().unwrap_or_else(|_| chat.to_path_buf()),
+        "model": model,
+        "timestamp": parser::now_timestamp(),
+    });
+    if let (Some(payload), Value::Object(fields)) = (payload.as_object_mut(), fields) {
+        payload.extend(fields);
+    }
+
+    tokio::spawn(async move {
+        let client = match reqwest::Client::builder().timeout(TIMEOUT).build() {
+            Ok(client) => client,
+            Err(e) => return debug_log(&format!("error: webhook client: {}", e)),
+        };
+        for url in urls {
+            match client.post(&url).json(&payload).send().await {
+                Ok(response) if response.status().is_success() => {
+                    debug_log(&format!("call: webhook {} for {}", url, payload["event"]))
+                }
+                Ok(response) => debug_log(&format!("error: webhook {} answered {}", url, response.status())),
+                Err(e) => debug_log(&format!("error: webhook {}: {}", url, e)),
+            }
+        }
+    });
+}